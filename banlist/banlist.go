@@ -0,0 +1,272 @@
+package banlist
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/dpnam2112/bittorrent-client/bencode"
+)
+
+const (
+	defaultBanThreshold = -6
+	// Good pieces raise the trust of a peer up to this, so that a long history of good pieces
+	// doesn't buy the right to send many bad ones.
+	maxTrust = 8
+	// A peer known to have sent corrupt data loses this much trust.
+	culpritPenalty = 3
+	// A peer that sent blocks of a piece that failed verification, along with other peers, loses
+	// this much trust: it may be innocent.
+	suspectPenalty = 1
+)
+
+type Config struct {
+	// Path is the file the bans are saved to. When empty, the bans are kept in memory only.
+	Path string
+	// BanThreshold is the trust score at or below which a peer is banned, a negative value.
+	// Defaults to -6: two pieces known to be corrupted by a peer, or six pieces it shared the
+	// blame for.
+	BanThreshold int
+	// Now returns the current time. Defaults to time.Now.
+	Now func() time.Time
+}
+
+// Ban is a banned peer, identified by its IP address: a peer reconnecting from another port is
+// still banned.
+type Ban struct {
+	IP     string
+	Reason string
+	Time   time.Time
+}
+
+// List keeps a trust score for each peer, from the pieces it sent: good pieces raise it and
+// pieces that failed verification lower it. Peers whose score drops to the threshold are
+// banned. The bans are saved, so that they survive restarts; the scores aren't.
+//
+// On disk, the bans are a bencoded dictionary:
+//
+//	bans: list of dictionaries {ip, reason, time (Unix seconds)}
+type List struct {
+	config Config
+
+	mu     sync.Mutex
+	trust  map[string]int
+	banned map[string]Ban
+	// saveMu orders the writes of the file.
+	saveMu sync.Mutex
+}
+
+// Load creates a list with the bans saved in the file of the config, if any.
+func Load(config Config) (*List, error) {
+	if config.BanThreshold >= 0 {
+		config.BanThreshold = defaultBanThreshold
+	}
+	if config.Now == nil {
+		config.Now = time.Now
+	}
+
+	l := &List{
+		config: config,
+		trust:  make(map[string]int),
+		banned: make(map[string]Ban),
+	}
+	if config.Path == "" {
+		return l, nil
+	}
+
+	raw, err := os.ReadFile(config.Path)
+	if errors.Is(err, os.ErrNotExist) {
+		return l, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("Failed to read ban list: %w", err)
+	}
+	bans, err := unmarshalBans(raw)
+	if err != nil {
+		return nil, err
+	}
+	for _, ban := range bans {
+		l.banned[ban.IP] = ban
+	}
+	return l, nil
+}
+
+// Banned reports whether a peer is banned.
+func (l *List) Banned(ip string) bool {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	_, ok := l.banned[ip]
+	return ok
+}
+
+// Trust returns the trust score of a peer: 0 for unknown peers.
+func (l *List) Trust(ip string) int {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return l.trust[ip]
+}
+
+// GoodPiece raises the trust of a peer that sent blocks of a piece that passed verification.
+func (l *List) GoodPiece(ip string) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.trust[ip] = min(l.trust[ip]+1, maxTrust)
+}
+
+// BadPiece lowers the trust of a peer that sent blocks of a piece that failed verification.
+// culprit tells whether the peer is known to have sent corrupt data, or only shares the blame with
+// the other peers of the piece. It reports whether the peer got banned.
+func (l *List) BadPiece(ip string, culprit bool) (bool, error) {
+	penalty := suspectPenalty
+	if culprit {
+		penalty = culpritPenalty
+	}
+
+	l.mu.Lock()
+	l.trust[ip] -= penalty
+	trust := l.trust[ip]
+	_, banned := l.banned[ip]
+	l.mu.Unlock()
+
+	if banned || trust > l.config.BanThreshold {
+		return false, nil
+	}
+	return true, l.Ban(ip, fmt.Sprintf("Sent corrupt data (trust %d)", trust))
+}
+
+// Ban bans a peer, and saves the list.
+func (l *List) Ban(ip string, reason string) error {
+	l.mu.Lock()
+	l.banned[ip] = Ban{IP: ip, Reason: reason, Time: l.config.Now()}
+	l.mu.Unlock()
+	return l.save()
+}
+
+// Unban lifts the bans of the given peers, or of every peer if none is given, resets their trust
+// and saves the list. It returns the bans lifted.
+func (l *List) Unban(ips ...string) ([]Ban, error) {
+	l.mu.Lock()
+	if len(ips) == 0 {
+		for ip := range l.banned {
+			ips = append(ips, ip)
+		}
+	}
+	var lifted []Ban
+	for _, ip := range ips {
+		if ban, ok := l.banned[ip]; ok {
+			lifted = append(lifted, ban)
+			delete(l.banned, ip)
+		}
+		delete(l.trust, ip)
+	}
+	l.mu.Unlock()
+
+	if len(lifted) == 0 {
+		return nil, nil
+	}
+	sortBans(lifted)
+	return lifted, l.save()
+}
+
+// Bans returns the banned peers, sorted by IP address.
+func (l *List) Bans() []Ban {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	bans := make([]Ban, 0, len(l.banned))
+	for _, ban := range l.banned {
+		bans = append(bans, ban)
+	}
+	sortBans(bans)
+	return bans
+}
+
+func sortBans(bans []Ban) {
+	slices.SortFunc(bans, func(a, b Ban) int { return strings.Compare(a.IP, b.IP) })
+}
+
+// save writes the bans atomically: a crash while saving leaves the previous file intact.
+func (l *List) save() error {
+	if l.config.Path == "" {
+		return nil
+	}
+	path := l.config.Path
+	l.saveMu.Lock()
+	defer l.saveMu.Unlock()
+
+	if err := os.MkdirAll(filepath.Dir(path), 0o755); err != nil {
+		return fmt.Errorf("Failed to create ban list directory: %w", err)
+	}
+	tmp, err := os.CreateTemp(filepath.Dir(path), filepath.Base(path)+".*.tmp")
+	if err != nil {
+		return fmt.Errorf("Failed to create ban list file: %w", err)
+	}
+	defer os.Remove(tmp.Name())
+
+	if _, err := tmp.Write(marshalBans(l.Bans())); err != nil {
+		tmp.Close()
+		return fmt.Errorf("Failed to write ban list file: %w", err)
+	}
+	if err := tmp.Close(); err != nil {
+		return fmt.Errorf("Failed to write ban list file: %w", err)
+	}
+	if err := os.Rename(tmp.Name(), path); err != nil {
+		return fmt.Errorf("Failed to replace ban list file: %w", err)
+	}
+	return nil
+}
+
+func marshalBans(bans []Ban) []byte {
+	list := make([]bencode.BValue, 0, len(bans))
+	for _, ban := range bans {
+		list = append(list, &bencode.BDict{Dict: map[string]bencode.BValue{
+			"ip":     &bencode.BString{Value: []byte(ban.IP)},
+			"reason": &bencode.BString{Value: []byte(ban.Reason)},
+			"time":   &bencode.BInt{Value: ban.Time.Unix()},
+		}})
+	}
+	return bencode.Encode(&bencode.BDict{Dict: map[string]bencode.BValue{
+		"bans": &bencode.BList{Values: list},
+	}})
+}
+
+func unmarshalBans(raw []byte) ([]Ban, error) {
+	_, value, err := bencode.ParseBencode(raw)
+	if err != nil {
+		return nil, fmt.Errorf("Failed to parse ban list: %w", err)
+	}
+	dict, ok := value.(*bencode.BDict)
+	if !ok {
+		return nil, errors.New("Ban list is not a dictionary")
+	}
+	list, ok := dict.Dict["bans"].(*bencode.BList)
+	if !ok {
+		return nil, errors.New("Ban list has no bans")
+	}
+
+	var bans []Ban
+	for _, value := range list.Values {
+		entry, ok := value.(*bencode.BDict)
+		if !ok {
+			continue
+		}
+		ip, ok := entry.Dict["ip"].(*bencode.BString)
+		if !ok || len(ip.Value) == 0 {
+			continue
+		}
+		ban := Ban{IP: string(ip.Value)}
+		if reason, ok := entry.Dict["reason"].(*bencode.BString); ok {
+			ban.Reason = string(reason.Value)
+		}
+		if t, ok := entry.Dict["time"].(*bencode.BInt); ok {
+			ban.Time = time.Unix(t.Value, 0)
+		}
+		bans = append(bans, ban)
+	}
+	return bans, nil
+}
@@ -0,0 +1,93 @@
+package banlist
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestTrustAndBans(t *testing.T) {
+	now := time.Unix(1700000000, 0)
+	path := filepath.Join(t.TempDir(), "bans.dat")
+	l, err := Load(Config{Path: path, Now: func() time.Time { return now }})
+	assert.NoError(t, err)
+
+	// Trust earned with good pieces is capped.
+	for range 20 {
+		l.GoodPiece("10.0.0.1")
+	}
+	assert.Equal(t, maxTrust, l.Trust("10.0.0.1"))
+
+	// Sharing the blame lowers the trust slowly; known corruption fast.
+	for range 5 {
+		banned, err := l.BadPiece("10.0.0.2", false)
+		assert.NoError(t, err)
+		assert.False(t, banned)
+	}
+	assert.Equal(t, -5, l.Trust("10.0.0.2"))
+	banned, err := l.BadPiece("10.0.0.2", false)
+	assert.NoError(t, err)
+	assert.True(t, banned)
+
+	banned, err = l.BadPiece("10.0.0.3", true)
+	assert.NoError(t, err)
+	assert.False(t, banned)
+	banned, err = l.BadPiece("10.0.0.3", true)
+	assert.NoError(t, err)
+	assert.True(t, banned)
+
+	// Already banned.
+	banned, err = l.BadPiece("10.0.0.3", true)
+	assert.NoError(t, err)
+	assert.False(t, banned)
+
+	assert.NoError(t, l.Ban("10.0.0.4", "Manual"))
+	assert.True(t, l.Banned("10.0.0.4"))
+	assert.False(t, l.Banned("10.0.0.1"))
+
+	// The bans are saved, the trust isn't.
+	l, err = Load(Config{Path: path})
+	assert.NoError(t, err)
+	assert.Equal(t, []Ban{
+		{IP: "10.0.0.2", Reason: "Sent corrupt data (trust -6)", Time: now},
+		{IP: "10.0.0.3", Reason: "Sent corrupt data (trust -6)", Time: now},
+		{IP: "10.0.0.4", Reason: "Manual", Time: now},
+	}, l.Bans())
+	assert.Zero(t, l.Trust("10.0.0.1"))
+
+	lifted, err := l.Unban("10.0.0.3", "10.0.0.9")
+	assert.NoError(t, err)
+	assert.Len(t, lifted, 1)
+	assert.False(t, l.Banned("10.0.0.3"))
+
+	lifted, err = l.Unban()
+	assert.NoError(t, err)
+	assert.Len(t, lifted, 2)
+
+	l, err = Load(Config{Path: path})
+	assert.NoError(t, err)
+	assert.Empty(t, l.Bans())
+}
+
+func TestLoad(t *testing.T) {
+	dir := t.TempDir()
+
+	// No file yet: no bans.
+	l, err := Load(Config{Path: filepath.Join(dir, "missing", "bans.dat")})
+	assert.NoError(t, err)
+	assert.Empty(t, l.Bans())
+
+	corrupt := filepath.Join(dir, "corrupt.dat")
+	assert.NoError(t, os.WriteFile(corrupt, []byte("not bencode"), 0o644))
+	_, err = Load(Config{Path: corrupt})
+	assert.Error(t, err)
+
+	// In memory only.
+	l, err = Load(Config{})
+	assert.NoError(t, err)
+	assert.NoError(t, l.Ban("10.0.0.1", "Manual"))
+	assert.True(t, l.Banned("10.0.0.1"))
+}
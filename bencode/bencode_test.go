@@ -278,3 +278,25 @@ func TestParseDictionaryFail(t *testing.T) {
 		assert.Nil(t, val)
 	}
 }
+
+func TestEncode(t *testing.T) {
+	value := &BDict{Dict: map[string]BValue{
+		"zeta":  &BInt{Value: -3},
+		"alpha": &BString{Value: []byte("abc")},
+		"list": &BList{Values: []BValue{
+			&BInt{Value: 0},
+			&BDict{Dict: map[string]BValue{}},
+		}},
+	}}
+
+	encoded := Encode(value)
+	assert.Equal(t, "d5:alpha3:abc4:listli0edee4:zetai-3ee", string(encoded))
+
+	// Parsing then encoding must yield the original input.
+	inputs := []string{"i42e", "0:", "4:spam", "le", "d1:ad1:bli1ei2eeee"}
+	for _, input := range inputs {
+		_, val, err := ParseBencode([]byte(input))
+		assert.NoError(t, err)
+		assert.Equal(t, input, string(Encode(val)))
+	}
+}
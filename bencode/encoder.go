@@ -0,0 +1,52 @@
+package bencode
+
+import (
+	"bytes"
+	"slices"
+	"strconv"
+)
+
+// Encode serializes a bencoded value. Dictionary keys are written in sorted order, as required by
+// the specification, so encoding a parsed value yields the same bytes as the original input.
+func Encode(v BValue) []byte {
+	var buf bytes.Buffer
+	encodeTo(&buf, v)
+	return buf.Bytes()
+}
+
+func encodeTo(buf *bytes.Buffer, v BValue) {
+	switch val := v.(type) {
+	case *BInt:
+		buf.WriteByte('i')
+		buf.WriteString(strconv.FormatInt(val.Value, 10))
+		buf.WriteByte('e')
+
+	case *BString:
+		buf.WriteString(strconv.Itoa(len(val.Value)))
+		buf.WriteByte(':')
+		buf.Write(val.Value)
+
+	case *BList:
+		buf.WriteByte('l')
+		for _, item := range val.Values {
+			encodeTo(buf, item)
+		}
+		buf.WriteByte('e')
+
+	case *BDict:
+		keys := make([]string, 0, len(val.Dict))
+		for key := range val.Dict {
+			keys = append(keys, key)
+		}
+		slices.Sort(keys)
+
+		buf.WriteByte('d')
+		for _, key := range keys {
+			buf.WriteString(strconv.Itoa(len(key)))
+			buf.WriteByte(':')
+			buf.WriteString(key)
+			encodeTo(buf, val.Dict[key])
+		}
+		buf.WriteByte('e')
+	}
+}
@@ -0,0 +1,86 @@
+package cmd
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"os"
+	"time"
+
+	"github.com/dpnam2112/bittorrent-client/common"
+	"github.com/dpnam2112/bittorrent-client/torrentparser"
+	"github.com/dpnam2112/bittorrent-client/trackerclient"
+	"github.com/spf13/cobra"
+)
+
+var announceCmd = &cobra.Command{
+	Use:   "announce ./path/to/file.torrent",
+	Short: "Announce a torrent to its trackers",
+	Long:  `Announces a torrent once to every tracker it lists and reports the status of each tracker.`,
+	Args:  cobra.ExactArgs(1),
+	Run: func(cmd *cobra.Command, args []string) {
+		port, _ := cmd.Flags().GetUint16("port")
+		timeout, _ := cmd.Flags().GetDuration("timeout")
+
+		file, err := os.Open(args[0])
+		if err != nil {
+			log.Fatalf("Failed to read file: %v", err)
+		}
+		defer file.Close()
+
+		metainfo, err := torrentparser.ParseTorrent(file)
+		if err != nil {
+			log.Fatalf("Error parsing torrent file: %v", err)
+		}
+
+		resolver := trackerclient.NewTrackerPeerResolver(metainfo, -1, trackerclient.TrackerPeerResolverConfig{
+			PeerID:  common.GeneratePeerID(),
+			Port:    port,
+			Logger:  newLogger(cmd),
+			Timeout: timeout,
+		})
+
+		done := make(chan struct{}, 1)
+		resolver.RegisterStatusHandler(func(status trackerclient.TrackerStatus) {
+			if allAnnounced(resolver.Statuses()) {
+				select {
+				case done <- struct{}{}:
+				default:
+				}
+			}
+		})
+
+		ctx, cancel := context.WithTimeout(context.Background(), 2*timeout)
+		defer cancel()
+
+		if err := resolver.Start(ctx); err != nil {
+			log.Fatalf("Failed to start announcing: %v", err)
+		}
+
+		select {
+		case <-done:
+		case <-ctx.Done():
+		}
+		resolver.Close()
+
+		for _, status := range resolver.Statuses() {
+			fmt.Printf("[tier %d] %s: %s\n", status.Tier, status.URL, status.Message())
+		}
+	},
+}
+
+// allAnnounced reports whether every tracker has answered (or failed to answer) an announce.
+func allAnnounced(statuses []trackerclient.TrackerStatus) bool {
+	for _, status := range statuses {
+		if status.State == trackerclient.TrackerStateNotContacted || status.State == trackerclient.TrackerStateUpdating {
+			return false
+		}
+	}
+	return true
+}
+
+func init() {
+	announceCmd.Flags().Uint16("port", 6881, "Port advertised to the trackers")
+	announceCmd.Flags().Duration("timeout", 15*time.Second, "Timeout of each announce")
+	rootCmd.AddCommand(announceCmd)
+}
@@ -0,0 +1,76 @@
+package cmd
+
+import (
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/dpnam2112/bittorrent-client/banlist"
+	"github.com/spf13/cobra"
+)
+
+var bansCmd = &cobra.Command{
+	Use:   "bans",
+	Short: "Manage the peers banned for sending corrupt data",
+}
+
+var bansListCmd = &cobra.Command{
+	Use:   "list",
+	Short: "List the banned peers",
+	Args:  cobra.NoArgs,
+	Run: func(cmd *cobra.Command, args []string) {
+		bans := loadBanList(cmd).Bans()
+		if len(bans) == 0 {
+			fmt.Println("No banned peer")
+			return
+		}
+
+		fmt.Println("IP                                       Banned at            Reason")
+		for _, ban := range bans {
+			fmt.Printf("%-40s %-20s %s\n", ban.IP, ban.Time.Format(time.DateTime), ban.Reason)
+		}
+	},
+}
+
+var bansClearCmd = &cobra.Command{
+	Use:   "clear [ip...]",
+	Short: "Lift the bans of the given peers, or of every peer",
+	Run: func(cmd *cobra.Command, args []string) {
+		lifted, err := loadBanList(cmd).Unban(args...)
+		if err != nil {
+			log.Fatalf("%v", err)
+		}
+		for _, ban := range lifted {
+			fmt.Printf("Unbanned %s\n", ban.IP)
+		}
+		fmt.Printf("%d ban(s) lifted\n", len(lifted))
+	},
+}
+
+// defaultBanListFile returns the path of the ban list in the user's config directory.
+func defaultBanListFile() string {
+	dir, err := os.UserConfigDir()
+	if err != nil {
+		return "bans.dat"
+	}
+	return filepath.Join(dir, "bittorrent-client", "bans.dat")
+}
+
+func loadBanList(cmd *cobra.Command) *banlist.List {
+	path, _ := cmd.Flags().GetString("file")
+	bans, err := banlist.Load(banlist.Config{Path: path})
+	if err != nil {
+		log.Fatalf("%v", err)
+	}
+	return bans
+}
+
+func init() {
+	bansCmd.PersistentFlags().String("file", defaultBanListFile(), "File the bans are saved to")
+
+	bansCmd.AddCommand(bansListCmd)
+	bansCmd.AddCommand(bansClearCmd)
+	rootCmd.AddCommand(bansCmd)
+}
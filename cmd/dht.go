@@ -0,0 +1,141 @@
+package cmd
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/dpnam2112/bittorrent-client/dht"
+	"github.com/dpnam2112/bittorrent-client/torrentparser"
+	"github.com/spf13/cobra"
+)
+
+var dhtCmd = &cobra.Command{
+	Use:   "dht",
+	Short: "Interact with the mainline DHT",
+}
+
+var dhtStatsCmd = &cobra.Command{
+	Use:   "stats",
+	Short: "Join the DHT and show routing table statistics",
+	Long: `Starts a DHT node from the saved state, bootstraps it, runs a few lookups for random IDs and
+prints the fill of the routing table buckets and the success rates of the lookups. The state is
+saved on exit, so running the command again starts from a warm routing table.`,
+	Run: func(cmd *cobra.Command, args []string) {
+		lookups, _ := cmd.Flags().GetInt("lookups")
+
+		node := startDHTNode(cmd)
+		defer closeDHTNode(node)
+
+		ctx := context.Background()
+		for i := 0; i < lookups; i++ {
+			node.FindNode(ctx, dht.RandomNodeID())
+		}
+
+		printDHTStats(node.Stats())
+	},
+}
+
+// defaultDHTStateFile returns the path of the DHT state file in the user's config directory.
+func defaultDHTStateFile() string {
+	dir, err := os.UserConfigDir()
+	if err != nil {
+		return "dht.dat"
+	}
+	return filepath.Join(dir, "bittorrent-client", "dht.dat")
+}
+
+// startDHTNode starts a node configured by the persistent flags of the dht command, restores its
+// saved state, and bootstraps it.
+func startDHTNode(cmd *cobra.Command) *dht.Node {
+	flags := cmd.Flags()
+	addr, _ := flags.GetString("addr")
+	stateFile, _ := flags.GetString("state")
+	bootstrapAddrs, _ := flags.GetStringSlice("bootstrap")
+	torrentFiles, _ := flags.GetStringSlice("torrent")
+	timeout, _ := flags.GetDuration("timeout")
+
+	config := dht.Config{
+		Addr:           addr,
+		BootstrapAddrs: bootstrapAddrs,
+		StateFile:      stateFile,
+		QueryTimeout:   timeout,
+	}
+
+	if stateFile != "" {
+		state, err := dht.LoadState(stateFile)
+		switch {
+		case err == nil:
+			config.ID = state.ID
+			config.KnownNodes = state.Nodes
+		case !errors.Is(err, os.ErrNotExist):
+			log.Printf("Ignoring DHT state: %v", err)
+		}
+	}
+
+	node := dht.NewNode(config, newLogger(cmd))
+
+	for _, path := range torrentFiles {
+		file, err := os.Open(path)
+		if err != nil {
+			log.Fatalf("Failed to read file: %v", err)
+		}
+		metainfo, err := torrentparser.ParseTorrent(file)
+		file.Close()
+		if err != nil {
+			log.Fatalf("Error parsing torrent file: %v", err)
+		}
+		node.AddBootstrapAddrs(metainfo.Nodes()...)
+	}
+
+	if err := node.Start(context.Background()); err != nil {
+		log.Fatalf("Failed to start the DHT node: %v", err)
+	}
+
+	if err := node.Bootstrap(context.Background()); err != nil {
+		node.Close()
+		log.Fatalf("%v", err)
+	}
+
+	return node
+}
+
+func closeDHTNode(node *dht.Node) {
+	if err := node.Close(); err != nil {
+		log.Printf("Failed to save DHT state: %v", err)
+	}
+}
+
+func printDHTStats(stats dht.Stats) {
+	fmt.Printf("Node ID: %s\n", stats.ID)
+	fmt.Printf("Nodes:   %d\n\n", stats.Nodes)
+
+	fmt.Println("Bucket  Nodes  Good  Replacements")
+	for _, b := range stats.Buckets {
+		fmt.Printf("%6d  %2d/%d  %4d  %12d\n", b.Index, b.Nodes, dht.BucketSize, b.Good, b.Replacements)
+	}
+
+	fmt.Println()
+	fmt.Printf("Queries:   %d sent, %d answered, %d timed out\n", stats.QueriesSent, stats.QueriesAnswered, stats.QueriesTimedOut)
+	fmt.Printf("Lookups:   %d/%d successful (%.0f%%)\n", stats.SuccessfulLookups, stats.Lookups, 100*stats.LookupSuccessRate())
+	if stats.Announces > 0 {
+		fmt.Printf("Announces: %d/%d successful (%.0f%%)\n", stats.SuccessfulAnnounces, stats.Announces, 100*stats.AnnounceSuccessRate())
+	}
+}
+
+func init() {
+	dhtCmd.PersistentFlags().String("addr", ":6881", "UDP listen address of the DHT node")
+	dhtCmd.PersistentFlags().String("state", defaultDHTStateFile(), "File the node ID and routing table are saved to (empty to disable)")
+	dhtCmd.PersistentFlags().StringSlice("bootstrap", dht.DefaultBootstrapAddrs, "Bootstrap nodes, as host:port")
+	dhtCmd.PersistentFlags().StringSlice("torrent", nil, "Torrent files whose 'nodes' are used to bootstrap")
+	dhtCmd.PersistentFlags().Duration("timeout", 5*time.Second, "Timeout of a single query")
+
+	dhtStatsCmd.Flags().Int("lookups", 5, "Number of lookups for random IDs to run")
+
+	dhtCmd.AddCommand(dhtStatsCmd)
+	rootCmd.AddCommand(dhtCmd)
+}
@@ -0,0 +1,183 @@
+package cmd
+
+import (
+	"context"
+	"crypto/ed25519"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/dpnam2112/bittorrent-client/bencode"
+	"github.com/dpnam2112/bittorrent-client/dht"
+	"github.com/spf13/cobra"
+)
+
+var dhtPutCmd = &cobra.Command{
+	Use:   "put <value>",
+	Short: "Store a value in the DHT (BEP 44)",
+	Long: `Stores a string in the DHT. Without --mutable, the value is immutable and stored under its
+SHA-1, which is printed. With --mutable, the value is signed with the key in --key (created if
+missing) and stored under the public key and --salt; every put publishes a new version, with a
+sequence number one above the current one unless --seq is given.`,
+	Args: cobra.ExactArgs(1),
+	Run: func(cmd *cobra.Command, args []string) {
+		flags := cmd.Flags()
+		mutable, _ := flags.GetBool("mutable")
+		value := &bencode.BString{Value: []byte(args[0])}
+
+		node := startDHTNode(cmd)
+		defer closeDHTNode(node)
+		ctx := context.Background()
+
+		if !mutable {
+			target, err := node.PutImmutable(ctx, value)
+			if err != nil {
+				log.Fatalf("%v", err)
+			}
+			fmt.Printf("Target: %s\n", target)
+			return
+		}
+
+		keyFile, _ := flags.GetString("key")
+		salt, _ := flags.GetString("salt")
+		seq, _ := flags.GetInt64("seq")
+
+		privateKey, err := loadOrCreateKey(keyFile)
+		if err != nil {
+			log.Fatalf("%v", err)
+		}
+		publicKey := privateKey.Public().(ed25519.PublicKey)
+
+		// Publish the version following the current one, and make sure nobody published another
+		// version in the meantime.
+		var cas *int64
+		if !flags.Changed("seq") {
+			current, err := node.GetMutable(ctx, publicKey, []byte(salt))
+			switch {
+			case err == nil:
+				seq = current.Seq + 1
+				cas = &current.Seq
+			case !errors.Is(err, dht.ErrItemNotFound):
+				log.Fatalf("%v", err)
+			}
+		}
+
+		item := dht.NewMutableItem(privateKey, []byte(salt), seq, value)
+		if err := node.PutMutable(ctx, item, cas); err != nil {
+			log.Fatalf("%v", err)
+		}
+
+		fmt.Printf("Target:     %s\n", item.Target())
+		fmt.Printf("Public key: %s\n", hex.EncodeToString(publicKey))
+		fmt.Printf("Seq:        %d\n", item.Seq)
+	},
+}
+
+var dhtGetCmd = &cobra.Command{
+	Use:   "get [target]",
+	Short: "Retrieve a value from the DHT (BEP 44)",
+	Long: `Retrieves an immutable value by its hex-encoded target, or the latest version of a mutable
+value when --pubkey (and optionally --salt) is given.`,
+	Args: cobra.MaximumNArgs(1),
+	Run: func(cmd *cobra.Command, args []string) {
+		flags := cmd.Flags()
+		rawPublicKey, _ := flags.GetString("pubkey")
+		salt, _ := flags.GetString("salt")
+
+		if (rawPublicKey == "") == (len(args) == 0) {
+			log.Fatalf("Either a target or --pubkey must be given")
+		}
+
+		var target dht.NodeID
+		var publicKey ed25519.PublicKey
+		if rawPublicKey != "" {
+			decoded, err := hex.DecodeString(rawPublicKey)
+			if err != nil || len(decoded) != ed25519.PublicKeySize {
+				log.Fatalf("Invalid public key '%s'", rawPublicKey)
+			}
+			publicKey = decoded
+		} else {
+			infoHash, err := parseInfoHash(args[0])
+			if err != nil {
+				log.Fatalf("Invalid target: %v", err)
+			}
+			target = dht.NodeID(infoHash)
+		}
+
+		node := startDHTNode(cmd)
+		defer closeDHTNode(node)
+		ctx := context.Background()
+
+		if publicKey == nil {
+			value, err := node.GetImmutable(ctx, target)
+			if err != nil {
+				log.Fatalf("%v", err)
+			}
+			fmt.Println(formatItemValue(value))
+			return
+		}
+
+		item, err := node.GetMutable(ctx, publicKey, []byte(salt))
+		if err != nil {
+			log.Fatalf("%v", err)
+		}
+		fmt.Printf("Seq:   %d\n", item.Seq)
+		fmt.Printf("Value: %s\n", formatItemValue(item.Value))
+	},
+}
+
+// formatItemValue prints string values as is, and other values in the readable bencode format.
+func formatItemValue(value bencode.BValue) string {
+	if str, ok := value.(*bencode.BString); ok {
+		return string(str.Value)
+	}
+	return strings.TrimSpace(bencode.BValueToString(value, 0))
+}
+
+// loadOrCreateKey reads a hex-encoded ed25519 seed from path, generating and saving a new one if
+// the file doesn't exist.
+func loadOrCreateKey(path string) (ed25519.PrivateKey, error) {
+	raw, err := os.ReadFile(path)
+	if err == nil {
+		seed, err := hex.DecodeString(strings.TrimSpace(string(raw)))
+		if err != nil || len(seed) != ed25519.SeedSize {
+			return nil, fmt.Errorf("Invalid key file %s", path)
+		}
+		return ed25519.NewKeyFromSeed(seed), nil
+	}
+	if !errors.Is(err, os.ErrNotExist) {
+		return nil, fmt.Errorf("Failed to read key file: %w", err)
+	}
+
+	_, privateKey, err := ed25519.GenerateKey(nil)
+	if err != nil {
+		return nil, fmt.Errorf("Failed to generate key: %w", err)
+	}
+
+	if err := os.MkdirAll(filepath.Dir(path), 0o700); err != nil {
+		return nil, fmt.Errorf("Failed to create key directory: %w", err)
+	}
+	if err := os.WriteFile(path, []byte(hex.EncodeToString(privateKey.Seed())+"\n"), 0o600); err != nil {
+		return nil, fmt.Errorf("Failed to write key file: %w", err)
+	}
+	return privateKey, nil
+}
+
+func init() {
+	defaultKeyFile := filepath.Join(filepath.Dir(defaultDHTStateFile()), "dht.key")
+
+	dhtPutCmd.Flags().Bool("mutable", false, "Store a mutable item signed with --key")
+	dhtPutCmd.Flags().String("key", defaultKeyFile, "File holding the hex-encoded ed25519 seed of mutable items")
+	dhtPutCmd.Flags().String("salt", "", "Salt of the mutable item, to publish several items with the same key")
+	dhtPutCmd.Flags().Int64("seq", 0, "Sequence number of the mutable item (default: current + 1)")
+
+	dhtGetCmd.Flags().String("pubkey", "", "Hex-encoded public key of a mutable item")
+	dhtGetCmd.Flags().String("salt", "", "Salt of the mutable item")
+
+	dhtCmd.AddCommand(dhtPutCmd)
+	dhtCmd.AddCommand(dhtGetCmd)
+}
@@ -0,0 +1,86 @@
+package cmd
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"os"
+	"time"
+
+	"github.com/dpnam2112/bittorrent-client/common"
+	"github.com/dpnam2112/bittorrent-client/dht"
+	torrentclient "github.com/dpnam2112/bittorrent-client/torrent"
+	"github.com/dpnam2112/bittorrent-client/torrentparser"
+	"github.com/spf13/cobra"
+)
+
+var fetchMetadataCmd = &cobra.Command{
+	Use:   "fetch-metadata magnet:?xt=urn:btih:...",
+	Short: "Fetch the metadata of a magnet link and save it as a .torrent file",
+	Long: `Finds the peers of a magnet link through its trackers, its x.pe peers and optionally the DHT,
+fetches the info dictionary from them (BEP 9) and saves it as a .torrent file. The content of the
+torrent isn't downloaded.`,
+	Args: cobra.ExactArgs(1),
+	Run: func(cmd *cobra.Command, args []string) {
+		output, _ := cmd.Flags().GetString("output")
+		port, _ := cmd.Flags().GetUint16("port")
+		timeout, _ := cmd.Flags().GetDuration("timeout")
+		useDHT, _ := cmd.Flags().GetBool("dht")
+
+		magnet, err := torrentparser.ParseMagnet(args[0])
+		if err != nil {
+			log.Fatalf("Invalid magnet link: %v", err)
+		}
+
+		config := torrentclient.MetadataFetchConfig{
+			PeerID: common.GeneratePeerID(),
+			Port:   port,
+			Logger: newLogger(cmd),
+		}
+
+		if useDHT {
+			node := dht.NewNode(dht.Config{
+				Addr:           fmt.Sprintf(":%d", port),
+				BootstrapAddrs: dht.DefaultBootstrapAddrs,
+			}, newLogger(cmd))
+			if err := node.Start(context.Background()); err != nil {
+				log.Fatalf("Failed to start the DHT node: %v", err)
+			}
+			defer node.Close()
+			if err := node.Bootstrap(context.Background()); err != nil {
+				log.Printf("Failed to bootstrap the DHT node: %v", err)
+			}
+			config.DHT = node
+		}
+
+		ctx, cancel := context.WithTimeout(context.Background(), timeout)
+		defer cancel()
+
+		metainfo, err := torrentclient.FetchMetadata(ctx, magnet, config)
+		if err != nil {
+			log.Fatalf("%v", err)
+		}
+
+		fmt.Println(metainfo.String())
+
+		if output == "" {
+			output = metainfo.Info().Name() + ".torrent"
+		}
+		raw, err := torrentparser.MarshalTorrent(*metainfo)
+		if err != nil {
+			log.Fatalf("Failed to encode torrent: %v", err)
+		}
+		if err := os.WriteFile(output, raw, 0o644); err != nil {
+			log.Fatalf("Failed to write torrent file: %v", err)
+		}
+		fmt.Printf("Saved torrent to %s\n", output)
+	},
+}
+
+func init() {
+	fetchMetadataCmd.Flags().StringP("output", "o", "", "Path of the .torrent file to write (default: <name>.torrent)")
+	fetchMetadataCmd.Flags().Uint16("port", 6881, "Port advertised to the trackers and the peers")
+	fetchMetadataCmd.Flags().Duration("timeout", 5*time.Minute, "Time to wait for the metadata")
+	fetchMetadataCmd.Flags().Bool("dht", true, "Find peers on the mainline DHT")
+	rootCmd.AddCommand(fetchMetadataCmd)
+}
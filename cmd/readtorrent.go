@@ -5,7 +5,7 @@ import (
 	"log"
 	"os"
 
-	"github.com/dpnam2112/bittorrent-client/torrent"
+	"github.com/dpnam2112/bittorrent-client/torrentparser"
 	"github.com/spf13/cobra"
 )
 
@@ -26,7 +26,7 @@ var readCmd = &cobra.Command{
 			return
 		}
 
-		torrent, err := torrent.ParseTorrent(file)
+		torrent, err := torrentparser.ParseTorrent(file)
 
 		if err != nil {
 			log.Println("Error parsing torrent file:", err)
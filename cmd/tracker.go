@@ -0,0 +1,105 @@
+package cmd
+
+import (
+	"context"
+	"encoding/hex"
+	"fmt"
+	"log"
+	"log/slog"
+	"os"
+	"os/signal"
+	"syscall"
+	"time"
+
+	"github.com/dpnam2112/bittorrent-client/common"
+	"github.com/dpnam2112/bittorrent-client/tracker"
+	"github.com/spf13/cobra"
+)
+
+var trackerCmd = &cobra.Command{
+	Use:   "tracker",
+	Short: "Run a BitTorrent tracker",
+}
+
+var trackerServeCmd = &cobra.Command{
+	Use:   "serve",
+	Short: "Serve a tracker over UDP and HTTP",
+	Long: `Runs an in-memory BitTorrent tracker speaking the UDP (BEP 15) and HTTP tracker protocols.
+Pass an empty address to disable one of the transports.`,
+	Run: func(cmd *cobra.Command, args []string) {
+		flags := cmd.Flags()
+		udpAddr, _ := flags.GetString("udp")
+		httpAddr, _ := flags.GetString("http")
+		interval, _ := flags.GetDuration("interval")
+		peerTTL, _ := flags.GetDuration("peer-ttl")
+		maxNumWant, _ := flags.GetInt("max-numwant")
+		rawWhitelist, _ := flags.GetStringSlice("whitelist")
+
+		whitelist := make([]common.InfoHash, 0, len(rawWhitelist))
+		for _, raw := range rawWhitelist {
+			infoHash, err := parseInfoHash(raw)
+			if err != nil {
+				log.Fatalf("Invalid whitelisted info hash: %v", err)
+			}
+			whitelist = append(whitelist, infoHash)
+		}
+
+		server := tracker.NewServer(tracker.Config{
+			UDPAddr:    udpAddr,
+			HTTPAddr:   httpAddr,
+			Interval:   interval,
+			PeerTTL:    peerTTL,
+			MaxNumWant: maxNumWant,
+			Whitelist:  whitelist,
+		}, newLogger(cmd))
+
+		ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+		defer stop()
+
+		if err := server.Start(ctx); err != nil {
+			log.Fatalf("Failed to start the tracker: %v", err)
+		}
+
+		<-ctx.Done()
+		server.Close()
+	},
+}
+
+// parseInfoHash decodes a hex-encoded, 20-byte info hash.
+func parseInfoHash(raw string) (common.InfoHash, error) {
+	var infoHash common.InfoHash
+
+	decoded, err := hex.DecodeString(raw)
+	if err != nil {
+		return infoHash, err
+	}
+
+	if len(decoded) != len(infoHash) {
+		return infoHash, fmt.Errorf("'%s' is not 20 bytes long", raw)
+	}
+
+	copy(infoHash[:], decoded)
+	return infoHash, nil
+}
+
+// newLogger creates a logger writing to stderr, at debug level if --verbose is set.
+func newLogger(cmd *cobra.Command) *slog.Logger {
+	level := slog.LevelInfo
+	if VerboseEnabled(cmd) {
+		level = slog.LevelDebug
+	}
+
+	return slog.New(slog.NewTextHandler(os.Stderr, &slog.HandlerOptions{Level: level}))
+}
+
+func init() {
+	trackerServeCmd.Flags().String("udp", ":6969", "UDP listen address")
+	trackerServeCmd.Flags().String("http", ":6969", "HTTP listen address")
+	trackerServeCmd.Flags().Duration("interval", 30*time.Minute, "Announce interval sent to clients")
+	trackerServeCmd.Flags().Duration("peer-ttl", 0, "Time after which silent peers are dropped (default: twice the interval)")
+	trackerServeCmd.Flags().Int("max-numwant", 200, "Maximum number of peers returned per announce")
+	trackerServeCmd.Flags().StringSlice("whitelist", nil, "Hex-encoded info hashes allowed on this tracker (default: all)")
+
+	trackerCmd.AddCommand(trackerServeCmd)
+	rootCmd.AddCommand(trackerCmd)
+}
@@ -0,0 +1,17 @@
+package common
+
+import (
+	"crypto/rand"
+)
+
+// Client identifier, in the Azureus-style peer ID convention: '-' + 2-letter client code +
+// 4-digit version + '-'.
+const PeerIDPrefix = "-GO0001-"
+
+// GeneratePeerID creates a random peer ID starting with PeerIDPrefix.
+func GeneratePeerID() PeerID {
+	var peerID PeerID
+	copy(peerID[:], PeerIDPrefix)
+	rand.Read(peerID[len(PeerIDPrefix):])
+	return peerID
+}
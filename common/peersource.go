@@ -0,0 +1,25 @@
+package common
+
+// PeerSourceTag identifies where a peer address was learned from.
+type PeerSourceTag string
+
+const (
+	PeerSourceTracker PeerSourceTag = "tracker"
+	PeerSourceDHT     PeerSourceTag = "dht"
+	PeerSourcePEX     PeerSourceTag = "pex"
+	PeerSourceLSD     PeerSourceTag = "lsd"
+	// Peers listed in the x.pe parameters of a magnet link.
+	PeerSourceMagnet PeerSourceTag = "magnet"
+	// Peers added by the user.
+	PeerSourceManual PeerSourceTag = "manual"
+)
+
+// PeerSource discovers peers of a torrent. Start begins the discovery; the addresses found are
+// sent on the Peers channel, in batches, until Close is called. The channel is never closed:
+// consumers stop reading once they closed the source.
+type PeerSource interface {
+	LifeCycle
+
+	Tag() PeerSourceTag
+	Peers() <-chan []PeerAddr
+}
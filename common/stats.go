@@ -0,0 +1,70 @@
+package common
+
+import (
+	"sync"
+	"sync/atomic"
+)
+
+// TransferStats holds the byte counters of a torrent, as reported to trackers. The download and
+// upload engine add to them as data is transferred; readers take snapshots at any time. All
+// methods are safe for concurrent use.
+type TransferStats struct {
+	uploaded   atomic.Int64
+	downloaded atomic.Int64
+	left       atomic.Int64
+
+	completeOnce sync.Once
+	completed    chan struct{}
+}
+
+func NewTransferStats(left int64) *TransferStats {
+	stats := &TransferStats{completed: make(chan struct{})}
+	stats.left.Store(left)
+	return stats
+}
+
+// AddUploaded records n bytes of piece data sent to peers.
+func (s *TransferStats) AddUploaded(n int64) {
+	s.uploaded.Add(n)
+}
+
+// AddDownloaded records n bytes of piece data received from peers, including data that later
+// fails verification.
+func (s *TransferStats) AddDownloaded(n int64) {
+	s.downloaded.Add(n)
+}
+
+// SetLeft sets the number of bytes still missing. When left drops to 0 from a positive value,
+// the channel returned by Completed is closed; starting with left = 0 (seeding) doesn't count as
+// a completion.
+func (s *TransferStats) SetLeft(left int64) {
+	previous := s.left.Swap(left)
+	if previous > 0 && left == 0 {
+		s.completeOnce.Do(func() { close(s.completed) })
+	}
+}
+
+// AddLeft adds delta (usually negative, the size of a verified piece) to the bytes left.
+func (s *TransferStats) AddLeft(delta int64) {
+	left := s.left.Add(delta)
+	if left == 0 && delta < 0 {
+		s.completeOnce.Do(func() { close(s.completed) })
+	}
+}
+
+func (s *TransferStats) Uploaded() int64 {
+	return s.uploaded.Load()
+}
+
+func (s *TransferStats) Downloaded() int64 {
+	return s.downloaded.Load()
+}
+
+func (s *TransferStats) Left() int64 {
+	return s.left.Load()
+}
+
+// Completed returns a channel that is closed once, when the download finishes.
+func (s *TransferStats) Completed() <-chan struct{} {
+	return s.completed
+}
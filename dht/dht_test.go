@@ -0,0 +1,364 @@
+package dht
+
+import (
+	"context"
+	"crypto/ed25519"
+	"encoding/hex"
+	"io"
+	"log/slog"
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/dpnam2112/bittorrent-client/bencode"
+	"github.com/dpnam2112/bittorrent-client/common"
+	"github.com/stretchr/testify/assert"
+)
+
+var discardLogger = slog.New(slog.NewTextHandler(io.Discard, nil))
+
+func idWithPrefix(prefix ...byte) NodeID {
+	var id NodeID
+	copy(id[:], prefix)
+	return id
+}
+
+func loopbackAddr(port int) *net.UDPAddr {
+	return &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1), Port: port}
+}
+
+func TestNodeIDDistance(t *testing.T) {
+	a := idWithPrefix(0xf0)
+	b := idWithPrefix(0xf8)
+
+	assert.Equal(t, idWithPrefix(0x08), a.Distance(b))
+	assert.Equal(t, 4, a.CommonPrefixLen(b))
+	assert.Equal(t, 160, a.CommonPrefixLen(a))
+	assert.True(t, idWithPrefix(0x01).Less(idWithPrefix(0x02)))
+
+	for _, prefixLen := range []int{0, 7, 100, 159} {
+		assert.Equal(t, prefixLen, a.CommonPrefixLen(randomIDWithPrefix(a, prefixLen)))
+	}
+}
+
+func TestKRPCMessageRoundTrip(t *testing.T) {
+	query := &krpcMessage{
+		TxnID: "aa",
+		Type:  krpcQuery,
+		Query: MethodGetPeers,
+		Args:  map[string]bencode.BValue{"info_hash": bstring("mnopqrstuvwxyz123456")},
+	}
+	raw := query.Marshal()
+	assert.Equal(t, "d1:ad9:info_hash20:mnopqrstuvwxyz123456e1:q9:get_peers1:t2:aa1:y1:qe", string(raw))
+
+	decoded, err := unmarshalKRPCMessage(raw)
+	assert.NoError(t, err)
+	assert.Equal(t, MethodGetPeers, decoded.Query)
+	infoHash, ok := getID(decoded.Args, "info_hash")
+	assert.True(t, ok)
+	assert.Equal(t, "mnopqrstuvwxyz123456", string(infoHash[:]))
+
+	decoded, err = unmarshalKRPCMessage([]byte("d1:eli201e23:A Generic Error Ocurrede1:t2:aa1:y1:ee"))
+	assert.NoError(t, err)
+	assert.Equal(t, &KRPCError{Code: 201, Message: "A Generic Error Ocurred"}, decoded.Err)
+
+	_, err = unmarshalKRPCMessage([]byte("d1:t2:aa1:y1:qe"))
+	assert.Error(t, err)
+}
+
+func TestCompactNodesRoundTrip(t *testing.T) {
+	nodes := []NodeInfo{
+		{ID: idWithPrefix(1), Addr: loopbackAddr(6881)},
+		{ID: idWithPrefix(2), Addr: &net.UDPAddr{IP: net.ParseIP("2001:db8::1"), Port: 6882}},
+	}
+
+	raw := MarshalCompactNodes(nodes, false)
+	assert.Len(t, raw, CompactNodeSizeIPv4)
+	decoded, err := UnmarshalCompactNodes(raw, false)
+	assert.NoError(t, err)
+	assert.Equal(t, nodes[0].ID, decoded[0].ID)
+	assert.Equal(t, "127.0.0.1:6881", decoded[0].Addr.String())
+
+	raw6 := MarshalCompactNodes(nodes, true)
+	decoded, err = UnmarshalCompactNodes(raw6, true)
+	assert.NoError(t, err)
+	assert.Len(t, decoded, 1)
+	assert.Equal(t, "[2001:db8::1]:6882", decoded[0].Addr.String())
+
+	_, err = UnmarshalCompactNodes(raw[:25], false)
+	assert.Error(t, err)
+}
+
+func TestRoutingTableBuckets(t *testing.T) {
+	table := newRoutingTable(NodeID{})
+
+	// All these IDs start with bit 1 and fall in bucket 0.
+	for i := 0; i < BucketSize+2; i++ {
+		table.Seen(NodeInfo{ID: idWithPrefix(0x80, byte(i)), Addr: loopbackAddr(1000 + i)})
+	}
+	assert.Equal(t, BucketSize, table.Len())
+	assert.Len(t, table.buckets[0].replacements, 2)
+
+	// A bad node is replaced by the latest replacement candidate.
+	bad := idWithPrefix(0x80, 0)
+	table.Failed(bad)
+	table.Failed(bad)
+	closest := table.Closest(idWithPrefix(0x80, byte(BucketSize+1)), BucketSize)
+	assert.Len(t, closest, BucketSize)
+	assert.Equal(t, idWithPrefix(0x80, byte(BucketSize+1)), closest[0].ID)
+	assert.NotContains(t, closest, NodeInfo{ID: bad, Addr: loopbackAddr(1000)})
+
+	// Closest sorts by XOR distance, across buckets.
+	table.Seen(NodeInfo{ID: idWithPrefix(0x01), Addr: loopbackAddr(2000)})
+	closest = table.Closest(idWithPrefix(0x03), 2)
+	assert.Equal(t, idWithPrefix(0x01), closest[0].ID)
+
+	// Our own ID is never added.
+	table.Seen(NodeInfo{ID: NodeID{}, Addr: loopbackAddr(3000)})
+	assert.Equal(t, BucketSize+1, table.Len())
+}
+
+func TestTokenRotation(t *testing.T) {
+	tokens := newTokenManager()
+	ip := net.ParseIP("10.0.0.1")
+
+	token := tokens.Generate(ip)
+	assert.True(t, tokens.Validate(token, ip))
+	assert.False(t, tokens.Validate(token, net.ParseIP("10.0.0.2")))
+
+	tokens.Rotate()
+	assert.True(t, tokens.Validate(token, ip))
+
+	tokens.Rotate()
+	assert.False(t, tokens.Validate(token, ip))
+}
+
+// startNetwork starts count nodes on loopback. Every node bootstraps from the first one.
+func startNetwork(t *testing.T, count int) []*Node {
+	var nodes []*Node
+	for i := 0; i < count; i++ {
+		config := Config{Addr: "127.0.0.1:0", QueryTimeout: time.Second}
+		if i > 0 {
+			config.BootstrapAddrs = []string{nodes[0].Addr().String()}
+		}
+
+		node := NewNode(config, discardLogger)
+		assert.NoError(t, node.Start(context.Background()))
+		t.Cleanup(func() { node.Close() })
+		nodes = append(nodes, node)
+	}
+
+	for _, node := range nodes[1:] {
+		assert.NoError(t, node.Bootstrap(context.Background()))
+	}
+	return nodes
+}
+
+func TestLookupsConverge(t *testing.T) {
+	nodes := startNetwork(t, 40)
+	ctx := context.Background()
+
+	// From any node, looking up the ID of any other node must find that node first.
+	for i := 0; i < len(nodes); i += 7 {
+		searcher := nodes[(i+13)%len(nodes)]
+		target := nodes[i]
+
+		found := searcher.FindNode(ctx, target.ID())
+		if assert.NotEmpty(t, found) {
+			assert.Equal(t, target.ID(), found[0].ID)
+		}
+	}
+
+	// A peer announced by one node can be found from every other node.
+	infoHash := common.InfoHash(RandomNodeID())
+	_, err := nodes[5].Announce(ctx, infoHash, 6881, false)
+	assert.NoError(t, err)
+
+	for _, node := range []*Node{nodes[0], nodes[17], nodes[39]} {
+		peers := node.GetPeers(ctx, infoHash)
+		assert.Contains(t, peers, common.PeerAddr{Host: "127.0.0.1", Port: 6881})
+	}
+}
+
+func TestAnnounceRejectsBadToken(t *testing.T) {
+	nodes := startNetwork(t, 2)
+
+	args := map[string]bencode.BValue{
+		"info_hash": bstring("mnopqrstuvwxyz123456"),
+		"port":      &bencode.BInt{Value: 6881},
+		"token":     bstring("forged"),
+	}
+	_, err := nodes[1].query(context.Background(), nodes[0].Addr().(*net.UDPAddr), MethodAnnouncePeer, args)
+	assert.ErrorContains(t, err, "bad token")
+}
+
+func TestPeerResolver(t *testing.T) {
+	nodes := startNetwork(t, 10)
+	infoHash := common.InfoHash(RandomNodeID())
+
+	_, err := nodes[3].Announce(context.Background(), infoHash, 7000, false)
+	assert.NoError(t, err)
+
+	resolver := NewPeerResolver(nodes[8], infoHash, PeerResolverConfig{Port: 7001, Logger: discardLogger})
+	discovered := make(chan []common.PeerAddr, 1)
+	resolver.RegisterHandler(func(peers []common.PeerAddr) error {
+		discovered <- peers
+		return nil
+	})
+
+	assert.NoError(t, resolver.Start(context.Background()))
+	defer resolver.Close()
+
+	select {
+	case peers := <-discovered:
+		assert.Contains(t, peers, common.PeerAddr{Host: "127.0.0.1", Port: 7000})
+	case <-time.After(10 * time.Second):
+		t.Fatal("DHT peer resolver didn't find the announced peer")
+	}
+
+	// The resolver announced us as well.
+	assert.Contains(t, nodes[0].GetPeers(context.Background(), infoHash), common.PeerAddr{Host: "127.0.0.1", Port: 7001})
+}
+
+func TestStateRoundTrip(t *testing.T) {
+	state := State{
+		ID: idWithPrefix(0xab),
+		Nodes: []NodeInfo{
+			{ID: idWithPrefix(1), Addr: loopbackAddr(6881)},
+			{ID: idWithPrefix(2), Addr: &net.UDPAddr{IP: net.ParseIP("2001:db8::1"), Port: 6882}},
+		},
+	}
+
+	path := filepath.Join(t.TempDir(), "dht", "state.dat")
+	assert.NoError(t, SaveState(path, state))
+
+	loaded, err := LoadState(path)
+	assert.NoError(t, err)
+	assert.Equal(t, state.ID, loaded.ID)
+	assert.Len(t, loaded.Nodes, 2)
+	assert.Equal(t, "[2001:db8::1]:6882", loaded.Nodes[1].Addr.String())
+
+	_, err = LoadState(filepath.Join(t.TempDir(), "missing.dat"))
+	assert.ErrorIs(t, err, os.ErrNotExist)
+}
+
+func TestRestartFromSavedState(t *testing.T) {
+	nodes := startNetwork(t, 10)
+	path := filepath.Join(t.TempDir(), "state.dat")
+
+	node := NewNode(Config{
+		Addr:           "127.0.0.1:0",
+		BootstrapAddrs: []string{nodes[0].Addr().String()},
+		StateFile:      path,
+		QueryTimeout:   time.Second,
+	}, discardLogger)
+	assert.NoError(t, node.Start(context.Background()))
+	assert.NoError(t, node.Bootstrap(context.Background()))
+	known := node.NodeCount()
+	assert.NoError(t, node.Close())
+
+	// The restarted node keeps its ID and joins without any bootstrap host.
+	state, err := LoadState(path)
+	assert.NoError(t, err)
+	assert.Equal(t, node.ID(), state.ID)
+	assert.Len(t, state.Nodes, known)
+
+	restarted := NewNode(Config{Addr: "127.0.0.1:0", ID: state.ID, KnownNodes: state.Nodes, QueryTimeout: time.Second}, discardLogger)
+	assert.NoError(t, restarted.Start(context.Background()))
+	defer restarted.Close()
+	assert.NoError(t, restarted.Bootstrap(context.Background()))
+
+	stats := restarted.Stats()
+	assert.Equal(t, known, stats.Nodes)
+	assert.Equal(t, int64(1), stats.Lookups)
+	assert.Equal(t, 1.0, stats.LookupSuccessRate())
+	assert.Equal(t, int64(0), stats.QueriesTimedOut)
+
+	filled := 0
+	for _, b := range stats.Buckets {
+		filled += b.Nodes
+	}
+	assert.Equal(t, known, filled)
+}
+
+func TestMutableItemSignatureVectors(t *testing.T) {
+	// Test vectors from BEP 44.
+	publicKey, _ := hex.DecodeString("77ff84905a91936367c01360803104f92432fcd904a43511876df5cdf3e7e548")
+	sig, _ := hex.DecodeString("305ac8aeb6c9c151fa120f120ea2cfb923564e11552d06a5d856091e5e853cff1260d3f39e4999684aa92eb73ffd136e6f4f3ecbfda0ce53a1608ecd7ae21f01")
+	item := MutableItem{PublicKey: publicKey, Seq: 1, Value: bstring("Hello World!"), Signature: sig}
+	assert.Equal(t, "3:seqi1e1:v12:Hello World!", string(item.signedData()))
+	assert.True(t, item.Verify())
+	assert.Equal(t, "4a533d47ec9c7d95b1ad75f576cffc641853b750", item.Target().String())
+
+	sig, _ = hex.DecodeString("6834284b6b24c3204eb2fea824d82f88883a3d95e8b4a21b8c0ded553d17d17ddf9a8a7104b1258f30bed3787e6cb896fca78c58f8e03b5f18f14951a87d9a08")
+	item = MutableItem{PublicKey: publicKey, Salt: []byte("foobar"), Seq: 1, Value: bstring("Hello World!"), Signature: sig}
+	assert.Equal(t, "4:salt6:foobar3:seqi1e1:v12:Hello World!", string(item.signedData()))
+	assert.True(t, item.Verify())
+	assert.Equal(t, "411eba73b6f087ca51a3795d9c8c938d365e32c1", item.Target().String())
+
+	item.Seq = 2
+	assert.False(t, item.Verify())
+
+	assert.Equal(t, "e5f96f6f38320f0f33959cb4d3d656452117aadb", ImmutableTarget(bstring("Hello World!")).String())
+}
+
+func TestPutGetItems(t *testing.T) {
+	nodes := startNetwork(t, 20)
+	ctx := context.Background()
+
+	// Immutable items
+	target, err := nodes[2].PutImmutable(ctx, bstring("Hello World!"))
+	assert.NoError(t, err)
+
+	value, err := nodes[15].GetImmutable(ctx, target)
+	assert.NoError(t, err)
+	assert.Equal(t, bstring("Hello World!"), value)
+
+	_, err = nodes[15].GetImmutable(ctx, RandomNodeID())
+	assert.ErrorIs(t, err, ErrItemNotFound)
+
+	// Mutable items
+	_, privateKey, _ := ed25519.GenerateKey(nil)
+	publicKey := privateKey.Public().(ed25519.PublicKey)
+	salt := []byte("feed")
+
+	assert.NoError(t, nodes[4].PutMutable(ctx, NewMutableItem(privateKey, salt, 1, bstring("v1")), nil))
+	item, err := nodes[11].GetMutable(ctx, publicKey, salt)
+	assert.NoError(t, err)
+	assert.Equal(t, int64(1), item.Seq)
+	assert.Equal(t, bstring("v1"), item.Value)
+
+	// Updates must increase the sequence number, and CAS must match the stored one.
+	cas := int64(1)
+	assert.NoError(t, nodes[7].PutMutable(ctx, NewMutableItem(privateKey, salt, 2, bstring("v2")), &cas))
+
+	var krpcErr *KRPCError
+	err = nodes[7].PutMutable(ctx, NewMutableItem(privateKey, salt, 3, bstring("v3")), &cas)
+	if assert.ErrorAs(t, err, &krpcErr) {
+		assert.Equal(t, int64(ErrorCodeCASMismatch), krpcErr.Code)
+	}
+
+	err = nodes[7].PutMutable(ctx, NewMutableItem(privateKey, salt, 1, bstring("old")), nil)
+	if assert.ErrorAs(t, err, &krpcErr) {
+		assert.Equal(t, int64(ErrorCodeSeqTooLow), krpcErr.Code)
+	}
+
+	item, err = nodes[19].GetMutable(ctx, publicKey, salt)
+	assert.NoError(t, err)
+	assert.Equal(t, int64(2), item.Seq)
+	assert.Equal(t, bstring("v2"), item.Value)
+
+	// A different salt is a different item.
+	_, err = nodes[19].GetMutable(ctx, publicKey, []byte("other"))
+	assert.ErrorIs(t, err, ErrItemNotFound)
+
+	// Items with a forged signature are rejected.
+	forged := NewMutableItem(privateKey, salt, 5, bstring("v5"))
+	forged.Value = bstring("forged")
+	err = nodes[7].PutMutable(ctx, forged, nil)
+	if assert.ErrorAs(t, err, &krpcErr) {
+		assert.Equal(t, int64(ErrorCodeInvalidSignature), krpcErr.Code)
+	}
+}
@@ -0,0 +1,168 @@
+package dht
+
+import (
+	"bytes"
+	"crypto/ed25519"
+	"crypto/sha1"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/dpnam2112/bittorrent-client/bencode"
+)
+
+const (
+	// Maximum size of the bencoded value of an item (BEP 44).
+	MaxItemValueSize = 1000
+	// Maximum size of the salt of a mutable item (BEP 44).
+	MaxItemSaltSize = 64
+
+	// Stored items are dropped if nobody puts them again within this window.
+	itemTTL  = 2 * time.Hour
+	maxItems = 10000
+)
+
+// ImmutableTarget returns the key an immutable item is stored under: the SHA-1 of its bencoded
+// value.
+func ImmutableTarget(value bencode.BValue) NodeID {
+	return sha1.Sum(bencode.Encode(value))
+}
+
+// MutableItem is a value signed with an ed25519 key (BEP 44). It's stored under the SHA-1 of the
+// public key and salt, so its owner can publish new versions under the same key by increasing
+// Seq.
+type MutableItem struct {
+	PublicKey ed25519.PublicKey
+	Salt      []byte
+	Seq       int64
+	Value     bencode.BValue
+	Signature []byte
+}
+
+// NewMutableItem creates a mutable item signed with privateKey.
+func NewMutableItem(privateKey ed25519.PrivateKey, salt []byte, seq int64, value bencode.BValue) MutableItem {
+	item := MutableItem{
+		PublicKey: privateKey.Public().(ed25519.PublicKey),
+		Salt:      salt,
+		Seq:       seq,
+		Value:     value,
+	}
+	item.Signature = ed25519.Sign(privateKey, item.signedData())
+	return item
+}
+
+// MutableTarget returns the key a mutable item is stored under.
+func MutableTarget(publicKey ed25519.PublicKey, salt []byte) NodeID {
+	return sha1.Sum(append(append([]byte{}, publicKey...), salt...))
+}
+
+func (item MutableItem) Target() NodeID {
+	return MutableTarget(item.PublicKey, item.Salt)
+}
+
+// Verify checks the signature of the item.
+func (item MutableItem) Verify() bool {
+	return len(item.PublicKey) == ed25519.PublicKeySize &&
+		len(item.Signature) == ed25519.SignatureSize &&
+		ed25519.Verify(item.PublicKey, item.signedData(), item.Signature)
+}
+
+// signedData returns the buffer covered by the signature: the bencoded salt (if any), seq and v
+// entries of the put arguments, without the enclosing dictionary.
+func (item MutableItem) signedData() []byte {
+	var buf bytes.Buffer
+	if len(item.Salt) > 0 {
+		buf.WriteString("4:salt")
+		buf.WriteString(strconv.Itoa(len(item.Salt)))
+		buf.WriteByte(':')
+		buf.Write(item.Salt)
+	}
+	buf.WriteString("3:seqi")
+	buf.WriteString(strconv.FormatInt(item.Seq, 10))
+	buf.WriteString("e1:v")
+	buf.Write(bencode.Encode(item.Value))
+	return buf.Bytes()
+}
+
+// storedItem is an item put to this node by another one. For immutable items, mutable is nil.
+type storedItem struct {
+	value   bencode.BValue
+	mutable *MutableItem
+	stored  time.Time
+}
+
+// itemStore holds the BEP 44 items put to this node.
+type itemStore struct {
+	now func() time.Time
+
+	mu    sync.Mutex
+	items map[NodeID]storedItem
+}
+
+func newItemStore() *itemStore {
+	return &itemStore{now: time.Now, items: make(map[NodeID]storedItem)}
+}
+
+func (s *itemStore) Get(target NodeID) (storedItem, bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	item, ok := s.items[target]
+	return item, ok
+}
+
+func (s *itemStore) PutImmutable(value bencode.BValue) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.putLocked(ImmutableTarget(value), storedItem{value: value})
+}
+
+// PutMutable stores a verified mutable item, enforcing the sequence number and compare-and-swap
+// rules. cas is the sequence number the writer expects to replace, or nil.
+func (s *itemStore) PutMutable(item MutableItem, cas *int64) *KRPCError {
+	target := item.Target()
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	existing, ok := s.items[target]
+	if ok && existing.mutable != nil {
+		current := existing.mutable
+		if cas != nil && *cas != current.Seq {
+			return &KRPCError{Code: ErrorCodeCASMismatch, Message: "CAS mismatch, re-read value and try again"}
+		}
+		if item.Seq < current.Seq ||
+			item.Seq == current.Seq && !bytes.Equal(bencode.Encode(item.Value), bencode.Encode(current.Value)) {
+			return &KRPCError{Code: ErrorCodeSeqTooLow, Message: "sequence number less than current"}
+		}
+	}
+
+	s.putLocked(target, storedItem{value: item.Value, mutable: &item})
+	return nil
+}
+
+func (s *itemStore) putLocked(target NodeID, item storedItem) {
+	if _, ok := s.items[target]; !ok && len(s.items) >= maxItems {
+		return
+	}
+	item.stored = s.now()
+	s.items[target] = item
+}
+
+func (s *itemStore) Count() int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return len(s.items)
+}
+
+// Expire removes the items that weren't put again within itemTTL.
+func (s *itemStore) Expire() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	deadline := s.now().Add(-itemTTL)
+	for target, item := range s.items {
+		if item.stored.Before(deadline) {
+			delete(s.items, target)
+		}
+	}
+}
@@ -0,0 +1,263 @@
+package dht
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"net"
+
+	"github.com/dpnam2112/bittorrent-client/bencode"
+	"github.com/dpnam2112/bittorrent-client/common"
+)
+
+// KRPC message types (the 'y' key).
+const (
+	krpcQuery    = "q"
+	krpcResponse = "r"
+	krpcError    = "e"
+)
+
+// KRPC query methods (the 'q' key).
+const (
+	MethodPing         = "ping"
+	MethodFindNode     = "find_node"
+	MethodGetPeers     = "get_peers"
+	MethodAnnouncePeer = "announce_peer"
+	MethodGet          = "get"
+	MethodPut          = "put"
+)
+
+// KRPC error codes.
+const (
+	ErrorCodeGeneric       = 201
+	ErrorCodeServer        = 202
+	ErrorCodeProtocol      = 203
+	ErrorCodeMethodUnknown = 204
+
+	// BEP 44 error codes.
+	ErrorCodeValueTooBig      = 205
+	ErrorCodeInvalidSignature = 206
+	ErrorCodeSaltTooBig       = 207
+	ErrorCodeCASMismatch      = 301
+	ErrorCodeSeqTooLow        = 302
+)
+
+const (
+	// Size of a compact node info entry: node ID (20) + IPv4 (4) + port (2).
+	CompactNodeSizeIPv4 = 26
+	// Size of a compact node info entry for IPv6 nodes ('nodes6' key): node ID (20) + IPv6 (16) + port (2).
+	CompactNodeSizeIPv6 = 38
+)
+
+// KRPCError is the error returned by a remote node (a message with y = "e").
+type KRPCError struct {
+	Code    int64
+	Message string
+}
+
+func (e *KRPCError) Error() string {
+	return fmt.Sprintf("KRPC error %d: %s", e.Code, e.Message)
+}
+
+// krpcMessage is a decoded KRPC message. Depending on Type, either Query and Args, Response, or
+// Err is set.
+//
+// Wire layout (bencoded dictionary):
+//
+//	t: transaction ID (string)
+//	y: "q", "r" or "e"
+//	q: method name (queries)
+//	a: arguments dictionary (queries)
+//	r: return values dictionary (responses)
+//	e: [code, message] (errors)
+type krpcMessage struct {
+	TxnID    string
+	Type     string
+	Query    string
+	Args     map[string]bencode.BValue
+	Response map[string]bencode.BValue
+	Err      *KRPCError
+}
+
+func (m *krpcMessage) Marshal() []byte {
+	dict := map[string]bencode.BValue{
+		"t": bstring(m.TxnID),
+		"y": bstring(m.Type),
+	}
+
+	switch m.Type {
+	case krpcQuery:
+		dict["q"] = bstring(m.Query)
+		dict["a"] = &bencode.BDict{Dict: m.Args}
+	case krpcResponse:
+		dict["r"] = &bencode.BDict{Dict: m.Response}
+	case krpcError:
+		dict["e"] = &bencode.BList{Values: []bencode.BValue{
+			&bencode.BInt{Value: m.Err.Code},
+			bstring(m.Err.Message),
+		}}
+	}
+
+	return bencode.Encode(&bencode.BDict{Dict: dict})
+}
+
+func unmarshalKRPCMessage(raw []byte) (*krpcMessage, error) {
+	_, value, err := bencode.ParseBencode(raw)
+	if err != nil {
+		return nil, fmt.Errorf("Failed to parse KRPC message: %w", err)
+	}
+
+	dict, ok := value.(*bencode.BDict)
+	if !ok {
+		return nil, errors.New("KRPC message is not a dictionary")
+	}
+
+	msg := &krpcMessage{}
+	if msg.TxnID, ok = getString(dict.Dict, "t"); !ok {
+		return nil, errors.New("KRPC message has no transaction ID")
+	}
+	if msg.Type, ok = getString(dict.Dict, "y"); !ok {
+		return nil, errors.New("KRPC message has no type")
+	}
+
+	switch msg.Type {
+	case krpcQuery:
+		if msg.Query, ok = getString(dict.Dict, "q"); !ok {
+			return nil, errors.New("KRPC query has no method")
+		}
+		if msg.Args, ok = getDict(dict.Dict, "a"); !ok {
+			return nil, errors.New("KRPC query has no arguments")
+		}
+	case krpcResponse:
+		if msg.Response, ok = getDict(dict.Dict, "r"); !ok {
+			return nil, errors.New("KRPC response has no return values")
+		}
+	case krpcError:
+		list, ok := dict.Dict["e"].(*bencode.BList)
+		if !ok || len(list.Values) < 2 {
+			return nil, errors.New("KRPC error has no [code, message] list")
+		}
+		code, okCode := list.Values[0].(*bencode.BInt)
+		message, okMessage := list.Values[1].(*bencode.BString)
+		if !okCode || !okMessage {
+			return nil, errors.New("KRPC error has an invalid [code, message] list")
+		}
+		msg.Err = &KRPCError{Code: code.Value, Message: string(message.Value)}
+	default:
+		return nil, fmt.Errorf("Unknown KRPC message type '%s'", msg.Type)
+	}
+
+	return msg, nil
+}
+
+// NodeInfo is the contact information of a DHT node.
+type NodeInfo struct {
+	ID   NodeID
+	Addr *net.UDPAddr
+}
+
+// MarshalCompactNodes encodes nodes of one address family in the compact node info format.
+// Nodes of the other family are skipped.
+func MarshalCompactNodes(nodes []NodeInfo, ipv6 bool) []byte {
+	var raw []byte
+	for _, node := range nodes {
+		ip := node.Addr.IP.To4()
+		if ipv6 {
+			if ip != nil {
+				continue
+			}
+			ip = node.Addr.IP.To16()
+		} else if ip == nil {
+			continue
+		}
+
+		raw = append(raw, node.ID[:]...)
+		raw = append(raw, ip...)
+		raw = binary.BigEndian.AppendUint16(raw, uint16(node.Addr.Port))
+	}
+	return raw
+}
+
+// UnmarshalCompactNodes decodes the 'nodes' (IPv4) or 'nodes6' (IPv6) value of a response.
+func UnmarshalCompactNodes(raw []byte, ipv6 bool) ([]NodeInfo, error) {
+	entrySize, ipSize := CompactNodeSizeIPv4, net.IPv4len
+	if ipv6 {
+		entrySize, ipSize = CompactNodeSizeIPv6, net.IPv6len
+	}
+	if len(raw)%entrySize != 0 {
+		return nil, fmt.Errorf("Compact node info length %d is not a multiple of %d", len(raw), entrySize)
+	}
+
+	nodes := make([]NodeInfo, 0, len(raw)/entrySize)
+	for offset := 0; offset < len(raw); offset += entrySize {
+		var node NodeInfo
+		copy(node.ID[:], raw[offset:offset+20])
+		ip := make(net.IP, ipSize)
+		copy(ip, raw[offset+20:offset+20+ipSize])
+		port := binary.BigEndian.Uint16(raw[offset+20+ipSize:])
+		node.Addr = &net.UDPAddr{IP: ip, Port: int(port)}
+		nodes = append(nodes, node)
+	}
+	return nodes, nil
+}
+
+// marshalCompactPeer encodes a peer address in the compact format used by the 'values' list of
+// get_peers responses (6 bytes for IPv4, 18 for IPv6).
+func marshalCompactPeer(ip net.IP, port uint16) []byte {
+	if ip4 := ip.To4(); ip4 != nil {
+		ip = ip4
+	}
+	return binary.BigEndian.AppendUint16(append([]byte{}, ip...), port)
+}
+
+func unmarshalCompactPeer(raw []byte) (common.PeerAddr, error) {
+	if len(raw) != 6 && len(raw) != 18 {
+		return common.PeerAddr{}, fmt.Errorf("Invalid compact peer length %d", len(raw))
+	}
+	ip := net.IP(raw[:len(raw)-2])
+	port := binary.BigEndian.Uint16(raw[len(raw)-2:])
+	return common.PeerAddr{Host: ip.String(), Port: port}, nil
+}
+
+func bstring(s string) *bencode.BString {
+	return &bencode.BString{Value: []byte(s)}
+}
+
+func bbytes(b []byte) *bencode.BString {
+	return &bencode.BString{Value: b}
+}
+
+func getString(dict map[string]bencode.BValue, key string) (string, bool) {
+	value, ok := dict[key].(*bencode.BString)
+	if !ok {
+		return "", false
+	}
+	return string(value.Value), true
+}
+
+func getInt(dict map[string]bencode.BValue, key string) (int64, bool) {
+	value, ok := dict[key].(*bencode.BInt)
+	if !ok {
+		return 0, false
+	}
+	return value.Value, true
+}
+
+func getDict(dict map[string]bencode.BValue, key string) (map[string]bencode.BValue, bool) {
+	value, ok := dict[key].(*bencode.BDict)
+	if !ok {
+		return nil, false
+	}
+	return value.Dict, true
+}
+
+// getID reads a 20-byte identifier (node ID, info hash, target) from a dictionary.
+func getID(dict map[string]bencode.BValue, key string) (NodeID, bool) {
+	var id NodeID
+	value, ok := getString(dict, key)
+	if !ok || len(value) != len(id) {
+		return id, false
+	}
+	copy(id[:], value)
+	return id, true
+}
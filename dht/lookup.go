@@ -0,0 +1,266 @@
+package dht
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"slices"
+	"sync"
+
+	"github.com/dpnam2112/bittorrent-client/bencode"
+	"github.com/dpnam2112/bittorrent-client/common"
+)
+
+// Number of queries a lookup keeps in flight (alpha in the Kademlia paper).
+const lookupConcurrency = 3
+
+type lookupCandidate struct {
+	node      NodeInfo
+	queried   bool
+	responded bool
+	// token is the announce token returned by the node in a get_peers response.
+	token []byte
+}
+
+// lookup is the state of an iterative lookup: the candidates discovered so far, nearest to the
+// target first.
+type lookup struct {
+	target     NodeID
+	candidates []*lookupCandidate
+	known      map[NodeID]struct{}
+}
+
+func (l *lookup) add(nodes []NodeInfo) {
+	for _, node := range nodes {
+		if _, ok := l.known[node.ID]; ok {
+			continue
+		}
+		l.known[node.ID] = struct{}{}
+		l.candidates = append(l.candidates, &lookupCandidate{node: node})
+	}
+
+	slices.SortFunc(l.candidates, func(a, b *lookupCandidate) int {
+		return compareDistance(a.node.ID, b.node.ID, l.target)
+	})
+}
+
+// next returns a candidate to query among the BucketSize closest ones that haven't failed, or nil
+// if they have all been queried. This is the termination condition of the lookup: it ends once
+// the closest nodes it knows of have all answered.
+func (l *lookup) next() *lookupCandidate {
+	considered := 0
+	for _, c := range l.candidates {
+		if c.queried && !c.responded {
+			continue
+		}
+		if !c.queried {
+			return c
+		}
+		considered++
+		if considered == BucketSize {
+			break
+		}
+	}
+	return nil
+}
+
+// closest returns up to BucketSize candidates that answered, nearest first.
+func (l *lookup) closest() []*lookupCandidate {
+	var result []*lookupCandidate
+	for _, c := range l.candidates {
+		if c.responded {
+			result = append(result, c)
+			if len(result) == BucketSize {
+				break
+			}
+		}
+	}
+	return result
+}
+
+type lookupResult struct {
+	candidate *lookupCandidate
+	resp      map[string]bencode.BValue
+	err       error
+}
+
+// iterativeLookup runs a Kademlia lookup for target, starting from the closest nodes of the
+// routing table. Each queried node is sent method with the arguments built by makeArgs, and
+// onResponse is called (from the lookup goroutine) with each answer. It returns the closest nodes
+// that answered.
+func (n *Node) iterativeLookup(ctx context.Context, target NodeID, method string, makeArgs func() map[string]bencode.BValue, onResponse func(resp map[string]bencode.BValue)) []*lookupCandidate {
+	l := &lookup{target: target, known: map[NodeID]struct{}{n.id: {}}}
+	l.add(n.table.Closest(target, BucketSize))
+
+	results := make(chan lookupResult)
+	inflight := 0
+
+	for {
+		for inflight < lookupConcurrency && ctx.Err() == nil {
+			c := l.next()
+			if c == nil {
+				break
+			}
+
+			c.queried = true
+			inflight++
+			go func() {
+				resp, err := n.query(ctx, c.node.Addr, method, makeArgs())
+				results <- lookupResult{candidate: c, resp: resp, err: err}
+			}()
+		}
+
+		if inflight == 0 {
+			break
+		}
+
+		result := <-results
+		inflight--
+
+		if result.err != nil {
+			if errors.Is(result.err, ErrQueryTimeout) {
+				n.table.Failed(result.candidate.node.ID)
+			}
+			continue
+		}
+
+		result.candidate.responded = true
+		if token, ok := getString(result.resp, "token"); ok {
+			result.candidate.token = []byte(token)
+		}
+		if onResponse != nil {
+			onResponse(result.resp)
+		}
+
+		l.add(nodesFromResponse(result.resp))
+	}
+
+	closest := l.closest()
+	n.counters.lookups.Add(1)
+	if len(closest) > 0 {
+		n.counters.successfulLookups.Add(1)
+	}
+	return closest
+}
+
+// nodesFromResponse decodes the 'nodes' and 'nodes6' values of a response. Malformed values are
+// ignored.
+func nodesFromResponse(resp map[string]bencode.BValue) []NodeInfo {
+	var nodes []NodeInfo
+	if raw, ok := getString(resp, "nodes"); ok {
+		decoded, _ := UnmarshalCompactNodes([]byte(raw), false)
+		nodes = append(nodes, decoded...)
+	}
+	if raw, ok := getString(resp, "nodes6"); ok {
+		decoded, _ := UnmarshalCompactNodes([]byte(raw), true)
+		nodes = append(nodes, decoded...)
+	}
+	return nodes
+}
+
+// FindNode looks up the nodes closest to target, nearest first.
+func (n *Node) FindNode(ctx context.Context, target NodeID) []NodeInfo {
+	makeArgs := func() map[string]bencode.BValue {
+		return map[string]bencode.BValue{"target": bbytes(target[:])}
+	}
+
+	var nodes []NodeInfo
+	for _, c := range n.iterativeLookup(ctx, target, MethodFindNode, makeArgs, nil) {
+		nodes = append(nodes, c.node)
+	}
+	return nodes
+}
+
+// GetPeers looks up the peers of a torrent.
+func (n *Node) GetPeers(ctx context.Context, infoHash common.InfoHash) []common.PeerAddr {
+	peers, _ := n.getPeers(ctx, infoHash)
+	return peers
+}
+
+// Announce looks up the peers of a torrent, then announces to the closest nodes that we are a
+// peer listening on port. If impliedPort is set, the nodes use the source port of our queries
+// instead, which is useful behind a NAT. It returns the peers found during the lookup.
+func (n *Node) Announce(ctx context.Context, infoHash common.InfoHash, port uint16, impliedPort bool) ([]common.PeerAddr, error) {
+	peers, closest := n.getPeers(ctx, infoHash)
+
+	var wg sync.WaitGroup
+	var mu sync.Mutex
+	accepted := 0
+	var lastErr error
+
+	for _, c := range closest {
+		if c.token == nil {
+			continue
+		}
+
+		args := map[string]bencode.BValue{
+			"info_hash": bbytes(infoHash[:]),
+			"port":      &bencode.BInt{Value: int64(port)},
+			"token":     bbytes(c.token),
+		}
+		if impliedPort {
+			args["implied_port"] = &bencode.BInt{Value: 1}
+		}
+
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			_, err := n.query(ctx, c.node.Addr, MethodAnnouncePeer, args)
+
+			mu.Lock()
+			defer mu.Unlock()
+			if err != nil {
+				lastErr = err
+			} else {
+				accepted++
+			}
+		}()
+	}
+	wg.Wait()
+
+	n.counters.announces.Add(1)
+	if accepted > 0 {
+		n.counters.successfulAnnounces.Add(1)
+	}
+
+	if accepted == 0 {
+		if lastErr == nil {
+			lastErr = errors.New("no node returned a token")
+		}
+		return peers, fmt.Errorf("Failed to announce to the DHT: %w", lastErr)
+	}
+	return peers, nil
+}
+
+func (n *Node) getPeers(ctx context.Context, infoHash common.InfoHash) ([]common.PeerAddr, []*lookupCandidate) {
+	makeArgs := func() map[string]bencode.BValue {
+		return map[string]bencode.BValue{"info_hash": bbytes(infoHash[:])}
+	}
+
+	var peers []common.PeerAddr
+	seen := make(map[common.PeerAddr]struct{})
+	onResponse := func(resp map[string]bencode.BValue) {
+		values, ok := resp["values"].(*bencode.BList)
+		if !ok {
+			return
+		}
+
+		for _, value := range values.Values {
+			raw, ok := value.(*bencode.BString)
+			if !ok {
+				continue
+			}
+			peer, err := unmarshalCompactPeer(raw.Value)
+			if err != nil {
+				continue
+			}
+			if _, dup := seen[peer]; !dup {
+				seen[peer] = struct{}{}
+				peers = append(peers, peer)
+			}
+		}
+	}
+
+	closest := n.iterativeLookup(ctx, NodeID(infoHash), MethodGetPeers, makeArgs, onResponse)
+	return peers, closest
+}
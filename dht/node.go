@@ -0,0 +1,514 @@
+package dht
+
+import (
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net"
+	"sync"
+	"time"
+
+	"github.com/dpnam2112/bittorrent-client/bencode"
+	"github.com/dpnam2112/bittorrent-client/common"
+)
+
+const (
+	defaultQueryTimeout = 5 * time.Second
+	maintenanceInterval = 1 * time.Minute
+	stateSaveInterval   = 10 * time.Minute
+)
+
+// DefaultBootstrapAddrs are well-known routers of the mainline DHT.
+var DefaultBootstrapAddrs = []string{
+	"router.bittorrent.com:6881",
+	"router.utorrent.com:6881",
+	"dht.transmissionbt.com:6881",
+}
+
+// Config controls the behaviour of a DHT node. Zero values are replaced with defaults by NewNode.
+type Config struct {
+	// Addr is the UDP address to listen on, e.g. ":6881". Ignored if Conn is set.
+	Addr string
+	// Conn is an already bound packet connection to serve on, instead of listening on Addr.
+	Conn net.PacketConn
+
+	// ID is the node ID; a random one is generated if zero.
+	ID NodeID
+
+	// BootstrapAddrs are "host:port" addresses of nodes used to join the network, e.g.
+	// DefaultBootstrapAddrs.
+	BootstrapAddrs []string
+	// KnownNodes are nodes remembered from a previous run (see LoadState), tried first when
+	// bootstrapping.
+	KnownNodes []NodeInfo
+
+	// StateFile, when set, is where the node ID and the good nodes of the routing table are saved,
+	// periodically and on Close.
+	StateFile string
+
+	// QueryTimeout is the time to wait for the answer to a single query.
+	QueryTimeout time.Duration
+}
+
+func (cfg *Config) setDefaults() {
+	if cfg.ID == (NodeID{}) {
+		cfg.ID = RandomNodeID()
+	}
+
+	if cfg.QueryTimeout <= 0 {
+		cfg.QueryTimeout = defaultQueryTimeout
+	}
+}
+
+// Node is a node of the mainline DHT (BEP 5). It answers the queries of other nodes, keeps a
+// Kademlia routing table and stores the peers announced to it, and performs iterative lookups
+// to find peers of a torrent.
+type Node struct {
+	config Config
+	id     NodeID
+	logger *slog.Logger
+
+	conn   net.PacketConn
+	table  *routingTable
+	peers  *peerStore
+	items  *itemStore
+	tokens *tokenManager
+
+	counters nodeCounters
+
+	mu      sync.Mutex
+	pending map[string]*pendingQuery
+	nextTxn uint16
+	// extraBootstrapAddrs are bootstrap nodes added after creation, e.g. from torrent files.
+	extraBootstrapAddrs []string
+
+	cancel context.CancelFunc
+	wg     sync.WaitGroup
+}
+
+// pendingQuery is a query waiting for its response.
+type pendingQuery struct {
+	addr     *net.UDPAddr
+	response chan *krpcMessage
+}
+
+var _ common.LifeCycle = (*Node)(nil)
+
+// ErrQueryTimeout is returned when a node doesn't answer a query in time.
+var ErrQueryTimeout = errors.New("DHT query timed out")
+
+func NewNode(config Config, logger *slog.Logger) *Node {
+	config.setDefaults()
+
+	return &Node{
+		config:  config,
+		id:      config.ID,
+		logger:  logger,
+		table:   newRoutingTable(config.ID),
+		peers:   newPeerStore(),
+		items:   newItemStore(),
+		tokens:  newTokenManager(),
+		pending: make(map[string]*pendingQuery),
+	}
+}
+
+// ID returns the ID of the node.
+func (n *Node) ID() NodeID {
+	return n.id
+}
+
+// Addr returns the address the node is bound to, or nil if it hasn't been started.
+func (n *Node) Addr() net.Addr {
+	if n.conn == nil {
+		return nil
+	}
+	return n.conn.LocalAddr()
+}
+
+// Start binds the UDP socket and serves queries in the background until Close is called or ctx is
+// cancelled. It doesn't join the network by itself; call Bootstrap for that.
+func (n *Node) Start(ctx context.Context) error {
+	n.conn = n.config.Conn
+	if n.conn == nil {
+		conn, err := net.ListenPacket("udp", n.config.Addr)
+		if err != nil {
+			return fmt.Errorf("Failed to listen on UDP address %s: %w", n.config.Addr, err)
+		}
+		n.conn = conn
+	}
+
+	ctx, n.cancel = context.WithCancel(ctx)
+	n.logger.Info("DHT node listening", "addr", n.conn.LocalAddr().String(), "id", n.id.String())
+
+	n.wg.Add(2)
+	go func() {
+		defer n.wg.Done()
+		n.serve()
+	}()
+	go func() {
+		defer n.wg.Done()
+		n.maintenanceLoop(ctx)
+	}()
+
+	go func() {
+		<-ctx.Done()
+		n.conn.Close()
+	}()
+
+	return nil
+}
+
+// Close stops serving and waits for the background goroutines to exit. The state is saved if a
+// state file is configured.
+func (n *Node) Close() error {
+	if n.cancel != nil {
+		n.cancel()
+	}
+	if n.conn != nil {
+		n.conn.Close()
+	}
+	n.wg.Wait()
+
+	if n.config.StateFile != "" && n.conn != nil {
+		return SaveState(n.config.StateFile, n.State())
+	}
+	return nil
+}
+
+// State returns the node ID and the good nodes of the routing table.
+func (n *Node) State() State {
+	return State{ID: n.id, Nodes: n.table.GoodNodes()}
+}
+
+// AddBootstrapAddrs adds "host:port" addresses to bootstrap from, such as the nodes listed in a
+// trackerless torrent.
+func (n *Node) AddBootstrapAddrs(addrs ...string) {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	n.extraBootstrapAddrs = append(n.extraBootstrapAddrs, addrs...)
+}
+
+// Bootstrap joins the network: the known nodes and the bootstrap nodes are pinged, then a lookup
+// for our own ID fills the routing table with our neighbourhood.
+func (n *Node) Bootstrap(ctx context.Context) error {
+	n.mu.Lock()
+	addrs := append(append([]string(nil), n.config.BootstrapAddrs...), n.extraBootstrapAddrs...)
+	n.mu.Unlock()
+
+	var wg sync.WaitGroup
+	seen := make(map[string]struct{})
+	ping := func(addr *net.UDPAddr) {
+		if _, ok := seen[addr.String()]; ok {
+			return
+		}
+		seen[addr.String()] = struct{}{}
+
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if _, err := n.Ping(ctx, addr); err != nil {
+				n.logger.Debug("DHT bootstrap node didn't answer", "addr", addr.String(), "err", err)
+			}
+		}()
+	}
+
+	for _, node := range n.config.KnownNodes {
+		ping(node.Addr)
+	}
+
+	for _, addr := range addrs {
+		udpAddr, err := net.ResolveUDPAddr("udp", addr)
+		if err != nil {
+			n.logger.Debug("Failed to resolve DHT bootstrap node", "addr", addr, "err", err)
+			continue
+		}
+		ping(udpAddr)
+	}
+	wg.Wait()
+
+	if n.table.Len() == 0 {
+		return errors.New("Failed to bootstrap DHT node: no node answered")
+	}
+
+	n.FindNode(ctx, n.id)
+	return nil
+}
+
+// NodeCount returns the number of nodes in the routing table.
+func (n *Node) NodeCount() int {
+	return n.table.Len()
+}
+
+// Ping queries a node and returns its ID. The node is added to the routing table.
+func (n *Node) Ping(ctx context.Context, addr *net.UDPAddr) (NodeID, error) {
+	resp, err := n.query(ctx, addr, MethodPing, map[string]bencode.BValue{})
+	if err != nil {
+		return NodeID{}, err
+	}
+	id, _ := getID(resp, "id")
+	return id, nil
+}
+
+// query sends a query to a node and waits for its response. Responding nodes are added to the
+// routing table.
+func (n *Node) query(ctx context.Context, addr *net.UDPAddr, method string, args map[string]bencode.BValue) (map[string]bencode.BValue, error) {
+	args["id"] = bbytes(n.id[:])
+
+	n.mu.Lock()
+	n.nextTxn++
+	var txn [2]byte
+	binary.BigEndian.PutUint16(txn[:], n.nextTxn)
+	txnID := string(txn[:])
+	pending := &pendingQuery{addr: addr, response: make(chan *krpcMessage, 1)}
+	n.pending[txnID] = pending
+	n.mu.Unlock()
+
+	defer func() {
+		n.mu.Lock()
+		delete(n.pending, txnID)
+		n.mu.Unlock()
+	}()
+
+	msg := &krpcMessage{TxnID: txnID, Type: krpcQuery, Query: method, Args: args}
+	if _, err := n.conn.WriteTo(msg.Marshal(), addr); err != nil {
+		return nil, fmt.Errorf("Failed to send %s query to %s: %w", method, addr, err)
+	}
+	n.counters.queriesSent.Add(1)
+
+	timer := time.NewTimer(n.config.QueryTimeout)
+	defer timer.Stop()
+
+	select {
+	case resp := <-pending.response:
+		n.counters.queriesAnswered.Add(1)
+		if resp.Type == krpcError {
+			return nil, resp.Err
+		}
+
+		id, ok := getID(resp.Response, "id")
+		if !ok {
+			return nil, fmt.Errorf("Response of %s to %s query has no node ID", addr, method)
+		}
+		n.table.Seen(NodeInfo{ID: id, Addr: addr})
+		return resp.Response, nil
+
+	case <-timer.C:
+		n.counters.queriesTimedOut.Add(1)
+		return nil, fmt.Errorf("%s query to %s: %w", method, addr, ErrQueryTimeout)
+
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
+}
+
+func (n *Node) serve() {
+	// Max size of an IP packet is 65535 bytes
+	buf := make([]byte, 65535)
+	for {
+		size, addr, err := n.conn.ReadFrom(buf)
+		if err != nil {
+			if !errors.Is(err, net.ErrClosed) {
+				n.logger.Error("Failed to read DHT packet", "err", err)
+			}
+			return
+		}
+
+		udpAddr, ok := addr.(*net.UDPAddr)
+		if !ok {
+			continue
+		}
+
+		// Decoded values point into the packet, and responses are handed to other goroutines, so
+		// the read buffer can't be reused for them.
+		packet := append([]byte(nil), buf[:size]...)
+		msg, err := unmarshalKRPCMessage(packet)
+		if err != nil {
+			n.logger.Debug("Dropping invalid DHT packet", "addr", addr.String(), "err", err)
+			continue
+		}
+
+		switch msg.Type {
+		case krpcQuery:
+			n.handleQuery(msg, udpAddr)
+		default:
+			n.handleResponse(msg, udpAddr)
+		}
+	}
+}
+
+func (n *Node) handleResponse(msg *krpcMessage, addr *net.UDPAddr) {
+	n.mu.Lock()
+	pending, ok := n.pending[msg.TxnID]
+	n.mu.Unlock()
+
+	// Only the node the query was sent to may answer it.
+	if !ok || !sameAddr(pending.addr, addr) {
+		return
+	}
+
+	select {
+	case pending.response <- msg:
+	default:
+	}
+}
+
+func (n *Node) handleQuery(msg *krpcMessage, addr *net.UDPAddr) {
+	id, ok := getID(msg.Args, "id")
+	if !ok {
+		n.sendError(msg.TxnID, addr, ErrorCodeProtocol, "missing or invalid 'id'")
+		return
+	}
+
+	var resp map[string]bencode.BValue
+	var krpcErr *KRPCError
+
+	switch msg.Query {
+	case MethodPing:
+		resp = map[string]bencode.BValue{}
+	case MethodFindNode:
+		resp, krpcErr = n.handleFindNode(msg.Args)
+	case MethodGetPeers:
+		resp, krpcErr = n.handleGetPeers(msg.Args, addr)
+	case MethodAnnouncePeer:
+		resp, krpcErr = n.handleAnnouncePeer(msg.Args, addr)
+	case MethodGet:
+		resp, krpcErr = n.handleGet(msg.Args, addr)
+	case MethodPut:
+		resp, krpcErr = n.handlePut(msg.Args, addr)
+	default:
+		krpcErr = &KRPCError{Code: ErrorCodeMethodUnknown, Message: "method unknown"}
+	}
+
+	if krpcErr != nil {
+		n.sendError(msg.TxnID, addr, krpcErr.Code, krpcErr.Message)
+		return
+	}
+
+	n.table.Seen(NodeInfo{ID: id, Addr: addr})
+
+	resp["id"] = bbytes(n.id[:])
+	n.send(&krpcMessage{TxnID: msg.TxnID, Type: krpcResponse, Response: resp}, addr)
+}
+
+func (n *Node) handleFindNode(args map[string]bencode.BValue) (map[string]bencode.BValue, *KRPCError) {
+	target, ok := getID(args, "target")
+	if !ok {
+		return nil, &KRPCError{Code: ErrorCodeProtocol, Message: "missing or invalid 'target'"}
+	}
+
+	return n.closestNodes(target), nil
+}
+
+func (n *Node) handleGetPeers(args map[string]bencode.BValue, addr *net.UDPAddr) (map[string]bencode.BValue, *KRPCError) {
+	infoHash, ok := getID(args, "info_hash")
+	if !ok {
+		return nil, &KRPCError{Code: ErrorCodeProtocol, Message: "missing or invalid 'info_hash'"}
+	}
+
+	resp := map[string]bencode.BValue{
+		"token": bbytes(n.tokens.Generate(addr.IP)),
+	}
+
+	if peers := n.peers.Get(common.InfoHash(infoHash)); len(peers) > 0 {
+		values := &bencode.BList{}
+		for _, peer := range peers {
+			values.Values = append(values.Values, bbytes(marshalCompactPeer(net.ParseIP(peer.Host), peer.Port)))
+		}
+		resp["values"] = values
+		return resp, nil
+	}
+
+	for key, value := range n.closestNodes(infoHash) {
+		resp[key] = value
+	}
+	return resp, nil
+}
+
+func (n *Node) handleAnnouncePeer(args map[string]bencode.BValue, addr *net.UDPAddr) (map[string]bencode.BValue, *KRPCError) {
+	infoHash, ok := getID(args, "info_hash")
+	if !ok {
+		return nil, &KRPCError{Code: ErrorCodeProtocol, Message: "missing or invalid 'info_hash'"}
+	}
+
+	token, _ := getString(args, "token")
+	if !n.tokens.Validate([]byte(token), addr.IP) {
+		return nil, &KRPCError{Code: ErrorCodeProtocol, Message: "bad token"}
+	}
+
+	port, _ := getInt(args, "port")
+	if impliedPort, _ := getInt(args, "implied_port"); impliedPort != 0 {
+		port = int64(addr.Port)
+	}
+	if port <= 0 || port > 65535 {
+		return nil, &KRPCError{Code: ErrorCodeProtocol, Message: "invalid 'port'"}
+	}
+
+	n.peers.Add(common.InfoHash(infoHash), common.PeerAddr{Host: addr.IP.String(), Port: uint16(port)})
+	return map[string]bencode.BValue{}, nil
+}
+
+// closestNodes returns the 'nodes' and 'nodes6' values for the nodes closest to target.
+func (n *Node) closestNodes(target NodeID) map[string]bencode.BValue {
+	closest := n.table.Closest(target, BucketSize)
+
+	resp := map[string]bencode.BValue{}
+	if nodes := MarshalCompactNodes(closest, false); len(nodes) > 0 {
+		resp["nodes"] = bbytes(nodes)
+	}
+	if nodes6 := MarshalCompactNodes(closest, true); len(nodes6) > 0 {
+		resp["nodes6"] = bbytes(nodes6)
+	}
+	if len(resp) == 0 {
+		resp["nodes"] = bbytes(nil)
+	}
+	return resp
+}
+
+func (n *Node) sendError(txnID string, addr *net.UDPAddr, code int64, message string) {
+	n.send(&krpcMessage{TxnID: txnID, Type: krpcError, Err: &KRPCError{Code: code, Message: message}}, addr)
+}
+
+func (n *Node) send(msg *krpcMessage, addr *net.UDPAddr) {
+	if _, err := n.conn.WriteTo(msg.Marshal(), addr); err != nil {
+		n.logger.Debug("Failed to send DHT message", "addr", addr.String(), "err", err)
+	}
+}
+
+// maintenanceLoop rotates the token secret, expires stored peers and items, and refreshes the
+// buckets that haven't seen any activity for a while.
+func (n *Node) maintenanceLoop(ctx context.Context) {
+	ticker := time.NewTicker(maintenanceInterval)
+	defer ticker.Stop()
+
+	lastRotation := time.Now()
+	lastSave := time.Now()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+
+		if time.Since(lastRotation) >= tokenRotation {
+			n.tokens.Rotate()
+			lastRotation = time.Now()
+		}
+
+		n.peers.Expire()
+		n.items.Expire()
+
+		if n.config.StateFile != "" && time.Since(lastSave) >= stateSaveInterval {
+			if err := SaveState(n.config.StateFile, n.State()); err != nil {
+				n.logger.Warn("Failed to save DHT state", "err", err)
+			}
+			lastSave = time.Now()
+		}
+
+		for _, index := range n.table.StaleBuckets() {
+			n.table.Touch(index)
+			n.FindNode(ctx, randomIDWithPrefix(n.id, index))
+		}
+	}
+}
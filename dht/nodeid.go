@@ -0,0 +1,75 @@
+package dht
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"math/bits"
+)
+
+// NodeID identifies a node of the DHT. It lives in the same 160-bit space as info hashes, and the
+// distance between two IDs is their XOR.
+type NodeID [20]byte
+
+// RandomNodeID generates a uniformly random node ID.
+func RandomNodeID() NodeID {
+	var id NodeID
+	rand.Read(id[:])
+	return id
+}
+
+func (id NodeID) String() string {
+	return hex.EncodeToString(id[:])
+}
+
+// Distance returns the XOR distance between two IDs.
+func (id NodeID) Distance(other NodeID) NodeID {
+	var d NodeID
+	for i := range id {
+		d[i] = id[i] ^ other[i]
+	}
+	return d
+}
+
+// Less compares two distances (or IDs) as 160-bit big-endian integers.
+func (id NodeID) Less(other NodeID) bool {
+	for i := range id {
+		if id[i] != other[i] {
+			return id[i] < other[i]
+		}
+	}
+	return false
+}
+
+// CommonPrefixLen returns the number of leading bits shared by two IDs (160 if they are equal).
+func (id NodeID) CommonPrefixLen(other NodeID) int {
+	for i := range id {
+		if x := id[i] ^ other[i]; x != 0 {
+			return i*8 + bits.LeadingZeros8(x)
+		}
+	}
+	return 160
+}
+
+// randomIDWithPrefix returns a random ID sharing exactly prefixLen leading bits with id.
+func randomIDWithPrefix(id NodeID, prefixLen int) NodeID {
+	target := RandomNodeID()
+	for i := 0; i < prefixLen; i++ {
+		setBit(&target, i, bit(id, i))
+	}
+	if prefixLen < 160 {
+		setBit(&target, prefixLen, !bit(id, prefixLen))
+	}
+	return target
+}
+
+func bit(id NodeID, i int) bool {
+	return id[i/8]&(0x80>>(i%8)) != 0
+}
+
+func setBit(id *NodeID, i int, v bool) {
+	if v {
+		id[i/8] |= 0x80 >> (i % 8)
+	} else {
+		id[i/8] &^= 0x80 >> (i % 8)
+	}
+}
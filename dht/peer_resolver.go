@@ -0,0 +1,154 @@
+package dht
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"sync"
+	"time"
+
+	"github.com/dpnam2112/bittorrent-client/common"
+)
+
+const (
+	defaultResolverInterval = 15 * time.Minute
+	defaultResolverTimeout  = 1 * time.Minute
+	// Delay before retrying when the node isn't connected to the network yet.
+	resolverRetryDelay = 30 * time.Second
+)
+
+type PeerDiscoveryHandler func(peers []common.PeerAddr) error
+
+type PeerResolverConfig struct {
+	// Port is the port we are listening on for incoming peer connections.
+	Port uint16
+	// ImpliedPort asks the nodes to announce the source port of our queries instead of Port.
+	ImpliedPort bool
+	// Interval between two announces. Defaults to 15 minutes.
+	Interval time.Duration
+	// Timeout of a single lookup and announce. Defaults to 1 minute.
+	Timeout time.Duration
+	Logger  *slog.Logger
+}
+
+// PeerResolver finds the peers of a torrent through a DHT node, and periodically announces us as
+// a peer. It plays the same role as the tracker peer resolver: discovered peers are passed to the
+// registered handlers, and it's up to the caller to connect to them.
+type PeerResolver struct {
+	node     *Node
+	infoHash common.InfoHash
+	config   PeerResolverConfig
+	logger   *slog.Logger
+
+	mu       sync.Mutex
+	handlers []PeerDiscoveryHandler
+
+	cancel context.CancelFunc
+	wg     sync.WaitGroup
+}
+
+var _ common.LifeCycle = (*PeerResolver)(nil)
+
+func NewPeerResolver(node *Node, infoHash common.InfoHash, config PeerResolverConfig) *PeerResolver {
+	if config.Logger == nil {
+		config.Logger = slog.Default()
+	}
+
+	if config.Interval <= 0 {
+		config.Interval = defaultResolverInterval
+	}
+
+	if config.Timeout <= 0 {
+		config.Timeout = defaultResolverTimeout
+	}
+
+	return &PeerResolver{
+		node:     node,
+		infoHash: infoHash,
+		config:   config,
+		logger:   config.Logger,
+	}
+}
+
+// Start announces to the DHT in the background until Close is called or ctx is cancelled. The
+// node must be started by the caller; it can be shared by the resolvers of several torrents.
+func (r *PeerResolver) Start(ctx context.Context) error {
+	if r.cancel != nil {
+		return fmt.Errorf("DHT peer resolver is already started.")
+	}
+
+	ctx, r.cancel = context.WithCancel(ctx)
+
+	r.wg.Add(1)
+	go func() {
+		defer r.wg.Done()
+		r.run(ctx)
+	}()
+
+	return nil
+}
+
+func (r *PeerResolver) Close() error {
+	if r.cancel == nil {
+		return nil
+	}
+	r.cancel()
+	r.wg.Wait()
+	return nil
+}
+
+// RegisterHandler registers a function called with the peers found by every lookup.
+func (r *PeerResolver) RegisterHandler(handler PeerDiscoveryHandler) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.handlers = append(r.handlers, handler)
+}
+
+func (r *PeerResolver) run(ctx context.Context) {
+	for {
+		delay := r.config.Interval
+		if !r.announce(ctx) {
+			delay = min(resolverRetryDelay, r.config.Interval)
+		}
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(delay):
+		}
+	}
+}
+
+// announce runs one lookup and announce, and reports whether it reached the network.
+func (r *PeerResolver) announce(ctx context.Context) bool {
+	if r.node.NodeCount() == 0 {
+		r.logger.Debug("DHT routing table is empty, bootstrapping")
+		if err := r.node.Bootstrap(ctx); err != nil {
+			r.logger.Debug("Failed to bootstrap DHT node", "err", err)
+			return false
+		}
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, r.config.Timeout)
+	defer cancel()
+
+	peers, err := r.node.Announce(ctx, r.infoHash, r.config.Port, r.config.ImpliedPort)
+	if err != nil {
+		r.logger.Debug("DHT announce failed", "err", err)
+	}
+	r.logger.Debug("DHT lookup finished", "peers", len(peers))
+
+	if len(peers) > 0 {
+		r.mu.Lock()
+		handlers := append([]PeerDiscoveryHandler(nil), r.handlers...)
+		r.mu.Unlock()
+
+		for _, handler := range handlers {
+			if err := handler(peers); err != nil {
+				r.logger.Debug("DHT peer discovery handler failed", "err", err)
+			}
+		}
+	}
+
+	return err == nil
+}
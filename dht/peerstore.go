@@ -0,0 +1,97 @@
+package dht
+
+import (
+	"sync"
+	"time"
+
+	"github.com/dpnam2112/bittorrent-client/common"
+)
+
+const (
+	// Announced peers are forgotten if they don't announce again within this window.
+	peerTTL = 30 * time.Minute
+	// Upper bounds on what a node stores for others, so that announces can't exhaust memory.
+	maxPeersPerInfoHash = 500
+	maxInfoHashes       = 10000
+	// Maximum number of peers returned in the 'values' of a get_peers response; more wouldn't fit
+	// in a single UDP datagram.
+	maxPeersPerResponse = 50
+)
+
+// peerStore holds the peers announced to this node, per info hash.
+type peerStore struct {
+	now func() time.Time
+
+	mu    sync.Mutex
+	peers map[common.InfoHash]map[common.PeerAddr]time.Time
+}
+
+func newPeerStore() *peerStore {
+	return &peerStore{
+		now:   time.Now,
+		peers: make(map[common.InfoHash]map[common.PeerAddr]time.Time),
+	}
+}
+
+func (s *peerStore) Add(infoHash common.InfoHash, peer common.PeerAddr) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	swarm, ok := s.peers[infoHash]
+	if !ok {
+		if len(s.peers) >= maxInfoHashes {
+			return
+		}
+		swarm = make(map[common.PeerAddr]time.Time)
+		s.peers[infoHash] = swarm
+	}
+
+	if _, known := swarm[peer]; !known && len(swarm) >= maxPeersPerInfoHash {
+		return
+	}
+	swarm[peer] = s.now()
+}
+
+// Get returns up to maxPeersPerResponse peers of a swarm.
+func (s *peerStore) Get(infoHash common.InfoHash) []common.PeerAddr {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	var peers []common.PeerAddr
+	for peer := range s.peers[infoHash] {
+		if len(peers) == maxPeersPerResponse {
+			break
+		}
+		peers = append(peers, peer)
+	}
+	return peers
+}
+
+// Count returns the number of swarms and the total number of peers stored.
+func (s *peerStore) Count() (infoHashes int, peers int) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	for _, swarm := range s.peers {
+		peers += len(swarm)
+	}
+	return len(s.peers), peers
+}
+
+// Expire removes the peers that haven't announced within peerTTL.
+func (s *peerStore) Expire() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	deadline := s.now().Add(-peerTTL)
+	for infoHash, swarm := range s.peers {
+		for peer, announced := range swarm {
+			if announced.Before(deadline) {
+				delete(swarm, peer)
+			}
+		}
+		if len(swarm) == 0 {
+			delete(s.peers, infoHash)
+		}
+	}
+}
@@ -0,0 +1,89 @@
+package dht
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+
+	"github.com/dpnam2112/bittorrent-client/bencode"
+)
+
+// State is what a node persists across restarts: its ID, so that it keeps its place in the
+// network, and the good nodes of its routing table, to bootstrap from.
+//
+// On disk, it's a bencoded dictionary:
+//
+//	id:     node ID (20 bytes)
+//	nodes:  compact IPv4 node info
+//	nodes6: compact IPv6 node info
+type State struct {
+	ID    NodeID
+	Nodes []NodeInfo
+}
+
+func (s State) Marshal() []byte {
+	dict := map[string]bencode.BValue{
+		"id":     bbytes(s.ID[:]),
+		"nodes":  bbytes(MarshalCompactNodes(s.Nodes, false)),
+		"nodes6": bbytes(MarshalCompactNodes(s.Nodes, true)),
+	}
+	return bencode.Encode(&bencode.BDict{Dict: dict})
+}
+
+func UnmarshalState(raw []byte) (State, error) {
+	var state State
+
+	_, value, err := bencode.ParseBencode(raw)
+	if err != nil {
+		return state, fmt.Errorf("Failed to parse DHT state: %w", err)
+	}
+
+	dict, ok := value.(*bencode.BDict)
+	if !ok {
+		return state, errors.New("DHT state is not a dictionary")
+	}
+
+	if state.ID, ok = getID(dict.Dict, "id"); !ok {
+		return state, errors.New("DHT state has no valid node ID")
+	}
+
+	state.Nodes = nodesFromResponse(dict.Dict)
+	return state, nil
+}
+
+// LoadState reads a state file written by SaveState. The returned error wraps os.ErrNotExist if
+// there is no such file.
+func LoadState(path string) (State, error) {
+	raw, err := os.ReadFile(path)
+	if err != nil {
+		return State{}, fmt.Errorf("Failed to read DHT state file: %w", err)
+	}
+	return UnmarshalState(raw)
+}
+
+// SaveState writes a state file atomically: a crash while saving leaves the previous file intact.
+func SaveState(path string, state State) error {
+	if err := os.MkdirAll(filepath.Dir(path), 0o755); err != nil {
+		return fmt.Errorf("Failed to create DHT state directory: %w", err)
+	}
+
+	tmp, err := os.CreateTemp(filepath.Dir(path), filepath.Base(path)+".*.tmp")
+	if err != nil {
+		return fmt.Errorf("Failed to create DHT state file: %w", err)
+	}
+	defer os.Remove(tmp.Name())
+
+	if _, err := tmp.Write(state.Marshal()); err != nil {
+		tmp.Close()
+		return fmt.Errorf("Failed to write DHT state file: %w", err)
+	}
+	if err := tmp.Close(); err != nil {
+		return fmt.Errorf("Failed to write DHT state file: %w", err)
+	}
+
+	if err := os.Rename(tmp.Name(), path); err != nil {
+		return fmt.Errorf("Failed to replace DHT state file: %w", err)
+	}
+	return nil
+}
@@ -0,0 +1,85 @@
+package dht
+
+import "sync/atomic"
+
+// BucketStats describes the fill of a k-bucket. Index is the number of leading bits the bucket's
+// nodes share with our ID.
+type BucketStats struct {
+	Index        int
+	Nodes        int
+	Good         int
+	Replacements int
+}
+
+// Stats is a snapshot of the activity of a node.
+type Stats struct {
+	ID    NodeID
+	Nodes int
+	// Buckets lists the non-empty buckets, by increasing index.
+	Buckets []BucketStats
+
+	QueriesSent     int64
+	QueriesAnswered int64
+	QueriesTimedOut int64
+
+	// A lookup succeeds if at least one node answered it; an announce succeeds if at least one
+	// node accepted it.
+	Lookups             int64
+	SuccessfulLookups   int64
+	Announces           int64
+	SuccessfulAnnounces int64
+
+	// Peers announced to us by other nodes.
+	StoredInfoHashes int
+	StoredPeers      int
+	// BEP 44 items put to us by other nodes.
+	StoredItems int
+}
+
+// LookupSuccessRate returns the share of successful lookups, or 0 if there was none.
+func (s Stats) LookupSuccessRate() float64 {
+	return rate(s.SuccessfulLookups, s.Lookups)
+}
+
+// AnnounceSuccessRate returns the share of successful announces, or 0 if there was none.
+func (s Stats) AnnounceSuccessRate() float64 {
+	return rate(s.SuccessfulAnnounces, s.Announces)
+}
+
+func rate(successes, total int64) float64 {
+	if total == 0 {
+		return 0
+	}
+	return float64(successes) / float64(total)
+}
+
+type nodeCounters struct {
+	queriesSent         atomic.Int64
+	queriesAnswered     atomic.Int64
+	queriesTimedOut     atomic.Int64
+	lookups             atomic.Int64
+	successfulLookups   atomic.Int64
+	announces           atomic.Int64
+	successfulAnnounces atomic.Int64
+}
+
+// Stats returns a snapshot of the routing table and of the node's counters.
+func (n *Node) Stats() Stats {
+	infoHashes, peers := n.peers.Count()
+
+	return Stats{
+		ID:                  n.id,
+		Nodes:               n.table.Len(),
+		Buckets:             n.table.BucketStats(),
+		QueriesSent:         n.counters.queriesSent.Load(),
+		QueriesAnswered:     n.counters.queriesAnswered.Load(),
+		QueriesTimedOut:     n.counters.queriesTimedOut.Load(),
+		Lookups:             n.counters.lookups.Load(),
+		SuccessfulLookups:   n.counters.successfulLookups.Load(),
+		Announces:           n.counters.announces.Load(),
+		SuccessfulAnnounces: n.counters.successfulAnnounces.Load(),
+		StoredInfoHashes:    infoHashes,
+		StoredPeers:         peers,
+		StoredItems:         n.items.Count(),
+	}
+}
@@ -0,0 +1,252 @@
+package dht
+
+import (
+	"bytes"
+	"context"
+	"crypto/ed25519"
+	"errors"
+	"fmt"
+	"net"
+	"sync"
+
+	"github.com/dpnam2112/bittorrent-client/bencode"
+)
+
+// ErrItemNotFound is returned by gets when no node stores a valid item for the target.
+var ErrItemNotFound = errors.New("DHT item not found")
+
+func (n *Node) handleGet(args map[string]bencode.BValue, addr *net.UDPAddr) (map[string]bencode.BValue, *KRPCError) {
+	target, ok := getID(args, "target")
+	if !ok {
+		return nil, &KRPCError{Code: ErrorCodeProtocol, Message: "missing or invalid 'target'"}
+	}
+
+	resp := n.closestNodes(target)
+	resp["token"] = bbytes(n.tokens.Generate(addr.IP))
+
+	item, ok := n.items.Get(target)
+	if !ok {
+		return resp, nil
+	}
+
+	if item.mutable == nil {
+		resp["v"] = item.value
+		return resp, nil
+	}
+
+	resp["k"] = bbytes(item.mutable.PublicKey)
+	resp["sig"] = bbytes(item.mutable.Signature)
+	resp["seq"] = &bencode.BInt{Value: item.mutable.Seq}
+	// A reader that already has the current version doesn't need the value again.
+	if seq, ok := getInt(args, "seq"); !ok || seq < item.mutable.Seq {
+		resp["v"] = item.value
+	}
+	return resp, nil
+}
+
+func (n *Node) handlePut(args map[string]bencode.BValue, addr *net.UDPAddr) (map[string]bencode.BValue, *KRPCError) {
+	token, _ := getString(args, "token")
+	if !n.tokens.Validate([]byte(token), addr.IP) {
+		return nil, &KRPCError{Code: ErrorCodeProtocol, Message: "bad token"}
+	}
+
+	value, ok := args["v"]
+	if !ok {
+		return nil, &KRPCError{Code: ErrorCodeProtocol, Message: "missing 'v'"}
+	}
+	if len(bencode.Encode(value)) > MaxItemValueSize {
+		return nil, &KRPCError{Code: ErrorCodeValueTooBig, Message: "message (v field) too big"}
+	}
+
+	if _, ok := args["k"]; !ok {
+		n.items.PutImmutable(value)
+		return map[string]bencode.BValue{}, nil
+	}
+
+	item, err := mutableItemFromArgs(args)
+	if err != nil {
+		return nil, err
+	}
+
+	var cas *int64
+	if value, ok := getInt(args, "cas"); ok {
+		cas = &value
+	}
+
+	if err := n.items.PutMutable(item, cas); err != nil {
+		return nil, err
+	}
+	return map[string]bencode.BValue{}, nil
+}
+
+// mutableItemFromArgs decodes and verifies the mutable item of a put query or a get response.
+func mutableItemFromArgs(args map[string]bencode.BValue) (MutableItem, *KRPCError) {
+	var item MutableItem
+
+	key, _ := getString(args, "k")
+	sig, _ := getString(args, "sig")
+	salt, _ := getString(args, "salt")
+	seq, hasSeq := getInt(args, "seq")
+	value, hasValue := args["v"]
+
+	if len(key) != ed25519.PublicKeySize || len(sig) != ed25519.SignatureSize || !hasSeq || !hasValue {
+		return item, &KRPCError{Code: ErrorCodeProtocol, Message: "invalid mutable item"}
+	}
+	if len(salt) > MaxItemSaltSize {
+		return item, &KRPCError{Code: ErrorCodeSaltTooBig, Message: "salt (salt field) too big"}
+	}
+
+	item = MutableItem{
+		PublicKey: ed25519.PublicKey(key),
+		Salt:      []byte(salt),
+		Seq:       seq,
+		Value:     value,
+		Signature: []byte(sig),
+	}
+	if !item.Verify() {
+		return item, &KRPCError{Code: ErrorCodeInvalidSignature, Message: "invalid signature"}
+	}
+	return item, nil
+}
+
+// PutImmutable stores a value on the nodes closest to its SHA-1, and returns that target.
+func (n *Node) PutImmutable(ctx context.Context, value bencode.BValue) (NodeID, error) {
+	if len(bencode.Encode(value)) > MaxItemValueSize {
+		return NodeID{}, fmt.Errorf("Value is larger than %d bytes", MaxItemValueSize)
+	}
+
+	target := ImmutableTarget(value)
+	err := n.put(ctx, target, func() map[string]bencode.BValue {
+		return map[string]bencode.BValue{"v": value}
+	})
+	return target, err
+}
+
+// GetImmutable retrieves the value stored under target. Values that don't hash to target are
+// ignored.
+func (n *Node) GetImmutable(ctx context.Context, target NodeID) (bencode.BValue, error) {
+	var found bencode.BValue
+	onResponse := func(resp map[string]bencode.BValue) {
+		if value, ok := resp["v"]; ok && found == nil && ImmutableTarget(value) == target {
+			found = value
+		}
+	}
+
+	n.iterativeLookup(ctx, target, MethodGet, getArgs(target, nil), onResponse)
+	if found == nil {
+		return nil, ErrItemNotFound
+	}
+	return found, nil
+}
+
+// PutMutable stores a signed item on the nodes closest to its target. If cas is set, nodes only
+// accept the item if the sequence number they store is *cas; a *KRPCError with code
+// ErrorCodeCASMismatch is returned otherwise.
+func (n *Node) PutMutable(ctx context.Context, item MutableItem, cas *int64) error {
+	if len(bencode.Encode(item.Value)) > MaxItemValueSize {
+		return fmt.Errorf("Value is larger than %d bytes", MaxItemValueSize)
+	}
+	if len(item.Salt) > MaxItemSaltSize {
+		return fmt.Errorf("Salt is larger than %d bytes", MaxItemSaltSize)
+	}
+
+	return n.put(ctx, item.Target(), func() map[string]bencode.BValue {
+		args := map[string]bencode.BValue{
+			"k":   bbytes(item.PublicKey),
+			"sig": bbytes(item.Signature),
+			"seq": &bencode.BInt{Value: item.Seq},
+			"v":   item.Value,
+		}
+		if len(item.Salt) > 0 {
+			args["salt"] = bbytes(item.Salt)
+		}
+		if cas != nil {
+			args["cas"] = &bencode.BInt{Value: *cas}
+		}
+		return args
+	})
+}
+
+// GetMutable retrieves the most recent version of the item published with publicKey and salt.
+// Items with an invalid signature are ignored.
+func (n *Node) GetMutable(ctx context.Context, publicKey ed25519.PublicKey, salt []byte) (MutableItem, error) {
+	var found *MutableItem
+	onResponse := func(resp map[string]bencode.BValue) {
+		key, _ := getString(resp, "k")
+		if !bytes.Equal([]byte(key), publicKey) {
+			return
+		}
+
+		args := map[string]bencode.BValue{"salt": bbytes(salt)}
+		for k, v := range resp {
+			args[k] = v
+		}
+		item, err := mutableItemFromArgs(args)
+		if err != nil {
+			return
+		}
+		if found == nil || item.Seq > found.Seq {
+			found = &item
+		}
+	}
+
+	target := MutableTarget(publicKey, salt)
+	n.iterativeLookup(ctx, target, MethodGet, getArgs(target, nil), onResponse)
+	if found == nil {
+		return MutableItem{}, ErrItemNotFound
+	}
+	return *found, nil
+}
+
+func getArgs(target NodeID, seq *int64) func() map[string]bencode.BValue {
+	return func() map[string]bencode.BValue {
+		args := map[string]bencode.BValue{"target": bbytes(target[:])}
+		if seq != nil {
+			args["seq"] = &bencode.BInt{Value: *seq}
+		}
+		return args
+	}
+}
+
+// put runs a get lookup for target to collect write tokens, then sends a put query built by
+// makeArgs to the closest nodes. It succeeds if at least one node stored the item.
+func (n *Node) put(ctx context.Context, target NodeID, makeArgs func() map[string]bencode.BValue) error {
+	closest := n.iterativeLookup(ctx, target, MethodGet, getArgs(target, nil), nil)
+
+	var wg sync.WaitGroup
+	var mu sync.Mutex
+	stored := 0
+	var lastErr error
+
+	for _, c := range closest {
+		if c.token == nil {
+			continue
+		}
+
+		args := makeArgs()
+		args["token"] = bbytes(c.token)
+
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			_, err := n.query(ctx, c.node.Addr, MethodPut, args)
+
+			mu.Lock()
+			defer mu.Unlock()
+			if err != nil {
+				lastErr = err
+			} else {
+				stored++
+			}
+		}()
+	}
+	wg.Wait()
+
+	if stored == 0 {
+		if lastErr == nil {
+			lastErr = errors.New("no node returned a token")
+		}
+		return fmt.Errorf("Failed to put item to the DHT: %w", lastErr)
+	}
+	return nil
+}
@@ -0,0 +1,257 @@
+package dht
+
+import (
+	"net"
+	"slices"
+	"sync"
+	"time"
+)
+
+const (
+	// BucketSize is the maximum number of nodes per k-bucket (K in the Kademlia paper).
+	BucketSize = 8
+	// Nodes that failed to answer this many consecutive queries are considered bad and evicted.
+	maxNodeFailures = 2
+	// A node that hasn't been heard from within this window is questionable.
+	nodeFreshness = 15 * time.Minute
+	// Number of candidates remembered per bucket to replace nodes that go bad.
+	replacementCacheSize = 8
+)
+
+type tableEntry struct {
+	NodeInfo
+	lastSeen time.Time
+	failures int
+}
+
+// bucket holds the nodes sharing the same number of leading bits with our ID, least recently seen
+// first.
+type bucket struct {
+	entries      []*tableEntry
+	replacements []NodeInfo
+	lastChanged  time.Time
+}
+
+// routingTable is a Kademlia routing table. Instead of splitting buckets as they fill up, it
+// keeps one bucket per common prefix length with our own ID, which holds the same nodes a fully
+// split table would.
+type routingTable struct {
+	self NodeID
+	now  func() time.Time
+
+	mu      sync.Mutex
+	buckets [160]bucket
+}
+
+func newRoutingTable(self NodeID) *routingTable {
+	return &routingTable{self: self, now: time.Now}
+}
+
+func (t *routingTable) bucketIndex(id NodeID) int {
+	return t.self.CommonPrefixLen(id)
+}
+
+// Seen records that a node answered a query or sent us one. Known nodes are refreshed; new nodes
+// are added if their bucket has room or holds a bad node, and are otherwise kept as replacement
+// candidates.
+func (t *routingTable) Seen(node NodeInfo) {
+	index := t.bucketIndex(node.ID)
+	if index == 160 {
+		return
+	}
+
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	now := t.now()
+	b := &t.buckets[index]
+
+	if i := b.find(node.ID); i >= 0 {
+		entry := b.entries[i]
+		entry.Addr = node.Addr
+		entry.lastSeen = now
+		entry.failures = 0
+		// Move to the back: the front of the bucket holds the least recently seen nodes.
+		b.entries = append(slices.Delete(b.entries, i, i+1), entry)
+		return
+	}
+
+	entry := &tableEntry{NodeInfo: node, lastSeen: now}
+	if len(b.entries) < BucketSize {
+		b.entries = append(b.entries, entry)
+		b.lastChanged = now
+		return
+	}
+
+	for i, existing := range b.entries {
+		if existing.failures >= maxNodeFailures {
+			b.entries = append(slices.Delete(b.entries, i, i+1), entry)
+			b.lastChanged = now
+			return
+		}
+	}
+
+	b.addReplacement(node)
+}
+
+// Failed records that a node didn't answer a query. Nodes that fail too many times in a row are
+// replaced by the most recently seen replacement candidate, if any.
+func (t *routingTable) Failed(id NodeID) {
+	index := t.bucketIndex(id)
+	if index == 160 {
+		return
+	}
+
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	b := &t.buckets[index]
+	i := b.find(id)
+	if i < 0 {
+		return
+	}
+
+	b.entries[i].failures++
+	if b.entries[i].failures < maxNodeFailures || len(b.replacements) == 0 {
+		return
+	}
+
+	replacement := b.replacements[len(b.replacements)-1]
+	b.replacements = b.replacements[:len(b.replacements)-1]
+	b.entries = append(slices.Delete(b.entries, i, i+1), &tableEntry{NodeInfo: replacement, lastSeen: t.now()})
+	b.lastChanged = t.now()
+}
+
+// Closest returns up to count nodes closest to target, nearest first. Bad nodes are skipped.
+func (t *routingTable) Closest(target NodeID, count int) []NodeInfo {
+	t.mu.Lock()
+	var nodes []NodeInfo
+	for i := range t.buckets {
+		for _, entry := range t.buckets[i].entries {
+			if entry.failures < maxNodeFailures {
+				nodes = append(nodes, entry.NodeInfo)
+			}
+		}
+	}
+	t.mu.Unlock()
+
+	sortByDistance(nodes, target)
+	if len(nodes) > count {
+		nodes = nodes[:count]
+	}
+	return nodes
+}
+
+// Len returns the number of nodes in the table.
+func (t *routingTable) Len() int {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	n := 0
+	for i := range t.buckets {
+		n += len(t.buckets[i].entries)
+	}
+	return n
+}
+
+// GoodNodes returns the nodes that answered their last query, most recently seen first within
+// each bucket.
+func (t *routingTable) GoodNodes() []NodeInfo {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	var nodes []NodeInfo
+	for i := range t.buckets {
+		entries := t.buckets[i].entries
+		for j := len(entries) - 1; j >= 0; j-- {
+			if entries[j].failures == 0 {
+				nodes = append(nodes, entries[j].NodeInfo)
+			}
+		}
+	}
+	return nodes
+}
+
+// BucketStats returns the fill of the non-empty buckets.
+func (t *routingTable) BucketStats() []BucketStats {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	var stats []BucketStats
+	for i := range t.buckets {
+		b := &t.buckets[i]
+		if len(b.entries) == 0 && len(b.replacements) == 0 {
+			continue
+		}
+
+		bucketStats := BucketStats{Index: i, Nodes: len(b.entries), Replacements: len(b.replacements)}
+		for _, entry := range b.entries {
+			if entry.failures == 0 {
+				bucketStats.Good++
+			}
+		}
+		stats = append(stats, bucketStats)
+	}
+	return stats
+}
+
+// StaleBuckets returns the indexes of non-empty buckets that haven't changed within the freshness
+// window. They are refreshed with a lookup for a random ID in their range.
+func (t *routingTable) StaleBuckets() []int {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	now := t.now()
+	var stale []int
+	for i := range t.buckets {
+		b := &t.buckets[i]
+		if len(b.entries) > 0 && now.Sub(b.lastChanged) >= nodeFreshness {
+			stale = append(stale, i)
+		}
+	}
+	return stale
+}
+
+// Touch marks a bucket as refreshed.
+func (t *routingTable) Touch(index int) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.buckets[index].lastChanged = t.now()
+}
+
+func (b *bucket) find(id NodeID) int {
+	return slices.IndexFunc(b.entries, func(e *tableEntry) bool { return e.ID == id })
+}
+
+func (b *bucket) addReplacement(node NodeInfo) {
+	if i := slices.IndexFunc(b.replacements, func(n NodeInfo) bool { return n.ID == node.ID }); i >= 0 {
+		b.replacements = slices.Delete(b.replacements, i, i+1)
+	}
+	b.replacements = append(b.replacements, node)
+	if len(b.replacements) > replacementCacheSize {
+		b.replacements = b.replacements[1:]
+	}
+}
+
+func sortByDistance(nodes []NodeInfo, target NodeID) {
+	slices.SortFunc(nodes, func(a, b NodeInfo) int {
+		return compareDistance(a.ID, b.ID, target)
+	})
+}
+
+// compareDistance orders a and b by their distance to target.
+func compareDistance(a, b, target NodeID) int {
+	da, db := a.Distance(target), b.Distance(target)
+	switch {
+	case da.Less(db):
+		return -1
+	case db.Less(da):
+		return 1
+	default:
+		return 0
+	}
+}
+
+func sameAddr(a, b *net.UDPAddr) bool {
+	return a.Port == b.Port && a.IP.Equal(b.IP)
+}
@@ -0,0 +1,61 @@
+package dht
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha1"
+	"net"
+	"sync"
+	"time"
+)
+
+// Tokens handed out in get_peers responses are valid for at least this long: the secret rotates
+// every tokenRotation and tokens signed with the previous secret are still accepted.
+const tokenRotation = 5 * time.Minute
+
+// tokenManager issues and checks announce_peer tokens. A token is a MAC of the requester's IP, so
+// a node can only announce itself from the address that asked for the token.
+type tokenManager struct {
+	mu       sync.Mutex
+	current  []byte
+	previous []byte
+}
+
+func newTokenManager() *tokenManager {
+	return &tokenManager{current: newSecret(), previous: newSecret()}
+}
+
+func newSecret() []byte {
+	secret := make([]byte, 16)
+	rand.Read(secret)
+	return secret
+}
+
+// Rotate replaces the secret; tokens issued before the previous rotation become invalid.
+func (m *tokenManager) Rotate() {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.previous = m.current
+	m.current = newSecret()
+}
+
+func (m *tokenManager) Generate(ip net.IP) []byte {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return tokenFor(m.current, ip)
+}
+
+func (m *tokenManager) Validate(token []byte, ip net.IP) bool {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return hmac.Equal(token, tokenFor(m.current, ip)) || hmac.Equal(token, tokenFor(m.previous, ip))
+}
+
+func tokenFor(secret []byte, ip net.IP) []byte {
+	if ip4 := ip.To4(); ip4 != nil {
+		ip = ip4
+	}
+	mac := hmac.New(sha1.New, secret)
+	mac.Write(ip)
+	return mac.Sum(nil)[:8]
+}
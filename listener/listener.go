@@ -0,0 +1,322 @@
+package listener
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net"
+	"sync"
+	"time"
+
+	"github.com/dpnam2112/bittorrent-client/common"
+	"github.com/dpnam2112/bittorrent-client/peer"
+)
+
+const (
+	defaultAddr                     = ":6881"
+	defaultMaxConnections           = 200
+	defaultMaxConnectionsPerTorrent = 50
+	defaultHandshakeTimeout         = 10 * time.Second
+
+	protocolName = "BitTorrent protocol"
+)
+
+// ConnectionHandler takes ownership of an incoming connection whose handshakes were exchanged,
+// with the capabilities both sides advertised. Closing the connection frees its slot in the
+// connection limits. Handlers must not block: the connection is meant to be served in its own
+// goroutine.
+type ConnectionHandler func(conn peer.PeerWireConnection, result peer.HandshakeResult)
+
+type Config struct {
+	// Addr is the TCP address to listen on. Defaults to ":6881"; use ":0" to pick any free port.
+	Addr string
+	// Listener, when set, is used instead of listening on Addr.
+	Listener net.Listener
+	PeerID   common.PeerID
+	// Capabilities advertised in our handshake.
+	Capabilities peer.Capabilities
+	// Maximum number of incoming connections, over all torrents. Defaults to 200.
+	MaxConnections int
+	// Maximum number of connections of a single torrent: the incoming connections, and the
+	// outgoing connections reserved by the torrent (see Reserve). Defaults to 50.
+	MaxConnectionsPerTorrent int
+	// Time allowed to the remote peer to send its handshake. Defaults to 10 seconds.
+	HandshakeTimeout time.Duration
+	Logger           *slog.Logger
+}
+
+// Listener accepts incoming peer connections for every torrent. It reads the handshake of the
+// remote peer first, routes the connection to the torrent with the same info hash, and answers
+// with our handshake. Connections for unknown torrents, and connections above the limits, are
+// closed.
+type Listener struct {
+	config   Config
+	logger   *slog.Logger
+	listener net.Listener
+
+	mu       sync.Mutex
+	torrents map[common.InfoHash]*torrentEntry
+	// active counts the incoming connections, including those still handshaking.
+	active int
+
+	cancel context.CancelFunc
+	wg     sync.WaitGroup
+}
+
+type torrentEntry struct {
+	handler ConnectionHandler
+	active  int
+}
+
+var _ common.LifeCycle = (*Listener)(nil)
+
+func NewListener(config Config) *Listener {
+	if config.Logger == nil {
+		config.Logger = slog.Default()
+	}
+
+	if config.Addr == "" {
+		config.Addr = defaultAddr
+	}
+
+	if config.MaxConnections <= 0 {
+		config.MaxConnections = defaultMaxConnections
+	}
+
+	if config.MaxConnectionsPerTorrent <= 0 {
+		config.MaxConnectionsPerTorrent = defaultMaxConnectionsPerTorrent
+	}
+
+	if config.HandshakeTimeout <= 0 {
+		config.HandshakeTimeout = defaultHandshakeTimeout
+	}
+
+	return &Listener{
+		config:   config,
+		logger:   config.Logger,
+		torrents: make(map[common.InfoHash]*torrentEntry),
+	}
+}
+
+// Start listens and accepts connections in the background until Close is called or ctx is
+// cancelled.
+func (l *Listener) Start(ctx context.Context) error {
+	if l.cancel != nil {
+		return fmt.Errorf("Listener is already started.")
+	}
+
+	l.listener = l.config.Listener
+	if l.listener == nil {
+		listener, err := net.Listen("tcp", l.config.Addr)
+		if err != nil {
+			return fmt.Errorf("Failed to listen on %s: %w", l.config.Addr, err)
+		}
+		l.listener = listener
+	}
+
+	ctx, l.cancel = context.WithCancel(ctx)
+
+	l.wg.Add(1)
+	go func() {
+		defer l.wg.Done()
+		l.acceptLoop()
+	}()
+
+	go func() {
+		<-ctx.Done()
+		l.listener.Close()
+	}()
+
+	l.logger.Info("Listening for peer connections", "addr", l.listener.Addr().String())
+	return nil
+}
+
+func (l *Listener) Close() error {
+	if l.cancel == nil {
+		return nil
+	}
+	l.cancel()
+	l.listener.Close()
+	l.wg.Wait()
+	return nil
+}
+
+// Addr returns the address the listener is bound to, or nil before Start.
+func (l *Listener) Addr() net.Addr {
+	if l.listener == nil {
+		return nil
+	}
+	return l.listener.Addr()
+}
+
+// Port returns the port the listener is bound to, which is advertised to trackers, the DHT and
+// local peers. It's 0 before Start.
+func (l *Listener) Port() uint16 {
+	if addr, ok := l.Addr().(*net.TCPAddr); ok {
+		return uint16(addr.Port)
+	}
+	return 0
+}
+
+// RegisterTorrent routes the incoming connections for infoHash to handler.
+func (l *Listener) RegisterTorrent(infoHash common.InfoHash, handler ConnectionHandler) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	if entry, ok := l.torrents[infoHash]; ok {
+		entry.handler = handler
+		return
+	}
+	l.torrents[infoHash] = &torrentEntry{handler: handler}
+}
+
+// UnregisterTorrent stops accepting connections for infoHash. Connections already handed over
+// are left open.
+func (l *Listener) UnregisterTorrent(infoHash common.InfoHash) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	delete(l.torrents, infoHash)
+}
+
+// Reserve takes a connection slot of a torrent for an outgoing connection, so that the incoming
+// and outgoing connections of the torrent share its limit. It returns the function freeing the
+// slot, or false when the torrent isn't registered or has no slot left.
+func (l *Listener) Reserve(infoHash common.InfoHash) (release func(), ok bool) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	entry, ok := l.torrents[infoHash]
+	if !ok || entry.active >= l.config.MaxConnectionsPerTorrent {
+		return nil, false
+	}
+	entry.active++
+	return sync.OnceFunc(func() {
+		l.mu.Lock()
+		defer l.mu.Unlock()
+		entry.active--
+	}), true
+}
+
+func (l *Listener) acceptLoop() {
+	for {
+		conn, err := l.listener.Accept()
+		if err != nil {
+			if !errors.Is(err, net.ErrClosed) {
+				l.logger.Error("Failed to accept peer connection", "err", err)
+			}
+			return
+		}
+
+		l.mu.Lock()
+		if l.active >= l.config.MaxConnections {
+			l.mu.Unlock()
+			l.logger.Debug("Rejecting peer connection: too many connections", "remote_addr", conn.RemoteAddr().String())
+			conn.Close()
+			continue
+		}
+		l.active++
+		l.mu.Unlock()
+
+		l.wg.Add(1)
+		go func() {
+			defer l.wg.Done()
+			l.handshake(conn)
+		}()
+	}
+}
+
+// handshake reads the handshake of an accepted connection, and hands the connection over to its
+// torrent.
+func (l *Listener) handshake(conn net.Conn) {
+	logger := l.logger.With("remote_addr", conn.RemoteAddr().String())
+	wireConn := peer.NewPeerWireConnection(conn, *logger)
+
+	reject := func(reason string, args ...any) {
+		logger.Debug("Rejecting peer connection: "+reason, args...)
+		l.release(nil)
+		wireConn.Close()
+	}
+
+	conn.SetDeadline(time.Now().Add(l.config.HandshakeTimeout))
+	handshake, err := wireConn.ReadHandshake()
+	if err != nil {
+		reject("invalid handshake", "err", err)
+		return
+	}
+	if handshake.Protocol() != protocolName {
+		reject("unknown protocol", "protocol", handshake.Protocol())
+		return
+	}
+
+	infoHash := common.InfoHash(handshake.InfoHash())
+
+	l.mu.Lock()
+	entry, ok := l.torrents[infoHash]
+	if ok && entry.active >= l.config.MaxConnectionsPerTorrent {
+		l.mu.Unlock()
+		reject("too many connections for the torrent", "info_hash", fmt.Sprintf("%x", infoHash))
+		return
+	}
+	var handler ConnectionHandler
+	if ok {
+		entry.active++
+		handler = entry.handler
+	}
+	l.mu.Unlock()
+
+	if !ok {
+		reject("unknown torrent", "info_hash", fmt.Sprintf("%x", infoHash))
+		return
+	}
+
+	if err := wireConn.SendHandshake(peer.HandshakeOptions{
+		PeerID:       l.config.PeerID,
+		InfoHash:     infoHash,
+		Protocol:     protocolName,
+		Capabilities: l.config.Capabilities,
+	}); err != nil {
+		logger.Debug("Failed to answer handshake", "err", err)
+		l.release(entry)
+		wireConn.Close()
+		return
+	}
+	conn.SetDeadline(time.Time{})
+
+	remote := handshake.Capabilities()
+	handler(&inboundConnection{PeerWireConnection: wireConn, release: func() { l.release(entry) }}, peer.HandshakeResult{
+		Handshake:          handshake,
+		RemoteCapabilities: remote,
+		Capabilities:       l.config.Capabilities.Intersect(remote),
+	})
+}
+
+// release frees the slot of a connection, and its torrent slot when entry is not nil.
+func (l *Listener) release(entry *torrentEntry) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.active--
+	if entry != nil {
+		entry.active--
+	}
+}
+
+// Active returns the number of incoming connections, including those still handshaking.
+func (l *Listener) Active() int {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return l.active
+}
+
+// inboundConnection frees its slots in the connection limits when closed.
+type inboundConnection struct {
+	peer.PeerWireConnection
+	release   func()
+	closeOnce sync.Once
+}
+
+func (c *inboundConnection) Close() error {
+	err := c.PeerWireConnection.Close()
+	c.closeOnce.Do(c.release)
+	return err
+}
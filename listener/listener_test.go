@@ -0,0 +1,147 @@
+package listener
+
+import (
+	"context"
+	"io"
+	"log/slog"
+	"testing"
+	"time"
+
+	"github.com/dpnam2112/bittorrent-client/common"
+	"github.com/dpnam2112/bittorrent-client/peer"
+	"github.com/stretchr/testify/assert"
+)
+
+func newTestListener(t *testing.T, config Config) *Listener {
+	config.Addr = "127.0.0.1:0"
+	config.Logger = slog.New(slog.NewTextHandler(io.Discard, nil))
+	listener := NewListener(config)
+	assert.NoError(t, listener.Start(context.Background()))
+	t.Cleanup(func() { listener.Close() })
+	return listener
+}
+
+func dial(t *testing.T, listener *Listener, infoHash common.InfoHash) (peer.PeerWireConnection, peer.HandshakeMessage, error) {
+	conn, err := peer.CreatePeerWireConnection(listener.Addr().String(), *slog.New(slog.NewTextHandler(io.Discard, nil)))
+	assert.NoError(t, err)
+	t.Cleanup(func() { conn.Close() })
+
+	handshake, err := conn.Handshake(common.PeerID{'r', 'e', 'm', 'o', 't', 'e'}, "", infoHash)
+	return conn, handshake, err
+}
+
+func TestListenerRoutesByInfoHash(t *testing.T) {
+	localID := common.GeneratePeerID()
+	listener := newTestListener(t, Config{PeerID: localID})
+	assert.NotZero(t, listener.Port())
+
+	known := common.InfoHash{0x01}
+	accepted := make(chan peer.HandshakeResult, 1)
+	listener.RegisterTorrent(known, func(conn peer.PeerWireConnection, result peer.HandshakeResult) {
+		accepted <- result
+	})
+
+	// Our handshake answers the remote one.
+	_, handshake, err := dial(t, listener, known)
+	assert.NoError(t, err)
+	assert.Equal(t, [20]byte(localID), handshake.PeerID())
+	assert.Equal(t, [20]byte(known), handshake.InfoHash())
+
+	select {
+	case result := <-accepted:
+		assert.Equal(t, [20]byte{'r', 'e', 'm', 'o', 't', 'e'}, result.Handshake.PeerID())
+		// The remote peer advertised no capability.
+		assert.Equal(t, peer.Capabilities{}, result.Capabilities)
+	case <-time.After(5 * time.Second):
+		t.Fatal("Connection not handed over")
+	}
+
+	// Unknown torrents are rejected without answering.
+	conn, _, _ := dial(t, listener, common.InfoHash{0x02})
+	_, err = conn.ReadPeerMessage()
+	assert.Error(t, err)
+
+	listener.UnregisterTorrent(known)
+	conn, _, _ = dial(t, listener, known)
+	_, err = conn.ReadPeerMessage()
+	assert.Error(t, err)
+}
+
+func TestListenerEnforcesLimits(t *testing.T) {
+	listener := newTestListener(t, Config{MaxConnections: 3, MaxConnectionsPerTorrent: 2})
+
+	handed := make(chan peer.PeerWireConnection, 10)
+	handler := func(conn peer.PeerWireConnection, _ peer.HandshakeResult) { handed <- conn }
+	first, second := common.InfoHash{0x01}, common.InfoHash{0x02}
+	listener.RegisterTorrent(first, handler)
+	listener.RegisterTorrent(second, handler)
+
+	receive := func() peer.PeerWireConnection {
+		select {
+		case conn := <-handed:
+			return conn
+		case <-time.After(5 * time.Second):
+			t.Fatal("Connection not handed over")
+			return nil
+		}
+	}
+
+	_, _, err := dial(t, listener, first)
+	assert.NoError(t, err)
+	a := receive()
+	_, _, err = dial(t, listener, first)
+	assert.NoError(t, err)
+	receive()
+
+	// Per-torrent limit.
+	_, _, err = dial(t, listener, first)
+	assert.Error(t, err)
+
+	_, _, err = dial(t, listener, second)
+	assert.NoError(t, err)
+	receive()
+	assert.Equal(t, 3, listener.Active())
+
+	// Global limit.
+	_, _, err = dial(t, listener, second)
+	assert.Error(t, err)
+
+	// Closing a connection frees its slots.
+	assert.NoError(t, a.Close())
+	assert.Equal(t, 2, listener.Active())
+	_, _, err = dial(t, listener, first)
+	assert.NoError(t, err)
+	receive()
+}
+
+func TestListenerReserveSharesTorrentLimit(t *testing.T) {
+	listener := newTestListener(t, Config{MaxConnectionsPerTorrent: 2})
+
+	handed := make(chan peer.PeerWireConnection, 10)
+	known := common.InfoHash{0x01}
+	listener.RegisterTorrent(known, func(conn peer.PeerWireConnection, _ peer.HandshakeResult) { handed <- conn })
+
+	_, ok := listener.Reserve(common.InfoHash{0x02})
+	assert.False(t, ok)
+
+	// An outgoing connection and an incoming one take the slots of the torrent.
+	release, ok := listener.Reserve(known)
+	assert.True(t, ok)
+	_, _, err := dial(t, listener, known)
+	assert.NoError(t, err)
+	<-handed
+	// Outgoing connections don't count in the limit of incoming connections.
+	assert.Equal(t, 1, listener.Active())
+	_, ok = listener.Reserve(known)
+	assert.False(t, ok)
+	_, _, err = dial(t, listener, known)
+	assert.Error(t, err)
+
+	// Releasing twice frees a single slot.
+	release()
+	release()
+	_, ok = listener.Reserve(known)
+	assert.True(t, ok)
+	_, ok = listener.Reserve(known)
+	assert.False(t, ok)
+}
@@ -0,0 +1,174 @@
+package lsd
+
+import (
+	"context"
+	"io"
+	"log/slog"
+	"net"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/dpnam2112/bittorrent-client/common"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestAnnounceRoundTrip(t *testing.T) {
+	announce := Announce{
+		Host:       IPv4Group,
+		Port:       6881,
+		InfoHashes: []common.InfoHash{{0x01, 0x02}, {0xab, 0xcd}},
+		Cookie:     "c00k1e",
+	}
+
+	raw := announce.Marshal()
+	assert.Equal(t, "BT-SEARCH * HTTP/1.1\r\n"+
+		"Host: 239.192.152.143:6771\r\n"+
+		"Port: 6881\r\n"+
+		"Infohash: 0102000000000000000000000000000000000000\r\n"+
+		"Infohash: abcd000000000000000000000000000000000000\r\n"+
+		"cookie: c00k1e\r\n"+
+		"\r\n\r\n", string(raw))
+
+	decoded, err := UnmarshalAnnounce(raw)
+	assert.NoError(t, err)
+	assert.Equal(t, announce, decoded)
+
+	// Invalid info hashes are skipped.
+	decoded, err = UnmarshalAnnounce([]byte("BT-SEARCH * HTTP/1.1\r\nPort: 51413\r\n" +
+		"Infohash: xyz\r\nInfohash: ABCD000000000000000000000000000000000000\r\n\r\n"))
+	assert.NoError(t, err)
+	assert.Equal(t, []common.InfoHash{{0xab, 0xcd}}, decoded.InfoHashes)
+
+	for _, invalid := range []string{
+		"M-SEARCH * HTTP/1.1\r\nPort: 6881\r\nInfohash: abcd000000000000000000000000000000000000\r\n\r\n",
+		"BT-SEARCH * HTTP/1.1\r\nInfohash: abcd000000000000000000000000000000000000\r\n\r\n",
+		"BT-SEARCH * HTTP/1.1\r\nPort: 70000\r\nInfohash: abcd000000000000000000000000000000000000\r\n\r\n",
+		"BT-SEARCH * HTTP/1.1\r\nPort: 6881\r\n\r\n",
+	} {
+		_, err := UnmarshalAnnounce([]byte(invalid))
+		assert.Error(t, err, invalid)
+	}
+}
+
+// bus is an in-memory multicast group: a packet written by a member is delivered to every member,
+// including the sender, like multicast loopback.
+type bus struct {
+	mu      sync.Mutex
+	members []*busConn
+}
+
+type packet struct {
+	data []byte
+	from net.Addr
+}
+
+type busConn struct {
+	bus    *bus
+	addr   *net.UDPAddr
+	queue  chan packet
+	closed chan struct{}
+	once   sync.Once
+}
+
+func (b *bus) join(ip string) *busConn {
+	conn := &busConn{
+		bus:    b,
+		addr:   &net.UDPAddr{IP: net.ParseIP(ip), Port: 6771},
+		queue:  make(chan packet, 16),
+		closed: make(chan struct{}),
+	}
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.members = append(b.members, conn)
+	return conn
+}
+
+func (c *busConn) ReadFrom(p []byte) (int, net.Addr, error) {
+	select {
+	case pkt := <-c.queue:
+		return copy(p, pkt.data), pkt.from, nil
+	case <-c.closed:
+		return 0, nil, net.ErrClosed
+	}
+}
+
+func (c *busConn) WriteTo(p []byte, _ net.Addr) (int, error) {
+	c.bus.mu.Lock()
+	defer c.bus.mu.Unlock()
+	for _, member := range c.bus.members {
+		select {
+		case member.queue <- packet{data: append([]byte(nil), p...), from: c.addr}:
+		default:
+		}
+	}
+	return len(p), nil
+}
+
+func (c *busConn) Close() error {
+	c.once.Do(func() { close(c.closed) })
+	return nil
+}
+
+func (c *busConn) LocalAddr() net.Addr              { return c.addr }
+func (c *busConn) SetDeadline(time.Time) error      { return nil }
+func (c *busConn) SetReadDeadline(time.Time) error  { return nil }
+func (c *busConn) SetWriteDeadline(time.Time) error { return nil }
+
+func TestServiceDiscoversLocalPeers(t *testing.T) {
+	group, _ := net.ResolveUDPAddr("udp4", IPv4Group)
+	network := &bus{}
+	logger := slog.New(slog.NewTextHandler(io.Discard, nil))
+
+	newService := func(ip string, port uint16) *Service {
+		return NewService(Config{
+			Port:       port,
+			Transports: []Transport{{Conn: network.join(ip), Group: group}},
+			Logger:     logger,
+		})
+	}
+
+	collect := func(discovered chan common.PeerAddr) PeerDiscoveryHandler {
+		return func(peers []common.PeerAddr) error {
+			for _, peer := range peers {
+				discovered <- peer
+			}
+			return nil
+		}
+	}
+
+	shared := common.InfoHash{0x01}
+	discoveredByA := make(chan common.PeerAddr, 16)
+	discoveredByB := make(chan common.PeerAddr, 16)
+
+	a := newService("192.168.1.10", 6881)
+	b := newService("192.168.1.20", 6882)
+	a.AddTorrent(shared, collect(discoveredByA))
+	b.AddTorrent(shared, collect(discoveredByB))
+	b.AddTorrent(common.InfoHash{0x02}, func([]common.PeerAddr) error {
+		t.Error("Unexpected peer for a torrent nobody else announces")
+		return nil
+	})
+
+	for _, service := range []*Service{a, b} {
+		assert.NoError(t, service.Start(context.Background()))
+		defer service.Close()
+	}
+	assert.Error(t, a.Start(context.Background()))
+
+	expect := func(discovered chan common.PeerAddr, peer common.PeerAddr) {
+		select {
+		case got := <-discovered:
+			assert.Equal(t, peer, got)
+		case <-time.After(5 * time.Second):
+			t.Fatal("No peer discovered")
+		}
+	}
+	expect(discoveredByA, common.PeerAddr{Host: "192.168.1.20", Port: 6882})
+	expect(discoveredByB, common.PeerAddr{Host: "192.168.1.10", Port: 6881})
+
+	// Our own announces, looped back by the group, are ignored.
+	time.Sleep(100 * time.Millisecond)
+	assert.Empty(t, discoveredByA)
+	assert.Empty(t, discoveredByB)
+}
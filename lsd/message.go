@@ -0,0 +1,88 @@
+package lsd
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"net/textproto"
+	"strconv"
+	"strings"
+
+	"github.com/dpnam2112/bittorrent-client/common"
+)
+
+const searchRequestLine = "BT-SEARCH * HTTP/1.1"
+
+// Announce is a BT-SEARCH message, multicast to the local network to tell other clients that we
+// are a peer of the listed torrents.
+//
+// Wire format (HTTP-like, lines end with \r\n, terminated by an empty line):
+//
+//	BT-SEARCH * HTTP/1.1
+//	Host: <multicast group>:<port>
+//	Port: <listen port>
+//	Infohash: <40 hex digits>     (repeated for every torrent)
+//	cookie: <opaque value>         (optional, lets the sender recognize its own announces)
+type Announce struct {
+	Host       string
+	Port       uint16
+	InfoHashes []common.InfoHash
+	Cookie     string
+}
+
+func (a Announce) Marshal() []byte {
+	var buf bytes.Buffer
+	buf.WriteString(searchRequestLine + "\r\n")
+	buf.WriteString("Host: " + a.Host + "\r\n")
+	buf.WriteString("Port: " + strconv.Itoa(int(a.Port)) + "\r\n")
+	for _, infoHash := range a.InfoHashes {
+		buf.WriteString("Infohash: " + hex.EncodeToString(infoHash[:]) + "\r\n")
+	}
+	if a.Cookie != "" {
+		buf.WriteString("cookie: " + a.Cookie + "\r\n")
+	}
+	buf.WriteString("\r\n\r\n")
+	return buf.Bytes()
+}
+
+func UnmarshalAnnounce(raw []byte) (Announce, error) {
+	var a Announce
+
+	r := textproto.NewReader(bufio.NewReader(bytes.NewReader(raw)))
+	line, err := r.ReadLine()
+	if err != nil {
+		return a, fmt.Errorf("Failed to read LSD request line: %w", err)
+	}
+	if line != searchRequestLine {
+		return a, fmt.Errorf("Unexpected LSD request line '%s'", line)
+	}
+
+	header, err := r.ReadMIMEHeader()
+	if err != nil && len(header) == 0 {
+		return a, fmt.Errorf("Failed to read LSD headers: %w", err)
+	}
+
+	a.Host = header.Get("Host")
+	a.Cookie = header.Get("Cookie")
+
+	port, err := strconv.ParseUint(header.Get("Port"), 10, 16)
+	if err != nil || port == 0 {
+		return a, fmt.Errorf("Invalid LSD port '%s'", header.Get("Port"))
+	}
+	a.Port = uint16(port)
+
+	for _, value := range header.Values("Infohash") {
+		decoded, err := hex.DecodeString(strings.TrimSpace(value))
+		if err != nil || len(decoded) != 20 {
+			continue
+		}
+		a.InfoHashes = append(a.InfoHashes, common.InfoHash(decoded))
+	}
+	if len(a.InfoHashes) == 0 {
+		return a, errors.New("LSD announce has no valid info hash")
+	}
+
+	return a, nil
+}
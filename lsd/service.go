@@ -0,0 +1,291 @@
+package lsd
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net"
+	"sync"
+	"time"
+
+	"github.com/dpnam2112/bittorrent-client/common"
+)
+
+const (
+	// Multicast groups of BEP 14. The IPv6 group is organization-local.
+	IPv4Group = "239.192.152.143:6771"
+	IPv6Group = "[ff15::efc0:988f]:6771"
+
+	defaultAnnounceInterval = 5 * time.Minute
+	// Announces are never sent more often than this, even when torrents are added in a burst.
+	minAnnounceInterval = 1 * time.Minute
+	// Keep announces within a single unfragmented datagram.
+	maxInfoHashesPerAnnounce = 20
+)
+
+type PeerDiscoveryHandler func(peers []common.PeerAddr) error
+
+// Transport is a packet connection announces are sent and received on, and the group they are
+// sent to.
+type Transport struct {
+	Conn  net.PacketConn
+	Group net.Addr
+}
+
+type Config struct {
+	// Port is the port we are listening on for incoming peer connections.
+	Port uint16
+	// Transports to announce on. When empty, Start joins the IPv4 and IPv6 multicast groups;
+	// tests inject their own connections.
+	Transports []Transport
+	// Interval between two announces of the same torrents. Defaults to 5 minutes.
+	Interval time.Duration
+	Logger   *slog.Logger
+}
+
+// Service implements Local Service Discovery (BEP 14): it periodically multicasts the torrents
+// we are downloading to the local network, and reports the peers that announce the same
+// torrents. A single service is shared by all torrents.
+type Service struct {
+	config Config
+	logger *slog.Logger
+	cookie string
+
+	mu         sync.Mutex
+	torrents   map[common.InfoHash]PeerDiscoveryHandler
+	transports []Transport
+	wake       chan struct{}
+
+	cancel context.CancelFunc
+	wg     sync.WaitGroup
+}
+
+var _ common.LifeCycle = (*Service)(nil)
+
+func NewService(config Config) *Service {
+	if config.Logger == nil {
+		config.Logger = slog.Default()
+	}
+
+	if config.Interval <= 0 {
+		config.Interval = defaultAnnounceInterval
+	}
+
+	cookie := make([]byte, 8)
+	rand.Read(cookie)
+
+	return &Service{
+		config:   config,
+		logger:   config.Logger,
+		cookie:   hex.EncodeToString(cookie),
+		torrents: make(map[common.InfoHash]PeerDiscoveryHandler),
+		wake:     make(chan struct{}, 1),
+	}
+}
+
+// Start joins the multicast groups (unless transports were injected), then announces and listens
+// in the background until Close is called or ctx is cancelled. It fails only if no transport
+// could be set up.
+func (s *Service) Start(ctx context.Context) error {
+	if s.cancel != nil {
+		return fmt.Errorf("LSD service is already started.")
+	}
+
+	transports := s.config.Transports
+	if len(transports) == 0 {
+		for _, group := range []struct{ network, addr string }{{"udp4", IPv4Group}, {"udp6", IPv6Group}} {
+			transport, err := joinGroup(group.network, group.addr)
+			if err != nil {
+				s.logger.Debug("Failed to join LSD multicast group", "group", group.addr, "err", err)
+				continue
+			}
+			transports = append(transports, transport)
+		}
+	}
+	if len(transports) == 0 {
+		return errors.New("Failed to start LSD: could not join any multicast group")
+	}
+
+	s.mu.Lock()
+	s.transports = transports
+	s.mu.Unlock()
+
+	ctx, s.cancel = context.WithCancel(ctx)
+
+	for _, transport := range transports {
+		s.wg.Add(1)
+		go func() {
+			defer s.wg.Done()
+			s.receive(transport.Conn)
+		}()
+	}
+
+	s.wg.Add(1)
+	go func() {
+		defer s.wg.Done()
+		s.announceLoop(ctx)
+	}()
+
+	go func() {
+		<-ctx.Done()
+		for _, transport := range transports {
+			transport.Conn.Close()
+		}
+	}()
+
+	return nil
+}
+
+func (s *Service) Close() error {
+	if s.cancel == nil {
+		return nil
+	}
+	s.cancel()
+
+	s.mu.Lock()
+	for _, transport := range s.transports {
+		transport.Conn.Close()
+	}
+	s.mu.Unlock()
+
+	s.wg.Wait()
+	return nil
+}
+
+func joinGroup(network, addr string) (Transport, error) {
+	group, err := net.ResolveUDPAddr(network, addr)
+	if err != nil {
+		return Transport{}, err
+	}
+
+	conn, err := net.ListenMulticastUDP(network, nil, group)
+	if err != nil {
+		return Transport{}, err
+	}
+	return Transport{Conn: conn, Group: group}, nil
+}
+
+// AddTorrent starts announcing a torrent. Peers announcing it on the local network are passed to
+// handler.
+func (s *Service) AddTorrent(infoHash common.InfoHash, handler PeerDiscoveryHandler) {
+	s.mu.Lock()
+	s.torrents[infoHash] = handler
+	s.mu.Unlock()
+
+	select {
+	case s.wake <- struct{}{}:
+	default:
+	}
+}
+
+// RemoveTorrent stops announcing a torrent and reporting its peers.
+func (s *Service) RemoveTorrent(infoHash common.InfoHash) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	delete(s.torrents, infoHash)
+}
+
+func (s *Service) announceLoop(ctx context.Context) {
+	var lastAnnounce time.Time
+	timer := time.NewTimer(0)
+	defer timer.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-s.wake:
+			// A torrent was added: announce it right away, unless we just did.
+			if wait := minAnnounceInterval - time.Since(lastAnnounce); wait > 0 {
+				timer.Reset(wait)
+				continue
+			}
+		case <-timer.C:
+		}
+
+		if s.announce() {
+			lastAnnounce = time.Now()
+		}
+		timer.Reset(s.config.Interval)
+	}
+}
+
+// announce multicasts every torrent on every transport, in as many datagrams as needed. It
+// returns false if there was nothing to announce.
+func (s *Service) announce() bool {
+	s.mu.Lock()
+	infoHashes := make([]common.InfoHash, 0, len(s.torrents))
+	for infoHash := range s.torrents {
+		infoHashes = append(infoHashes, infoHash)
+	}
+	transports := s.transports
+	s.mu.Unlock()
+
+	if len(infoHashes) == 0 {
+		return false
+	}
+
+	for len(infoHashes) > 0 {
+		batch := infoHashes[:min(len(infoHashes), maxInfoHashesPerAnnounce)]
+		infoHashes = infoHashes[len(batch):]
+
+		for _, transport := range transports {
+			announce := Announce{
+				Host:       transport.Group.String(),
+				Port:       s.config.Port,
+				InfoHashes: batch,
+				Cookie:     s.cookie,
+			}
+			if _, err := transport.Conn.WriteTo(announce.Marshal(), transport.Group); err != nil {
+				s.logger.Debug("Failed to send LSD announce", "group", transport.Group.String(), "err", err)
+			}
+		}
+	}
+	return true
+}
+
+func (s *Service) receive(conn net.PacketConn) {
+	buf := make([]byte, 65535)
+	for {
+		n, addr, err := conn.ReadFrom(buf)
+		if err != nil {
+			if !errors.Is(err, net.ErrClosed) {
+				s.logger.Error("Failed to read LSD packet", "err", err)
+			}
+			return
+		}
+
+		udpAddr, ok := addr.(*net.UDPAddr)
+		if !ok {
+			continue
+		}
+
+		announce, err := UnmarshalAnnounce(buf[:n])
+		if err != nil {
+			s.logger.Debug("Dropping invalid LSD packet", "addr", addr.String(), "err", err)
+			continue
+		}
+
+		// Our own announces are looped back by the multicast group.
+		if announce.Cookie == s.cookie {
+			continue
+		}
+
+		peer := common.PeerAddr{Host: udpAddr.IP.String(), Port: announce.Port}
+		for _, infoHash := range announce.InfoHashes {
+			s.mu.Lock()
+			handler, ok := s.torrents[infoHash]
+			s.mu.Unlock()
+			if !ok {
+				continue
+			}
+
+			if err := handler([]common.PeerAddr{peer}); err != nil {
+				s.logger.Debug("LSD peer discovery handler failed", "err", err)
+			}
+		}
+	}
+}
@@ -0,0 +1,357 @@
+package metadata
+
+import (
+	"bytes"
+	"crypto/sha1"
+	"errors"
+	"log/slog"
+	"sync"
+	"time"
+
+	"github.com/dpnam2112/bittorrent-client/peer"
+)
+
+const (
+	// Metadata larger than this is refused: it's far above any real info dictionary, and would
+	// let a peer make us allocate as much as it wants.
+	MaxMetadataSize = 16 * 1024 * 1024
+
+	// A piece requested longer ago than this can be requested from another peer.
+	defaultRequestTimeout = 20 * time.Second
+)
+
+// ErrMetadataMismatch is returned when metadata doesn't hash to the info hash of the torrent.
+var ErrMetadataMismatch = errors.New("Metadata doesn't match the info hash")
+
+type Config struct {
+	// RequestTimeout is the time after which a piece that wasn't received is requested from
+	// another peer. Defaults to 20 seconds.
+	RequestTimeout time.Duration
+	Logger         *slog.Logger
+}
+
+// Exchange runs ut_metadata (BEP 9) for a torrent. Until the metadata is known, it requests its
+// pieces from the peers that advertise its size, assembles them and checks the result against
+// the info hash. Once known, it serves the metadata to other peers.
+type Exchange struct {
+	infoHash [20]byte
+	config   Config
+	logger   *slog.Logger
+	now      func() time.Time
+
+	mu       sync.Mutex
+	metadata []byte
+	// size and pieces describe the metadata being fetched. size is taken from the first peer
+	// advertising it.
+	size   int
+	pieces [][]byte
+	// sources are the connections each piece was received from, to stop requesting from them
+	// when the assembled metadata doesn't match.
+	sources   []*Conn
+	requested map[int]pieceRequest
+	conns     map[*Conn]struct{}
+	done      chan struct{}
+}
+
+type pieceRequest struct {
+	conn *Conn
+	at   time.Time
+}
+
+func NewExchange(infoHash [20]byte, config Config) *Exchange {
+	if config.Logger == nil {
+		config.Logger = slog.Default()
+	}
+
+	if config.RequestTimeout <= 0 {
+		config.RequestTimeout = defaultRequestTimeout
+	}
+
+	return &Exchange{
+		infoHash:  infoHash,
+		config:    config,
+		logger:    config.Logger,
+		now:       time.Now,
+		requested: make(map[int]pieceRequest),
+		conns:     make(map[*Conn]struct{}),
+		done:      make(chan struct{}),
+	}
+}
+
+// SetMetadata sets the metadata of a torrent we already have, so that it's served to peers.
+func (e *Exchange) SetMetadata(metadata []byte) error {
+	if sha1.Sum(metadata) != e.infoHash {
+		return ErrMetadataMismatch
+	}
+
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	e.complete(metadata)
+	return nil
+}
+
+// Metadata returns the metadata, or nil if it isn't known yet.
+func (e *Exchange) Metadata() []byte {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	return e.metadata
+}
+
+// Done returns a channel closed once the metadata is known.
+func (e *Exchange) Done() <-chan struct{} {
+	return e.done
+}
+
+// complete records the verified metadata. The caller holds e.mu.
+func (e *Exchange) complete(metadata []byte) {
+	if e.metadata != nil {
+		return
+	}
+	e.metadata = metadata
+	e.pieces = nil
+	e.sources = nil
+	e.requested = make(map[int]pieceRequest)
+	close(e.done)
+}
+
+// Extension returns the BEP 10 extension running ut_metadata on the connections of the torrent.
+func (e *Exchange) Extension() peer.Extension {
+	return extension{exchange: e}
+}
+
+type extension struct {
+	exchange *Exchange
+}
+
+func (extension) Name() string {
+	return ExtensionName
+}
+
+// ExtendHandshake advertises the size of the metadata once we have it.
+func (ext extension) ExtendHandshake(h *peer.ExtensionHandshake) {
+	if metadata := ext.exchange.Metadata(); metadata != nil {
+		h.MetadataSize = len(metadata)
+	}
+}
+
+func (ext extension) Connect(conn peer.ExtensionConn, remote peer.ExtensionHandshake) (peer.ExtensionHandler, error) {
+	e := ext.exchange
+	c := &Conn{exchange: e, send: conn.Send, piece: -1}
+
+	e.mu.Lock()
+	e.conns[c] = struct{}{}
+	if e.metadata == nil && remote.MetadataSize > 0 && remote.MetadataSize <= MaxMetadataSize {
+		if e.size == 0 {
+			e.size = remote.MetadataSize
+			e.pieces = make([][]byte, (e.size+PieceSize-1)/PieceSize)
+			e.sources = make([]*Conn, len(e.pieces))
+		}
+		// Peers disagreeing with the size we use can't help.
+		c.canRequest = remote.MetadataSize == e.size
+	}
+	e.mu.Unlock()
+
+	return c, c.requestNext()
+}
+
+// pieceLength returns the length of a metadata piece. The caller holds e.mu.
+func (e *Exchange) pieceLength(piece int) int {
+	return min(PieceSize, e.size-piece*PieceSize)
+}
+
+// kick makes the idle connections request the pieces still missing.
+func (e *Exchange) kick() {
+	e.mu.Lock()
+	conns := make([]*Conn, 0, len(e.conns))
+	for c := range e.conns {
+		conns = append(conns, c)
+	}
+	e.mu.Unlock()
+
+	for _, c := range conns {
+		if err := c.requestNext(); err != nil {
+			e.logger.Debug("Failed to request metadata piece", "err", err)
+		}
+	}
+}
+
+// Conn is the ut_metadata state of a single connection.
+type Conn struct {
+	exchange *Exchange
+	send     func(payload []byte) error
+
+	// The fields below are guarded by exchange.mu.
+	canRequest bool
+	// piece is the piece requested on the connection, or -1.
+	piece int
+}
+
+// requestNext requests a missing piece from the connection, unless it already has one pending.
+// Pieces requested from another connection are only requested again once their request timed
+// out.
+func (c *Conn) requestNext() error {
+	e := c.exchange
+
+	e.mu.Lock()
+	if e.metadata != nil || !c.canRequest || c.piece >= 0 {
+		e.mu.Unlock()
+		return nil
+	}
+
+	now := e.now()
+	next := -1
+	for i, data := range e.pieces {
+		if data != nil {
+			continue
+		}
+		if request, ok := e.requested[i]; ok && now.Sub(request.at) < e.config.RequestTimeout {
+			continue
+		}
+		next = i
+		break
+	}
+	if next < 0 {
+		e.mu.Unlock()
+		return nil
+	}
+
+	e.requested[next] = pieceRequest{conn: c, at: now}
+	c.piece = next
+	e.mu.Unlock()
+
+	return c.send(Message{Type: MessageRequest, Piece: next}.Marshal())
+}
+
+// release forgets the piece pending on the connection. The caller holds exchange.mu.
+func (c *Conn) release() {
+	if c.piece < 0 {
+		return
+	}
+	if request, ok := c.exchange.requested[c.piece]; ok && request.conn == c {
+		delete(c.exchange.requested, c.piece)
+	}
+	c.piece = -1
+}
+
+// Close unregisters the connection. Its pending piece is requested from other connections.
+func (c *Conn) Close() {
+	e := c.exchange
+	e.mu.Lock()
+	c.release()
+	delete(e.conns, c)
+	e.mu.Unlock()
+
+	e.kick()
+}
+
+// HandleMessage processes the payload of a ut_metadata message received on the connection.
+func (c *Conn) HandleMessage(payload []byte) error {
+	msg, err := UnmarshalMessage(payload)
+	if err != nil {
+		return err
+	}
+
+	switch msg.Type {
+	case MessageRequest:
+		return c.serve(msg.Piece)
+	case MessageReject:
+		c.handleReject(msg.Piece)
+		return nil
+	default:
+		return c.handleData(msg)
+	}
+}
+
+// serve answers a request with the piece, or rejects it if we don't have the metadata. The
+// piece index comes from the peer: it's checked against the number of pieces, since multiplying
+// it by PieceSize may overflow.
+func (c *Conn) serve(piece int) error {
+	metadata := c.exchange.Metadata()
+
+	if metadata == nil || piece < 0 || piece >= (len(metadata)+PieceSize-1)/PieceSize {
+		return c.send(Message{Type: MessageReject, Piece: piece}.Marshal())
+	}
+
+	end := min(len(metadata), (piece+1)*PieceSize)
+	return c.send(Message{
+		Type:      MessageData,
+		Piece:     piece,
+		TotalSize: len(metadata),
+		Data:      metadata[piece*PieceSize : end],
+	}.Marshal())
+}
+
+// handleReject stops requesting from a peer that rejected a request: it doesn't have the
+// metadata, or doesn't want to serve it.
+func (c *Conn) handleReject(piece int) {
+	e := c.exchange
+
+	e.mu.Lock()
+	if c.piece == piece {
+		c.release()
+		c.canRequest = false
+	}
+	e.mu.Unlock()
+
+	e.logger.Debug("Metadata request rejected", "piece", piece)
+	e.kick()
+}
+
+func (c *Conn) handleData(msg Message) error {
+	e := c.exchange
+
+	e.mu.Lock()
+	if e.metadata != nil || c.piece != msg.Piece {
+		// Unsolicited, or answered after the metadata was completed.
+		e.mu.Unlock()
+		return nil
+	}
+	c.release()
+
+	if msg.TotalSize != e.size || len(msg.Data) != e.pieceLength(msg.Piece) {
+		c.canRequest = false
+		e.mu.Unlock()
+		e.kick()
+		return errors.New("Received metadata piece of unexpected size")
+	}
+
+	if e.pieces[msg.Piece] == nil {
+		e.pieces[msg.Piece] = append([]byte(nil), msg.Data...)
+		e.sources[msg.Piece] = c
+	}
+
+	var verifyErr error
+	if complete := !containsNil(e.pieces); complete {
+		metadata := bytes.Join(e.pieces, nil)
+		if sha1.Sum(metadata) == e.infoHash {
+			e.complete(metadata)
+		} else {
+			// We can't tell which of the peers sent a bad piece: stop requesting from all of
+			// them, and start over.
+			verifyErr = ErrMetadataMismatch
+			for _, source := range e.sources {
+				source.canRequest = false
+			}
+			e.pieces = make([][]byte, len(e.pieces))
+			e.sources = make([]*Conn, len(e.pieces))
+		}
+	}
+	e.mu.Unlock()
+
+	if verifyErr != nil {
+		e.logger.Warn("Fetched metadata doesn't match the info hash, fetching it again")
+		e.kick()
+		return verifyErr
+	}
+
+	return c.requestNext()
+}
+
+func containsNil(pieces [][]byte) bool {
+	for _, piece := range pieces {
+		if piece == nil {
+			return true
+		}
+	}
+	return false
+}
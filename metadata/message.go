@@ -0,0 +1,94 @@
+package metadata
+
+import (
+	"errors"
+	"fmt"
+
+	"github.com/dpnam2112/bittorrent-client/bencode"
+)
+
+// ExtensionName is the name ut_metadata is registered under in the extension handshake (BEP 10).
+const ExtensionName = "ut_metadata"
+
+// PieceSize is the size of every metadata piece but the last one.
+const PieceSize = 16 * 1024
+
+type MessageType int
+
+const (
+	MessageRequest MessageType = 0
+	MessageData    MessageType = 1
+	MessageReject  MessageType = 2
+)
+
+// Message is the payload of a ut_metadata extended message.
+//
+// Wire layout: a bencoded dictionary, followed by the piece data for data messages.
+//
+//	msg_type:   0 request, 1 data, 2 reject
+//	piece:      index of the metadata piece
+//	total_size: size of the whole metadata (data messages only)
+type Message struct {
+	Type      MessageType
+	Piece     int
+	TotalSize int
+	// Data is the content of the piece, for data messages.
+	Data []byte
+}
+
+func (msg Message) Marshal() []byte {
+	dict := map[string]bencode.BValue{
+		"msg_type": &bencode.BInt{Value: int64(msg.Type)},
+		"piece":    &bencode.BInt{Value: int64(msg.Piece)},
+	}
+	if msg.Type == MessageData {
+		dict["total_size"] = &bencode.BInt{Value: int64(msg.TotalSize)}
+	}
+
+	raw := bencode.Encode(&bencode.BDict{Dict: dict})
+	if msg.Type == MessageData {
+		raw = append(raw, msg.Data...)
+	}
+	return raw
+}
+
+func UnmarshalMessage(raw []byte) (Message, error) {
+	var msg Message
+
+	remaining, value, err := bencode.ParseBencode(raw)
+	if err != nil {
+		return msg, fmt.Errorf("Failed to parse ut_metadata message: %w", err)
+	}
+
+	dict, ok := value.(*bencode.BDict)
+	if !ok {
+		return msg, errors.New("ut_metadata message is not a dictionary")
+	}
+
+	msgType, ok := dict.Dict["msg_type"].(*bencode.BInt)
+	if !ok {
+		return msg, errors.New("ut_metadata message has no msg_type")
+	}
+	piece, ok := dict.Dict["piece"].(*bencode.BInt)
+	if !ok || piece.Value < 0 {
+		return msg, errors.New("ut_metadata message has no valid piece")
+	}
+
+	msg.Type = MessageType(msgType.Value)
+	msg.Piece = int(piece.Value)
+
+	switch msg.Type {
+	case MessageRequest, MessageReject:
+	case MessageData:
+		totalSize, ok := dict.Dict["total_size"].(*bencode.BInt)
+		if !ok || totalSize.Value <= 0 {
+			return msg, errors.New("ut_metadata data message has no valid total_size")
+		}
+		msg.TotalSize = int(totalSize.Value)
+		msg.Data = remaining
+	default:
+		return msg, fmt.Errorf("Unknown ut_metadata message type %d", msg.Type)
+	}
+
+	return msg, nil
+}
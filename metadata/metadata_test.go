@@ -0,0 +1,183 @@
+package metadata
+
+import (
+	"crypto/sha1"
+	"io"
+	"log/slog"
+	"net"
+	"testing"
+
+	"github.com/dpnam2112/bittorrent-client/peer"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestMessageRoundTrip(t *testing.T) {
+	data := Message{Type: MessageData, Piece: 1, TotalSize: 20000, Data: []byte("piece data")}
+	raw := data.Marshal()
+	assert.Equal(t, "d8:msg_typei1e5:piecei1e10:total_sizei20000eepiece data", string(raw))
+
+	decoded, err := UnmarshalMessage(raw)
+	assert.NoError(t, err)
+	assert.Equal(t, data, decoded)
+
+	request := Message{Type: MessageRequest, Piece: 2}
+	decoded, err = UnmarshalMessage(request.Marshal())
+	assert.NoError(t, err)
+	assert.Equal(t, request, decoded)
+
+	for _, invalid := range []string{
+		"d5:piecei0ee",
+		"d8:msg_typei0ee",
+		"d8:msg_typei1e5:piecei0ee",
+		"d8:msg_typei7e5:piecei0ee",
+		"le",
+	} {
+		_, err := UnmarshalMessage([]byte(invalid))
+		assert.Error(t, err, invalid)
+	}
+}
+
+// network queues the messages sent on its pipes, so that they are delivered after the handlers
+// are connected, like messages read from a connection.
+type network struct {
+	queue []delivery
+}
+
+type delivery struct {
+	to      *pipe
+	payload []byte
+}
+
+// pump delivers the queued messages until there are none left, and returns the first error.
+func (n *network) pump() error {
+	var firstErr error
+	for len(n.queue) > 0 {
+		d := n.queue[0]
+		n.queue = n.queue[1:]
+		if err := d.to.handler.HandleMessage(d.payload); err != nil && firstErr == nil {
+			firstErr = err
+		}
+	}
+	return firstErr
+}
+
+// pipe is an ExtensionConn delivering the messages sent on it to the handler of the other side.
+type pipe struct {
+	network *network
+	peer    *pipe
+	handler peer.ExtensionHandler
+}
+
+func (p *pipe) Send(payload []byte) error {
+	p.network.queue = append(p.network.queue, delivery{to: p.peer, payload: payload})
+	return nil
+}
+
+func (p *pipe) RemoteAddr() net.Addr { return &net.TCPAddr{} }
+
+func newTestExchange(infoHash [20]byte) *Exchange {
+	return NewExchange(infoHash, Config{Logger: slog.New(slog.NewTextHandler(io.Discard, nil))})
+}
+
+// connect connects a leecher to a remote exchange advertising size, and exchanges messages until
+// both sides are idle. It returns the first error of a handler.
+func connect(t *testing.T, leecher, remote *Exchange, size int) error {
+	n := &network{}
+	leecherEnd, remoteEnd := &pipe{network: n}, &pipe{network: n}
+	leecherEnd.peer, remoteEnd.peer = remoteEnd, leecherEnd
+
+	var err error
+	remoteEnd.handler, err = remote.Extension().Connect(remoteEnd, peer.ExtensionHandshake{})
+	assert.NoError(t, err)
+	leecherEnd.handler, err = leecher.Extension().Connect(leecherEnd, peer.ExtensionHandshake{MetadataSize: size})
+	assert.NoError(t, err)
+
+	return n.pump()
+}
+
+func testMetadata() ([]byte, [20]byte) {
+	metadata := make([]byte, 2*PieceSize+100)
+	for i := range metadata {
+		metadata[i] = byte(i * 7)
+	}
+	return metadata, sha1.Sum(metadata)
+}
+
+func TestFetchMetadata(t *testing.T) {
+	metadata, infoHash := testMetadata()
+
+	seeder := newTestExchange(infoHash)
+	assert.ErrorIs(t, seeder.SetMetadata([]byte("other")), ErrMetadataMismatch)
+	assert.NoError(t, seeder.SetMetadata(metadata))
+
+	var h peer.ExtensionHandshake
+	seeder.Extension().(peer.HandshakeExtender).ExtendHandshake(&h)
+	assert.Equal(t, len(metadata), h.MetadataSize)
+
+	// A peer without the metadata rejects our requests; we then fetch from the seeder.
+	leecher := newTestExchange(infoHash)
+	err := connect(t, leecher, newTestExchange(infoHash), len(metadata))
+	assert.NoError(t, err)
+	assert.Nil(t, leecher.Metadata())
+
+	err = connect(t, leecher, seeder, len(metadata))
+	assert.NoError(t, err)
+
+	select {
+	case <-leecher.Done():
+	default:
+		t.Fatal("Metadata not fetched")
+	}
+	assert.Equal(t, metadata, leecher.Metadata())
+}
+
+func TestFetchMetadataMismatch(t *testing.T) {
+	metadata, infoHash := testMetadata()
+
+	// A peer serving other metadata of the same size: the result is rejected.
+	corrupted := append([]byte(nil), metadata...)
+	corrupted[0]++
+	liar := newTestExchange(sha1.Sum(corrupted))
+	assert.NoError(t, liar.SetMetadata(corrupted))
+
+	leecher := newTestExchange(infoHash)
+	err := connect(t, leecher, liar, len(metadata))
+	assert.ErrorIs(t, err, ErrMetadataMismatch)
+	assert.Nil(t, leecher.Metadata())
+
+	// Pieces of the wrong size are refused.
+	short := newTestExchange(sha1.Sum(metadata[:100]))
+	assert.NoError(t, short.SetMetadata(metadata[:100]))
+	leecher = newTestExchange(infoHash)
+	err = connect(t, leecher, short, len(metadata))
+	assert.Error(t, err)
+	assert.Nil(t, leecher.Metadata())
+
+	seeder := newTestExchange(infoHash)
+	assert.NoError(t, seeder.SetMetadata(metadata))
+	err = connect(t, leecher, seeder, len(metadata))
+	assert.NoError(t, err)
+	assert.Equal(t, metadata, leecher.Metadata())
+}
+
+func TestServeRejectsOutOfRangePieces(t *testing.T) {
+	metadata, infoHash := testMetadata()
+	seeder := newTestExchange(infoHash)
+	assert.NoError(t, seeder.SetMetadata(metadata))
+
+	n := &network{}
+	seederEnd, remoteEnd := &pipe{network: n}, &pipe{network: n}
+	seederEnd.peer, remoteEnd.peer = remoteEnd, seederEnd
+	handler, err := seeder.Extension().Connect(seederEnd, peer.ExtensionHandshake{})
+	assert.NoError(t, err)
+
+	// A huge index would overflow once multiplied by the piece size.
+	for _, piece := range []int{3, 1 << 49, 1<<63 - 1} {
+		assert.NoError(t, handler.HandleMessage(Message{Type: MessageRequest, Piece: piece}.Marshal()))
+		assert.Len(t, n.queue, 1)
+		reply, err := UnmarshalMessage(n.queue[0].payload)
+		assert.NoError(t, err)
+		assert.Equal(t, Message{Type: MessageReject, Piece: piece}, reply)
+		n.queue = nil
+	}
+}
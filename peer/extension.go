@@ -0,0 +1,392 @@
+package peer
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"sync"
+
+	"github.com/dpnam2112/bittorrent-client/bencode"
+)
+
+// ExtensionHandshakeID is the extended message ID of the extension handshake (BEP 10).
+const ExtensionHandshakeID uint8 = 0
+
+// ErrExtensionNotSupported is returned when sending a message of an extension the remote peer
+// didn't advertise.
+var (
+	ErrExtensionNotSupported = errors.New("Extension not supported by the peer")
+	// ErrTooManyExtensions is returned when registering an extension in a registry that already
+	// assigned every extended message ID.
+	ErrTooManyExtensions = errors.New("Too many registered extensions")
+)
+
+// ExtensionHandshake is the payload of the extension handshake, the extended message with ID 0.
+//
+// Wire layout (bencoded dictionary, every key is optional):
+//
+//	m:             dictionary of extension name -> extended message ID (0 disables an extension)
+//	v:             client name and version
+//	p:             TCP listen port
+//	reqq:          number of outstanding requests the client accepts
+//	yourip:        the IP of the recipient, as seen by the sender (4 or 16 bytes)
+//	metadata_size: size of the info dictionary (BEP 9)
+type ExtensionHandshake struct {
+	M            map[string]uint8
+	V            string
+	P            uint16
+	Reqq         int
+	YourIP       net.IP
+	MetadataSize int
+}
+
+func (h ExtensionHandshake) Marshal() []byte {
+	m := make(map[string]bencode.BValue, len(h.M))
+	for name, id := range h.M {
+		m[name] = &bencode.BInt{Value: int64(id)}
+	}
+
+	dict := map[string]bencode.BValue{"m": &bencode.BDict{Dict: m}}
+	if h.V != "" {
+		dict["v"] = &bencode.BString{Value: []byte(h.V)}
+	}
+	if h.P != 0 {
+		dict["p"] = &bencode.BInt{Value: int64(h.P)}
+	}
+	if h.Reqq > 0 {
+		dict["reqq"] = &bencode.BInt{Value: int64(h.Reqq)}
+	}
+	if ip4 := h.YourIP.To4(); ip4 != nil {
+		dict["yourip"] = &bencode.BString{Value: ip4}
+	} else if len(h.YourIP) == net.IPv6len {
+		dict["yourip"] = &bencode.BString{Value: h.YourIP}
+	}
+	if h.MetadataSize > 0 {
+		dict["metadata_size"] = &bencode.BInt{Value: int64(h.MetadataSize)}
+	}
+	return bencode.Encode(&bencode.BDict{Dict: dict})
+}
+
+// UnmarshalExtensionHandshake parses an extension handshake. Keys with an unexpected type or an
+// out-of-range value are ignored, as clients disagree on many details.
+func UnmarshalExtensionHandshake(raw []byte) (ExtensionHandshake, error) {
+	h := ExtensionHandshake{M: map[string]uint8{}}
+
+	_, value, err := bencode.ParseBencode(raw)
+	if err != nil {
+		return h, fmt.Errorf("Failed to parse extension handshake: %w", err)
+	}
+
+	dict, ok := value.(*bencode.BDict)
+	if !ok {
+		return h, errors.New("Extension handshake is not a dictionary")
+	}
+
+	if m, ok := dict.Dict["m"].(*bencode.BDict); ok {
+		for name, value := range m.Dict {
+			if id, ok := value.(*bencode.BInt); ok && id.Value >= 0 && id.Value <= 255 {
+				h.M[name] = uint8(id.Value)
+			}
+		}
+	}
+
+	if v, ok := dict.Dict["v"].(*bencode.BString); ok {
+		h.V = string(v.Value)
+	}
+	if p, ok := dict.Dict["p"].(*bencode.BInt); ok && p.Value > 0 && p.Value <= 65535 {
+		h.P = uint16(p.Value)
+	}
+	if reqq, ok := dict.Dict["reqq"].(*bencode.BInt); ok && reqq.Value > 0 {
+		h.Reqq = int(reqq.Value)
+	}
+	if ip, ok := dict.Dict["yourip"].(*bencode.BString); ok && (len(ip.Value) == net.IPv4len || len(ip.Value) == net.IPv6len) {
+		h.YourIP = net.IP(ip.Value)
+	}
+	if size, ok := dict.Dict["metadata_size"].(*bencode.BInt); ok && size.Value > 0 {
+		h.MetadataSize = int(size.Value)
+	}
+
+	return h, nil
+}
+
+// Extension is a BEP 10 extension, registered in the ExtensionRegistry of a torrent.
+type Extension interface {
+	// Name is the key of the extension in the 'm' dictionary, e.g. "ut_pex".
+	Name() string
+	// Connect is called when the remote peer advertises the extension in its handshake. The
+	// returned handler receives the extension messages of the connection; conn sends them.
+	Connect(conn ExtensionConn, remote ExtensionHandshake) (ExtensionHandler, error)
+}
+
+// HandshakeExtender is implemented by extensions that add fields to our extension handshake,
+// like ut_metadata setting metadata_size.
+type HandshakeExtender interface {
+	ExtendHandshake(h *ExtensionHandshake)
+}
+
+// ExtensionHandler handles the messages of an extension on a connection.
+type ExtensionHandler interface {
+	HandleMessage(payload []byte) error
+	// Close is called when the connection is closed, or when the remote peer disables the
+	// extension.
+	Close()
+}
+
+// ExtensionConn is the side of a connection an extension sees.
+type ExtensionConn interface {
+	// Send sends a message of the extension, with the ID the remote peer assigned to it.
+	Send(payload []byte) error
+	RemoteAddr() net.Addr
+}
+
+// ExtensionRegistry holds the extensions enabled for a torrent, and the IDs we assign to them.
+// It's shared by the connections of the torrent.
+type ExtensionRegistry struct {
+	mu         sync.RWMutex
+	extensions []Extension
+}
+
+func NewExtensionRegistry() *ExtensionRegistry {
+	return &ExtensionRegistry{}
+}
+
+// Register adds an extension, and returns the extended message ID remote peers use to send us
+// its messages. Extensions registered after a connection sent its handshake aren't advertised
+// on it. An extension with the name of a registered one replaces it, and keeps its ID.
+func (r *ExtensionRegistry) Register(extension Extension) (uint8, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	for i, registered := range r.extensions {
+		if registered.Name() == extension.Name() {
+			r.extensions[i] = extension
+			return uint8(i + 1), nil
+		}
+	}
+
+	// ID 0 is the extension handshake.
+	if len(r.extensions) == 255 {
+		return 0, fmt.Errorf("Failed to register %s: %w", extension.Name(), ErrTooManyExtensions)
+	}
+	r.extensions = append(r.extensions, extension)
+	return uint8(len(r.extensions)), nil
+}
+
+func (r *ExtensionRegistry) snapshot() []Extension {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	return append([]Extension(nil), r.extensions...)
+}
+
+type ExtensionSessionConfig struct {
+	// Version is sent as 'v'.
+	Version string
+	// Port is our listen port, sent as 'p'.
+	Port uint16
+	// Reqq is the number of outstanding requests we accept.
+	Reqq int
+	// RemoteIP is the IP of the remote peer, sent as 'yourip'.
+	RemoteIP net.IP
+	// RemoteAddr is the address of the remote peer.
+	RemoteAddr net.Addr
+	// Send writes a message on the connection.
+	Send func(msg PeerMessage) error
+}
+
+// ExtensionSession is the extension protocol state of a connection: it sends our handshake,
+// records the IDs the remote peer assigned to its extensions, and dispatches the extended
+// messages received to the handlers of the extensions. The message loop of the connection only
+// passes Extended messages to HandleMessage.
+type ExtensionSession struct {
+	config     ExtensionSessionConfig
+	extensions []Extension
+
+	mu        sync.Mutex
+	remote    *ExtensionHandshake
+	remoteIDs map[string]uint8
+	handlers  map[string]ExtensionHandler
+	closed    bool
+}
+
+func NewExtensionSession(registry *ExtensionRegistry, config ExtensionSessionConfig) *ExtensionSession {
+	return &ExtensionSession{
+		config:     config,
+		extensions: registry.snapshot(),
+		remoteIDs:  make(map[string]uint8),
+		handlers:   make(map[string]ExtensionHandler),
+	}
+}
+
+// LocalHandshake returns the extension handshake we send.
+func (s *ExtensionSession) LocalHandshake() ExtensionHandshake {
+	h := ExtensionHandshake{
+		M:      make(map[string]uint8, len(s.extensions)),
+		V:      s.config.Version,
+		P:      s.config.Port,
+		Reqq:   s.config.Reqq,
+		YourIP: s.config.RemoteIP,
+	}
+	for i, extension := range s.extensions {
+		h.M[extension.Name()] = uint8(i + 1)
+		if extender, ok := extension.(HandshakeExtender); ok {
+			extender.ExtendHandshake(&h)
+		}
+	}
+	return h
+}
+
+// SendHandshake sends our extension handshake. It must be the first extended message sent on
+// the connection.
+func (s *ExtensionSession) SendHandshake() error {
+	return s.config.Send(CreateExtendedMessage(ExtensionHandshakeID, s.LocalHandshake().Marshal()))
+}
+
+// RemoteHandshake returns the last extension handshake received, if any.
+func (s *ExtensionSession) RemoteHandshake() (ExtensionHandshake, bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.remote == nil {
+		return ExtensionHandshake{}, false
+	}
+	return *s.remote, true
+}
+
+// Supports reports whether the remote peer advertised the extension.
+func (s *ExtensionSession) Supports(name string) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	_, ok := s.remoteIDs[name]
+	return ok
+}
+
+// Send sends a message of the named extension.
+func (s *ExtensionSession) Send(name string, payload []byte) error {
+	s.mu.Lock()
+	id, ok := s.remoteIDs[name]
+	s.mu.Unlock()
+	if !ok {
+		return fmt.Errorf("%w: %s", ErrExtensionNotSupported, name)
+	}
+	return s.config.Send(CreateExtendedMessage(id, payload))
+}
+
+// HandleMessage processes an extended message received on the connection. Messages for
+// extensions we didn't advertise are an error; the caller decides whether to drop the peer.
+func (s *ExtensionSession) HandleMessage(msg Extended) error {
+	if msg.ID == ExtensionHandshakeID {
+		return s.handleHandshake(msg.Data)
+	}
+
+	if int(msg.ID) > len(s.extensions) {
+		return fmt.Errorf("Received message for unknown extension ID %d", msg.ID)
+	}
+	name := s.extensions[msg.ID-1].Name()
+
+	s.mu.Lock()
+	handler, ok := s.handlers[name]
+	s.mu.Unlock()
+	if !ok {
+		return fmt.Errorf("Received %s message before the peer enabled it", name)
+	}
+
+	return handler.HandleMessage(msg.Data)
+}
+
+// handleHandshake records the IDs of the remote extensions. A peer may send several handshakes:
+// later ones add extensions, or disable them with ID 0.
+func (s *ExtensionSession) handleHandshake(raw []byte) error {
+	remote, err := UnmarshalExtensionHandshake(raw)
+	if err != nil {
+		return err
+	}
+
+	s.mu.Lock()
+	if s.closed {
+		s.mu.Unlock()
+		return nil
+	}
+	if s.remote != nil {
+		// Later handshakes only carry the changes to 'm'.
+		for name, id := range s.remoteIDs {
+			if _, ok := remote.M[name]; !ok {
+				remote.M[name] = id
+			}
+		}
+	}
+	s.remote = &remote
+
+	s.remoteIDs = make(map[string]uint8, len(remote.M))
+	for name, id := range remote.M {
+		if id != 0 {
+			s.remoteIDs[name] = id
+		}
+	}
+
+	var connect []Extension
+	var disconnect []ExtensionHandler
+	for _, extension := range s.extensions {
+		name := extension.Name()
+		_, enabled := s.remoteIDs[name]
+		handler, connected := s.handlers[name]
+		switch {
+		case enabled && !connected:
+			connect = append(connect, extension)
+		case !enabled && connected:
+			delete(s.handlers, name)
+			disconnect = append(disconnect, handler)
+		}
+	}
+	s.mu.Unlock()
+
+	for _, handler := range disconnect {
+		handler.Close()
+	}
+
+	var errs []error
+	for _, extension := range connect {
+		handler, err := extension.Connect(&extensionConn{session: s, name: extension.Name()}, remote)
+		if err != nil {
+			errs = append(errs, fmt.Errorf("Failed to enable %s: %w", extension.Name(), err))
+			continue
+		}
+
+		// The session may have been closed while connecting: the handler is closed right away,
+		// since Close won't see it.
+		s.mu.Lock()
+		closed := s.closed
+		if !closed {
+			s.handlers[extension.Name()] = handler
+		}
+		s.mu.Unlock()
+		if closed {
+			handler.Close()
+		}
+	}
+	return errors.Join(errs...)
+}
+
+// Close closes the handlers of every enabled extension.
+func (s *ExtensionSession) Close() {
+	s.mu.Lock()
+	handlers := s.handlers
+	s.handlers = make(map[string]ExtensionHandler)
+	s.closed = true
+	s.mu.Unlock()
+
+	for _, handler := range handlers {
+		handler.Close()
+	}
+}
+
+type extensionConn struct {
+	session *ExtensionSession
+	name    string
+}
+
+func (c *extensionConn) Send(payload []byte) error {
+	return c.session.Send(c.name, payload)
+}
+
+func (c *extensionConn) RemoteAddr() net.Addr {
+	return c.session.config.RemoteAddr
+}
@@ -0,0 +1,185 @@
+package peer
+
+import (
+	"fmt"
+	"net"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestExtensionHandshakeRoundTrip(t *testing.T) {
+	h := ExtensionHandshake{
+		M:            map[string]uint8{"ut_metadata": 1, "ut_pex": 2},
+		V:            "GoTorrent 0.1",
+		P:            6881,
+		Reqq:         250,
+		YourIP:       net.ParseIP("192.168.1.20"),
+		MetadataSize: 31235,
+	}
+
+	raw := h.Marshal()
+	assert.Equal(t, "d1:md11:ut_metadatai1e6:ut_pexi2ee13:metadata_sizei31235e1:pi6881e"+
+		"4:reqqi250e1:v13:GoTorrent 0.16:yourip4:\xc0\xa8\x01\x14e", string(raw))
+
+	decoded, err := UnmarshalExtensionHandshake(raw)
+	assert.NoError(t, err)
+	assert.Equal(t, h.M, decoded.M)
+	assert.Equal(t, h.V, decoded.V)
+	assert.Equal(t, h.P, decoded.P)
+	assert.Equal(t, h.Reqq, decoded.Reqq)
+	assert.True(t, h.YourIP.Equal(decoded.YourIP))
+	assert.Equal(t, h.MetadataSize, decoded.MetadataSize)
+
+	// Malformed fields are ignored.
+	decoded, err = UnmarshalExtensionHandshake([]byte("d1:md1:ai300e1:bi3e1:c1:xe1:pi70000e6:yourip3:abce"))
+	assert.NoError(t, err)
+	assert.Equal(t, map[string]uint8{"b": 3}, decoded.M)
+	assert.Zero(t, decoded.P)
+	assert.Nil(t, decoded.YourIP)
+
+	_, err = UnmarshalExtensionHandshake([]byte("li1ee"))
+	assert.Error(t, err)
+}
+
+// echoExtension records the messages it receives, and answers each one with its reversal.
+type echoExtension struct {
+	name     string
+	received [][]byte
+	closed   int
+}
+
+func (e *echoExtension) Name() string { return e.name }
+
+func (e *echoExtension) Connect(conn ExtensionConn, _ ExtensionHandshake) (ExtensionHandler, error) {
+	return &echoHandler{extension: e, conn: conn}, nil
+}
+
+func (e *echoExtension) ExtendHandshake(h *ExtensionHandshake) { h.MetadataSize = 42 }
+
+type echoHandler struct {
+	extension *echoExtension
+	conn      ExtensionConn
+}
+
+func (h *echoHandler) HandleMessage(payload []byte) error {
+	h.extension.received = append(h.extension.received, payload)
+	if string(payload) == "ping" {
+		return h.conn.Send([]byte("pong"))
+	}
+	return nil
+}
+
+func (h *echoHandler) Close() { h.extension.closed++ }
+
+// hookExtension is an echoExtension calling a function before connecting.
+type hookExtension struct {
+	*echoExtension
+	beforeConnect func()
+}
+
+func (e *hookExtension) Connect(conn ExtensionConn, remote ExtensionHandshake) (ExtensionHandler, error) {
+	e.beforeConnect()
+	return e.echoExtension.Connect(conn, remote)
+}
+
+// connectSessions returns two sessions delivering their messages to each other.
+func connectSessions(t *testing.T, a, b *ExtensionRegistry) (*ExtensionSession, *ExtensionSession) {
+	var sessionA, sessionB *ExtensionSession
+	deliver := func(to **ExtensionSession) func(PeerMessage) error {
+		return func(msg PeerMessage) error {
+			decoded, err := DecodeMessage(msg)
+			assert.NoError(t, err)
+			return (*to).HandleMessage(decoded.(Extended))
+		}
+	}
+
+	sessionA = NewExtensionSession(a, ExtensionSessionConfig{Version: "a", Send: deliver(&sessionB)})
+	sessionB = NewExtensionSession(b, ExtensionSessionConfig{Version: "b", Send: deliver(&sessionA)})
+	return sessionA, sessionB
+}
+
+func TestExtensionRegistryLimit(t *testing.T) {
+	registry := NewExtensionRegistry()
+	for i := range 255 {
+		id, err := registry.Register(&echoExtension{name: fmt.Sprintf("ext%d", i)})
+		assert.NoError(t, err)
+		assert.Equal(t, uint8(i+1), id)
+	}
+
+	// Every ID is taken, but a registered extension can still be replaced.
+	_, err := registry.Register(&echoExtension{name: "one_more"})
+	assert.ErrorIs(t, err, ErrTooManyExtensions)
+	id, err := registry.Register(&echoExtension{name: "ext7"})
+	assert.NoError(t, err)
+	assert.Equal(t, uint8(8), id)
+}
+
+func TestExtensionSessionClosedWhileConnecting(t *testing.T) {
+	echoA := &echoExtension{name: "echo"}
+	hook := &hookExtension{echoExtension: echoA}
+	registryA, registryB := NewExtensionRegistry(), NewExtensionRegistry()
+	_, err := registryA.Register(hook)
+	assert.NoError(t, err)
+	_, err = registryB.Register(&echoExtension{name: "echo"})
+	assert.NoError(t, err)
+
+	a, b := connectSessions(t, registryA, registryB)
+	hook.beforeConnect = a.Close
+	assert.NoError(t, b.SendHandshake())
+
+	// The handler connected after Close is closed, not kept.
+	assert.Equal(t, 1, echoA.closed)
+	assert.Empty(t, a.handlers)
+}
+
+func TestExtensionSession(t *testing.T) {
+	echoA, onlyA := &echoExtension{name: "echo"}, &echoExtension{name: "only_a"}
+	echoB := &echoExtension{name: "echo"}
+
+	registryA := NewExtensionRegistry()
+	id, err := registryA.Register(onlyA)
+	assert.NoError(t, err)
+	assert.Equal(t, uint8(1), id)
+	id, err = registryA.Register(echoA)
+	assert.NoError(t, err)
+	assert.Equal(t, uint8(2), id)
+	registryB := NewExtensionRegistry()
+	id, err = registryB.Register(echoB)
+	assert.NoError(t, err)
+	assert.Equal(t, uint8(1), id)
+
+	a, b := connectSessions(t, registryA, registryB)
+	assert.Equal(t, map[string]uint8{"only_a": 1, "echo": 2}, a.LocalHandshake().M)
+	assert.Equal(t, 42, a.LocalHandshake().MetadataSize)
+
+	// Nothing can be sent before the handshakes.
+	assert.ErrorIs(t, a.Send("echo", []byte("ping")), ErrExtensionNotSupported)
+
+	assert.NoError(t, a.SendHandshake())
+	assert.NoError(t, b.SendHandshake())
+	remote, ok := a.RemoteHandshake()
+	assert.True(t, ok)
+	assert.Equal(t, "b", remote.V)
+	assert.True(t, a.Supports("echo"))
+	assert.False(t, a.Supports("only_a"))
+	assert.True(t, b.Supports("only_a"))
+
+	// Messages are sent with the remote ID, and dispatched with the local one.
+	assert.NoError(t, a.Send("echo", []byte("ping")))
+	assert.Equal(t, [][]byte{[]byte("ping")}, echoB.received)
+	assert.Equal(t, [][]byte{[]byte("pong")}, echoA.received)
+	assert.ErrorIs(t, a.Send("only_a", nil), ErrExtensionNotSupported)
+
+	// Unknown IDs are rejected.
+	assert.Error(t, a.HandleMessage(Extended{ID: 9, Data: []byte("x")}))
+
+	// A later handshake can disable an extension.
+	assert.NoError(t, a.HandleMessage(Extended{ID: ExtensionHandshakeID, Data: []byte("d1:md4:echoi0eee")}))
+	assert.False(t, a.Supports("echo"))
+	assert.Equal(t, 1, echoA.closed)
+	assert.Error(t, a.HandleMessage(Extended{ID: 2, Data: []byte("ping")}))
+
+	b.Close()
+	assert.Equal(t, 1, echoB.closed)
+}
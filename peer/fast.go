@@ -0,0 +1,234 @@
+package peer
+
+import (
+	"crypto/sha1"
+	"encoding/binary"
+	"errors"
+	"net"
+	"slices"
+	"sync"
+)
+
+// DefaultAllowedFastCount is the number of pieces a choked peer may request from us, the value
+// suggested by BEP 6.
+const DefaultAllowedFastCount = 10
+
+// Suggestions beyond this are dropped, oldest first.
+const maxSuggestedPieces = 32
+
+// ErrFastNotNegotiated is returned for Fast extension messages received on a connection that
+// didn't negotiate the extension. BEP 6 requires closing the connection.
+var ErrFastNotNegotiated = errors.New("Received Fast extension message without negotiating it")
+
+// AllowedFastSet computes the canonical allowed fast set of a peer (BEP 6): k pieces derived from
+// the info hash and the /24 network of the peer, so that every peer behind the same NAT gets the
+// same set. BEP 6 only defines it for IPv4 peers: other peers get none.
+func AllowedFastSet(k int, numPieces uint32, infoHash [20]byte, ip net.IP) []uint32 {
+	ip4 := ip.To4()
+	if ip4 == nil || numPieces == 0 {
+		return nil
+	}
+	k = min(k, int(numPieces))
+
+	x := make([]byte, 0, 24)
+	x = append(x, ip4[0], ip4[1], ip4[2], 0)
+	x = append(x, infoHash[:]...)
+
+	set := make([]uint32, 0, k)
+	for len(set) < k {
+		sum := sha1.Sum(x)
+		x = sum[:]
+		for i := 0; i < 5 && len(set) < k; i++ {
+			index := binary.BigEndian.Uint32(x[4*i:]) % numPieces
+			if !slices.Contains(set, index) {
+				set = append(set, index)
+			}
+		}
+	}
+	return set
+}
+
+// FastState is the Fast extension (BEP 6) state of a connection: the pieces each side may request
+// while choked, and the pieces the peer suggested. When the extension wasn't negotiated, its
+// methods follow the base protocol instead, so the session doesn't need to tell the cases apart.
+type FastState struct {
+	enabled bool
+
+	mu sync.Mutex
+	// allowedByUs are the pieces the peer may request while we choke it.
+	allowedByUs map[uint32]struct{}
+	// allowedByPeer are the pieces we may request while the peer chokes us.
+	allowedByPeer map[uint32]struct{}
+	suggested     []uint32
+}
+
+func NewFastState(enabled bool) *FastState {
+	return &FastState{
+		enabled:       enabled,
+		allowedByUs:   make(map[uint32]struct{}),
+		allowedByPeer: make(map[uint32]struct{}),
+	}
+}
+
+func (s *FastState) Enabled() bool {
+	return s.enabled
+}
+
+// BitfieldMessage returns the message announcing our pieces, sent right after the handshake: a
+// seed sends HaveAll and a peer without any piece HaveNone. Without the extension, the bitfield
+// is sent as is, or nil is returned if we have no piece, as the bitfield is then optional.
+func (s *FastState) BitfieldMessage(bitfield []byte, numPieces int) PeerMessage {
+	count := 0
+	for i := 0; i < numPieces && i/8 < len(bitfield); i++ {
+		if bitfield[i/8]&(0x80>>(i%8)) != 0 {
+			count++
+		}
+	}
+
+	switch {
+	case count == 0 && s.enabled:
+		return CreateHaveNoneMessage()
+	case count == 0:
+		return nil
+	case count == numPieces && s.enabled:
+		return CreateHaveAllMessage()
+	default:
+		return CreateBitfieldMessage(bitfield)
+	}
+}
+
+// Allow lets the peer request the pieces while we choke it, and returns the AllowedFast messages
+// telling it so. Without the extension, nothing is allowed and nil is returned.
+func (s *FastState) Allow(pieces ...uint32) []PeerMessage {
+	if !s.enabled {
+		return nil
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	var messages []PeerMessage
+	for _, index := range pieces {
+		if _, ok := s.allowedByUs[index]; ok {
+			continue
+		}
+		s.allowedByUs[index] = struct{}{}
+		messages = append(messages, CreateAllowedFastMessage(index))
+	}
+	return messages
+}
+
+// CheckRequest decides whether a request of the peer is served. Requests of pieces we don't have,
+// or made while we choke the peer outside of its allowed fast set, are refused: with the
+// extension, reject is the RejectRequest message to send; without it, the request is dropped
+// silently and reject is nil.
+func (s *FastState) CheckRequest(request Request, choking bool, havePiece bool) (serve bool, reject PeerMessage) {
+	if havePiece && (!choking || s.isAllowedByUs(request.Index)) {
+		return true, nil
+	}
+	if !s.enabled {
+		return false, nil
+	}
+	return false, RejectRequest(request).Message()
+}
+
+func (s *FastState) isAllowedByUs(index uint32) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	_, ok := s.allowedByUs[index]
+	return ok
+}
+
+// Choke returns, when we choke the peer, the pending requests of the peer that are still served,
+// which are the ones in its allowed fast set, and the RejectRequest messages for the others.
+// Without the extension, choking discards every pending request without telling the peer.
+func (s *FastState) Choke(pending []Request) (kept []Request, rejects []PeerMessage) {
+	if !s.enabled {
+		return nil, nil
+	}
+
+	for _, request := range pending {
+		if s.isAllowedByUs(request.Index) {
+			kept = append(kept, request)
+		} else {
+			rejects = append(rejects, RejectRequest(request).Message())
+		}
+	}
+	return kept, rejects
+}
+
+// Choked returns, when the peer chokes us, our pending requests it discarded. Without the
+// extension, that's all of them. With it, the peer rejects each request it won't serve with a
+// RejectRequest message, and nothing is discarded implicitly.
+func (s *FastState) Choked(pending []Request) []Request {
+	if s.enabled {
+		return nil
+	}
+	return pending
+}
+
+// CanRequest reports whether we may request a piece from the peer: always when it doesn't choke
+// us, otherwise only the pieces it allowed.
+func (s *FastState) CanRequest(index uint32, choked bool) bool {
+	if !choked {
+		return true
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	_, ok := s.allowedByPeer[index]
+	return ok
+}
+
+// AllowedByPeer returns the pieces the peer lets us request while it chokes us.
+func (s *FastState) AllowedByPeer() []uint32 {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	pieces := make([]uint32, 0, len(s.allowedByPeer))
+	for index := range s.allowedByPeer {
+		pieces = append(pieces, index)
+	}
+	slices.Sort(pieces)
+	return pieces
+}
+
+// Suggestions returns the pieces the peer suggested since the last call, most recent first.
+func (s *FastState) Suggestions() []uint32 {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	suggested := s.suggested
+	s.suggested = nil
+	slices.Reverse(suggested)
+	return suggested
+}
+
+// HandleMessage records the Fast extension messages of the peer that change the state:
+// AllowedFast and SuggestPiece. HaveAll, HaveNone and RejectRequest are accepted, but are for the
+// session to act on. Any of them is an error when the extension wasn't negotiated.
+func (s *FastState) HandleMessage(msg TypedMessage) error {
+	switch msg.Type() {
+	case TypeSuggestPiece, TypeHaveAll, TypeHaveNone, TypeRejectRequest, TypeAllowedFast:
+	default:
+		return nil
+	}
+	if !s.enabled {
+		return ErrFastNotNegotiated
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	switch m := msg.(type) {
+	case AllowedFast:
+		s.allowedByPeer[m.Index] = struct{}{}
+	case SuggestPiece:
+		s.suggested = slices.DeleteFunc(s.suggested, func(index uint32) bool { return index == m.Index })
+		s.suggested = append(s.suggested, m.Index)
+		if len(s.suggested) > maxSuggestedPieces {
+			s.suggested = s.suggested[len(s.suggested)-maxSuggestedPieces:]
+		}
+	}
+	return nil
+}
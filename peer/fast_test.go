@@ -0,0 +1,101 @@
+package peer
+
+import (
+	"bytes"
+	"net"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestAllowedFastSet(t *testing.T) {
+	// Test vectors of BEP 6.
+	infoHash := [20]byte(bytes.Repeat([]byte{0xaa}, 20))
+	ip := net.ParseIP("80.4.4.200")
+
+	assert.Equal(t, []uint32{1059, 431, 808, 1217, 287, 376, 1188}, AllowedFastSet(7, 1313, infoHash, ip))
+	assert.Equal(t, []uint32{1059, 431, 808, 1217, 287, 376, 1188, 353, 508}, AllowedFastSet(9, 1313, infoHash, ip))
+
+	// Peers of the same /24 network share the set.
+	assert.Equal(t, AllowedFastSet(9, 1313, infoHash, ip), AllowedFastSet(9, 1313, infoHash, net.ParseIP("80.4.4.1")))
+
+	assert.Len(t, AllowedFastSet(10, 3, infoHash, ip), 3)
+	assert.Empty(t, AllowedFastSet(10, 1313, infoHash, net.ParseIP("2001::1")))
+}
+
+func TestFastStateRequests(t *testing.T) {
+	fast := NewFastState(true)
+	assert.Equal(t, []PeerMessage{CreateAllowedFastMessage(1), CreateAllowedFastMessage(2)}, fast.Allow(1, 2, 1))
+	assert.Empty(t, fast.Allow(2))
+
+	served := Request{Index: 1, Begin: 0, Length: 16384}
+	refused := Request{Index: 5, Begin: 0, Length: 16384}
+
+	serve, reject := fast.CheckRequest(refused, false, true)
+	assert.True(t, serve)
+	assert.Nil(t, reject)
+
+	// While choking, only the allowed fast pieces are served, and only if we have them.
+	serve, reject = fast.CheckRequest(served, true, true)
+	assert.True(t, serve)
+	assert.Nil(t, reject)
+	serve, reject = fast.CheckRequest(refused, true, true)
+	assert.False(t, serve)
+	assert.Equal(t, CreateRejectRequestMessage(5, 0, 16384), reject)
+	serve, reject = fast.CheckRequest(served, false, false)
+	assert.False(t, serve)
+	assert.Equal(t, CreateRejectRequestMessage(1, 0, 16384), reject)
+
+	kept, rejects := fast.Choke([]Request{served, refused})
+	assert.Equal(t, []Request{served}, kept)
+	assert.Equal(t, []PeerMessage{CreateRejectRequestMessage(5, 0, 16384)}, rejects)
+	assert.Empty(t, fast.Choked([]Request{served}))
+
+	// Without the extension, refused requests are dropped silently.
+	base := NewFastState(false)
+	assert.Nil(t, base.Allow(1))
+	serve, reject = base.CheckRequest(served, true, true)
+	assert.False(t, serve)
+	assert.Nil(t, reject)
+	kept, rejects = base.Choke([]Request{served})
+	assert.Empty(t, kept)
+	assert.Empty(t, rejects)
+	assert.Equal(t, []Request{served}, base.Choked([]Request{served}))
+}
+
+func TestFastStateRemoteMessages(t *testing.T) {
+	fast := NewFastState(true)
+
+	assert.NoError(t, fast.HandleMessage(AllowedFast{Index: 4}))
+	assert.True(t, fast.CanRequest(4, true))
+	assert.False(t, fast.CanRequest(5, true))
+	assert.True(t, fast.CanRequest(5, false))
+	assert.Equal(t, []uint32{4}, fast.AllowedByPeer())
+
+	for _, index := range []uint32{1, 2, 1, 3} {
+		assert.NoError(t, fast.HandleMessage(SuggestPiece{Index: index}))
+	}
+	assert.Equal(t, []uint32{3, 1, 2}, fast.Suggestions())
+	assert.Empty(t, fast.Suggestions())
+
+	assert.NoError(t, fast.HandleMessage(HaveAll{}))
+	assert.NoError(t, fast.HandleMessage(Have{Index: 1}))
+
+	base := NewFastState(false)
+	for _, msg := range []TypedMessage{HaveAll{}, HaveNone{}, SuggestPiece{}, RejectRequest{}, AllowedFast{}} {
+		assert.ErrorIs(t, base.HandleMessage(msg), ErrFastNotNegotiated, msg.Type().String())
+	}
+	assert.NoError(t, base.HandleMessage(Choke{}))
+}
+
+func TestFastStateBitfieldMessage(t *testing.T) {
+	fast, base := NewFastState(true), NewFastState(false)
+
+	assert.Equal(t, CreateHaveNoneMessage(), fast.BitfieldMessage([]byte{0x00, 0x00}, 10))
+	assert.Nil(t, base.BitfieldMessage([]byte{0x00, 0x00}, 10))
+
+	assert.Equal(t, CreateHaveAllMessage(), fast.BitfieldMessage([]byte{0xff, 0xc0}, 10))
+	assert.Equal(t, CreateBitfieldMessage([]byte{0xff, 0xc0}), base.BitfieldMessage([]byte{0xff, 0xc0}, 10))
+
+	assert.Equal(t, CreateBitfieldMessage([]byte{0xff, 0x80}), fast.BitfieldMessage([]byte{0xff, 0x80}, 10))
+}
@@ -0,0 +1,152 @@
+package peer
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"sync"
+)
+
+const (
+	// DefaultMaxMessageSize bounds the length prefix of the messages read from a peer. It's large
+	// enough for the bitfield of a torrent with 8 million pieces.
+	DefaultMaxMessageSize uint32 = 1 << 20
+	// MaxBlockSize is the largest block a peer may send in a Piece message. Requests are for 16 KiB
+	// blocks, but some clients accept up to 128 KiB.
+	MaxBlockSize uint32 = 128 * 1024
+	// StandardBlockSize is the size of the blocks we request. Piece messages of this size reuse
+	// pooled buffers.
+	StandardBlockSize uint32 = 16 * 1024
+)
+
+var (
+	// ErrMessageTooLarge is returned when a peer announces a message longer than the limits of
+	// its type. Nothing is allocated for it.
+	ErrMessageTooLarge = errors.New("Peer message is too large")
+	// ErrMessageTooShort is returned when a message is shorter than its type requires.
+	ErrMessageTooShort = errors.New("Peer message is too short")
+)
+
+// Length of the length prefix and of the message ID.
+const frameHeaderSize = 5
+
+// pooledFrameSize fits a Piece message carrying a standard block.
+const pooledFrameSize = frameHeaderSize + 8 + int(StandardBlockSize)
+
+var framePool = sync.Pool{
+	New: func() any {
+		buf := make([]byte, pooledFrameSize)
+		return &buf
+	},
+}
+
+// ReleaseMessage returns the buffer of a Piece message to the pool, once its block was copied or
+// written out. The message, and the payload views decoded from it, must not be used afterwards.
+// Other messages are ignored.
+func ReleaseMessage(msg PeerMessage) {
+	raw, ok := msg.(peerMessage)
+	if !ok || cap(raw) != pooledFrameSize || raw.Type() != TypePiece {
+		return
+	}
+	buf := []byte(raw[:cap(raw)])
+	framePool.Put(&buf)
+}
+
+// messageLengthBounds returns the minimum and maximum length (message ID included) of a message
+// type. Types whose payload is variable are only bounded by maxSize.
+func messageLengthBounds(msgType PeerMsgType, maxSize uint32) (uint32, uint32) {
+	switch msgType {
+	case TypeChoke, TypeUnchoke, TypeInterested, TypeNotInterested, TypeHaveAll, TypeHaveNone:
+		return 1, 1
+	case TypeHave, TypeSuggestPiece, TypeAllowedFast:
+		return 5, 5
+	case TypeRequest, TypeCancel, TypeRejectRequest:
+		return 13, 13
+	case TypePort:
+		return 3, 3
+	case TypePiece:
+		return 9, min(9+MaxBlockSize, maxSize)
+	case TypeExtended:
+		return 2, maxSize
+	default:
+		return 1, maxSize
+	}
+}
+
+// readFrame reads a length-prefixed message. The length is checked against maxSize and against
+// the bounds of the message type before the payload is allocated, so a peer can't make us
+// allocate more than maxSize bytes, nor send a fixed-size message with a bogus length.
+func readFrame(r io.Reader, maxSize uint32) (PeerMessage, error) {
+	var header [frameHeaderSize]byte
+	if _, err := io.ReadFull(r, header[:4]); err != nil {
+		return nil, fmt.Errorf("An error occurred while reading peer message: %w", err)
+	}
+
+	bodyLen := binary.BigEndian.Uint32(header[:4])
+	if bodyLen == 0 {
+		return peerMessage(header[:4:4]), nil
+	}
+	if bodyLen > maxSize {
+		return nil, fmt.Errorf("%w: %d bytes, the limit is %d", ErrMessageTooLarge, bodyLen, maxSize)
+	}
+
+	if _, err := io.ReadFull(r, header[4:]); err != nil {
+		return nil, fmt.Errorf("An error occurred while reading peer message: %w", eofAsUnexpected(err))
+	}
+
+	msgType := PeerMsgType(header[4])
+	minLen, maxLen := messageLengthBounds(msgType, maxSize)
+	if bodyLen < minLen {
+		return nil, fmt.Errorf("%w: %s message of %d bytes, expected at least %d", ErrMessageTooShort, msgType, bodyLen, minLen)
+	}
+	if bodyLen > maxLen {
+		return nil, fmt.Errorf("%w: %s message of %d bytes, expected at most %d", ErrMessageTooLarge, msgType, bodyLen, maxLen)
+	}
+
+	size := 4 + int(bodyLen)
+	var msg []byte
+	if msgType == TypePiece && size == pooledFrameSize {
+		msg = *framePool.Get().(*[]byte)
+	} else {
+		msg = make([]byte, size)
+	}
+
+	copy(msg, header[:])
+	if _, err := io.ReadFull(r, msg[frameHeaderSize:]); err != nil {
+		if msgType == TypePiece {
+			ReleaseMessage(peerMessage(msg))
+		}
+		return nil, fmt.Errorf("An error occurred while reading peer message: %w", eofAsUnexpected(err))
+	}
+
+	return peerMessage(msg), nil
+}
+
+// readHandshakeFrame reads a handshake: the protocol length, the protocol, 8 reserved bytes, the
+// info hash and the peer ID.
+func readHandshakeFrame(r io.Reader) (handshakeMessage, error) {
+	var pstrLen [1]byte
+	if _, err := io.ReadFull(r, pstrLen[:]); err != nil {
+		return nil, fmt.Errorf("Error while reading handshake message from reader: %w", err)
+	}
+	if pstrLen[0] == 0 {
+		return nil, errors.New("Error while reading handshake message from reader: empty protocol name")
+	}
+
+	msg := make([]byte, 1+int(pstrLen[0])+48)
+	msg[0] = pstrLen[0]
+	if _, err := io.ReadFull(r, msg[1:]); err != nil {
+		return nil, fmt.Errorf("Error while reading handshake message from reader: %w", eofAsUnexpected(err))
+	}
+
+	return handshakeMessage(msg), nil
+}
+
+// eofAsUnexpected reports a frame cut short by the end of the stream as io.ErrUnexpectedEOF.
+func eofAsUnexpected(err error) error {
+	if errors.Is(err, io.EOF) {
+		return io.ErrUnexpectedEOF
+	}
+	return err
+}
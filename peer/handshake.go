@@ -0,0 +1,132 @@
+package peer
+
+import (
+	"errors"
+	"fmt"
+)
+
+var (
+	ErrProtocolMismatch = errors.New("Handshake protocol mismatch")
+	ErrInfoHashMismatch = errors.New("Handshake info hash mismatch")
+	ErrPeerIDMismatch   = errors.New("Handshake peer ID mismatch")
+)
+
+// Capabilities are the protocol extensions advertised in the reserved bytes of a handshake.
+//
+// Reserved bits (bytes are numbered from 0, bits from the most significant):
+//
+//	Extension | Byte | Mask
+//	--------- | ---- | ----
+//	BEP 10    | 5    | 0x10  extension protocol
+//	BEP 52    | 7    | 0x10  upgrade to v2
+//	BEP 6     | 7    | 0x04  Fast extension
+//	BEP 5     | 7    | 0x01  DHT
+type Capabilities struct {
+	ExtensionProtocol bool
+	V2Upgrade         bool
+	Fast              bool
+	DHT               bool
+}
+
+type reservedBit struct {
+	byteIndex int
+	mask      byte
+}
+
+var (
+	bitExtensionProtocol = reservedBit{5, 0x10}
+	bitV2Upgrade         = reservedBit{7, 0x10}
+	bitFast              = reservedBit{7, 0x04}
+	bitDHT               = reservedBit{7, 0x01}
+)
+
+// ParseReserved reads the capabilities from the reserved bytes of a handshake. Unknown bits are
+// ignored.
+func ParseReserved(reserved [8]byte) Capabilities {
+	isSet := func(bit reservedBit) bool {
+		return reserved[bit.byteIndex]&bit.mask != 0
+	}
+
+	return Capabilities{
+		ExtensionProtocol: isSet(bitExtensionProtocol),
+		V2Upgrade:         isSet(bitV2Upgrade),
+		Fast:              isSet(bitFast),
+		DHT:               isSet(bitDHT),
+	}
+}
+
+// Reserved returns the reserved bytes advertising the capabilities.
+func (c Capabilities) Reserved() [8]byte {
+	var reserved [8]byte
+	set := func(bit reservedBit, enabled bool) {
+		if enabled {
+			reserved[bit.byteIndex] |= bit.mask
+		}
+	}
+
+	set(bitExtensionProtocol, c.ExtensionProtocol)
+	set(bitV2Upgrade, c.V2Upgrade)
+	set(bitFast, c.Fast)
+	set(bitDHT, c.DHT)
+	return reserved
+}
+
+// Intersect returns the capabilities supported by both sides, which are the ones that can be
+// used on a connection.
+func (c Capabilities) Intersect(other Capabilities) Capabilities {
+	return Capabilities{
+		ExtensionProtocol: c.ExtensionProtocol && other.ExtensionProtocol,
+		V2Upgrade:         c.V2Upgrade && other.V2Upgrade,
+		Fast:              c.Fast && other.Fast,
+		DHT:               c.DHT && other.DHT,
+	}
+}
+
+type HandshakeOptions struct {
+	PeerID   [20]byte
+	InfoHash [20]byte
+	// Protocol defaults to "BitTorrent protocol".
+	Protocol string
+	// Capabilities we advertise.
+	Capabilities Capabilities
+	// ExpectedPeerID, when set, is the peer ID the remote peer must send, e.g. the one a tracker
+	// returned with its address.
+	ExpectedPeerID *[20]byte
+}
+
+type HandshakeResult struct {
+	// Handshake is the handshake received from the remote peer.
+	Handshake HandshakeMessage
+	// RemoteCapabilities are the capabilities advertised by the remote peer.
+	RemoteCapabilities Capabilities
+	// Capabilities are the capabilities both sides advertised.
+	Capabilities Capabilities
+}
+
+// verifyHandshake checks a received handshake against the options of our own, and returns the
+// negotiated capabilities.
+func verifyHandshake(received HandshakeMessage, options HandshakeOptions) (HandshakeResult, error) {
+	protocol := options.Protocol
+	if protocol == "" {
+		protocol = defaultProtocolName
+	}
+
+	if received.Protocol() != protocol {
+		return HandshakeResult{}, fmt.Errorf("%w: expected '%s', got '%s'", ErrProtocolMismatch, protocol, received.Protocol())
+	}
+
+	if received.InfoHash() != options.InfoHash {
+		return HandshakeResult{}, fmt.Errorf("%w: expected %x, got %x", ErrInfoHashMismatch, options.InfoHash, received.InfoHash())
+	}
+
+	if options.ExpectedPeerID != nil && received.PeerID() != *options.ExpectedPeerID {
+		return HandshakeResult{}, fmt.Errorf("%w: expected %x, got %x", ErrPeerIDMismatch, *options.ExpectedPeerID, received.PeerID())
+	}
+
+	remote := received.Capabilities()
+	return HandshakeResult{
+		Handshake:          received,
+		RemoteCapabilities: remote,
+		Capabilities:       options.Capabilities.Intersect(remote),
+	}, nil
+}
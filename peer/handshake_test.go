@@ -0,0 +1,75 @@
+package peer
+
+import (
+	"io"
+	"log/slog"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestReservedBits(t *testing.T) {
+	capabilities := Capabilities{ExtensionProtocol: true, Fast: true, DHT: true}
+	assert.Equal(t, [8]byte{0, 0, 0, 0, 0, 0x10, 0, 0x05}, capabilities.Reserved())
+	assert.Equal(t, capabilities, ParseReserved(capabilities.Reserved()))
+
+	// Unknown bits are ignored.
+	assert.Equal(t, Capabilities{V2Upgrade: true}, ParseReserved([8]byte{0xff, 0, 0, 0, 0, 0x01, 0, 0x10}))
+
+	assert.Equal(t, Capabilities{Fast: true}, capabilities.Intersect(Capabilities{Fast: true, V2Upgrade: true}))
+}
+
+// negotiate runs Negotiate with local, against a peer answering with the handshake of remote.
+func negotiate(t *testing.T, local, remote HandshakeOptions) (HandshakeResult, error) {
+	conn, remoteEnd := newPipe(t)
+
+	go func() {
+		remoteConn := NewPeerWireConnection(remoteEnd, *slog.New(slog.NewTextHandler(io.Discard, nil)))
+		if _, err := remoteConn.ReadHandshake(); err == nil {
+			remoteConn.SendHandshake(remote)
+		}
+	}()
+
+	return conn.Negotiate(local)
+}
+
+func TestNegotiate(t *testing.T) {
+	localID, remoteID := [20]byte{'l'}, [20]byte{'r'}
+	infoHash := [20]byte{1}
+	local := HandshakeOptions{
+		PeerID:       localID,
+		InfoHash:     infoHash,
+		Capabilities: Capabilities{ExtensionProtocol: true, Fast: true, DHT: true},
+	}
+	remote := HandshakeOptions{
+		PeerID:       remoteID,
+		InfoHash:     infoHash,
+		Capabilities: Capabilities{ExtensionProtocol: true, V2Upgrade: true},
+	}
+
+	result, err := negotiate(t, local, remote)
+	assert.NoError(t, err)
+	assert.Equal(t, remoteID, result.Handshake.PeerID())
+	assert.Equal(t, remote.Capabilities, result.RemoteCapabilities)
+	assert.Equal(t, Capabilities{ExtensionProtocol: true}, result.Capabilities)
+
+	// The expected peer ID is checked when given.
+	local.ExpectedPeerID = &remoteID
+	_, err = negotiate(t, local, remote)
+	assert.NoError(t, err)
+
+	local.ExpectedPeerID = &[20]byte{'x'}
+	_, err = negotiate(t, local, remote)
+	assert.ErrorIs(t, err, ErrPeerIDMismatch)
+	local.ExpectedPeerID = nil
+
+	wrongTorrent := remote
+	wrongTorrent.InfoHash = [20]byte{2}
+	_, err = negotiate(t, local, wrongTorrent)
+	assert.ErrorIs(t, err, ErrInfoHashMismatch)
+
+	wrongProtocol := remote
+	wrongProtocol.Protocol = "Other protocol"
+	_, err = negotiate(t, local, wrongProtocol)
+	assert.ErrorIs(t, err, ErrProtocolMismatch)
+}
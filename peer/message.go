@@ -0,0 +1,294 @@
+package peer
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+)
+
+var (
+	// ErrInvalidMessage is returned when the payload of a message doesn't have the length its type
+	// requires.
+	ErrInvalidMessage = errors.New("Invalid peer message")
+	// ErrUnknownMessage is returned for message IDs we don't support.
+	ErrUnknownMessage = errors.New("Unknown peer message")
+)
+
+// TypedMessage is a decoded peer message. Each message type has its own struct, returned by
+// DecodeMessage; Message encodes it back to the wire format.
+type TypedMessage interface {
+	Type() PeerMsgType
+	Message() PeerMessage
+}
+
+type KeepAlive struct{}
+
+type Choke struct{}
+
+type Unchoke struct{}
+
+type Interested struct{}
+
+type NotInterested struct{}
+
+// HaveAll and HaveNone replace the bitfield of a seed, or of a peer with no piece (BEP 6).
+type HaveAll struct{}
+
+type HaveNone struct{}
+
+// Have: [ index (4 bytes) ]
+type Have struct {
+	Index uint32
+}
+
+// Bitfield: [ bitfield (variable) ], the high bit of the first byte being piece 0.
+type Bitfield struct {
+	Bits []byte
+}
+
+// Request: [ index (4 bytes) ][ begin (4 bytes) ][ length (4 bytes) ]
+type Request struct {
+	Index  uint32
+	Begin  uint32
+	Length uint32
+}
+
+// Piece: [ index (4 bytes) ][ begin (4 bytes) ][ block (variable) ]
+type Piece struct {
+	Index uint32
+	Begin uint32
+	Block []byte
+}
+
+// Cancel has the same layout as Request.
+type Cancel struct {
+	Index  uint32
+	Begin  uint32
+	Length uint32
+}
+
+// Port: [ DHT listen port (2 bytes) ]
+type Port struct {
+	Port uint16
+}
+
+// SuggestPiece: [ index (4 bytes) ], a piece the sender would like us to download (BEP 6).
+type SuggestPiece struct {
+	Index uint32
+}
+
+// RejectRequest has the same layout as Request. It tells that a request won't be served
+// (BEP 6).
+type RejectRequest struct {
+	Index  uint32
+	Begin  uint32
+	Length uint32
+}
+
+// AllowedFast: [ index (4 bytes) ], a piece the sender serves even while choking us (BEP 6).
+type AllowedFast struct {
+	Index uint32
+}
+
+// Extended: [ extended message ID (1 byte) ][ data (variable) ]
+type Extended struct {
+	ID   uint8
+	Data []byte
+}
+
+func (KeepAlive) Type() PeerMsgType     { return TypeKeepAlive }
+func (Choke) Type() PeerMsgType         { return TypeChoke }
+func (Unchoke) Type() PeerMsgType       { return TypeUnchoke }
+func (Interested) Type() PeerMsgType    { return TypeInterested }
+func (NotInterested) Type() PeerMsgType { return TypeNotInterested }
+func (HaveAll) Type() PeerMsgType       { return TypeHaveAll }
+func (HaveNone) Type() PeerMsgType      { return TypeHaveNone }
+func (Have) Type() PeerMsgType          { return TypeHave }
+func (Bitfield) Type() PeerMsgType      { return TypeBitfield }
+func (Request) Type() PeerMsgType       { return TypeRequest }
+func (Piece) Type() PeerMsgType         { return TypePiece }
+func (Cancel) Type() PeerMsgType        { return TypeCancel }
+func (Port) Type() PeerMsgType          { return TypePort }
+func (SuggestPiece) Type() PeerMsgType  { return TypeSuggestPiece }
+func (RejectRequest) Type() PeerMsgType { return TypeRejectRequest }
+func (AllowedFast) Type() PeerMsgType   { return TypeAllowedFast }
+func (Extended) Type() PeerMsgType      { return TypeExtended }
+
+func (KeepAlive) Message() PeerMessage      { return CreateKeepAliveMessage() }
+func (Choke) Message() PeerMessage          { return CreateChokeMessage() }
+func (Unchoke) Message() PeerMessage        { return CreateUnchokeMessage() }
+func (Interested) Message() PeerMessage     { return CreateInterestedMessage() }
+func (NotInterested) Message() PeerMessage  { return CreateNotInterestedMessage() }
+func (HaveAll) Message() PeerMessage        { return CreateHaveAllMessage() }
+func (HaveNone) Message() PeerMessage       { return CreateHaveNoneMessage() }
+func (m Have) Message() PeerMessage         { return CreateHaveMessage(int(m.Index)) }
+func (m Bitfield) Message() PeerMessage     { return CreateBitfieldMessage(m.Bits) }
+func (m Piece) Message() PeerMessage        { return CreatePieceMessage(m.Index, m.Begin, m.Block) }
+func (m Port) Message() PeerMessage         { return CreatePortMessage(m.Port) }
+func (m SuggestPiece) Message() PeerMessage { return CreateSuggestPieceMessage(m.Index) }
+func (m AllowedFast) Message() PeerMessage  { return CreateAllowedFastMessage(m.Index) }
+func (m Extended) Message() PeerMessage     { return CreateExtendedMessage(m.ID, m.Data) }
+
+func (m Request) Message() PeerMessage {
+	return CreateRequestMessage(int(m.Index), int(m.Begin), int(m.Length))
+}
+
+func (m Cancel) Message() PeerMessage {
+	return CreateCancelMessage(m.Index, m.Begin, m.Length)
+}
+
+func (m RejectRequest) Message() PeerMessage {
+	return CreateRejectRequestMessage(m.Index, m.Begin, m.Length)
+}
+
+// DecodeMessage decodes a message read from a peer into its typed struct. Messages whose payload
+// has the wrong length for their type return ErrInvalidMessage, unsupported IDs return
+// ErrUnknownMessage. Variable-length fields (bitfield, block, extended data) alias msg.
+func DecodeMessage(msg PeerMessage) (TypedMessage, error) {
+	raw := msg.Raw()
+	if len(raw) < 4 || int(binary.BigEndian.Uint32(raw[:4])) != len(raw)-4 {
+		return nil, fmt.Errorf("%w: length prefix doesn't match the message size", ErrInvalidMessage)
+	}
+	if len(raw) == 4 {
+		return KeepAlive{}, nil
+	}
+
+	msgType := PeerMsgType(raw[4])
+	payload := raw[5:]
+
+	expectLength := func(length int) error {
+		if len(payload) != length {
+			return fmt.Errorf("%w: %s payload is %d bytes, expected %d", ErrInvalidMessage, msgType, len(payload), length)
+		}
+		return nil
+	}
+
+	switch msgType {
+	case TypeChoke, TypeUnchoke, TypeInterested, TypeNotInterested, TypeHaveAll, TypeHaveNone:
+		if err := expectLength(0); err != nil {
+			return nil, err
+		}
+		switch msgType {
+		case TypeChoke:
+			return Choke{}, nil
+		case TypeUnchoke:
+			return Unchoke{}, nil
+		case TypeInterested:
+			return Interested{}, nil
+		case TypeNotInterested:
+			return NotInterested{}, nil
+		case TypeHaveAll:
+			return HaveAll{}, nil
+		default:
+			return HaveNone{}, nil
+		}
+
+	case TypeHave, TypeSuggestPiece, TypeAllowedFast:
+		if err := expectLength(4); err != nil {
+			return nil, err
+		}
+		index := binary.BigEndian.Uint32(payload)
+		switch msgType {
+		case TypeHave:
+			return Have{Index: index}, nil
+		case TypeSuggestPiece:
+			return SuggestPiece{Index: index}, nil
+		default:
+			return AllowedFast{Index: index}, nil
+		}
+
+	case TypeBitfield:
+		return Bitfield{Bits: payload}, nil
+
+	case TypeRequest, TypeCancel, TypeRejectRequest:
+		if err := expectLength(12); err != nil {
+			return nil, err
+		}
+		index := binary.BigEndian.Uint32(payload[0:4])
+		begin := binary.BigEndian.Uint32(payload[4:8])
+		length := binary.BigEndian.Uint32(payload[8:12])
+		switch msgType {
+		case TypeRequest:
+			return Request{Index: index, Begin: begin, Length: length}, nil
+		case TypeCancel:
+			return Cancel{Index: index, Begin: begin, Length: length}, nil
+		default:
+			return RejectRequest{Index: index, Begin: begin, Length: length}, nil
+		}
+
+	case TypePiece:
+		if len(payload) < 8 {
+			return nil, fmt.Errorf("%w: Piece payload is %d bytes, expected at least 8", ErrInvalidMessage, len(payload))
+		}
+		return Piece{
+			Index: binary.BigEndian.Uint32(payload[0:4]),
+			Begin: binary.BigEndian.Uint32(payload[4:8]),
+			Block: payload[8:],
+		}, nil
+
+	case TypePort:
+		if err := expectLength(2); err != nil {
+			return nil, err
+		}
+		return Port{Port: binary.BigEndian.Uint16(payload)}, nil
+
+	case TypeExtended:
+		if len(payload) < 1 {
+			return nil, fmt.Errorf("%w: Extended payload is empty", ErrInvalidMessage)
+		}
+		return Extended{ID: payload[0], Data: payload[1:]}, nil
+
+	default:
+		return nil, fmt.Errorf("%w: ID %d", ErrUnknownMessage, uint8(msgType))
+	}
+}
+
+func CreateKeepAliveMessage() PeerMessage {
+	return peerMessage(make([]byte, 4))
+}
+
+func CreateBitfieldMessage(bits []byte) PeerMessage {
+	return createPeerMessage(TypeBitfield, append(MessagePayload{}, bits...))
+}
+
+func CreatePieceMessage(index uint32, begin uint32, block []byte) PeerMessage {
+	msgPayload := make(MessagePayload, 8+len(block))
+	binary.BigEndian.PutUint32(msgPayload[:4], index)
+	binary.BigEndian.PutUint32(msgPayload[4:8], begin)
+	copy(msgPayload[8:], block)
+	return createPeerMessage(TypePiece, msgPayload)
+}
+
+func CreateCancelMessage(index uint32, begin uint32, length uint32) PeerMessage {
+	msgPayload := make(MessagePayload, 12)
+	binary.BigEndian.PutUint32(msgPayload[:4], index)
+	binary.BigEndian.PutUint32(msgPayload[4:8], begin)
+	binary.BigEndian.PutUint32(msgPayload[8:12], length)
+	return createPeerMessage(TypeCancel, msgPayload)
+}
+
+func CreateHaveAllMessage() PeerMessage {
+	return createPeerMessage(TypeHaveAll, nil)
+}
+
+func CreateSuggestPieceMessage(index uint32) PeerMessage {
+	return createPeerMessage(TypeSuggestPiece, binary.BigEndian.AppendUint32(nil, index))
+}
+
+func CreateRejectRequestMessage(index uint32, begin uint32, length uint32) PeerMessage {
+	msgPayload := make(MessagePayload, 12)
+	binary.BigEndian.PutUint32(msgPayload[:4], index)
+	binary.BigEndian.PutUint32(msgPayload[4:8], begin)
+	binary.BigEndian.PutUint32(msgPayload[8:12], length)
+	return createPeerMessage(TypeRejectRequest, msgPayload)
+}
+
+func CreateAllowedFastMessage(index uint32) PeerMessage {
+	return createPeerMessage(TypeAllowedFast, binary.BigEndian.AppendUint32(nil, index))
+}
+
+func CreatePortMessage(port uint16) PeerMessage {
+	msgPayload := make(MessagePayload, 2)
+	binary.BigEndian.PutUint16(msgPayload, port)
+	return createPeerMessage(TypePort, msgPayload)
+}
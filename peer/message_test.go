@@ -0,0 +1,69 @@
+package peer
+
+import (
+	"encoding/binary"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestDecodeMessageRoundTrip(t *testing.T) {
+	for _, msg := range []TypedMessage{
+		KeepAlive{},
+		Choke{},
+		Unchoke{},
+		Interested{},
+		NotInterested{},
+		HaveAll{},
+		HaveNone{},
+		Have{Index: 42},
+		Bitfield{Bits: []byte{0xff, 0x80}},
+		Request{Index: 1, Begin: 16384, Length: 16384},
+		Piece{Index: 1, Begin: 16384, Block: []byte("block")},
+		Cancel{Index: 1, Begin: 16384, Length: 16384},
+		Port{Port: 6881},
+		SuggestPiece{Index: 3},
+		RejectRequest{Index: 1, Begin: 0, Length: 16384},
+		AllowedFast{Index: 7},
+		Extended{ID: 1, Data: []byte("d1:ai1ee")},
+	} {
+		encoded := msg.Message()
+		assert.Equal(t, msg.Type(), encoded.Type(), msg.Type().String())
+
+		decoded, err := DecodeMessage(encoded)
+		assert.NoError(t, err, msg.Type().String())
+		assert.Equal(t, msg, decoded, msg.Type().String())
+	}
+}
+
+func TestDecodeMessageRejectsGarbage(t *testing.T) {
+	raw := func(id PeerMsgType, payload ...byte) PeerMessage {
+		msg := binary.BigEndian.AppendUint32(nil, uint32(1+len(payload)))
+		return peerMessage(append(append(msg, byte(id)), payload...))
+	}
+
+	for name, msg := range map[string]PeerMessage{
+		"choke with payload": raw(TypeChoke, 0x00),
+		"short have":         raw(TypeHave, 0x00, 0x01),
+		"long have":          raw(TypeHave, 0, 0, 0, 1, 2),
+		"short request":      raw(TypeRequest, make([]byte, 11)...),
+		"long cancel":        raw(TypeCancel, make([]byte, 13)...),
+		"short piece":        raw(TypePiece, make([]byte, 7)...),
+		"short port":         raw(TypePort, 0x1a),
+		"have all payload":   raw(TypeHaveAll, 0x00),
+		"short suggest":      raw(TypeSuggestPiece, 0x00),
+		"short reject":       raw(TypeRejectRequest, make([]byte, 8)...),
+		"long allowed fast":  raw(TypeAllowedFast, make([]byte, 5)...),
+		"empty extended":     raw(TypeExtended),
+		"bad length prefix":  peerMessage{0, 0, 0, 9, byte(TypeChoke)},
+	} {
+		_, err := DecodeMessage(msg)
+		assert.ErrorIs(t, err, ErrInvalidMessage, name)
+	}
+
+	_, err := DecodeMessage(raw(PeerMsgType(99)))
+	assert.ErrorIs(t, err, ErrUnknownMessage)
+
+	_, err = AsPeerMessage([]byte{0, 0, 0, 9, byte(TypeHave), 0})
+	assert.Error(t, err)
+}
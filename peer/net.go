@@ -2,12 +2,10 @@ package peer
 
 import (
 	"bufio"
-	"encoding/binary"
 	"fmt"
 	"io"
 	"log/slog"
 	"net"
-	"reflect"
 	"time"
 )
 
@@ -19,7 +17,19 @@ const (
 type PeerWireConnection interface {
 	SendPeerMessages(messages []PeerMessage) error
 	ReadPeerMessage() (PeerMessage, error)
+	// SetMaxMessageSize bounds the length of the messages read from the peer. Defaults to
+	// DefaultMaxMessageSize.
+	SetMaxMessageSize(size uint32)
+	// Handshake exchanges handshakes without advertising any capability.
 	Handshake(peerID [20]byte, protocolName string, infoHash [20]byte) (HandshakeMessage, error)
+	// Negotiate sends our handshake, reads the remote one and verifies it: the protocol and the
+	// info hash must match ours, and the peer ID the expected one if any.
+	Negotiate(options HandshakeOptions) (HandshakeResult, error)
+	// SendHandshake and ReadHandshake are the two halves of Negotiate. Incoming connections read
+	// the remote handshake first, to learn which torrent they are for, then answer with ours.
+	SendHandshake(options HandshakeOptions) error
+	ReadHandshake() (HandshakeMessage, error)
+	RemoteAddr() net.Addr
 	io.Closer
 }
 
@@ -31,6 +41,8 @@ type peerWireConnection struct {
 	connWriter   *bufio.Writer
 	readTimeout  int
 	writeTimeout int
+	// maxMessageSize bounds the length prefix of incoming messages.
+	maxMessageSize uint32
 }
 
 func CreatePeerWireConnection(
@@ -43,19 +55,25 @@ func CreatePeerWireConnection(
 		return nil, fmt.Errorf("Error while initiating peer wire connection: %w", err)
 	}
 
+	return NewPeerWireConnection(conn, logger), nil
+}
+
+// NewPeerWireConnection wraps an established connection, like one accepted by a listener.
+func NewPeerWireConnection(conn net.Conn, logger slog.Logger) PeerWireConnection {
 	logger = *logger.With(
 		"local_addr", conn.LocalAddr().String(),
 		"remote_addr", conn.RemoteAddr().String(),
 	)
 
 	c := peerWireConnection{
-		logger:     logger,
-		conn:       conn,
-		connReader: bufio.NewReader(conn),
-		connWriter: bufio.NewWriter(conn),
+		logger:         logger,
+		conn:           conn,
+		connReader:     bufio.NewReader(conn),
+		connWriter:     bufio.NewWriter(conn),
+		maxMessageSize: DefaultMaxMessageSize,
 	}
 
-	return &c, nil
+	return &c
 }
 
 func (c *peerWireConnection) SetReadTimeout(readTimeout int) {
@@ -66,6 +84,14 @@ func (c *peerWireConnection) SetReadTimeout(readTimeout int) {
 	}
 }
 
+func (c *peerWireConnection) SetMaxMessageSize(size uint32) {
+	if size == 0 {
+		c.maxMessageSize = DefaultMaxMessageSize
+	} else {
+		c.maxMessageSize = size
+	}
+}
+
 func (c *peerWireConnection) SetWriteTimeout(writeTimeout int) {
 	if writeTimeout < 0 {
 		c.writeTimeout = defaultWriteTimeout
@@ -79,65 +105,73 @@ func (c *peerWireConnection) Handshake(
 	protocolName string,
 	infoHash [20]byte,
 ) (HandshakeMessage, error) {
-	if len(peerID) != 20 {
-		return nil, fmt.Errorf("peerID's length must be exactly 20.")
+	result, err := c.Negotiate(HandshakeOptions{PeerID: peerID, InfoHash: infoHash, Protocol: protocolName})
+	if err != nil {
+		return nil, err
 	}
+	return result.Handshake, nil
+}
 
-	rAddr := c.conn.RemoteAddr().String()
+func (c *peerWireConnection) Negotiate(options HandshakeOptions) (HandshakeResult, error) {
+	if err := c.SendHandshake(options); err != nil {
+		return HandshakeResult{}, fmt.Errorf("Error while initiating peer wire connection: %w", err)
+	}
 
-	// handshaking
-	handshakeMsg, err := createHandshakeMessage(protocolName, infoHash, peerID)
+	received, err := c.ReadHandshake()
 	if err != nil {
-		return nil, fmt.Errorf("Error while initiating peer wire connection: %w", err)
+		return HandshakeResult{}, fmt.Errorf("Error while initiating peer wire connection: %w", err)
 	}
 
-	n, err := c.connWriter.Write(handshakeMsg)
-	err = c.connWriter.Flush()
+	result, err := verifyHandshake(received, options)
 	if err != nil {
-		return nil, fmt.Errorf("Error while initiating peer wire connection: %w", err)
+		return HandshakeResult{}, fmt.Errorf("Error while initiating peer wire connection: %w", err)
 	}
-	c.logger.Debug("Sent handshake message", "raw_msg", fmt.Sprintf("% x", handshakeMsg), "bytes_sent_count", n)
 
-	recvHandshakeMsg, err := c.readHandshakeMessage()
+	c.logger.Debug("Handshake completed", "capabilities", fmt.Sprintf("%+v", result.Capabilities))
+	return result, nil
+}
+
+func (c *peerWireConnection) SendHandshake(options HandshakeOptions) error {
+	handshakeMsg, err := createHandshakeMessage(options.Protocol, options.Capabilities.Reserved(), options.InfoHash, options.PeerID)
 	if err != nil {
-		return nil, fmt.Errorf("Error while initiating peer wire connection: %w", err)
+		return fmt.Errorf("Error while sending handshake: %w", err)
 	}
 
-	// check if the received handshake message is valid
-	if !reflect.DeepEqual(recvHandshakeMsg.Protocol(), handshakeMsg.Protocol()) {
-		return nil, fmt.Errorf(
-			"The received handshake's protocol field don't match with that of the sent one. Expect: '%s', but got: '%s'.",
-			string(handshakeMsg.Protocol()),
-			string(recvHandshakeMsg.Protocol()),
-		)
+	if err := c.writeHandshakeMessage(handshakeMsg); err != nil {
+		return fmt.Errorf("Error while sending handshake: %w", err)
 	}
+	return nil
+}
 
-	// check if the received handshake message is valid
-	if !reflect.DeepEqual(recvHandshakeMsg.Protocol(), handshakeMsg.Protocol()) {
-		return nil, fmt.Errorf("Info hash field of received handshake and the sent handshake don't match.")
+func (c *peerWireConnection) ReadHandshake() (HandshakeMessage, error) {
+	msg, err := c.readHandshakeMessage()
+	if err != nil {
+		return nil, err
 	}
-	c.logger.Debug("Handshake message", "remote_addr", rAddr, "raw_msg", fmt.Sprintf("% x", recvHandshakeMsg))
-	return recvHandshakeMsg, nil
+	c.logger.Debug("Received handshake message", "raw_msg", fmt.Sprintf("% x", msg))
+	return msg, nil
 }
 
-// readHandshakeMessage tries reading raw representation (slice) of the handshake message. if the format
-// is invalid, return an error.
-// The input can contains a handshake followed with multiple peer messages. In this case, the
-// function only returns the representation of the handshake message only.
-func (c *peerWireConnection) readHandshakeMessage() (handshakeMessage, error) {
-	r := c.connReader
+func (c *peerWireConnection) RemoteAddr() net.Addr {
+	return c.conn.RemoteAddr()
+}
 
-	pstrLen, err := r.ReadByte()
+func (c *peerWireConnection) writeHandshakeMessage(msg handshakeMessage) error {
+	n, err := c.connWriter.Write(msg)
+	if err == nil {
+		err = c.connWriter.Flush()
+	}
 	if err != nil {
-		return nil, fmt.Errorf("Error while reading handshake message from reader: %w", err)
+		return err
 	}
+	c.logger.Debug("Sent handshake message", "raw_msg", fmt.Sprintf("% x", msg), "bytes_sent_count", n)
+	return nil
+}
 
-	size := 1 + int(pstrLen) + 48
-	msg := make([]byte, size)
-	msg[0] = pstrLen
-	io.ReadFull(r, msg[1:1+pstrLen+48])
-
-	return handshakeMessage(msg), nil
+// readHandshakeMessage reads the handshake message of the remote peer. The input can contain a
+// handshake followed by peer messages; only the handshake is consumed.
+func (c *peerWireConnection) readHandshakeMessage() (handshakeMessage, error) {
+	return readHandshakeFrame(c.connReader)
 }
 
 // SendMessages sends a list of messages to the peer over a connection-oriented protocol.
@@ -172,10 +206,9 @@ func (c *peerWireConnection) ReadPeerMessage() (PeerMessage, error) {
 	return peerMsg, nil
 }
 
+// Close closes the connection. It may be called while another goroutine is blocked reading or
+// writing, which then fails.
 func (c *peerWireConnection) Close() error {
-	c.connReader = nil
-	c.connWriter = nil
-
 	err := c.conn.Close()
 	if err != nil {
 		return fmt.Errorf("Error while closing the client: %w", err)
@@ -186,26 +219,5 @@ func (c *peerWireConnection) Close() error {
 }
 
 func (c *peerWireConnection) readPeerMessage() (PeerMessage, error) {
-	r := c.connReader
-
-	// read message length
-	prefLenBytes := make([]byte, 4)
-	_, err := io.ReadFull(r, prefLenBytes)
-
-	if err != nil {
-		return nil, fmt.Errorf("An error occurred while reading peer message: %w", err)
-	}
-
-	bodyLen := binary.BigEndian.Uint32(prefLenBytes)
-
-	// 'unmarshal' data to a message instance
-	msg := make([]byte, 4+bodyLen)
-	copy(msg[:4], prefLenBytes)
-	_, err = io.ReadFull(r, msg[4:])
-
-	if err != nil {
-		return nil, fmt.Errorf("An error occurred while reading peer message: %w", err)
-	}
-
-	return peerMessage(msg), nil
+	return readFrame(c.connReader, c.maxMessageSize)
 }
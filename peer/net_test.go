@@ -0,0 +1,151 @@
+package peer
+
+import (
+	"encoding/binary"
+	"io"
+	"log/slog"
+	"net"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// newPipe returns a connection reading what is written to the other end of a net.Pipe.
+func newPipe(t *testing.T) (PeerWireConnection, net.Conn) {
+	local, remote := net.Pipe()
+	t.Cleanup(func() {
+		local.Close()
+		remote.Close()
+	})
+	return NewPeerWireConnection(local, *slog.New(slog.NewTextHandler(io.Discard, nil))), remote
+}
+
+// send writes raw to the remote end, then closes it so that reads past the end fail.
+func send(remote net.Conn, raw ...[]byte) {
+	go func() {
+		for _, chunk := range raw {
+			if _, err := remote.Write(chunk); err != nil {
+				return
+			}
+		}
+		remote.Close()
+	}()
+}
+
+func frame(length uint32, body ...byte) []byte {
+	return append(binary.BigEndian.AppendUint32(nil, length), body...)
+}
+
+func TestReadPeerMessage(t *testing.T) {
+	conn, remote := newPipe(t)
+	send(remote, CreateKeepAliveMessage().Raw(), CreateHaveMessage(7).Raw(),
+		CreatePieceMessage(1, 0, make([]byte, StandardBlockSize)).Raw())
+
+	msg, err := conn.ReadPeerMessage()
+	assert.NoError(t, err)
+	assert.Equal(t, TypeKeepAlive, msg.Type())
+
+	msg, err = conn.ReadPeerMessage()
+	assert.NoError(t, err)
+	assert.Equal(t, uint32(7), HaveMessagePayload(msg.Payload()).Index())
+
+	msg, err = conn.ReadPeerMessage()
+	assert.NoError(t, err)
+	assert.Len(t, PieceMessagePayload(msg.Payload()).Piece(), int(StandardBlockSize))
+	ReleaseMessage(msg)
+
+	_, err = conn.ReadPeerMessage()
+	assert.ErrorIs(t, err, io.EOF)
+}
+
+func TestReadPeerMessageTruncated(t *testing.T) {
+	for name, raw := range map[string][]byte{
+		"length prefix": {0, 0},
+		"message ID":    frame(5),
+		"payload":       frame(5, byte(TypeHave), 0, 0),
+		"piece block":   frame(9+StandardBlockSize, append([]byte{byte(TypePiece)}, make([]byte, 100)...)...),
+	} {
+		conn, remote := newPipe(t)
+		send(remote, raw)
+
+		_, err := conn.ReadPeerMessage()
+		assert.ErrorIs(t, err, io.ErrUnexpectedEOF, name)
+	}
+}
+
+func TestReadPeerMessageOversized(t *testing.T) {
+	for name, tc := range map[string]struct {
+		raw []byte
+		err error
+	}{
+		"4 GiB":            {frame(0xffffffff, byte(TypeBitfield)), ErrMessageTooLarge},
+		"over the limit":   {frame(DefaultMaxMessageSize+1, byte(TypeExtended)), ErrMessageTooLarge},
+		"piece over block": {frame(9+MaxBlockSize+1, byte(TypePiece)), ErrMessageTooLarge},
+		"long have":        {frame(100, byte(TypeHave)), ErrMessageTooLarge},
+		"long choke":       {frame(2, byte(TypeChoke)), ErrMessageTooLarge},
+		"short request":    {frame(5, byte(TypeRequest)), ErrMessageTooShort},
+		"short piece":      {frame(8, byte(TypePiece)), ErrMessageTooShort},
+	} {
+		conn, remote := newPipe(t)
+		send(remote, tc.raw)
+
+		_, err := conn.ReadPeerMessage()
+		assert.ErrorIs(t, err, tc.err, name)
+	}
+
+	// The limit is configurable.
+	conn, remote := newPipe(t)
+	conn.SetMaxMessageSize(64)
+	send(remote, CreateBitfieldMessage(make([]byte, 63)).Raw(), CreateBitfieldMessage(make([]byte, 64)).Raw())
+
+	_, err := conn.ReadPeerMessage()
+	assert.NoError(t, err)
+	_, err = conn.ReadPeerMessage()
+	assert.ErrorIs(t, err, ErrMessageTooLarge)
+}
+
+func TestReadHandshakeTruncated(t *testing.T) {
+	handshake, _ := createHandshakeMessage("", [8]byte{}, [20]byte{1}, [20]byte{2})
+
+	conn, remote := newPipe(t)
+	send(remote, handshake)
+	received, err := conn.ReadHandshake()
+	assert.NoError(t, err)
+	assert.Equal(t, [20]byte{1}, received.InfoHash())
+	assert.Equal(t, [20]byte{2}, received.PeerID())
+
+	for name, raw := range map[string][]byte{
+		"empty":      {},
+		"no pstr":    {0},
+		"truncated":  handshake[:40],
+		"no peer ID": handshake[:48],
+	} {
+		conn, remote := newPipe(t)
+		send(remote, raw)
+
+		_, err := conn.ReadHandshake()
+		assert.Error(t, err, name)
+	}
+}
+
+func TestPieceBuffersArePooled(t *testing.T) {
+	msg := CreatePieceMessage(0, 0, make([]byte, StandardBlockSize))
+	ReleaseMessage(msg)
+
+	// Pooled buffers are reused whole: a released message may hold stale data, but a pooled read
+	// overwrites all of it.
+	conn, remote := newPipe(t)
+	block := make([]byte, StandardBlockSize)
+	block[0], block[len(block)-1] = 0xaa, 0xbb
+	send(remote, CreatePieceMessage(3, 16384, block).Raw())
+
+	received, err := conn.ReadPeerMessage()
+	assert.NoError(t, err)
+	decoded, err := DecodeMessage(received)
+	assert.NoError(t, err)
+	assert.Equal(t, Piece{Index: 3, Begin: 16384, Block: block}, decoded)
+	ReleaseMessage(received)
+
+	// Other messages are left alone.
+	ReleaseMessage(CreateHaveMessage(1))
+}
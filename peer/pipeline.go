@@ -0,0 +1,305 @@
+package peer
+
+import (
+	"math"
+	"sync"
+	"time"
+)
+
+const (
+	defaultInitialPipelineDepth = 4
+	defaultMaxPipelineDepth     = 250
+	// Requests in flight longer than this are timed out, unless the round-trip time calls for
+	// more.
+	defaultMinRequestTimeout = 10 * time.Second
+	// The download rate is sampled over a few round-trip times, within these bounds.
+	minRateSampleInterval = 100 * time.Millisecond
+	maxRateSampleInterval = time.Second
+	// The minimum round-trip time is forgotten after this long, so that the estimate follows
+	// route changes.
+	minRTTWindow = 30 * time.Second
+)
+
+// BlockRequester sends the requests of a pipeline. It's implemented by Session.
+type BlockRequester interface {
+	Request(request Request) error
+	Cancel(request Request) error
+}
+
+type PipelineConfig struct {
+	// InitialDepth is the number of requests in flight before the download rate is known.
+	// Defaults to 4.
+	InitialDepth int
+	// MaxDepth bounds the number of requests in flight. Defaults to 250; SetPeerQueueLimit lowers
+	// it to the reqq of the peer.
+	MaxDepth int
+	// MinRequestTimeout is the minimum time after which a request is given up. Defaults to 10
+	// seconds; it grows with the round-trip time of slow peers.
+	MinRequestTimeout time.Duration
+	// Now returns the current time. Defaults to time.Now.
+	Now func() time.Time
+}
+
+// Pipeline keeps several block requests in flight on a peer connection, so that the link stays
+// busy while requests and blocks travel. Its depth follows the bandwidth-delay product of the
+// connection: the measured download rate times the round-trip time, in blocks, with headroom to
+// grow when the depth is what limits the rate.
+//
+// The round-trip time used for the depth is the minimum observed: the time of a single request
+// grows with the number of requests queued before it, and using it would make the depth grow
+// without end.
+type Pipeline struct {
+	requester BlockRequester
+	config    PipelineConfig
+	now       func() time.Time
+
+	mu       sync.Mutex
+	inFlight map[Request]time.Time
+	depth    int
+	maxDepth int
+
+	// srtt is the smoothed round-trip time of the requests, used for timeouts.
+	srtt time.Duration
+	// minRTT is the smallest round-trip time sampled since minRTTAt.
+	minRTT   time.Duration
+	minRTTAt time.Time
+
+	// rate is the smoothed download rate in bytes per second, 0 until the first sample.
+	rate        float64
+	sampleStart time.Time
+	sampleBytes int
+}
+
+func NewPipeline(requester BlockRequester, config PipelineConfig) *Pipeline {
+	if config.InitialDepth <= 0 {
+		config.InitialDepth = defaultInitialPipelineDepth
+	}
+	if config.MaxDepth <= 0 {
+		config.MaxDepth = defaultMaxPipelineDepth
+	}
+	if config.MinRequestTimeout <= 0 {
+		config.MinRequestTimeout = defaultMinRequestTimeout
+	}
+	if config.Now == nil {
+		config.Now = time.Now
+	}
+
+	return &Pipeline{
+		requester: requester,
+		config:    config,
+		now:       config.Now,
+		inFlight:  make(map[Request]time.Time),
+		depth:     min(config.InitialDepth, config.MaxDepth),
+		maxDepth:  config.MaxDepth,
+	}
+}
+
+// SetPeerQueueLimit bounds the depth by the number of outstanding requests the peer accepts, the
+// reqq of its extension handshake.
+func (p *Pipeline) SetPeerQueueLimit(reqq int) {
+	if reqq <= 0 {
+		return
+	}
+
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.maxDepth = min(p.config.MaxDepth, reqq)
+	p.depth = min(p.depth, p.maxDepth)
+}
+
+// Depth returns the number of requests the pipeline keeps in flight.
+func (p *Pipeline) Depth() int {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return p.depth
+}
+
+// InFlight returns the number of requests in flight.
+func (p *Pipeline) InFlight() int {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return len(p.inFlight)
+}
+
+// Pending reports whether a request is in flight.
+func (p *Pipeline) Pending(request Request) bool {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	_, ok := p.inFlight[request]
+	return ok
+}
+
+// Fill sends requests until the pipeline is full. next returns the block to request, or false
+// when there is nothing left to request from the peer. It returns the number of requests sent.
+func (p *Pipeline) Fill(next func() (Request, bool)) (int, error) {
+	sent := 0
+	for {
+		p.mu.Lock()
+		full := len(p.inFlight) >= p.depth
+		p.mu.Unlock()
+		if full {
+			return sent, nil
+		}
+
+		request, ok := next()
+		if !ok {
+			return sent, nil
+		}
+
+		p.mu.Lock()
+		if _, ok := p.inFlight[request]; ok {
+			p.mu.Unlock()
+			continue
+		}
+		now := p.now()
+		p.inFlight[request] = now
+		if p.sampleStart.IsZero() {
+			p.sampleStart = now
+		}
+		p.mu.Unlock()
+
+		if err := p.requester.Request(request); err != nil {
+			p.mu.Lock()
+			delete(p.inFlight, request)
+			p.mu.Unlock()
+			return sent, err
+		}
+		sent++
+	}
+}
+
+// Received records a block received from the peer, and adapts the depth. It returns false if the
+// block wasn't requested through the pipeline, or was canceled.
+func (p *Pipeline) Received(block Piece) bool {
+	request := Request{Index: block.Index, Begin: block.Begin, Length: uint32(len(block.Block))}
+
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	sentAt, ok := p.inFlight[request]
+	if !ok {
+		return false
+	}
+	delete(p.inFlight, request)
+
+	now := p.now()
+	p.sampleRTT(now, now.Sub(sentAt))
+	p.sampleRate(now, len(block.Block))
+	p.adapt()
+	return true
+}
+
+func (p *Pipeline) sampleRTT(now time.Time, rtt time.Duration) {
+	if p.srtt == 0 {
+		p.srtt = rtt
+	} else {
+		// Same smoothing as TCP (RFC 6298).
+		p.srtt = (7*p.srtt + rtt) / 8
+	}
+
+	if p.minRTT == 0 || rtt < p.minRTT || now.Sub(p.minRTTAt) > minRTTWindow {
+		p.minRTT = rtt
+		p.minRTTAt = now
+	}
+}
+
+func (p *Pipeline) sampleRate(now time.Time, n int) {
+	p.sampleBytes += n
+	elapsed := now.Sub(p.sampleStart)
+	if elapsed < min(maxRateSampleInterval, max(minRateSampleInterval, 4*p.minRTT)) {
+		return
+	}
+
+	sample := float64(p.sampleBytes) / elapsed.Seconds()
+	if p.rate == 0 {
+		p.rate = sample
+	} else {
+		p.rate = 0.7*p.rate + 0.3*sample
+	}
+	p.sampleStart = now
+	p.sampleBytes = 0
+}
+
+// adapt sets the depth to 1.5 times the bandwidth-delay product, plus one. When the depth limits
+// the rate, the rate grows with it, and so does the depth at the next sample; once the link is
+// the limit, the depth settles.
+func (p *Pipeline) adapt() {
+	if p.rate == 0 || p.minRTT == 0 {
+		return
+	}
+
+	bdp := p.rate * p.minRTT.Seconds() / float64(StandardBlockSize)
+	depth := int(math.Ceil(1.5*bdp)) + 1
+	p.depth = max(1, min(depth, p.maxDepth))
+}
+
+// RequestTimeout returns the time after which a request in flight is given up: four smoothed
+// round-trip times, and at least the minimum request timeout.
+func (p *Pipeline) RequestTimeout() time.Duration {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return p.requestTimeout()
+}
+
+func (p *Pipeline) requestTimeout() time.Duration {
+	return max(p.config.MinRequestTimeout, 4*p.srtt)
+}
+
+// Expire cancels the requests in flight for longer than the request timeout, and returns them so
+// that they are requested again, possibly from another peer. The depth is halved, as the peer
+// is slower than we thought.
+func (p *Pipeline) Expire() []Request {
+	p.mu.Lock()
+	now := p.now()
+	timeout := p.requestTimeout()
+	var expired []Request
+	for request, sentAt := range p.inFlight {
+		if now.Sub(sentAt) >= timeout {
+			expired = append(expired, request)
+			delete(p.inFlight, request)
+		}
+	}
+	if len(expired) > 0 {
+		p.depth = max(1, p.depth/2)
+	}
+	p.mu.Unlock()
+
+	for _, request := range expired {
+		p.requester.Cancel(request)
+	}
+	return expired
+}
+
+// Cancel cancels a request in flight, when its block arrived from another peer. It returns false
+// if the request isn't in flight.
+func (p *Pipeline) Cancel(request Request) bool {
+	p.mu.Lock()
+	_, ok := p.inFlight[request]
+	delete(p.inFlight, request)
+	p.mu.Unlock()
+
+	if ok {
+		p.requester.Cancel(request)
+	}
+	return ok
+}
+
+// Rejected forgets a request the peer won't serve, without canceling it on the wire.
+func (p *Pipeline) Rejected(request Request) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	delete(p.inFlight, request)
+}
+
+// Reset forgets every request in flight, e.g. when the peer choked us, and returns them.
+func (p *Pipeline) Reset() []Request {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	requests := make([]Request, 0, len(p.inFlight))
+	for request := range p.inFlight {
+		requests = append(requests, request)
+	}
+	clear(p.inFlight)
+	return requests
+}
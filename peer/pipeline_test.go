@@ -0,0 +1,359 @@
+package peer
+
+import (
+	"context"
+	"errors"
+	"io"
+	"log/slog"
+	"net"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+type fakeRequester struct {
+	requested []Request
+	canceled  []Request
+	err       error
+}
+
+func (r *fakeRequester) Request(request Request) error {
+	if r.err != nil {
+		return r.err
+	}
+	r.requested = append(r.requested, request)
+	return nil
+}
+
+func (r *fakeRequester) Cancel(request Request) error {
+	r.canceled = append(r.canceled, request)
+	return nil
+}
+
+// blocks returns a generator of the consecutive blocks of pieces of 16 blocks.
+func blocks() func() (Request, bool) {
+	next := 0
+	return func() (Request, bool) {
+		request := Request{
+			Index:  uint32(next / 16),
+			Begin:  uint32(next%16) * StandardBlockSize,
+			Length: StandardBlockSize,
+		}
+		next++
+		return request, true
+	}
+}
+
+func block(request Request) Piece {
+	return Piece{Index: request.Index, Begin: request.Begin, Block: make([]byte, request.Length)}
+}
+
+func TestPipelineFill(t *testing.T) {
+	requester := &fakeRequester{}
+	pipeline := NewPipeline(requester, PipelineConfig{})
+	next := blocks()
+
+	sent, err := pipeline.Fill(next)
+	assert.NoError(t, err)
+	assert.Equal(t, 4, sent)
+	assert.Equal(t, 4, pipeline.InFlight())
+	assert.True(t, pipeline.Pending(requester.requested[3]))
+
+	// Full: nothing more is requested.
+	sent, err = pipeline.Fill(next)
+	assert.NoError(t, err)
+	assert.Equal(t, 0, sent)
+
+	// Blocks that weren't requested through the pipeline are ignored.
+	assert.False(t, pipeline.Received(block(Request{Index: 9, Length: StandardBlockSize})))
+	assert.True(t, pipeline.Received(block(requester.requested[0])))
+	assert.False(t, pipeline.Received(block(requester.requested[0])))
+
+	sent, err = pipeline.Fill(next)
+	assert.NoError(t, err)
+	assert.Equal(t, 1, sent)
+
+	// Requests that fail to be sent aren't in flight.
+	requester.err = errors.New("closed")
+	pipeline.Rejected(requester.requested[1])
+	sent, err = pipeline.Fill(next)
+	assert.Error(t, err)
+	assert.Equal(t, 0, sent)
+	assert.Equal(t, 3, pipeline.InFlight())
+}
+
+func TestPipelineCancel(t *testing.T) {
+	requester := &fakeRequester{}
+	pipeline := NewPipeline(requester, PipelineConfig{})
+	_, err := pipeline.Fill(blocks())
+	assert.NoError(t, err)
+
+	// The block arrived from another peer: the request is canceled on the wire.
+	assert.True(t, pipeline.Cancel(requester.requested[0]))
+	assert.False(t, pipeline.Cancel(requester.requested[0]))
+	assert.Equal(t, requester.requested[:1], requester.canceled)
+	assert.False(t, pipeline.Received(block(requester.requested[0])))
+
+	// Rejected requests aren't canceled.
+	pipeline.Rejected(requester.requested[1])
+	assert.Len(t, requester.canceled, 1)
+
+	assert.ElementsMatch(t, requester.requested[2:], pipeline.Reset())
+	assert.Zero(t, pipeline.InFlight())
+}
+
+func TestPipelineExpire(t *testing.T) {
+	now := time.Unix(0, 0)
+	requester := &fakeRequester{}
+	pipeline := NewPipeline(requester, PipelineConfig{
+		MinRequestTimeout: time.Second,
+		Now:               func() time.Time { return now },
+	})
+	_, err := pipeline.Fill(blocks())
+	assert.NoError(t, err)
+
+	now = now.Add(100 * time.Millisecond)
+	assert.True(t, pipeline.Received(block(requester.requested[0])))
+	assert.Empty(t, pipeline.Expire())
+	assert.Equal(t, time.Second, pipeline.RequestTimeout())
+
+	// The other requests time out: they are canceled, and the depth is halved.
+	now = now.Add(time.Second)
+	expired := pipeline.Expire()
+	assert.ElementsMatch(t, requester.requested[1:], expired)
+	assert.ElementsMatch(t, expired, requester.canceled)
+	assert.Equal(t, 2, pipeline.Depth())
+	assert.Zero(t, pipeline.InFlight())
+
+	// The timeout follows slow peers: four times the smoothed round-trip time of 1.3375 s.
+	_, err = pipeline.Fill(blocks())
+	assert.NoError(t, err)
+	now = now.Add(10 * time.Second)
+	assert.True(t, pipeline.Received(block(requester.requested[4])))
+	assert.Equal(t, 5350*time.Millisecond, pipeline.RequestTimeout())
+}
+
+// simulateLink drives a pipeline over a simulated link with the given round-trip time, that
+// transfers a block per blockTime, for the given duration.
+func simulateLink(pipeline *Pipeline, now *time.Time, rtt, blockTime, duration time.Duration) {
+	type inFlight struct {
+		request Request
+		ready   time.Time
+	}
+	var queue []inFlight
+	var linkFree time.Time
+	requester := pipeline.requester.(*fakeRequester)
+	next := blocks()
+	// The requests in flight on a previous link are lost.
+	pipeline.Reset()
+
+	end := now.Add(duration)
+	for now.Before(end) {
+		for len(queue) > 0 && !queue[0].ready.After(*now) {
+			pipeline.Received(block(queue[0].request))
+			queue = queue[1:]
+		}
+
+		requester.requested = nil
+		pipeline.Fill(next)
+		for _, request := range requester.requested {
+			// The block leaves the peer half a round-trip after the request, once the link is free.
+			ready := now.Add(rtt / 2)
+			if linkFree.After(ready) {
+				ready = linkFree
+			}
+			ready = ready.Add(blockTime)
+			linkFree = ready
+			queue = append(queue, inFlight{request, ready.Add(rtt / 2)})
+		}
+
+		*now = now.Add(time.Millisecond)
+	}
+}
+
+func TestPipelineAdaptiveDepth(t *testing.T) {
+	now := time.Unix(0, 0)
+	pipeline := NewPipeline(&fakeRequester{}, PipelineConfig{Now: func() time.Time { return now }})
+
+	// 100 ms of round-trip time and 100 blocks per second: 10 blocks fill the link. The depth
+	// grows from 4, then settles with some headroom.
+	simulateLink(pipeline, &now, 100*time.Millisecond, 10*time.Millisecond, 10*time.Second)
+	assert.GreaterOrEqual(t, pipeline.Depth(), 10)
+	assert.LessOrEqual(t, pipeline.Depth(), 18)
+
+	// A faster link calls for more requests in flight.
+	simulateLink(pipeline, &now, 100*time.Millisecond, time.Millisecond, 10*time.Second)
+	assert.GreaterOrEqual(t, pipeline.Depth(), 100)
+
+	// The reqq of the peer bounds it.
+	pipeline.SetPeerQueueLimit(50)
+	assert.Equal(t, 50, pipeline.Depth())
+	simulateLink(pipeline, &now, 100*time.Millisecond, time.Millisecond, time.Second)
+	assert.Equal(t, 50, pipeline.Depth())
+}
+
+// latencyConn delays the data written to a connection by a one-way latency, and paces it to a
+// bandwidth, to simulate a link to a distant peer. Writes don't block.
+type latencyConn struct {
+	net.Conn
+	latency   time.Duration
+	bandwidth float64
+
+	mu       sync.Mutex
+	linkFree time.Time
+	queue    chan delivery
+	done     chan struct{}
+	once     sync.Once
+}
+
+type delivery struct {
+	data []byte
+	at   time.Time
+}
+
+func newLatencyConn(conn net.Conn, latency time.Duration, bandwidth float64) *latencyConn {
+	c := &latencyConn{
+		Conn:      conn,
+		latency:   latency,
+		bandwidth: bandwidth,
+		queue:     make(chan delivery, 4096),
+		done:      make(chan struct{}),
+	}
+	go c.deliver()
+	return c
+}
+
+func (c *latencyConn) Write(b []byte) (int, error) {
+	c.mu.Lock()
+	sent := time.Now()
+	if c.linkFree.After(sent) {
+		sent = c.linkFree
+	}
+	if c.bandwidth > 0 {
+		sent = sent.Add(time.Duration(float64(len(b)) / c.bandwidth * float64(time.Second)))
+	}
+	c.linkFree = sent
+	c.mu.Unlock()
+
+	select {
+	case c.queue <- delivery{data: append([]byte(nil), b...), at: sent.Add(c.latency)}:
+		return len(b), nil
+	case <-c.done:
+		return 0, net.ErrClosed
+	}
+}
+
+func (c *latencyConn) deliver() {
+	for {
+		select {
+		case d := <-c.queue:
+			time.Sleep(time.Until(d.at))
+			if _, err := c.Conn.Write(d.data); err != nil {
+				return
+			}
+		case <-c.done:
+			return
+		}
+	}
+}
+
+func (c *latencyConn) Close() error {
+	c.once.Do(func() { close(c.done) })
+	return c.Conn.Close()
+}
+
+// serveBlocks plays a seed: it unchokes and serves every request with zeros.
+func serveBlocks(conn PeerWireConnection, numPieces int) {
+	bitfield := make([]byte, (numPieces+7)/8)
+	for i := range numPieces {
+		setBit(bitfield, uint32(i))
+	}
+	if err := conn.SendPeerMessages([]PeerMessage{CreateBitfieldMessage(bitfield), CreateUnchokeMessage()}); err != nil {
+		return
+	}
+
+	zeros := make([]byte, MaxBlockSize)
+	for {
+		msg, err := conn.ReadPeerMessage()
+		if err != nil {
+			return
+		}
+		decoded, err := DecodeMessage(msg)
+		if err != nil {
+			return
+		}
+		if request, ok := decoded.(Request); ok {
+			piece := Piece{Index: request.Index, Begin: request.Begin, Block: zeros[:request.Length]}
+			if err := conn.SendPeerMessages([]PeerMessage{piece.Message()}); err != nil {
+				return
+			}
+		}
+	}
+}
+
+// benchmarkPipeline downloads 1 MiB per iteration from a seed over a link with 20 ms of
+// round-trip time and 16 MiB/s of bandwidth, through a session and a pipeline.
+func benchmarkPipeline(b *testing.B, config PipelineConfig) {
+	const numPieces = 32
+	logger := slog.New(slog.NewTextHandler(io.Discard, nil))
+	local, remote := net.Pipe()
+	localConn := NewPeerWireConnection(newLatencyConn(local, 10*time.Millisecond, 0), *logger)
+	remoteConn := NewPeerWireConnection(newLatencyConn(remote, 10*time.Millisecond, 16<<20), *logger)
+	go serveBlocks(remoteConn, numPieces)
+
+	events := make(chan Event, 256)
+	session := NewSession(localConn, SessionConfig{NumPieces: numPieces, Events: events, Logger: logger})
+	defer func() {
+		session.Close()
+		remoteConn.Close()
+	}()
+	if err := session.Start(context.Background()); err != nil {
+		b.Fatal(err)
+	}
+	for event := range events {
+		if event.Type == EventUnchoked {
+			break
+		}
+	}
+
+	pipeline := NewPipeline(session, config)
+	// The blocks of the pieces are requested in a loop, as the benchmark never keeps them.
+	generate := blocks()
+	next := func() (Request, bool) {
+		request, _ := generate()
+		request.Index %= numPieces
+		return request, true
+	}
+
+	b.SetBytes(1 << 20)
+	b.ResetTimer()
+	for range b.N {
+		for received := 0; received < 1<<20; {
+			if _, err := pipeline.Fill(next); err != nil {
+				b.Fatal(err)
+			}
+			event := <-events
+			if event.Type == EventClosed {
+				b.Fatal(event.Err)
+			}
+			if event.Type == EventPiece && pipeline.Received(event.Block) {
+				received += len(event.Block.Block)
+			}
+		}
+	}
+	b.ReportMetric(float64(pipeline.Depth()), "depth")
+}
+
+func BenchmarkPipeline(b *testing.B) {
+	b.Run("fixed-1", func(b *testing.B) {
+		benchmarkPipeline(b, PipelineConfig{InitialDepth: 1, MaxDepth: 1})
+	})
+	b.Run("fixed-4", func(b *testing.B) {
+		benchmarkPipeline(b, PipelineConfig{InitialDepth: 4, MaxDepth: 4})
+	})
+	b.Run("adaptive", func(b *testing.B) {
+		benchmarkPipeline(b, PipelineConfig{})
+	})
+}
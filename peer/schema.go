@@ -1,10 +1,8 @@
 package peer
 
 import (
-	"bufio"
 	"encoding/binary"
 	"fmt"
-	"io"
 )
 
 type Message interface {
@@ -16,6 +14,8 @@ type HandshakeMessage interface {
 	Protocol() string
 	InfoHash() [20]byte
 	PeerID() [20]byte
+	Reserved() [8]byte
+	Capabilities() Capabilities
 }
 
 // Handshake message format (in order):
@@ -41,10 +41,12 @@ func (msg handshakeMessage) Length() uint32 {
 	return 49 + uint32(pstrLen)
 }
 
+const defaultProtocolName = "BitTorrent protocol"
+
 // Create peer-wire protocol handshake message
-func createHandshakeMessage(protocolName string, infohash, peerID [20]byte) (handshakeMessage, error) {
+func createHandshakeMessage(protocolName string, reserved [8]byte, infohash, peerID [20]byte) (handshakeMessage, error) {
 	if protocolName == "" {
-		protocolName = "BitTorrent protocol"
+		protocolName = defaultProtocolName
 	}
 
 	if len(protocolName) > 255 {
@@ -55,6 +57,7 @@ func createHandshakeMessage(protocolName string, infohash, peerID [20]byte) (han
 	msg := make([]byte, size)
 	msg[0] = uint8(len(protocolName))
 	copy(msg[1:1+len(protocolName)], []byte(protocolName))
+	copy(msg[1+len(protocolName):1+len(protocolName)+8], reserved[:])
 	copy(msg[1+len(protocolName)+8:1+len(protocolName)+28], infohash[:])
 	copy(msg[1+len(protocolName)+28:1+len(protocolName)+48], peerID[:])
 
@@ -68,6 +71,15 @@ func (msg handshakeMessage) InfoHash() [20]byte {
 	return infoHash
 }
 
+func (msg handshakeMessage) Reserved() [8]byte {
+	reservedOffset := 1 + int(msg[0])
+	return [8]byte(msg[reservedOffset : reservedOffset+8])
+}
+
+func (msg handshakeMessage) Capabilities() Capabilities {
+	return ParseReserved(msg.Reserved())
+}
+
 func (msg handshakeMessage) PeerID() [20]byte {
 	peerIDOffset := 1 + msg[0] + 8 + 20
 	peerID := [20]byte{}
@@ -88,7 +100,12 @@ const (
 	TypePiece         PeerMsgType = 7
 	TypeCancel        PeerMsgType = 8
 	TypePort          PeerMsgType = 9
+	TypeSuggestPiece  PeerMsgType = 0xd
+	TypeHaveAll       PeerMsgType = 0xe
 	TypeHaveNone      PeerMsgType = 0xf
+	TypeRejectRequest PeerMsgType = 0x10
+	TypeAllowedFast   PeerMsgType = 0x11
+	TypeExtended      PeerMsgType = 20
 	// KeepAlive is a special case — it has no ID and length is 0
 	TypeKeepAlive PeerMsgType = 255 // Reserved for internal handling
 )
@@ -115,8 +132,18 @@ func (t PeerMsgType) String() string {
 		return "Cancel"
 	case TypePort:
 		return "Port"
+	case TypeSuggestPiece:
+		return "SuggestPiece"
+	case TypeHaveAll:
+		return "HaveAll"
 	case TypeHaveNone:
 		return "HaveNone"
+	case TypeRejectRequest:
+		return "RejectRequest"
+	case TypeAllowedFast:
+		return "AllowedFast"
+	case TypeExtended:
+		return "Extended"
 	case TypeKeepAlive:
 		return "KeepAlive"
 	default:
@@ -145,29 +172,6 @@ type PeerMessage interface {
 type peerMessage []byte
 type MessagePayload []byte
 
-func readPeerMessage(r *bufio.Reader) (PeerMessage, error) {
-	// read message length
-	prefLenBytes := make([]byte, 4)
-	_, err := io.ReadFull(r, prefLenBytes)
-
-	if err != nil {
-		return nil, fmt.Errorf("An error occurred while reading peer message: %w", err)
-	}
-
-	bodyLen := binary.BigEndian.Uint32(prefLenBytes)
-
-	// 'unmarshal' data to a message instance
-	msg := make([]byte, 4+bodyLen)
-	copy(msg[:4], prefLenBytes)
-	_, err = io.ReadFull(r, msg[4:])
-
-	if err != nil {
-		return nil, fmt.Errorf("An error occurred while reading peer message: %w", err)
-	}
-
-	return peerMessage(msg), nil
-}
-
 func (msg peerMessage) Raw() []byte {
 	return []byte(msg)
 }
@@ -184,6 +188,9 @@ func (msg peerMessage) Length() uint32 {
 }
 
 func (msg peerMessage) Payload() MessagePayload {
+	if len(msg) < 5 {
+		return nil
+	}
 	return MessagePayload(msg[5 : 4+msg.Length()])
 }
 
@@ -193,6 +200,9 @@ func AsPeerMessage(raw []byte) (PeerMessage, error) {
 	}
 
 	msgLength := binary.BigEndian.Uint32(raw[:4])
+	if uint64(len(raw)) < 4+uint64(msgLength) {
+		return nil, fmt.Errorf("Invalid slice length. The length prefix is %d but only %d bytes follow.", msgLength, len(raw)-4)
+	}
 	return peerMessage(raw[:4+msgLength]), nil
 }
 
@@ -276,3 +286,25 @@ func CreateHaveMessage(index int) PeerMessage {
 func CreateHaveNoneMessage() PeerMessage {
 	return createPeerMessage(TypeHaveNone, nil)
 }
+
+// Extended message payload (BEP 10):
+//
+//	[ extended_message_id (1 byte) ][ data (variable) ]
+//
+// ID 0 is the extension handshake; other IDs are assigned to extensions during the handshake.
+type ExtendedMessagePayload MessagePayload
+
+func (payload ExtendedMessagePayload) ExtendedID() uint8 {
+	return payload[0]
+}
+
+func (payload ExtendedMessagePayload) Data() []byte {
+	return payload[1:]
+}
+
+func CreateExtendedMessage(extendedID uint8, data []byte) PeerMessage {
+	msgPayload := make(MessagePayload, 1+len(data))
+	msgPayload[0] = extendedID
+	copy(msgPayload[1:], data)
+	return createPeerMessage(TypeExtended, msgPayload)
+}
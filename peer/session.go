@@ -0,0 +1,810 @@
+package peer
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"slices"
+	"sync"
+	"time"
+
+	"github.com/dpnam2112/bittorrent-client/common"
+)
+
+const (
+	// Peers usually drop connections silent for 2 minutes: we send a keep-alive well before.
+	defaultKeepAliveInterval = 90 * time.Second
+	// A peer sending nothing, not even keep-alives, for this long is dropped.
+	defaultIdleTimeout = 3 * time.Minute
+	// Requests of the peer beyond this are refused.
+	defaultMaxRemoteRequests = 250
+)
+
+var (
+	// ErrIdleTimeout closes a session whose peer sent nothing for the idle timeout.
+	ErrIdleTimeout = errors.New("Peer is idle")
+	// ErrSessionClosed is returned by the methods of a closed session.
+	ErrSessionClosed = errors.New("Peer session is closed")
+	// ErrProtocolViolation is returned when the peer sends a message that is invalid in the state
+	// of the session, like a Have for a piece that doesn't exist. The session is closed.
+	ErrProtocolViolation = errors.New("Peer violated the protocol")
+	// ErrRequestNotAllowed is returned when requesting a block the peer doesn't have, or while it
+	// chokes us outside of its allowed fast set.
+	ErrRequestNotAllowed = errors.New("Request not allowed by the peer")
+)
+
+type EventType int
+
+const (
+	// EventBitfield: the peer announced its pieces, with a Bitfield, HaveAll or HaveNone.
+	EventBitfield EventType = iota
+	// EventHave: the peer has a new piece (Index).
+	EventHave
+	// EventChoked and EventUnchoked: the peer choked or unchoked us.
+	EventChoked
+	EventUnchoked
+	// EventInterested and EventNotInterested: the peer's interest in our pieces changed.
+	EventInterested
+	EventNotInterested
+	// EventPiece: a block we requested was received (Block).
+	EventPiece
+	// EventRejected: a request of ours won't be served (Request), because the peer rejected it
+	// or, without the Fast extension, choked us.
+	EventRejected
+	// EventRequest: the peer requests a block (Request). The owner answers with SendBlock, or
+	// with RejectRequest.
+	EventRequest
+	// EventSuggest: the peer suggests downloading a piece (Index).
+	EventSuggest
+	// EventAllowedFast: the peer lets us request a piece while choked (Index).
+	EventAllowedFast
+	// EventClosed: the session ended on its own (Err). It isn't sent when the owner closes it.
+	EventClosed
+)
+
+func (t EventType) String() string {
+	switch t {
+	case EventBitfield:
+		return "Bitfield"
+	case EventHave:
+		return "Have"
+	case EventChoked:
+		return "Choked"
+	case EventUnchoked:
+		return "Unchoked"
+	case EventInterested:
+		return "Interested"
+	case EventNotInterested:
+		return "NotInterested"
+	case EventPiece:
+		return "Piece"
+	case EventRejected:
+		return "Rejected"
+	case EventRequest:
+		return "Request"
+	case EventSuggest:
+		return "Suggest"
+	case EventAllowedFast:
+		return "AllowedFast"
+	case EventClosed:
+		return "Closed"
+	default:
+		return fmt.Sprintf("UnknownEventType(%d)", int(t))
+	}
+}
+
+// Event is reported by a session to its owning torrent.
+type Event struct {
+	Session *Session
+	Type    EventType
+	// Index is the piece of Have, Suggest and AllowedFast events.
+	Index uint32
+	// Request is the block of Rejected and Request events.
+	Request Request
+	// Block is the block of Piece events. Its data is owned by the receiver.
+	Block Piece
+	Err   error
+}
+
+// SessionState is the choking and interest state of a session, from our side ("am") and from
+// the peer's side.
+type SessionState struct {
+	AmChoking      bool
+	AmInterested   bool
+	PeerChoking    bool
+	PeerInterested bool
+}
+
+type SessionConfig struct {
+	Addr common.PeerAddr
+	// Capabilities negotiated in the handshake.
+	Capabilities Capabilities
+	NumPieces    int
+	// Bitfield are the pieces we have, announced once the session starts. Have updates it.
+	Bitfield []byte
+	// AllowedFast are the pieces the peer may request while we choke it, when the Fast extension
+	// is negotiated. See AllowedFastSet.
+	AllowedFast []uint32
+	// Events receives the events of the session. Events are dropped when nil.
+	Events chan<- Event
+	// Stats, when set, counts the bytes of the blocks transferred.
+	Stats *common.TransferStats
+	// KeepAliveInterval is the time after which a keep-alive is sent if nothing else was.
+	// Defaults to 90 seconds.
+	KeepAliveInterval time.Duration
+	// IdleTimeout is the time after which the session is closed if the peer sent nothing.
+	// Defaults to 3 minutes.
+	IdleTimeout time.Duration
+	// MaxRemoteRequests is the number of pending requests of the peer. Defaults to 250.
+	MaxRemoteRequests int
+	Logger            *slog.Logger
+}
+
+// Session is the state machine of a connection to a peer, after the handshake: it tracks the
+// choking and interest state of both sides, the pieces of the peer, and the requests pending in
+// both directions. A reader goroutine processes the messages of the peer and reports them as
+// events; a writer goroutine sends our messages, and keep-alives when there is nothing to send.
+type Session struct {
+	conn   PeerWireConnection
+	config SessionConfig
+	logger *slog.Logger
+	fast   *FastState
+	// extensions is set by EnableExtensions, before the session starts.
+	extensions *ExtensionSession
+
+	mu     sync.Mutex
+	state  SessionState
+	local  []byte
+	remote []byte
+	// receivedBitfield is set once the peer announced its pieces, which it may only do first.
+	receivedBitfield bool
+	// requested are our requests the peer didn't answer yet.
+	requested map[Request]time.Time
+	// remoteRequests are the requests of the peer we didn't answer yet.
+	remoteRequests []Request
+	lastReceived   time.Time
+	outbox         []PeerMessage
+	err            error
+
+	// wake signals the writer that the outbox isn't empty.
+	wake      chan struct{}
+	closed    chan struct{}
+	closeOnce sync.Once
+	// stopped is closed when the owner closes the session, and stops reading its events.
+	stopped  chan struct{}
+	stopOnce sync.Once
+	started  bool
+	wg       sync.WaitGroup
+}
+
+var _ Peer = (*Session)(nil)
+
+// NewSession creates a session on a connection whose handshakes were exchanged. The session owns
+// the connection, and closes it when closed.
+func NewSession(conn PeerWireConnection, config SessionConfig) *Session {
+	if config.Logger == nil {
+		config.Logger = slog.Default()
+	}
+	if config.KeepAliveInterval <= 0 {
+		config.KeepAliveInterval = defaultKeepAliveInterval
+	}
+	if config.IdleTimeout <= 0 {
+		config.IdleTimeout = defaultIdleTimeout
+	}
+	if config.MaxRemoteRequests <= 0 {
+		config.MaxRemoteRequests = defaultMaxRemoteRequests
+	}
+
+	bitfieldLength := (config.NumPieces + 7) / 8
+	local := make([]byte, bitfieldLength)
+	copy(local, config.Bitfield)
+
+	return &Session{
+		conn:   conn,
+		config: config,
+		logger: config.Logger.With("peer", conn.RemoteAddr().String()),
+		fast:   NewFastState(config.Capabilities.Fast),
+		state: SessionState{
+			AmChoking:   true,
+			PeerChoking: true,
+		},
+		local:     local,
+		remote:    make([]byte, bitfieldLength),
+		requested: make(map[Request]time.Time),
+		wake:      make(chan struct{}, 1),
+		closed:    make(chan struct{}),
+		stopped:   make(chan struct{}),
+	}
+}
+
+// EnableExtensions runs the extension protocol (BEP 10) on the session, with the extensions of the
+// registry. Our extension handshake is sent when the session starts, after our pieces. It must be
+// called before Start, when the extension protocol was negotiated.
+func (s *Session) EnableExtensions(registry *ExtensionRegistry, config ExtensionSessionConfig) *ExtensionSession {
+	config.RemoteAddr = s.conn.RemoteAddr()
+	config.Send = func(msg PeerMessage) error { return s.send(msg) }
+	s.extensions = NewExtensionSession(registry, config)
+	return s.extensions
+}
+
+// Start announces our pieces, and starts the reader and writer goroutines. The session is
+// closed when ctx is done.
+func (s *Session) Start(ctx context.Context) error {
+	s.mu.Lock()
+	if s.started {
+		s.mu.Unlock()
+		return fmt.Errorf("Peer session is already started.")
+	}
+	s.started = true
+	s.lastReceived = time.Now()
+
+	if msg := s.fast.BitfieldMessage(s.local, s.config.NumPieces); msg != nil {
+		s.outbox = append(s.outbox, msg)
+	}
+	s.outbox = append(s.outbox, s.fast.Allow(s.config.AllowedFast...)...)
+	s.mu.Unlock()
+
+	if s.extensions != nil {
+		if err := s.extensions.SendHandshake(); err != nil {
+			return err
+		}
+	}
+	s.signalWriter()
+
+	s.wg.Add(2)
+	go s.readLoop()
+	go s.writeLoop()
+
+	go func() {
+		select {
+		case <-ctx.Done():
+			s.Close()
+		case <-s.closed:
+		}
+	}()
+
+	return nil
+}
+
+// Close closes the connection and waits for the goroutines of the session. No event is reported
+// afterwards.
+func (s *Session) Close() error {
+	s.stopOnce.Do(func() { close(s.stopped) })
+	s.shutdown(nil)
+	s.wg.Wait()
+	return nil
+}
+
+// shutdown closes the session, recording err as the reason. It doesn't wait for the goroutines,
+// as they call it themselves.
+func (s *Session) shutdown(err error) bool {
+	first := false
+	s.closeOnce.Do(func() {
+		first = true
+		s.mu.Lock()
+		s.err = err
+		s.mu.Unlock()
+
+		close(s.closed)
+		s.conn.Close()
+		if s.extensions != nil {
+			s.extensions.Close()
+		}
+	})
+	return first
+}
+
+// fail closes the session because of err, and reports it to the owner.
+func (s *Session) fail(err error) {
+	if s.shutdown(err) {
+		s.logger.Debug("Peer session closed", "err", err)
+		s.emit(Event{Type: EventClosed, Err: err})
+	}
+}
+
+// Err returns the reason the session ended on its own, or nil.
+func (s *Session) Err() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.err
+}
+
+func (s *Session) Addr() common.PeerAddr {
+	return s.config.Addr
+}
+
+func (s *Session) Capabilities() Capabilities {
+	return s.config.Capabilities
+}
+
+func (s *Session) State() SessionState {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.state
+}
+
+// RemoteBitfield returns a copy of the pieces of the peer.
+func (s *Session) RemoteBitfield() []byte {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return slices.Clone(s.remote)
+}
+
+// HasPiece reports whether the peer has a piece.
+func (s *Session) HasPiece(index uint32) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return hasBit(s.remote, index)
+}
+
+// PendingRequests returns our requests the peer didn't answer yet.
+func (s *Session) PendingRequests() []Request {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	requests := make([]Request, 0, len(s.requested))
+	for request := range s.requested {
+		requests = append(requests, request)
+	}
+	return requests
+}
+
+// RemoteRequests returns the requests of the peer we didn't answer yet.
+func (s *Session) RemoteRequests() []Request {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return slices.Clone(s.remoteRequests)
+}
+
+// AllowedFast returns the pieces the peer lets us request while it chokes us.
+func (s *Session) AllowedFast() []uint32 {
+	return s.fast.AllowedByPeer()
+}
+
+// Suggestions returns the pieces the peer suggested since the last call, most recent first.
+func (s *Session) Suggestions() []uint32 {
+	return s.fast.Suggestions()
+}
+
+// Choke stops serving the peer. With the Fast extension, its pending requests outside of its
+// allowed fast set are rejected; without it, they are all dropped.
+func (s *Session) Choke() error {
+	s.mu.Lock()
+	if s.state.AmChoking {
+		s.mu.Unlock()
+		return nil
+	}
+	s.state.AmChoking = true
+	kept, rejects := s.fast.Choke(s.remoteRequests)
+	s.remoteRequests = kept
+	s.mu.Unlock()
+
+	return s.send(append([]PeerMessage{CreateChokeMessage()}, rejects...)...)
+}
+
+func (s *Session) Unchoke() error {
+	s.mu.Lock()
+	if !s.state.AmChoking {
+		s.mu.Unlock()
+		return nil
+	}
+	s.state.AmChoking = false
+	s.mu.Unlock()
+
+	return s.send(CreateUnchokeMessage())
+}
+
+// SetInterested tells the peer whether we want pieces it has.
+func (s *Session) SetInterested(interested bool) error {
+	s.mu.Lock()
+	if s.state.AmInterested == interested {
+		s.mu.Unlock()
+		return nil
+	}
+	s.state.AmInterested = interested
+	s.mu.Unlock()
+
+	if interested {
+		return s.send(CreateInterestedMessage())
+	}
+	return s.send(CreateNotInterestedMessage())
+}
+
+// Request requests a block from the peer. The peer must have the piece, and either not choke
+// us, or allow the piece with the Fast extension.
+func (s *Session) Request(request Request) error {
+	s.mu.Lock()
+	if !hasBit(s.remote, request.Index) || !s.fast.CanRequest(request.Index, s.state.PeerChoking) {
+		s.mu.Unlock()
+		return fmt.Errorf("%w: piece %d", ErrRequestNotAllowed, request.Index)
+	}
+	if _, ok := s.requested[request]; ok {
+		s.mu.Unlock()
+		return nil
+	}
+	s.requested[request] = time.Now()
+	s.mu.Unlock()
+
+	return s.send(request.Message())
+}
+
+// Cancel cancels a pending request. A block may still arrive for it, and is then ignored.
+func (s *Session) Cancel(request Request) error {
+	s.mu.Lock()
+	if _, ok := s.requested[request]; !ok {
+		s.mu.Unlock()
+		return nil
+	}
+	delete(s.requested, request)
+	s.mu.Unlock()
+
+	return s.send(Cancel(request).Message())
+}
+
+// Have announces a piece we completed.
+func (s *Session) Have(index uint32) error {
+	s.mu.Lock()
+	if int(index) >= s.config.NumPieces || hasBit(s.local, index) {
+		s.mu.Unlock()
+		return nil
+	}
+	setBit(s.local, index)
+	s.mu.Unlock()
+
+	return s.send(CreateHaveMessage(int(index)))
+}
+
+// SendBlock answers a request of the peer. Blocks of requests that were canceled, or dropped
+// when we choked the peer, aren't sent.
+func (s *Session) SendBlock(index, begin uint32, block []byte) error {
+	request := Request{Index: index, Begin: begin, Length: uint32(len(block))}
+
+	s.mu.Lock()
+	i := slices.Index(s.remoteRequests, request)
+	if i < 0 {
+		s.mu.Unlock()
+		return nil
+	}
+	s.remoteRequests = slices.Delete(s.remoteRequests, i, i+1)
+	s.mu.Unlock()
+
+	if s.config.Stats != nil {
+		s.config.Stats.AddUploaded(int64(len(block)))
+	}
+	return s.send(CreatePieceMessage(index, begin, block))
+}
+
+// RejectRequest refuses a request of the peer, e.g. because the piece failed to be read. The
+// peer is told so only with the Fast extension.
+func (s *Session) RejectRequest(request Request) error {
+	s.mu.Lock()
+	i := slices.Index(s.remoteRequests, request)
+	if i < 0 {
+		s.mu.Unlock()
+		return nil
+	}
+	s.remoteRequests = slices.Delete(s.remoteRequests, i, i+1)
+	s.mu.Unlock()
+
+	if !s.fast.Enabled() {
+		return nil
+	}
+	return s.send(RejectRequest(request).Message())
+}
+
+// Send queues arbitrary messages, like extended messages.
+func (s *Session) Send(messages ...PeerMessage) error {
+	return s.send(messages...)
+}
+
+func (s *Session) send(messages ...PeerMessage) error {
+	select {
+	case <-s.closed:
+		return ErrSessionClosed
+	default:
+	}
+
+	s.mu.Lock()
+	s.outbox = append(s.outbox, messages...)
+	s.mu.Unlock()
+	s.signalWriter()
+	return nil
+}
+
+func (s *Session) signalWriter() {
+	select {
+	case s.wake <- struct{}{}:
+	default:
+	}
+}
+
+// emit reports an event to the owner. Events are dropped once the session is closed, except the
+// EventClosed reporting why, which is only dropped when the owner closes the session as well.
+func (s *Session) emit(event Event) {
+	if s.config.Events == nil {
+		return
+	}
+	event.Session = s
+
+	done := s.closed
+	if event.Type == EventClosed {
+		done = s.stopped
+	}
+
+	select {
+	case s.config.Events <- event:
+	case <-done:
+	}
+}
+
+// writeLoop sends the queued messages, and a keep-alive when nothing was sent for the keep-alive
+// interval. It also closes the session when the peer is idle for too long.
+func (s *Session) writeLoop() {
+	defer s.wg.Done()
+
+	keepAlive := time.NewTimer(s.config.KeepAliveInterval)
+	defer keepAlive.Stop()
+	idleCheck := time.NewTicker(min(s.config.IdleTimeout/4, time.Second*30))
+	defer idleCheck.Stop()
+
+	for {
+		var batch []PeerMessage
+		select {
+		case <-s.closed:
+			return
+		case <-s.wake:
+			s.mu.Lock()
+			batch = s.outbox
+			s.outbox = nil
+			s.mu.Unlock()
+		case <-keepAlive.C:
+			batch = []PeerMessage{CreateKeepAliveMessage()}
+		case <-idleCheck.C:
+			s.mu.Lock()
+			idle := time.Since(s.lastReceived)
+			s.mu.Unlock()
+			if idle > s.config.IdleTimeout {
+				s.fail(ErrIdleTimeout)
+				return
+			}
+			continue
+		}
+
+		if len(batch) == 0 {
+			continue
+		}
+		if err := s.conn.SendPeerMessages(batch); err != nil {
+			s.fail(err)
+			return
+		}
+		keepAlive.Reset(s.config.KeepAliveInterval)
+	}
+}
+
+func (s *Session) readLoop() {
+	defer s.wg.Done()
+
+	for {
+		msg, err := s.conn.ReadPeerMessage()
+		if err != nil {
+			s.fail(err)
+			return
+		}
+
+		s.mu.Lock()
+		s.lastReceived = time.Now()
+		s.mu.Unlock()
+
+		decoded, err := DecodeMessage(msg)
+		if err == nil {
+			err = s.handleMessage(decoded)
+		}
+		ReleaseMessage(msg)
+		if err != nil {
+			s.fail(err)
+			return
+		}
+	}
+}
+
+// handleMessage updates the state with a message of the peer, and reports it to the owner.
+func (s *Session) handleMessage(msg TypedMessage) error {
+	if err := s.fast.HandleMessage(msg); err != nil {
+		return err
+	}
+
+	switch m := msg.(type) {
+	case KeepAlive, Port:
+		return nil
+
+	case Choke:
+		s.mu.Lock()
+		s.state.PeerChoking = true
+		var discarded []Request
+		for request := range s.requested {
+			discarded = append(discarded, request)
+		}
+		discarded = s.fast.Choked(discarded)
+		for _, request := range discarded {
+			delete(s.requested, request)
+		}
+		s.mu.Unlock()
+
+		s.emit(Event{Type: EventChoked})
+		for _, request := range discarded {
+			s.emit(Event{Type: EventRejected, Request: request})
+		}
+
+	case Unchoke:
+		s.setState(func(state *SessionState) { state.PeerChoking = false })
+		s.emit(Event{Type: EventUnchoked})
+
+	case Interested:
+		s.setState(func(state *SessionState) { state.PeerInterested = true })
+		s.emit(Event{Type: EventInterested})
+
+	case NotInterested:
+		s.setState(func(state *SessionState) { state.PeerInterested = false })
+		s.emit(Event{Type: EventNotInterested})
+
+	case Bitfield, HaveAll, HaveNone:
+		if err := s.setRemoteBitfield(m); err != nil {
+			return err
+		}
+		s.emit(Event{Type: EventBitfield})
+
+	case Have:
+		if err := s.checkIndex(m.Index); err != nil {
+			return err
+		}
+		s.mu.Lock()
+		s.receivedBitfield = true
+		setBit(s.remote, m.Index)
+		s.mu.Unlock()
+		s.emit(Event{Type: EventHave, Index: m.Index})
+
+	case Request:
+		return s.handleRequest(m)
+
+	case Cancel:
+		s.mu.Lock()
+		s.remoteRequests = slices.DeleteFunc(s.remoteRequests, func(r Request) bool { return r == Request(m) })
+		s.mu.Unlock()
+
+	case Piece:
+		request := Request{Index: m.Index, Begin: m.Begin, Length: uint32(len(m.Block))}
+		s.mu.Lock()
+		_, ok := s.requested[request]
+		delete(s.requested, request)
+		s.mu.Unlock()
+		if !ok {
+			// Canceled, or never requested.
+			return nil
+		}
+
+		if s.config.Stats != nil {
+			s.config.Stats.AddDownloaded(int64(len(m.Block)))
+		}
+		// The block aliases a pooled buffer, released once the message is processed.
+		m.Block = slices.Clone(m.Block)
+		s.emit(Event{Type: EventPiece, Block: m})
+
+	case RejectRequest:
+		request := Request(m)
+		s.mu.Lock()
+		_, ok := s.requested[request]
+		delete(s.requested, request)
+		s.mu.Unlock()
+		if ok {
+			s.emit(Event{Type: EventRejected, Request: request})
+		}
+
+	case SuggestPiece:
+		if err := s.checkIndex(m.Index); err != nil {
+			return err
+		}
+		s.emit(Event{Type: EventSuggest, Index: m.Index})
+
+	case AllowedFast:
+		if err := s.checkIndex(m.Index); err != nil {
+			return err
+		}
+		s.emit(Event{Type: EventAllowedFast, Index: m.Index})
+
+	case Extended:
+		if s.extensions == nil {
+			return nil
+		}
+		if err := s.extensions.HandleMessage(m); err != nil {
+			s.logger.Debug("Failed to handle extended message", "err", err)
+		}
+	}
+
+	return nil
+}
+
+func (s *Session) setState(update func(state *SessionState)) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	update(&s.state)
+}
+
+func (s *Session) checkIndex(index uint32) error {
+	if int(index) >= s.config.NumPieces {
+		return fmt.Errorf("%w: piece %d out of range", ErrProtocolViolation, index)
+	}
+	return nil
+}
+
+func (s *Session) setRemoteBitfield(msg TypedMessage) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.receivedBitfield {
+		return fmt.Errorf("%w: %s after the first message", ErrProtocolViolation, msg.Type())
+	}
+	s.receivedBitfield = true
+
+	switch m := msg.(type) {
+	case Bitfield:
+		if len(m.Bits) != len(s.remote) {
+			return fmt.Errorf("%w: bitfield of %d bytes, expected %d", ErrProtocolViolation, len(m.Bits), len(s.remote))
+		}
+		copy(s.remote, m.Bits)
+		// Spare bits must be cleared; clear them rather than dropping the peer.
+		if spare := s.config.NumPieces % 8; spare != 0 {
+			s.remote[len(s.remote)-1] &= byte(0xff << (8 - spare))
+		}
+	case HaveAll:
+		for i := range s.config.NumPieces {
+			setBit(s.remote, uint32(i))
+		}
+	case HaveNone:
+		clear(s.remote)
+	}
+	return nil
+}
+
+// handleRequest queues a request of the peer for the owner to serve, or refuses it.
+func (s *Session) handleRequest(request Request) error {
+	if err := s.checkIndex(request.Index); err != nil {
+		return err
+	}
+	if request.Length == 0 || request.Length > MaxBlockSize {
+		return fmt.Errorf("%w: request of %d bytes", ErrProtocolViolation, request.Length)
+	}
+
+	s.mu.Lock()
+	serve, reject := s.fast.CheckRequest(request, s.state.AmChoking, hasBit(s.local, request.Index))
+	if serve && len(s.remoteRequests) >= s.config.MaxRemoteRequests {
+		serve, reject = false, nil
+		if s.fast.Enabled() {
+			reject = RejectRequest(request).Message()
+		}
+	}
+	if serve && !slices.Contains(s.remoteRequests, request) {
+		s.remoteRequests = append(s.remoteRequests, request)
+	}
+	s.mu.Unlock()
+
+	if !serve {
+		if reject != nil {
+			return s.send(reject)
+		}
+		return nil
+	}
+
+	s.emit(Event{Type: EventRequest, Request: request})
+	return nil
+}
+
+func hasBit(bitfield []byte, index uint32) bool {
+	i := int(index / 8)
+	return i < len(bitfield) && bitfield[i]&(0x80>>(index%8)) != 0
+}
+
+func setBit(bitfield []byte, index uint32) {
+	if i := int(index / 8); i < len(bitfield) {
+		bitfield[i] |= 0x80 >> (index % 8)
+	}
+}
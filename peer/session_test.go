@@ -0,0 +1,217 @@
+package peer
+
+import (
+	"context"
+	"io"
+	"log/slog"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// startSession starts a session on one end of a pipe, and returns the other end, read and written
+// by the test as the remote peer.
+func startSession(t *testing.T, config SessionConfig) (*Session, PeerWireConnection, <-chan Event) {
+	local, remote := net.Pipe()
+	logger := slog.New(slog.NewTextHandler(io.Discard, nil))
+
+	events := make(chan Event, 16)
+	config.Events = events
+	config.Logger = logger
+	if config.NumPieces == 0 {
+		config.NumPieces = 10
+	}
+
+	session := NewSession(NewPeerWireConnection(local, *logger), config)
+	remoteConn := NewPeerWireConnection(remote, *logger)
+	t.Cleanup(func() {
+		session.Close()
+		remoteConn.Close()
+	})
+
+	assert.NoError(t, session.Start(context.Background()))
+	return session, remoteConn, events
+}
+
+func readMessage(t *testing.T, conn PeerWireConnection) TypedMessage {
+	t.Helper()
+	msg, err := conn.ReadPeerMessage()
+	assert.NoError(t, err)
+	decoded, err := DecodeMessage(msg)
+	assert.NoError(t, err)
+	return decoded
+}
+
+func sendMessages(t *testing.T, conn PeerWireConnection, messages ...TypedMessage) {
+	t.Helper()
+	for _, msg := range messages {
+		assert.NoError(t, conn.SendPeerMessages([]PeerMessage{msg.Message()}))
+	}
+}
+
+func nextEvent(t *testing.T, events <-chan Event) Event {
+	t.Helper()
+	select {
+	case event := <-events:
+		return event
+	case <-time.After(5 * time.Second):
+		t.Fatal("No event received")
+		return Event{}
+	}
+}
+
+func TestSessionDownload(t *testing.T) {
+	session, remote, events := startSession(t, SessionConfig{Bitfield: []byte{0x80, 0x00}})
+
+	// Our pieces are announced first.
+	assert.Equal(t, Bitfield{Bits: []byte{0x80, 0x00}}, readMessage(t, remote))
+	assert.Equal(t, SessionState{AmChoking: true, PeerChoking: true}, session.State())
+
+	sendMessages(t, remote, Bitfield{Bits: []byte{0x60, 0x00}}, Have{Index: 9})
+	assert.Equal(t, EventBitfield, nextEvent(t, events).Type)
+	assert.Equal(t, Event{Session: session, Type: EventHave, Index: 9}, nextEvent(t, events))
+	assert.Equal(t, []byte{0x60, 0x40}, session.RemoteBitfield())
+
+	// Choked: nothing can be requested.
+	request := Request{Index: 1, Begin: 0, Length: 4}
+	assert.ErrorIs(t, session.Request(request), ErrRequestNotAllowed)
+
+	assert.NoError(t, session.SetInterested(true))
+	assert.Equal(t, Interested{}, readMessage(t, remote))
+	sendMessages(t, remote, Unchoke{})
+	assert.Equal(t, EventUnchoked, nextEvent(t, events).Type)
+	assert.Equal(t, SessionState{AmChoking: true, AmInterested: true}, session.State())
+
+	assert.ErrorIs(t, session.Request(Request{Index: 0, Length: 4}), ErrRequestNotAllowed)
+	assert.NoError(t, session.Request(request))
+	assert.Equal(t, request, readMessage(t, remote))
+	assert.Equal(t, []Request{request}, session.PendingRequests())
+
+	// Unrequested blocks are ignored.
+	sendMessages(t, remote, Piece{Index: 2, Begin: 0, Block: []byte("nope")}, Piece{Index: 1, Begin: 0, Block: []byte("data")})
+	assert.Equal(t, Event{Session: session, Type: EventPiece, Block: Piece{Index: 1, Begin: 0, Block: []byte("data")}}, nextEvent(t, events))
+	assert.Empty(t, session.PendingRequests())
+
+	// Without the Fast extension, choking drops the pending requests.
+	assert.NoError(t, session.Request(request))
+	assert.Equal(t, request, readMessage(t, remote))
+	sendMessages(t, remote, Choke{})
+	assert.Equal(t, EventChoked, nextEvent(t, events).Type)
+	assert.Equal(t, Event{Session: session, Type: EventRejected, Request: request}, nextEvent(t, events))
+	assert.Empty(t, session.PendingRequests())
+}
+
+func TestSessionUpload(t *testing.T) {
+	session, remote, events := startSession(t, SessionConfig{Bitfield: []byte{0xff, 0xc0}})
+	assert.Equal(t, Bitfield{Bits: []byte{0xff, 0xc0}}, readMessage(t, remote))
+
+	// Requests made while choked are dropped.
+	sendMessages(t, remote, Request{Index: 0, Length: 4}, Interested{})
+	assert.Equal(t, EventInterested, nextEvent(t, events).Type)
+	assert.Empty(t, session.RemoteRequests())
+
+	assert.NoError(t, session.Unchoke())
+	assert.Equal(t, Unchoke{}, readMessage(t, remote))
+
+	request := Request{Index: 3, Begin: 4, Length: 4}
+	sendMessages(t, remote, request)
+	assert.Equal(t, Event{Session: session, Type: EventRequest, Request: request}, nextEvent(t, events))
+	assert.Equal(t, []Request{request}, session.RemoteRequests())
+
+	assert.NoError(t, session.SendBlock(3, 4, []byte("data")))
+	assert.Equal(t, Piece{Index: 3, Begin: 4, Block: []byte("data")}, readMessage(t, remote))
+
+	// Canceled requests aren't served.
+	sendMessages(t, remote, request, Cancel(request))
+	assert.Equal(t, EventRequest, nextEvent(t, events).Type)
+	assert.Eventually(t, func() bool { return len(session.RemoteRequests()) == 0 }, time.Second, time.Millisecond)
+	assert.NoError(t, session.SendBlock(3, 4, []byte("data")))
+
+	assert.NoError(t, session.Have(3))
+	assert.NoError(t, session.Choke())
+	assert.Equal(t, Choke{}, readMessage(t, remote))
+}
+
+func TestSessionFastExtension(t *testing.T) {
+	session, remote, events := startSession(t, SessionConfig{
+		Capabilities: Capabilities{Fast: true},
+		Bitfield:     []byte{0xff, 0xc0},
+		AllowedFast:  []uint32{2},
+	})
+
+	assert.Equal(t, HaveAll{}, readMessage(t, remote))
+	assert.Equal(t, AllowedFast{Index: 2}, readMessage(t, remote))
+
+	// While choked, only the allowed fast pieces are served; the others are rejected.
+	allowed := Request{Index: 2, Length: 4}
+	refused := Request{Index: 3, Length: 4}
+	sendMessages(t, remote, HaveNone{}, allowed, refused)
+	assert.Equal(t, EventBitfield, nextEvent(t, events).Type)
+	assert.Equal(t, Event{Session: session, Type: EventRequest, Request: allowed}, nextEvent(t, events))
+	assert.Equal(t, RejectRequest(refused), readMessage(t, remote))
+
+	// The peer allows a piece and suggests another: we may request the allowed piece while
+	// choked, and rejected requests are reported.
+	sendMessages(t, remote, Have{Index: 5}, AllowedFast{Index: 5}, SuggestPiece{Index: 5})
+	assert.Equal(t, EventHave, nextEvent(t, events).Type)
+	assert.Equal(t, Event{Session: session, Type: EventAllowedFast, Index: 5}, nextEvent(t, events))
+	assert.Equal(t, Event{Session: session, Type: EventSuggest, Index: 5}, nextEvent(t, events))
+	assert.Equal(t, []uint32{5}, session.Suggestions())
+
+	request := Request{Index: 5, Length: 4}
+	assert.NoError(t, session.Request(request))
+	assert.Equal(t, request, readMessage(t, remote))
+	sendMessages(t, remote, Choke{}, RejectRequest(request))
+	assert.Equal(t, EventChoked, nextEvent(t, events).Type)
+	assert.Equal(t, Event{Session: session, Type: EventRejected, Request: request}, nextEvent(t, events))
+}
+
+func TestSessionKeepAliveAndIdleTimeout(t *testing.T) {
+	session, remote, events := startSession(t, SessionConfig{
+		KeepAliveInterval: 10 * time.Millisecond,
+		IdleTimeout:       200 * time.Millisecond,
+	})
+
+	assert.Equal(t, KeepAlive{}, readMessage(t, remote))
+
+	// The remote peer sends nothing: the session gives up.
+	drain(remote)
+	event := nextEvent(t, events)
+	assert.Equal(t, EventClosed, event.Type)
+	assert.ErrorIs(t, event.Err, ErrIdleTimeout)
+	assert.ErrorIs(t, session.Err(), ErrIdleTimeout)
+	assert.ErrorIs(t, session.SetInterested(true), ErrSessionClosed)
+}
+
+func TestSessionProtocolViolations(t *testing.T) {
+	for name, messages := range map[string][]TypedMessage{
+		"have out of range":   {Have{Index: 10}},
+		"bitfield too short":  {Bitfield{Bits: []byte{0xff}}},
+		"late bitfield":       {Have{Index: 1}, Bitfield{Bits: []byte{0xff, 0xc0}}},
+		"fast not negotiated": {HaveAll{}},
+		"huge request":        {Request{Index: 1, Length: MaxBlockSize + 1}},
+	} {
+		_, remote, events := startSession(t, SessionConfig{})
+		drain(remote)
+		sendMessages(t, remote, messages...)
+
+		event := nextEvent(t, events)
+		for event.Type != EventClosed {
+			event = nextEvent(t, events)
+		}
+		assert.Error(t, event.Err, name)
+	}
+}
+
+// drain reads the messages the session sends, until the connection is closed.
+func drain(conn PeerWireConnection) {
+	go func() {
+		for {
+			if _, err := conn.ReadPeerMessage(); err != nil {
+				return
+			}
+		}
+	}()
+}
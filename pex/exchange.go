@@ -0,0 +1,326 @@
+package pex
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"maps"
+	"net"
+	"sync"
+	"time"
+
+	"github.com/dpnam2112/bittorrent-client/common"
+)
+
+const (
+	// SendInterval is the minimum time between two ut_pex messages on a connection (BEP 11).
+	SendInterval = 1 * time.Minute
+	// Messages received more often than this are ignored. It's a bit shorter than SendInterval
+	// to tolerate timer jitter on the remote side.
+	minReceiveInterval = 45 * time.Second
+
+	// Maximum number of added and dropped peers per message, in both directions.
+	maxAddedPerMessage   = 50
+	maxDroppedPerMessage = 50
+	// Maximum number of peers learned from a single connection over its lifetime.
+	maxPeersPerConnection = 200
+
+	defaultMaxKnownPeers = 1000
+)
+
+type PeerDiscoveryHandler func(peers []common.PeerAddr) error
+
+type Config struct {
+	// MaxKnownPeers caps the number of distinct peers learned through PEX for a torrent.
+	// Defaults to 1000.
+	MaxKnownPeers int
+	Logger        *slog.Logger
+}
+
+// Exchange runs peer exchange for a torrent. It tracks our connected peers, periodically sends
+// every connection that negotiated ut_pex the changes since its previous message, and passes the
+// peers received from them to the registered handlers.
+type Exchange struct {
+	config Config
+	logger *slog.Logger
+	now    func() time.Time
+
+	mu        sync.Mutex
+	connected map[common.PeerAddr]Flags
+	conns     map[*Conn]struct{}
+	known     map[common.PeerAddr]struct{}
+	handlers  []PeerDiscoveryHandler
+
+	cancel context.CancelFunc
+	wg     sync.WaitGroup
+}
+
+var _ common.LifeCycle = (*Exchange)(nil)
+
+func NewExchange(config Config) *Exchange {
+	if config.Logger == nil {
+		config.Logger = slog.Default()
+	}
+
+	if config.MaxKnownPeers <= 0 {
+		config.MaxKnownPeers = defaultMaxKnownPeers
+	}
+
+	return &Exchange{
+		config:    config,
+		logger:    config.Logger,
+		now:       time.Now,
+		connected: make(map[common.PeerAddr]Flags),
+		conns:     make(map[*Conn]struct{}),
+		known:     make(map[common.PeerAddr]struct{}),
+	}
+}
+
+// Start sends the pending deltas every SendInterval until Close is called or ctx is cancelled.
+func (e *Exchange) Start(ctx context.Context) error {
+	if e.cancel != nil {
+		return fmt.Errorf("Peer exchange is already started.")
+	}
+
+	ctx, e.cancel = context.WithCancel(ctx)
+
+	e.wg.Add(1)
+	go func() {
+		defer e.wg.Done()
+
+		ticker := time.NewTicker(SendInterval)
+		defer ticker.Stop()
+
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case <-ticker.C:
+				e.flush()
+			}
+		}
+	}()
+
+	return nil
+}
+
+func (e *Exchange) Close() error {
+	if e.cancel == nil {
+		return nil
+	}
+	e.cancel()
+	e.wg.Wait()
+	return nil
+}
+
+// RegisterHandler registers a function called with the new peers received from connections.
+func (e *Exchange) RegisterHandler(handler PeerDiscoveryHandler) {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	e.handlers = append(e.handlers, handler)
+}
+
+// AddPeer records that we are connected to a peer listening on addr. It's announced to the
+// other connections with the next message.
+func (e *Exchange) AddPeer(addr common.PeerAddr, flags Flags) {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	e.connected[addr] = flags
+}
+
+// RemovePeer records that we disconnected from a peer. It's announced as dropped to the
+// connections it was announced to.
+func (e *Exchange) RemovePeer(addr common.PeerAddr) {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	delete(e.connected, addr)
+}
+
+// Peers returns the connected peers, with their flags.
+func (e *Exchange) Peers() map[common.PeerAddr]Flags {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	return maps.Clone(e.connected)
+}
+
+// Connect registers a connection that negotiated ut_pex. remote is the listen address of the
+// peer, which is never sent back to it; send is called with the payloads of the ut_pex messages
+// to send on the connection.
+func (e *Exchange) Connect(remote common.PeerAddr, send func(payload []byte) error) *Conn {
+	conn := &Conn{
+		exchange: e,
+		remote:   remote,
+		send:     send,
+		sent:     make(map[common.PeerAddr]Flags),
+	}
+
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	e.conns[conn] = struct{}{}
+	return conn
+}
+
+func (e *Exchange) flush() {
+	e.mu.Lock()
+	conns := make([]*Conn, 0, len(e.conns))
+	for conn := range e.conns {
+		conns = append(conns, conn)
+	}
+	e.mu.Unlock()
+
+	for _, conn := range conns {
+		if err := conn.flush(); err != nil {
+			e.logger.Debug("Failed to send ut_pex message", "peer", conn.remote, "err", err)
+		}
+	}
+}
+
+// learn records peers received from a connection, and returns those that weren't known yet.
+func (e *Exchange) learn(peers []common.PeerAddr) []common.PeerAddr {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+
+	var fresh []common.PeerAddr
+	for _, addr := range peers {
+		if len(e.known) >= e.config.MaxKnownPeers {
+			break
+		}
+		if _, ok := e.known[addr]; ok {
+			continue
+		}
+		if _, ok := e.connected[addr]; ok {
+			continue
+		}
+		e.known[addr] = struct{}{}
+		fresh = append(fresh, addr)
+	}
+	return fresh
+}
+
+// Conn is the ut_pex state of a single connection.
+type Conn struct {
+	exchange *Exchange
+	remote   common.PeerAddr
+	send     func(payload []byte) error
+
+	mu           sync.Mutex
+	sent         map[common.PeerAddr]Flags
+	lastSent     time.Time
+	lastReceived time.Time
+	learned      int
+}
+
+// Close unregisters the connection.
+func (c *Conn) Close() {
+	c.exchange.mu.Lock()
+	defer c.exchange.mu.Unlock()
+	delete(c.exchange.conns, c)
+}
+
+// flush sends the peers added and dropped since the previous message, unless a message was sent
+// less than SendInterval ago or there is nothing to send.
+func (c *Conn) flush() error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	now := c.exchange.now()
+	if !c.lastSent.IsZero() && now.Sub(c.lastSent) < SendInterval {
+		return nil
+	}
+
+	c.exchange.mu.Lock()
+	var msg Message
+	for addr, flags := range c.exchange.connected {
+		if len(msg.Added) == maxAddedPerMessage {
+			break
+		}
+		if addr == c.remote {
+			continue
+		}
+		if sentFlags, ok := c.sent[addr]; !ok || sentFlags != flags {
+			msg.Added = append(msg.Added, PeerEntry{Addr: addr, Flags: flags})
+		}
+	}
+	for addr := range c.sent {
+		if len(msg.Dropped) == maxDroppedPerMessage {
+			break
+		}
+		if _, ok := c.exchange.connected[addr]; !ok {
+			msg.Dropped = append(msg.Dropped, addr)
+		}
+	}
+	c.exchange.mu.Unlock()
+
+	if len(msg.Added) == 0 && len(msg.Dropped) == 0 {
+		return nil
+	}
+
+	if err := c.send(msg.Marshal()); err != nil {
+		return err
+	}
+
+	c.lastSent = now
+	for _, entry := range msg.Added {
+		c.sent[entry.Addr] = entry.Flags
+	}
+	for _, addr := range msg.Dropped {
+		delete(c.sent, addr)
+	}
+	return nil
+}
+
+// HandleMessage processes the payload of a ut_pex message received on the connection. Messages
+// sent too often are ignored, and the number of peers accepted per message and per connection is
+// capped, so that a single peer can't flood the peer list.
+func (c *Conn) HandleMessage(payload []byte) error {
+	msg, err := UnmarshalMessage(payload)
+	if err != nil {
+		return err
+	}
+
+	c.mu.Lock()
+	now := c.exchange.now()
+	if !c.lastReceived.IsZero() && now.Sub(c.lastReceived) < minReceiveInterval {
+		c.mu.Unlock()
+		c.exchange.logger.Debug("Ignoring ut_pex message sent too early", "peer", c.remote)
+		return nil
+	}
+	c.lastReceived = now
+
+	var candidates []common.PeerAddr
+	for _, entry := range msg.Added {
+		if len(candidates) == maxAddedPerMessage || c.learned+len(candidates) >= maxPeersPerConnection {
+			break
+		}
+		if entry.Addr != c.remote && validPeerAddr(entry.Addr) {
+			candidates = append(candidates, entry.Addr)
+		}
+	}
+	c.mu.Unlock()
+
+	fresh := c.exchange.learn(candidates)
+	if len(fresh) == 0 {
+		return nil
+	}
+
+	c.mu.Lock()
+	c.learned += len(fresh)
+	c.mu.Unlock()
+
+	c.exchange.mu.Lock()
+	handlers := append([]PeerDiscoveryHandler(nil), c.exchange.handlers...)
+	c.exchange.mu.Unlock()
+
+	for _, handler := range handlers {
+		if err := handler(fresh); err != nil {
+			c.exchange.logger.Debug("PEX peer discovery handler failed", "err", err)
+		}
+	}
+	return nil
+}
+
+// validPeerAddr rejects addresses no peer can be listening on.
+func validPeerAddr(addr common.PeerAddr) bool {
+	ip := net.ParseIP(addr.Host)
+	return addr.Port != 0 && ip != nil && !ip.IsUnspecified() && !ip.IsMulticast()
+}
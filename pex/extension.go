@@ -0,0 +1,46 @@
+package pex
+
+import (
+	"net"
+
+	"github.com/dpnam2112/bittorrent-client/common"
+	"github.com/dpnam2112/bittorrent-client/peer"
+)
+
+// Extension returns the BEP 10 extension running ut_pex on the connections of the torrent.
+func (e *Exchange) Extension() peer.Extension {
+	return extension{exchange: e}
+}
+
+type extension struct {
+	exchange *Exchange
+}
+
+func (extension) Name() string {
+	return ExtensionName
+}
+
+// Connect registers the connection to the exchange, keyed on the listen address of the remote
+// peer, so that it's never sent its own address.
+func (ext extension) Connect(conn peer.ExtensionConn, remote peer.ExtensionHandshake) (peer.ExtensionHandler, error) {
+	return ext.exchange.Connect(remoteListenAddr(conn.RemoteAddr(), remote.P), conn.Send), nil
+}
+
+// remoteListenAddr returns the address a peer listens on: the address of the connection, with
+// the port of its extension handshake when it advertises one. The port only applies to a known
+// IP: connections without one are keyed on their address, which matches no peer.
+func remoteListenAddr(remoteAddr net.Addr, port uint16) common.PeerAddr {
+	tcpAddr, ok := remoteAddr.(*net.TCPAddr)
+	if !ok || tcpAddr.IP == nil {
+		if remoteAddr == nil {
+			return common.PeerAddr{}
+		}
+		return common.PeerAddr{Host: remoteAddr.String()}
+	}
+
+	addr := common.PeerAddr{Host: tcpAddr.IP.String(), Port: uint16(tcpAddr.Port)}
+	if port != 0 {
+		addr.Port = port
+	}
+	return addr
+}
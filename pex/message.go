@@ -0,0 +1,168 @@
+package pex
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"net"
+
+	"github.com/dpnam2112/bittorrent-client/bencode"
+	"github.com/dpnam2112/bittorrent-client/common"
+)
+
+// ExtensionName is the name ut_pex is registered under in the extension handshake (BEP 10).
+const ExtensionName = "ut_pex"
+
+// Flags describe a peer in the 'added.f' and 'added6.f' lists, one byte per added peer.
+type Flags uint8
+
+const (
+	FlagPrefersEncryption Flags = 0x01
+	FlagSeed              Flags = 0x02
+	FlagUTP               Flags = 0x04
+	FlagHolepunch         Flags = 0x08
+	// The peer accepted an incoming connection, so it's reachable from outside.
+	FlagReachable Flags = 0x10
+)
+
+// PeerEntry is a peer in the 'added' lists.
+type PeerEntry struct {
+	Addr  common.PeerAddr
+	Flags Flags
+}
+
+// Message is the payload of a ut_pex extended message: the peers connected and disconnected
+// since the previous message sent on the connection.
+//
+// Wire layout (bencoded dictionary, all values are strings):
+//
+//	added:    compact IPv4 peers (6 bytes each)
+//	added.f:  one flags byte per IPv4 added peer
+//	added6:   compact IPv6 peers (18 bytes each)
+//	added6.f: one flags byte per IPv6 added peer
+//	dropped:  compact IPv4 peers
+//	dropped6: compact IPv6 peers
+type Message struct {
+	Added   []PeerEntry
+	Dropped []common.PeerAddr
+}
+
+func (msg Message) Marshal() []byte {
+	var added, addedFlags, added6, added6Flags []byte
+	for _, entry := range msg.Added {
+		compact, ipv6, ok := marshalCompactPeer(entry.Addr)
+		if !ok {
+			continue
+		}
+		if ipv6 {
+			added6 = append(added6, compact...)
+			added6Flags = append(added6Flags, byte(entry.Flags))
+		} else {
+			added = append(added, compact...)
+			addedFlags = append(addedFlags, byte(entry.Flags))
+		}
+	}
+
+	var dropped, dropped6 []byte
+	for _, addr := range msg.Dropped {
+		compact, ipv6, ok := marshalCompactPeer(addr)
+		if !ok {
+			continue
+		}
+		if ipv6 {
+			dropped6 = append(dropped6, compact...)
+		} else {
+			dropped = append(dropped, compact...)
+		}
+	}
+
+	dict := map[string]bencode.BValue{
+		"added":    &bencode.BString{Value: added},
+		"added.f":  &bencode.BString{Value: addedFlags},
+		"added6":   &bencode.BString{Value: added6},
+		"added6.f": &bencode.BString{Value: added6Flags},
+		"dropped":  &bencode.BString{Value: dropped},
+		"dropped6": &bencode.BString{Value: dropped6},
+	}
+	return bencode.Encode(&bencode.BDict{Dict: dict})
+}
+
+func UnmarshalMessage(raw []byte) (Message, error) {
+	var msg Message
+
+	_, value, err := bencode.ParseBencode(raw)
+	if err != nil {
+		return msg, fmt.Errorf("Failed to parse ut_pex message: %w", err)
+	}
+
+	dict, ok := value.(*bencode.BDict)
+	if !ok {
+		return msg, errors.New("ut_pex message is not a dictionary")
+	}
+
+	for _, family := range []struct {
+		added, flags, dropped string
+		size                  int
+	}{
+		{"added", "added.f", "dropped", 6},
+		{"added6", "added6.f", "dropped6", 18},
+	} {
+		added, err := unmarshalCompactPeers(getBytes(dict, family.added), family.size)
+		if err != nil {
+			return msg, err
+		}
+
+		// Flags are optional; a missing or short list leaves the remaining peers without flags.
+		flags := getBytes(dict, family.flags)
+		for i, addr := range added {
+			entry := PeerEntry{Addr: addr}
+			if i < len(flags) {
+				entry.Flags = Flags(flags[i])
+			}
+			msg.Added = append(msg.Added, entry)
+		}
+
+		dropped, err := unmarshalCompactPeers(getBytes(dict, family.dropped), family.size)
+		if err != nil {
+			return msg, err
+		}
+		msg.Dropped = append(msg.Dropped, dropped...)
+	}
+
+	return msg, nil
+}
+
+func getBytes(dict *bencode.BDict, key string) []byte {
+	if value, ok := dict.Dict[key].(*bencode.BString); ok {
+		return value.Value
+	}
+	return nil
+}
+
+// marshalCompactPeer encodes an address as 4 or 16 bytes of IP followed by the port. ok is false
+// if the host isn't an IP address.
+func marshalCompactPeer(addr common.PeerAddr) (compact []byte, ipv6 bool, ok bool) {
+	ip := net.ParseIP(addr.Host)
+	if ip == nil {
+		return nil, false, false
+	}
+
+	if ip4 := ip.To4(); ip4 != nil {
+		return binary.BigEndian.AppendUint16(append([]byte{}, ip4...), addr.Port), false, true
+	}
+	return binary.BigEndian.AppendUint16(append([]byte{}, ip...), addr.Port), true, true
+}
+
+func unmarshalCompactPeers(raw []byte, size int) ([]common.PeerAddr, error) {
+	if len(raw)%size != 0 {
+		return nil, fmt.Errorf("Compact peer list length %d is not a multiple of %d", len(raw), size)
+	}
+
+	peers := make([]common.PeerAddr, 0, len(raw)/size)
+	for offset := 0; offset < len(raw); offset += size {
+		ip := net.IP(raw[offset : offset+size-2])
+		port := binary.BigEndian.Uint16(raw[offset+size-2:])
+		peers = append(peers, common.PeerAddr{Host: ip.String(), Port: port})
+	}
+	return peers, nil
+}
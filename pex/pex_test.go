@@ -0,0 +1,190 @@
+package pex
+
+import (
+	"fmt"
+	"io"
+	"log/slog"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/dpnam2112/bittorrent-client/common"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestMessageRoundTrip(t *testing.T) {
+	msg := Message{
+		Added: []PeerEntry{
+			{Addr: common.PeerAddr{Host: "10.0.0.1", Port: 6881}, Flags: FlagSeed | FlagReachable},
+			{Addr: common.PeerAddr{Host: "2001:db8::1", Port: 6882}, Flags: FlagUTP},
+			{Addr: common.PeerAddr{Host: "10.0.0.2", Port: 6883}},
+		},
+		Dropped: []common.PeerAddr{
+			{Host: "10.0.0.3", Port: 6884},
+			{Host: "2001:db8::2", Port: 6885},
+		},
+	}
+
+	raw := msg.Marshal()
+	assert.Contains(t, string(raw), "7:added.f2:\x12\x00")
+
+	decoded, err := UnmarshalMessage(raw)
+	assert.NoError(t, err)
+	assert.ElementsMatch(t, msg.Added, decoded.Added)
+	assert.ElementsMatch(t, msg.Dropped, decoded.Dropped)
+
+	// Flags are optional.
+	decoded, err = UnmarshalMessage([]byte("d5:added6:\x0a\x00\x00\x01\x1a\xe1e"))
+	assert.NoError(t, err)
+	assert.Equal(t, []PeerEntry{{Addr: common.PeerAddr{Host: "10.0.0.1", Port: 6881}}}, decoded.Added)
+
+	_, err = UnmarshalMessage([]byte("d5:added5:\x0a\x00\x00\x01\x1ae"))
+	assert.Error(t, err)
+}
+
+type fakeClock struct{ now time.Time }
+
+func (c *fakeClock) Now() time.Time { return c.now }
+
+func newTestExchange(maxKnown int) (*Exchange, *fakeClock) {
+	clock := &fakeClock{now: time.Unix(1_700_000_000, 0)}
+	exchange := NewExchange(Config{
+		MaxKnownPeers: maxKnown,
+		Logger:        slog.New(slog.NewTextHandler(io.Discard, nil)),
+	})
+	exchange.now = clock.Now
+	return exchange, clock
+}
+
+func addr(i int) common.PeerAddr {
+	return common.PeerAddr{Host: fmt.Sprintf("10.0.%d.%d", i/256, i%256), Port: 6881}
+}
+
+func TestExchangeSendsDeltas(t *testing.T) {
+	exchange, clock := newTestExchange(0)
+
+	var sent []Message
+	remote := addr(1)
+	conn := exchange.Connect(remote, func(payload []byte) error {
+		msg, err := UnmarshalMessage(payload)
+		sent = append(sent, msg)
+		return err
+	})
+
+	exchange.AddPeer(remote, FlagReachable)
+	exchange.AddPeer(addr(2), FlagSeed)
+	exchange.AddPeer(addr(3), 0)
+
+	// The first message lists every connected peer except the recipient.
+	exchange.flush()
+	assert.Len(t, sent, 1)
+	assert.ElementsMatch(t, []PeerEntry{{Addr: addr(2), Flags: FlagSeed}, {Addr: addr(3)}}, sent[0].Added)
+
+	// No more than one message per minute.
+	exchange.RemovePeer(addr(2))
+	exchange.AddPeer(addr(4), FlagPrefersEncryption)
+	clock.now = clock.now.Add(30 * time.Second)
+	exchange.flush()
+	assert.Len(t, sent, 1)
+
+	clock.now = clock.now.Add(30 * time.Second)
+	exchange.flush()
+	assert.Len(t, sent, 2)
+	assert.Equal(t, []PeerEntry{{Addr: addr(4), Flags: FlagPrefersEncryption}}, sent[1].Added)
+	assert.Equal(t, []common.PeerAddr{addr(2)}, sent[1].Dropped)
+
+	// Nothing changed: nothing is sent.
+	clock.now = clock.now.Add(time.Minute)
+	exchange.flush()
+	assert.Len(t, sent, 2)
+
+	// Added peers are capped per message; the rest goes out with the next one.
+	for i := 10; i < 10+maxAddedPerMessage+5; i++ {
+		exchange.AddPeer(addr(i), 0)
+	}
+	exchange.flush()
+	assert.Len(t, sent[2].Added, maxAddedPerMessage)
+	clock.now = clock.now.Add(time.Minute)
+	exchange.flush()
+	assert.Len(t, sent[3].Added, 5)
+
+	// Closed connections don't receive messages anymore.
+	conn.Close()
+	exchange.AddPeer(addr(5), 0)
+	clock.now = clock.now.Add(time.Minute)
+	exchange.flush()
+	assert.Len(t, sent, 4)
+}
+
+func TestExchangeReceiveCapsAndDedupes(t *testing.T) {
+	exchange, clock := newTestExchange(120)
+
+	var discovered []common.PeerAddr
+	exchange.RegisterHandler(func(peers []common.PeerAddr) error {
+		discovered = append(discovered, peers...)
+		return nil
+	})
+
+	remote := addr(1)
+	conn := exchange.Connect(remote, func([]byte) error { return nil })
+	other := exchange.Connect(addr(2), func([]byte) error { return nil })
+
+	message := func(from, to int) []byte {
+		var msg Message
+		for i := from; i < to; i++ {
+			msg.Added = append(msg.Added, PeerEntry{Addr: addr(i)})
+		}
+		return msg.Marshal()
+	}
+
+	// Invalid addresses and the sender itself are skipped, and only maxAddedPerMessage peers
+	// are accepted per message.
+	bogus := Message{Added: []PeerEntry{
+		{Addr: remote},
+		{Addr: common.PeerAddr{Host: "0.0.0.0", Port: 6881}},
+		{Addr: common.PeerAddr{Host: "10.9.9.9", Port: 0}},
+	}}
+	assert.NoError(t, conn.HandleMessage(bogus.Marshal()))
+	assert.Empty(t, discovered)
+
+	clock.now = clock.now.Add(time.Minute)
+	assert.NoError(t, conn.HandleMessage(message(100, 200)))
+	assert.Len(t, discovered, maxAddedPerMessage)
+
+	// Messages sent too early are ignored.
+	clock.now = clock.now.Add(10 * time.Second)
+	assert.NoError(t, conn.HandleMessage(message(200, 210)))
+	assert.Len(t, discovered, maxAddedPerMessage)
+
+	// Peers already known are not reported twice, and the torrent-wide cap applies.
+	clock.now = clock.now.Add(time.Minute)
+	assert.NoError(t, other.HandleMessage(message(100, 150)))
+	assert.Len(t, discovered, maxAddedPerMessage)
+
+	for i := 0; i < 3; i++ {
+		clock.now = clock.now.Add(time.Minute)
+		assert.NoError(t, other.HandleMessage(message(300+50*i, 350+50*i)))
+	}
+	assert.Len(t, discovered, 120)
+	assert.Len(t, dedupe(discovered), 120)
+}
+
+func dedupe(peers []common.PeerAddr) map[common.PeerAddr]struct{} {
+	set := make(map[common.PeerAddr]struct{})
+	for _, p := range peers {
+		set[p] = struct{}{}
+	}
+	return set
+}
+
+func TestRemoteListenAddr(t *testing.T) {
+	tcpAddr := &net.TCPAddr{IP: net.ParseIP("10.0.0.1"), Port: 51413}
+	assert.Equal(t, common.PeerAddr{Host: "10.0.0.1", Port: 51413}, remoteListenAddr(tcpAddr, 0))
+	assert.Equal(t, common.PeerAddr{Host: "10.0.0.1", Port: 6881}, remoteListenAddr(tcpAddr, 6881))
+
+	// Without an IP, the handshake port doesn't make an address of its own.
+	unixAddr := &net.UnixAddr{Name: "/tmp/peer.sock", Net: "unix"}
+	assert.Equal(t, common.PeerAddr{Host: "/tmp/peer.sock"}, remoteListenAddr(unixAddr, 6881))
+	assert.Equal(t, common.PeerAddr{Host: ":0"}, remoteListenAddr(&net.TCPAddr{}, 6881))
+	assert.Equal(t, common.PeerAddr{}, remoteListenAddr(nil, 6881))
+}
@@ -0,0 +1,568 @@
+package picker
+
+import (
+	"math/rand/v2"
+	"slices"
+	"sync"
+
+	"github.com/dpnam2112/bittorrent-client/peer"
+)
+
+const defaultRandomFirstPieces = 4
+
+// In endgame, a block is requested from at most this many peers at once.
+const maxEndgameRequesters = 3
+
+type Config struct {
+	NumPieces   int
+	PieceLength int64
+	// TotalLength is the size of the torrent content, which gives the size of the last piece.
+	TotalLength int64
+	// BlockSize is the size of the requested blocks. Defaults to 16 KiB.
+	BlockSize uint32
+	// RandomFirstPieces is the number of pieces to complete, picked at random, before switching
+	// to rarest first: the rarest pieces are slow to get, while the first pieces are needed soon
+	// to have something to upload. Defaults to 4; a negative value picks rarest first right away.
+	RandomFirstPieces int
+	// Rand breaks ties between pieces. Defaults to a randomly seeded generator; tests set a seeded
+	// one to get the same picks on every run.
+	Rand *rand.Rand
+}
+
+// Picker decides which blocks to request from which peer. It tracks the availability of the
+// pieces among the peers, from their bitfield and have messages, and the state of the pieces
+// being downloaded:
+//   - the blocks of the pieces already started are requested first, so that pieces complete
+//     and can be verified and shared as soon as possible;
+//   - otherwise, a new piece is started: one at random for the first few pieces, then the rarest
+//     piece among the connected peers, ties broken at random;
+//   - once every missing block is requested, the picker is in endgame: the blocks still in flight
+//     are requested from other peers as well, and the extra requests are canceled as soon as one
+//     of them arrives, so that a slow peer doesn't hold back the end of the download.
+type Picker struct {
+	config Config
+
+	mu           sync.Mutex
+	have         []bool
+	haveCount    int
+	availability []int
+	// partial are the pieces started and not verified yet, in the order they were started.
+	partial map[uint32]*pieceState
+	order   []uint32
+	// unrequested is the number of blocks of the missing pieces that are neither received nor
+	// requested. The picker is in endgame when it reaches 0.
+	unrequested int
+	// exclusive are the pieces to download from a single peer.
+	exclusive map[uint32]struct{}
+}
+
+type pieceState struct {
+	blocks   []blockState
+	received int
+	// owner is the only peer the blocks of an exclusive piece are requested from, nil for the
+	// other pieces.
+	owner *Peer
+}
+
+type blockState struct {
+	received   bool
+	requesters []*Peer
+}
+
+// Peer is the state of a connected peer in the picker: its pieces and its requests.
+type Peer struct {
+	picker *Picker
+	// pieces is only accessed with the lock of the picker held.
+	pieces  []bool
+	removed bool
+}
+
+// Duplicate is a request sent to another peer for a block that was received, to be canceled.
+type Duplicate struct {
+	Peer    *Peer
+	Request peer.Request
+}
+
+func New(config Config) *Picker {
+	if config.BlockSize == 0 {
+		config.BlockSize = peer.StandardBlockSize
+	}
+	if config.RandomFirstPieces == 0 {
+		config.RandomFirstPieces = defaultRandomFirstPieces
+	}
+	if config.Rand == nil {
+		config.Rand = rand.New(rand.NewPCG(rand.Uint64(), rand.Uint64()))
+	}
+
+	p := &Picker{
+		config:       config,
+		have:         make([]bool, config.NumPieces),
+		availability: make([]int, config.NumPieces),
+		partial:      make(map[uint32]*pieceState),
+		exclusive:    make(map[uint32]struct{}),
+	}
+	for index := range config.NumPieces {
+		p.unrequested += p.numBlocks(uint32(index))
+	}
+	return p
+}
+
+func (p *Picker) pieceLength(index uint32) int64 {
+	if int(index) == p.config.NumPieces-1 {
+		return p.config.TotalLength - int64(index)*p.config.PieceLength
+	}
+	return p.config.PieceLength
+}
+
+func (p *Picker) numBlocks(index uint32) int {
+	blockSize := int64(p.config.BlockSize)
+	return int((p.pieceLength(index) + blockSize - 1) / blockSize)
+}
+
+func (p *Picker) blockRequest(index uint32, block int) peer.Request {
+	begin := uint32(block) * p.config.BlockSize
+	length := min(int64(p.config.BlockSize), p.pieceLength(index)-int64(begin))
+	return peer.Request{Index: index, Begin: begin, Length: uint32(length)}
+}
+
+// block returns the state of the block of a request, or nil if the piece isn't being downloaded
+// or the request isn't one of its blocks.
+func (p *Picker) block(request peer.Request) (*pieceState, *blockState) {
+	piece, ok := p.partial[request.Index]
+	if !ok || request.Begin%p.config.BlockSize != 0 {
+		return nil, nil
+	}
+	block := int(request.Begin / p.config.BlockSize)
+	if block >= len(piece.blocks) || p.blockRequest(request.Index, block) != request {
+		return nil, nil
+	}
+	return piece, &piece.blocks[block]
+}
+
+// unrequestedBlocks returns the number of blocks of a missing piece that are neither received nor
+// requested.
+func (p *Picker) unrequestedBlocks(index uint32) int {
+	piece, ok := p.partial[index]
+	if !ok {
+		return p.numBlocks(index)
+	}
+	count := 0
+	for _, block := range piece.blocks {
+		if !block.received && len(block.requesters) == 0 {
+			count++
+		}
+	}
+	return count
+}
+
+func (p *Picker) removePartial(index uint32) {
+	delete(p.partial, index)
+	if i := slices.Index(p.order, index); i >= 0 {
+		p.order = slices.Delete(p.order, i, i+1)
+	}
+}
+
+// NewPeer adds a peer, which has no piece until its bitfield or have messages are recorded.
+func (p *Picker) NewPeer() *Peer {
+	return &Peer{picker: p, pieces: make([]bool, p.config.NumPieces)}
+}
+
+// SetHave records a piece we have, verified or resumed from disk.
+func (p *Picker) SetHave(index uint32) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	if int(index) >= len(p.have) || p.have[index] {
+		return
+	}
+	p.unrequested -= p.unrequestedBlocks(index)
+	p.removePartial(index)
+	delete(p.exclusive, index)
+	p.have[index] = true
+	p.haveCount++
+}
+
+// Reset discards the blocks of a piece, e.g. when it failed verification, so that it's
+// downloaded again. The requests in flight for it are forgotten: their blocks are ignored.
+func (p *Picker) Reset(index uint32) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	if int(index) >= len(p.have) || p.have[index] {
+		return
+	}
+	p.unrequested += p.numBlocks(index) - p.unrequestedBlocks(index)
+	p.removePartial(index)
+}
+
+// SetExclusive makes the next download of a piece come from a single peer, e.g. to find out
+// which peer sent corrupt data when several peers contributed to a piece that failed
+// verification. The blocks received already are kept: reset the piece first to discard them.
+func (p *Picker) SetExclusive(index uint32) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	if int(index) >= len(p.have) || p.have[index] {
+		return
+	}
+	p.exclusive[index] = struct{}{}
+	if piece, ok := p.partial[index]; ok && piece.owner == nil {
+		piece.owner = p.requester(piece)
+	}
+}
+
+// requester returns a peer with a request in flight for the piece, or nil.
+func (p *Picker) requester(piece *pieceState) *Peer {
+	for _, block := range piece.blocks {
+		if len(block.requesters) > 0 {
+			return block.requesters[0]
+		}
+	}
+	return nil
+}
+
+// available reports whether the blocks of a piece may be requested from the peer.
+func (p *Picker) available(piece *pieceState, index uint32, pp *Peer) bool {
+	if !pp.pieces[index] {
+		return false
+	}
+	_, exclusive := p.exclusive[index]
+	return !exclusive || piece.owner == nil || piece.owner == pp
+}
+
+func (p *Picker) Have(index uint32) bool {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return int(index) < len(p.have) && p.have[index]
+}
+
+// Bitfield returns the pieces we have, as sent in a bitfield message.
+func (p *Picker) Bitfield() []byte {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	bitfield := make([]byte, (len(p.have)+7)/8)
+	for index, have := range p.have {
+		if have {
+			bitfield[index/8] |= 0x80 >> (index % 8)
+		}
+	}
+	return bitfield
+}
+
+// Complete reports whether we have every piece.
+func (p *Picker) Complete() bool {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return p.haveCount == len(p.have)
+}
+
+// Availability returns the number of connected peers that have a piece.
+func (p *Picker) Availability(index uint32) int {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if int(index) >= len(p.availability) {
+		return 0
+	}
+	return p.availability[index]
+}
+
+// Endgame reports whether every missing block is requested.
+func (p *Picker) Endgame() bool {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return p.unrequested == 0 && p.haveCount < len(p.have)
+}
+
+// SetBitfield records the pieces the peer announced with a bitfield, HaveAll or HaveNone message.
+// Bits past the last piece are ignored.
+func (pp *Peer) SetBitfield(bitfield []byte) {
+	p := pp.picker
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if pp.removed {
+		return
+	}
+
+	for index := range pp.pieces {
+		has := index/8 < len(bitfield) && bitfield[index/8]&(0x80>>(index%8)) != 0
+		if has != pp.pieces[index] {
+			pp.pieces[index] = has
+			if has {
+				p.availability[index]++
+			} else {
+				p.availability[index]--
+			}
+		}
+	}
+}
+
+// Have records a piece the peer announced with a have message.
+func (pp *Peer) Have(index uint32) {
+	p := pp.picker
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if pp.removed || int(index) >= len(pp.pieces) || pp.pieces[index] {
+		return
+	}
+	pp.pieces[index] = true
+	p.availability[index]++
+}
+
+// Interesting reports whether the peer has a piece we don't have.
+func (pp *Peer) Interesting() bool {
+	p := pp.picker
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	for index, has := range pp.pieces {
+		if has && !p.have[index] {
+			return true
+		}
+	}
+	return false
+}
+
+// Remove removes a disconnected peer: its pieces no longer count in the availability, and its
+// requests in flight can be sent to other peers.
+func (pp *Peer) Remove() {
+	p := pp.picker
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if pp.removed {
+		return
+	}
+	pp.removed = true
+
+	for index, has := range pp.pieces {
+		if has {
+			p.availability[index]--
+		}
+	}
+	for _, piece := range p.partial {
+		for i := range piece.blocks {
+			p.dropRequester(&piece.blocks[i], pp)
+		}
+		if piece.owner == pp {
+			piece.owner = nil
+		}
+	}
+}
+
+// dropRequester removes a peer from the requesters of a block.
+func (p *Picker) dropRequester(block *blockState, pp *Peer) {
+	i := slices.Index(block.requesters, pp)
+	if i < 0 {
+		return
+	}
+	block.requesters = slices.Delete(block.requesters, i, i+1)
+	if len(block.requesters) == 0 && !block.received {
+		p.unrequested++
+	}
+}
+
+// Pick returns the next block to request from the peer, and records the request. It returns false
+// when the peer has nothing we need that isn't requested already. It fits Pipeline.Fill.
+func (pp *Peer) Pick() (peer.Request, bool) {
+	p := pp.picker
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if pp.removed {
+		return peer.Request{}, false
+	}
+
+	// Finish the pieces already started.
+	for _, index := range p.order {
+		if request, ok := p.pickBlock(index, pp); ok {
+			return request, true
+		}
+	}
+
+	if index, ok := p.pickPiece(pp); ok {
+		return p.startPiece(index, pp), true
+	}
+
+	if p.unrequested == 0 {
+		return p.pickEndgame(pp, nil)
+	}
+	return peer.Request{}, false
+}
+
+// PickFrom is Pick restricted to some pieces, tried in order: the pieces the peer suggested, or
+// the pieces it lets us request while it chokes us. Pieces we have, or the peer doesn't, are
+// skipped.
+func (pp *Peer) PickFrom(pieces []uint32) (peer.Request, bool) {
+	p := pp.picker
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if pp.removed || len(pieces) == 0 {
+		return peer.Request{}, false
+	}
+
+	for _, index := range pieces {
+		if int(index) >= len(pp.pieces) || !pp.pieces[index] || p.have[index] {
+			continue
+		}
+		if _, ok := p.partial[index]; !ok {
+			return p.startPiece(index, pp), true
+		}
+		if request, ok := p.pickBlock(index, pp); ok {
+			return request, true
+		}
+	}
+
+	if p.unrequested == 0 {
+		return p.pickEndgame(pp, pieces)
+	}
+	return peer.Request{}, false
+}
+
+// pickBlock picks a block of a piece being downloaded that is neither received nor requested.
+func (p *Picker) pickBlock(index uint32, pp *Peer) (peer.Request, bool) {
+	piece := p.partial[index]
+	if !p.available(piece, index, pp) {
+		return peer.Request{}, false
+	}
+	for i := range piece.blocks {
+		block := &piece.blocks[i]
+		if !block.received && len(block.requesters) == 0 {
+			block.requesters = append(block.requesters, pp)
+			p.unrequested--
+			if _, ok := p.exclusive[index]; ok {
+				piece.owner = pp
+			}
+			return p.blockRequest(index, i), true
+		}
+	}
+	return peer.Request{}, false
+}
+
+// startPiece starts downloading a piece, and requests its first block from the peer.
+func (p *Picker) startPiece(index uint32, pp *Peer) peer.Request {
+	piece := &pieceState{blocks: make([]blockState, p.numBlocks(index))}
+	if _, ok := p.exclusive[index]; ok {
+		piece.owner = pp
+	}
+	p.partial[index] = piece
+	p.order = append(p.order, index)
+	piece.blocks[0].requesters = append(piece.blocks[0].requesters, pp)
+	p.unrequested--
+	return p.blockRequest(index, 0)
+}
+
+// pickPiece picks a piece to start among the pieces of the peer: at random while we have fewer
+// than RandomFirstPieces pieces, then the rarest one.
+func (p *Picker) pickPiece(pp *Peer) (uint32, bool) {
+	randomFirst := p.haveCount < p.config.RandomFirstPieces
+
+	var picked uint32
+	candidates := 0
+	rarest := 0
+	for i, has := range pp.pieces {
+		index := uint32(i)
+		if !has || p.have[index] {
+			continue
+		}
+		if _, ok := p.partial[index]; ok {
+			continue
+		}
+
+		if !randomFirst {
+			switch availability := p.availability[index]; {
+			case candidates == 0 || availability < rarest:
+				rarest = availability
+				candidates = 0
+			case availability > rarest:
+				continue
+			}
+		}
+		// Reservoir sampling: every candidate is picked with the same probability.
+		candidates++
+		if p.config.Rand.IntN(candidates) == 0 {
+			picked = index
+		}
+	}
+	return picked, candidates > 0
+}
+
+// pickEndgame picks a block requested from other peers, the one with the fewest requesters. When
+// pieces isn't nil, only their blocks are picked.
+func (p *Picker) pickEndgame(pp *Peer, pieces []uint32) (peer.Request, bool) {
+	var picked *blockState
+	var request peer.Request
+	for _, index := range p.order {
+		piece := p.partial[index]
+		if _, ok := p.exclusive[index]; ok || !pp.pieces[index] {
+			// Exclusive pieces aren't duplicated: their owner is the only source.
+			continue
+		}
+		if pieces != nil && !slices.Contains(pieces, index) {
+			continue
+		}
+		for i := range piece.blocks {
+			block := &piece.blocks[i]
+			if block.received || len(block.requesters) >= maxEndgameRequesters || slices.Contains(block.requesters, pp) {
+				continue
+			}
+			if picked == nil || len(block.requesters) < len(picked.requesters) {
+				picked = block
+				request = p.blockRequest(index, i)
+			}
+		}
+	}
+	if picked == nil {
+		return peer.Request{}, false
+	}
+	picked.requesters = append(picked.requesters, pp)
+	return request, true
+}
+
+// Received records a block received from the peer. It reports whether the block was recorded, and
+// whether the piece is complete, and returns the requests of the same block sent to other peers in
+// endgame, to be canceled. Blocks of pieces that aren't being downloaded, blocks received already,
+// and blocks of exclusive pieces the peer wasn't asked for, are ignored: they are late answers to
+// requests made before the piece was reset.
+func (pp *Peer) Received(request peer.Request) (accepted, complete bool, duplicates []Duplicate) {
+	p := pp.picker
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	piece, block := p.block(request)
+	if block == nil || block.received {
+		return false, false, nil
+	}
+	if _, exclusive := p.exclusive[request.Index]; exclusive && !slices.Contains(block.requesters, pp) {
+		return false, false, nil
+	}
+
+	if len(block.requesters) == 0 {
+		p.unrequested--
+	}
+	for _, requester := range block.requesters {
+		if requester != pp {
+			duplicates = append(duplicates, Duplicate{Peer: requester, Request: request})
+		}
+	}
+	block.requesters = nil
+	block.received = true
+	piece.received++
+	return true, piece.received == len(piece.blocks), duplicates
+}
+
+// Abort forgets a request of the peer that won't be served: rejected, timed out, or dropped when
+// the peer choked us. The block can be picked again. A peer left without requests for an
+// exclusive piece gives it up to the other peers.
+func (pp *Peer) Abort(request peer.Request) {
+	p := pp.picker
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	piece, block := p.block(request)
+	if block == nil {
+		return
+	}
+	p.dropRequester(block, pp)
+	if piece.owner == pp && p.requester(piece) == nil {
+		piece.owner = nil
+	}
+}
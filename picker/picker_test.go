@@ -0,0 +1,277 @@
+package picker
+
+import (
+	"math/rand/v2"
+	"testing"
+
+	"github.com/dpnam2112/bittorrent-client/peer"
+	"github.com/stretchr/testify/assert"
+)
+
+const blockSize = 16 * 1024
+
+func newPicker(numPieces int, randomFirst int, seed uint64) *Picker {
+	return New(Config{
+		NumPieces:   numPieces,
+		PieceLength: 2 * blockSize,
+		// The last piece is a single, short block.
+		TotalLength:       int64(numPieces-1)*2*blockSize + 100,
+		RandomFirstPieces: randomFirst,
+		Rand:              rand.New(rand.NewPCG(seed, seed)),
+	})
+}
+
+func newPeer(p *Picker, pieces ...uint32) *Peer {
+	pp := p.NewPeer()
+	for _, index := range pieces {
+		pp.Have(index)
+	}
+	return pp
+}
+
+func all(numPieces int) []uint32 {
+	pieces := make([]uint32, numPieces)
+	for i := range pieces {
+		pieces[i] = uint32(i)
+	}
+	return pieces
+}
+
+// pickPieces picks blocks from a peer, and returns the pieces they belong to.
+func pickPieces(pp *Peer, count int) []uint32 {
+	var pieces []uint32
+	for range count {
+		request, ok := pp.Pick()
+		if !ok {
+			break
+		}
+		pieces = append(pieces, request.Index)
+	}
+	return pieces
+}
+
+func TestPickerRandomFirst(t *testing.T) {
+	// The same seed gives the same picks.
+	first := pickPieces(newPeer(newPicker(100, 4, 1), all(100)...), 20)
+	second := pickPieces(newPeer(newPicker(100, 4, 1), all(100)...), 20)
+	assert.Equal(t, first, second)
+
+	// Pieces are started one after the other, in random order.
+	for i := 0; i < len(first); i += 2 {
+		assert.Equal(t, first[i], first[i+1])
+	}
+	assert.NotEqual(t, []uint32{0, 0, 1, 1, 2, 2}, first[:6])
+	assert.NotEqual(t, first, pickPieces(newPeer(newPicker(100, 4, 2), all(100)...), 20))
+}
+
+func TestPickerRarestFirst(t *testing.T) {
+	p := newPicker(8, -1, 1)
+	seed := newPeer(p, all(8)...)
+	newPeer(p, 0, 1, 2, 3)
+	newPeer(p, 0, 1)
+	assert.Equal(t, 3, p.Availability(0))
+	assert.Equal(t, 1, p.Availability(7))
+
+	// The pieces only the seed has come first, then the others by rarity.
+	pieces := pickPieces(seed, 16)
+	assert.ElementsMatch(t, []uint32{4, 4, 5, 5, 6, 6, 7}, pieces[:7])
+	assert.ElementsMatch(t, []uint32{2, 2, 3, 3}, pieces[7:11])
+	assert.ElementsMatch(t, []uint32{0, 0, 1, 1}, pieces[11:15])
+
+	// Random first switches to rarest first once enough pieces are verified.
+	p = newPicker(8, 1, 1)
+	seed = newPeer(p, all(8)...)
+	newPeer(p, 0, 1, 2, 3, 4, 5, 6)
+	p.SetHave(3)
+	request, ok := seed.Pick()
+	assert.True(t, ok)
+	assert.Equal(t, peer.Request{Index: 7, Length: 100}, request)
+}
+
+func TestPickerPartialPiecesFirst(t *testing.T) {
+	p := newPicker(8, -1, 1)
+	a := newPeer(p, all(8)...)
+	b := newPeer(p, all(8)...)
+
+	request, ok := a.Pick()
+	assert.True(t, ok)
+	assert.Equal(t, uint32(0), request.Begin)
+
+	// The other peer finishes the piece instead of starting another.
+	assert.Equal(t, []uint32{request.Index}, pickPieces(b, 1))
+
+	// A block dropped by a peer is picked again, before a new piece.
+	a.Abort(request)
+	again, ok := b.Pick()
+	assert.True(t, ok)
+	assert.Equal(t, request, again)
+
+	// The blocks of a disconnected peer too.
+	next, ok := a.Pick()
+	assert.True(t, ok)
+	a.Remove()
+	assert.Equal(t, 1, p.Availability(0))
+	again, ok = b.Pick()
+	assert.True(t, ok)
+	assert.Equal(t, next, again)
+	_, ok = a.Pick()
+	assert.False(t, ok)
+}
+
+func TestPickerPickFrom(t *testing.T) {
+	p := newPicker(8, -1, 1)
+	a := newPeer(p, 0, 1, 2, 3, 4, 5)
+
+	// The pieces are tried in order, skipping those the peer doesn't have.
+	request, ok := a.PickFrom([]uint32{7, 3, 5})
+	assert.True(t, ok)
+	assert.Equal(t, peer.Request{Index: 3, Begin: 0, Length: blockSize}, request)
+	request, ok = a.PickFrom([]uint32{7, 3, 5})
+	assert.True(t, ok)
+	assert.Equal(t, peer.Request{Index: 3, Begin: blockSize, Length: blockSize}, request)
+	request, ok = a.PickFrom([]uint32{7, 3, 5})
+	assert.True(t, ok)
+	assert.Equal(t, uint32(5), request.Index)
+
+	p.SetHave(1)
+	_, ok = a.PickFrom([]uint32{1, 6, 7})
+	assert.False(t, ok)
+	_, ok = a.PickFrom(nil)
+	assert.False(t, ok)
+
+	// In endgame, only the blocks of the given pieces are duplicated.
+	p = newPicker(2, -1, 1)
+	a = newPeer(p, 0, 1)
+	b := newPeer(p, 0, 1)
+	assert.Len(t, pickPieces(a, 3), 3)
+	assert.True(t, p.Endgame())
+	request, ok = b.PickFrom([]uint32{1})
+	assert.True(t, ok)
+	assert.Equal(t, peer.Request{Index: 1, Begin: 0, Length: 100}, request)
+	_, ok = b.PickFrom([]uint32{1})
+	assert.False(t, ok)
+}
+
+func TestPickerEndgame(t *testing.T) {
+	p := newPicker(2, -1, 1)
+	a := newPeer(p, 0, 1)
+	b := newPeer(p, 0)
+
+	var requests []peer.Request
+	for range 3 {
+		request, ok := a.Pick()
+		assert.True(t, ok)
+		requests = append(requests, request)
+	}
+	_, ok := a.Pick()
+	assert.False(t, ok)
+	assert.True(t, p.Endgame())
+
+	// Every block is requested: b duplicates the requests of a for the piece it has.
+	duplicates := map[peer.Request]bool{}
+	for range 2 {
+		request, ok := b.Pick()
+		assert.True(t, ok)
+		assert.Equal(t, uint32(0), request.Index)
+		duplicates[request] = true
+	}
+	_, ok = b.Pick()
+	assert.False(t, ok)
+	assert.Len(t, duplicates, 2)
+
+	// The first copy received cancels the other.
+	block := peer.Request{Index: 0, Begin: 0, Length: blockSize}
+	accepted, complete, cancels := b.Received(block)
+	assert.True(t, accepted)
+	assert.False(t, complete)
+	assert.Equal(t, []Duplicate{{Peer: a, Request: block}}, cancels)
+	accepted, complete, cancels = a.Received(block)
+	assert.False(t, accepted)
+	assert.False(t, complete)
+	assert.Empty(t, cancels)
+
+	_, complete, cancels = a.Received(peer.Request{Index: 0, Begin: blockSize, Length: blockSize})
+	assert.True(t, complete)
+	assert.Equal(t, []Duplicate{{Peer: b, Request: peer.Request{Index: 0, Begin: blockSize, Length: blockSize}}}, cancels)
+
+	_, complete, _ = a.Received(peer.Request{Index: 1, Length: 100})
+	assert.True(t, complete)
+	p.SetHave(0)
+	p.SetHave(1)
+	assert.True(t, p.Complete())
+	assert.False(t, p.Endgame())
+	assert.Equal(t, []byte{0xc0}, p.Bitfield())
+}
+
+func TestPickerReset(t *testing.T) {
+	p := newPicker(2, -1, 1)
+	a := newPeer(p, 1)
+	assert.True(t, a.Interesting())
+
+	request, ok := a.Pick()
+	assert.True(t, ok)
+	_, complete, _ := a.Received(request)
+	assert.True(t, complete)
+
+	// The piece failed verification: it's downloaded again.
+	p.Reset(1)
+	assert.False(t, p.Endgame())
+	again, ok := a.Pick()
+	assert.True(t, ok)
+	assert.Equal(t, request, again)
+
+	// Blocks of pieces that aren't being downloaded are ignored.
+	accepted, complete, _ := a.Received(peer.Request{Index: 0, Length: blockSize})
+	assert.False(t, accepted)
+	assert.False(t, complete)
+
+	a.Received(again)
+	p.SetHave(1)
+	assert.False(t, a.Interesting())
+	assert.True(t, p.Have(1))
+
+	a.SetBitfield([]byte{0xff})
+	assert.True(t, a.Interesting())
+	assert.Equal(t, 1, p.Availability(0))
+}
+
+func TestPickerExclusive(t *testing.T) {
+	p := newPicker(2, -1, 1)
+	a := newPeer(p, 0)
+	b := newPeer(p, 0)
+	p.SetHave(1)
+
+	// The piece failed verification: it's downloaded again from a single peer.
+	p.SetExclusive(0)
+	request, ok := a.Pick()
+	assert.True(t, ok)
+	assert.Equal(t, uint32(0), request.Index)
+	_, ok = b.Pick()
+	assert.False(t, ok)
+
+	// Not even in endgame.
+	second, ok := a.Pick()
+	assert.True(t, ok)
+	assert.True(t, p.Endgame())
+	_, ok = b.Pick()
+	assert.False(t, ok)
+
+	// Late blocks from other peers, requested before the piece failed, are ignored.
+	accepted, _, _ := b.Received(second)
+	assert.False(t, accepted)
+
+	// A peer that gives up every request of the piece releases it.
+	a.Abort(request)
+	a.Abort(second)
+	again, ok := b.Pick()
+	assert.True(t, ok)
+	assert.Equal(t, request, again)
+	_, ok = a.Pick()
+	assert.False(t, ok)
+
+	// So does a disconnected peer.
+	b.Remove()
+	again, ok = a.Pick()
+	assert.True(t, ok)
+	assert.Equal(t, request, again)
+}
@@ -24,13 +24,11 @@ package main
 
 import (
 	"bufio"
+	"context"
 	"fmt"
 	"log/slog"
 	"math/rand"
-	"net"
-	"net/url"
 	"os"
-	"strconv"
 	"time"
 
 	"github.com/dpnam2112/bittorrent-client/torrentparser"
@@ -55,13 +53,7 @@ func main() {
 	fmt.Println(torrent.String())
 	fmt.Println("Torrent's infohash:", fmt.Sprintf("% x\n", torrent.Info().Hash()))
 
-	parsedURL, err := url.Parse(torrent.Announce())
-	if err != nil {
-		panic(err)
-	}
-
-	IPs, err := net.LookupIP(parsedURL.Hostname())
-
+	trackerURL, err := trackerclient.ParseTrackerURL(torrent.Announce())
 	if err != nil {
 		panic(err)
 	}
@@ -73,36 +65,24 @@ func main() {
 		Logger: logger,
 	}
 
-	IP := IPs[0]
-	port, err := strconv.Atoi(parsedURL.Port())
-	if err != nil {
-		panic(err)
-	}
-
-	connResp, err := client.SendConnectRequest(IP, port, 30)
-	if err != nil {
-		panic(err)
-	}
-
 	var peerID [20]byte
 	copy(peerID[:], "dpnam2112bitorrent12")
 
 	announceRequest := trackerclient.TrackerUDPAnnounceRequest{
-		ConnectionID: connResp.ConnectionID,
-		TxnID:        rand.Int31(),
-		Downloaded:   10,
-		Uploaded:     0,
-		Left:         6969,
-		Event:        trackerclient.AnnounceEventNone,
-		IPAddr:       nil,
-		Port:         6969,
-		Key:          0,
-		NumWant:      10,
-		InfoHash:     torrent.Info().Hash(),
-		PeerID:       peerID,
+		TxnID:      rand.Int31(),
+		Downloaded: 10,
+		Uploaded:   0,
+		Left:       6969,
+		Event:      trackerclient.AnnounceEventNone,
+		IPAddr:     nil,
+		Port:       6969,
+		Key:        0,
+		NumWant:    10,
+		InfoHash:   torrent.Info().Hash(),
+		PeerID:     peerID,
 	}
 
-	resp, err := client.SendAnnounceRequest(IP, port, 30, &announceRequest)
+	resp, err := client.SendAnnounceRequestToURL(context.Background(), trackerURL, 30*time.Second, &announceRequest)
 	if err != nil {
 		panic(err)
 	}
@@ -0,0 +1,117 @@
+package storage
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sync"
+
+	"github.com/dpnam2112/bittorrent-client/torrentparser"
+)
+
+type BlobConfig struct {
+	// Path is the path of the blob file.
+	Path string
+}
+
+// BlobStorage keeps the pieces of a torrent in a single file, one after the other. The file is
+// sparse: it has the size of the torrent from the start, and the pieces that were never written
+// read as zeros.
+type BlobStorage struct {
+	layout Layout
+	path   string
+
+	// mu guards closed: reads and writes run concurrently, and Close waits for them.
+	mu     sync.RWMutex
+	closed bool
+	file   *os.File
+}
+
+// NewBlobStorage opens the blob of a torrent, creating it if needed.
+func NewBlobStorage(info torrentparser.InfoDict, config BlobConfig) (*BlobStorage, error) {
+	layout := pieceLayout(info)
+	if err := os.MkdirAll(filepath.Dir(config.Path), 0o755); err != nil {
+		return nil, fmt.Errorf("Failed to create the directory of %s: %w", config.Path, err)
+	}
+	f, err := os.OpenFile(config.Path, os.O_RDWR|os.O_CREATE, 0o644)
+	if err != nil {
+		return nil, fmt.Errorf("Failed to open %s: %w", config.Path, err)
+	}
+
+	stat, err := f.Stat()
+	if err == nil && stat.Size() < layout.TotalLength {
+		err = f.Truncate(layout.TotalLength)
+	}
+	if err != nil {
+		f.Close()
+		return nil, fmt.Errorf("Failed to size %s: %w", config.Path, err)
+	}
+	return &BlobStorage{layout: layout, path: config.Path, file: f}, nil
+}
+
+func (s *BlobStorage) ReadAt(p []byte, piece uint32, offset int64) (int, error) {
+	if err := s.layout.checkRange(piece, offset, len(p)); err != nil {
+		return 0, err
+	}
+
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	if s.closed {
+		return 0, ErrStorageClosed
+	}
+	n, err := s.file.ReadAt(p, int64(piece)*s.layout.PieceLength+offset)
+	if errors.Is(err, io.EOF) {
+		// The blob was truncated behind our back.
+		err = io.ErrUnexpectedEOF
+	}
+	if err != nil {
+		return n, fmt.Errorf("Failed to read %s: %w", s.path, err)
+	}
+	return n, nil
+}
+
+func (s *BlobStorage) WriteAt(p []byte, piece uint32, offset int64) (int, error) {
+	if err := s.layout.checkRange(piece, offset, len(p)); err != nil {
+		return 0, err
+	}
+
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	if s.closed {
+		return 0, ErrStorageClosed
+	}
+	n, err := s.file.WriteAt(p, int64(piece)*s.layout.PieceLength+offset)
+	if err != nil {
+		return n, fmt.Errorf("Failed to write %s: %w", s.path, err)
+	}
+	return n, nil
+}
+
+func (s *BlobStorage) Flush() error {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	if s.closed {
+		return ErrStorageClosed
+	}
+	if err := s.file.Sync(); err != nil {
+		return fmt.Errorf("Failed to sync %s: %w", s.path, err)
+	}
+	return nil
+}
+
+func (s *BlobStorage) Close() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.closed {
+		return nil
+	}
+	s.closed = true
+
+	syncErr := s.file.Sync()
+	if syncErr != nil {
+		syncErr = fmt.Errorf("Failed to sync %s: %w", s.path, syncErr)
+	}
+	return errors.Join(syncErr, s.file.Close())
+}
@@ -0,0 +1,229 @@
+package storage
+
+import (
+	"crypto/sha1"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sync"
+
+	"github.com/dpnam2112/bittorrent-client/torrentparser"
+)
+
+// ErrHashMismatch is returned for pieces whose data doesn't match their hash.
+var ErrHashMismatch = errors.New("Piece doesn't match its hash")
+
+// PieceStore is a content-addressed store of pieces: a piece is saved in a file named after its
+// SHA-1 hash, so that identical pieces of different torrents are stored once. It's safe for
+// concurrent use, by any number of torrents.
+type PieceStore struct {
+	dir string
+}
+
+func NewPieceStore(dir string) *PieceStore {
+	return &PieceStore{dir: dir}
+}
+
+// path returns the path of a piece. The pieces are spread in directories named after the first
+// byte of their hash.
+func (s *PieceStore) path(hash [20]byte) string {
+	return filepath.Join(s.dir, fmt.Sprintf("%02x", hash[0]), fmt.Sprintf("%x", hash))
+}
+
+// Has reports whether a piece of the given size is stored. A file of another size isn't the
+// piece, whatever its name.
+func (s *PieceStore) Has(hash [20]byte, size int64) bool {
+	stat, err := os.Stat(s.path(hash))
+	return err == nil && stat.Mode().IsRegular() && stat.Size() == size
+}
+
+// Put stores a piece, unless it's already stored. The piece is written atomically and synced
+// before Put returns: after a crash, the store holds the piece either whole or not at all.
+func (s *PieceStore) Put(hash [20]byte, data []byte) error {
+	if sha1.Sum(data) != hash {
+		return fmt.Errorf("Failed to store piece %x: %w", hash, ErrHashMismatch)
+	}
+	if s.Has(hash, int64(len(data))) {
+		return nil
+	}
+
+	path := s.path(hash)
+	if err := os.MkdirAll(filepath.Dir(path), 0o755); err != nil {
+		return fmt.Errorf("Failed to create piece directory: %w", err)
+	}
+	tmp, err := os.CreateTemp(filepath.Dir(path), filepath.Base(path)+".*.tmp")
+	if err != nil {
+		return fmt.Errorf("Failed to create piece file: %w", err)
+	}
+	defer os.Remove(tmp.Name())
+
+	if _, err := tmp.Write(data); err != nil {
+		tmp.Close()
+		return fmt.Errorf("Failed to write piece file: %w", err)
+	}
+	// The data must be on disk before the file gets its final name.
+	if err := tmp.Sync(); err != nil {
+		tmp.Close()
+		return fmt.Errorf("Failed to sync piece file: %w", err)
+	}
+	if err := tmp.Close(); err != nil {
+		return fmt.Errorf("Failed to write piece file: %w", err)
+	}
+	if err := os.Rename(tmp.Name(), path); err != nil {
+		return fmt.Errorf("Failed to replace piece file: %w", err)
+	}
+	// And so must the new name.
+	if err := syncDir(filepath.Dir(path)); err != nil {
+		return fmt.Errorf("Failed to sync piece directory: %w", err)
+	}
+	return nil
+}
+
+func syncDir(dir string) error {
+	f, err := os.Open(dir)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	return f.Sync()
+}
+
+// ReadAt reads len(p) bytes of a piece, starting at offset.
+func (s *PieceStore) ReadAt(hash [20]byte, p []byte, offset int64) (int, error) {
+	f, err := os.Open(s.path(hash))
+	if errors.Is(err, os.ErrNotExist) {
+		return 0, fmt.Errorf("Failed to read piece %x: %w", hash, ErrNotStored)
+	}
+	if err != nil {
+		return 0, fmt.Errorf("Failed to read piece %x: %w", hash, err)
+	}
+	defer f.Close()
+
+	n, err := f.ReadAt(p, offset)
+	if err != nil {
+		return n, fmt.Errorf("Failed to read piece %x: %w", hash, err)
+	}
+	return n, nil
+}
+
+// pendingPiece is a piece being written in parts.
+type pendingPiece struct {
+	data []byte
+	// written counts the bytes written, including the bytes written more than once: the piece
+	// may be complete once it reaches the size of the piece.
+	written int64
+}
+
+// ContentStorage is the view of a torrent on a piece store: its pieces are stored by the hashes
+// of the torrent. Pieces written in parts are kept in memory until they are complete and match
+// their hash; reads of pieces that aren't in the store fail.
+type ContentStorage struct {
+	layout Layout
+	hashes []byte
+	store  *PieceStore
+
+	mu      sync.Mutex
+	closed  bool
+	pending map[uint32]*pendingPiece
+}
+
+func NewContentStorage(info torrentparser.InfoDict, store *PieceStore) *ContentStorage {
+	return &ContentStorage{
+		layout:  pieceLayout(info),
+		hashes:  info.Pieces(),
+		store:   store,
+		pending: map[uint32]*pendingPiece{},
+	}
+}
+
+func (s *ContentStorage) hash(piece uint32) [20]byte {
+	return [20]byte(s.hashes[piece*20 : piece*20+20])
+}
+
+func (s *ContentStorage) checkRange(piece uint32, offset int64, n int) error {
+	if int(piece) >= len(s.hashes)/20 {
+		return fmt.Errorf("%w: piece %d", ErrOutOfRange, piece)
+	}
+	return s.layout.checkRange(piece, offset, n)
+}
+
+// Has reports whether a piece is in the store, possibly stored by another torrent.
+func (s *ContentStorage) Has(piece uint32) bool {
+	return int(piece) < len(s.hashes)/20 && s.store.Has(s.hash(piece), s.layout.PieceSize(piece))
+}
+
+func (s *ContentStorage) ReadAt(p []byte, piece uint32, offset int64) (int, error) {
+	if err := s.checkRange(piece, offset, len(p)); err != nil {
+		return 0, err
+	}
+
+	s.mu.Lock()
+	closed := s.closed
+	s.mu.Unlock()
+	if closed {
+		return 0, ErrStorageClosed
+	}
+	return s.store.ReadAt(s.hash(piece), p, offset)
+}
+
+// WriteAt writes a part of a piece. The piece is stored once its data matches its hash: writing a
+// whole piece that doesn't match is an error.
+func (s *ContentStorage) WriteAt(p []byte, piece uint32, offset int64) (int, error) {
+	if err := s.checkRange(piece, offset, len(p)); err != nil {
+		return 0, err
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.closed {
+		return 0, ErrStorageClosed
+	}
+
+	hash := s.hash(piece)
+	size := s.layout.PieceSize(piece)
+	if offset == 0 && int64(len(p)) == size {
+		// The whole piece at once, as written by the torrent client.
+		if err := s.store.Put(hash, p); err != nil {
+			return 0, err
+		}
+		delete(s.pending, piece)
+		return len(p), nil
+	}
+
+	pending, ok := s.pending[piece]
+	if !ok {
+		pending = &pendingPiece{data: make([]byte, size)}
+		s.pending[piece] = pending
+	}
+	copy(pending.data[offset:], p)
+	pending.written += int64(len(p))
+	if pending.written < size || sha1.Sum(pending.data) != hash {
+		return len(p), nil
+	}
+
+	if err := s.store.Put(hash, pending.data); err != nil {
+		return 0, err
+	}
+	delete(s.pending, piece)
+	return len(p), nil
+}
+
+// Flush has nothing to commit: the pieces are synced as they are stored.
+func (s *ContentStorage) Flush() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.closed {
+		return ErrStorageClosed
+	}
+	return nil
+}
+
+// Close drops the pieces written in parts that aren't complete yet.
+func (s *ContentStorage) Close() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.closed = true
+	s.pending = nil
+	return nil
+}
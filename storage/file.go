@@ -0,0 +1,238 @@
+package storage
+
+import (
+	"container/list"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sync"
+
+	"github.com/dpnam2112/bittorrent-client/torrentparser"
+)
+
+type FileConfig struct {
+	// Dir is the directory the content is saved in.
+	Dir string
+	// MaxOpenFiles bounds the number of files kept open; the least recently used file is closed
+	// to open another. Defaults to 32.
+	MaxOpenFiles int
+}
+
+type openFile struct {
+	index int
+	file  *os.File
+	// dirty is set by writes, and cleared when the file is synced.
+	dirty bool
+}
+
+// FileStorage saves the content of a torrent in its files, laid out as in the torrent. Directories
+// and files are created on the first write; reads of files that were never written fail.
+type FileStorage struct {
+	config FileConfig
+	layout Layout
+
+	mu     sync.Mutex
+	closed bool
+	// lru holds the open files, the most recently used at the front.
+	lru  *list.List
+	open map[int]*list.Element
+	// unsynced holds the files closed with unsynced writes, synced by the next Flush.
+	unsynced map[int]bool
+}
+
+// NewFileStorage returns the storage of a torrent in a directory. Empty files are created
+// immediately, since they are never written.
+func NewFileStorage(info torrentparser.InfoDict, config FileConfig) (*FileStorage, error) {
+	layout, err := NewLayout(info)
+	if err != nil {
+		return nil, err
+	}
+	return newFileStorage(layout, config)
+}
+
+func newFileStorage(layout Layout, config FileConfig) (*FileStorage, error) {
+	if config.MaxOpenFiles <= 0 {
+		config.MaxOpenFiles = 32
+	}
+	s := &FileStorage{
+		config:   config,
+		layout:   layout,
+		lru:      list.New(),
+		open:     map[int]*list.Element{},
+		unsynced: map[int]bool{},
+	}
+
+	for _, file := range layout.Files {
+		if file.Length != 0 {
+			continue
+		}
+		path := filepath.Join(config.Dir, file.Path)
+		if err := os.MkdirAll(filepath.Dir(path), 0o755); err != nil {
+			return nil, fmt.Errorf("Failed to create the directory of %s: %w", path, err)
+		}
+		f, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE, 0o644)
+		if err != nil {
+			return nil, fmt.Errorf("Failed to create %s: %w", path, err)
+		}
+		f.Close()
+	}
+	return s, nil
+}
+
+// Layout returns the files of the storage.
+func (s *FileStorage) Layout() Layout {
+	return s.layout
+}
+
+func (s *FileStorage) ReadAt(p []byte, piece uint32, offset int64) (int, error) {
+	segments, err := s.layout.segments(piece, offset, len(p))
+	if err != nil {
+		return 0, err
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.closed {
+		return 0, ErrStorageClosed
+	}
+
+	n := 0
+	for _, segment := range segments {
+		f, err := s.file(segment.file, false)
+		if err != nil {
+			return n, err
+		}
+		read, err := f.ReadAt(p[segment.begin:segment.end], segment.offset)
+		n += read
+		if errors.Is(err, io.EOF) {
+			// The file is shorter: that part was never written.
+			return n, fmt.Errorf("Failed to read %s: %w", s.layout.Files[segment.file].Path, io.ErrUnexpectedEOF)
+		}
+		if err != nil {
+			return n, fmt.Errorf("Failed to read %s: %w", s.layout.Files[segment.file].Path, err)
+		}
+	}
+	return n, nil
+}
+
+func (s *FileStorage) WriteAt(p []byte, piece uint32, offset int64) (int, error) {
+	segments, err := s.layout.segments(piece, offset, len(p))
+	if err != nil {
+		return 0, err
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.closed {
+		return 0, ErrStorageClosed
+	}
+
+	n := 0
+	for _, segment := range segments {
+		f, err := s.file(segment.file, true)
+		if err != nil {
+			return n, err
+		}
+		written, err := f.WriteAt(p[segment.begin:segment.end], segment.offset)
+		n += written
+		s.open[segment.file].Value.(*openFile).dirty = true
+		if err != nil {
+			return n, fmt.Errorf("Failed to write %s: %w", s.layout.Files[segment.file].Path, err)
+		}
+	}
+	return n, nil
+}
+
+// file returns an open file, opening it if needed. Files are created only for writes.
+func (s *FileStorage) file(index int, create bool) (*os.File, error) {
+	if element, ok := s.open[index]; ok {
+		s.lru.MoveToFront(element)
+		return element.Value.(*openFile).file, nil
+	}
+
+	path := filepath.Join(s.config.Dir, s.layout.Files[index].Path)
+	flags := os.O_RDWR
+	if create {
+		if err := os.MkdirAll(filepath.Dir(path), 0o755); err != nil {
+			return nil, fmt.Errorf("Failed to create the directory of %s: %w", path, err)
+		}
+		flags |= os.O_CREATE
+	}
+	f, err := os.OpenFile(path, flags, 0o644)
+	if err != nil {
+		return nil, fmt.Errorf("Failed to open %s: %w", path, err)
+	}
+
+	for s.lru.Len() >= s.config.MaxOpenFiles {
+		s.closeFile(s.lru.Back())
+	}
+	s.open[index] = s.lru.PushFront(&openFile{index: index, file: f})
+	return f, nil
+}
+
+// closeFile closes an open file. A file with unsynced writes is synced by the next Flush: syncing
+// it now would make every eviction wait for the disk.
+func (s *FileStorage) closeFile(element *list.Element) error {
+	file := s.lru.Remove(element).(*openFile)
+	delete(s.open, file.index)
+	if file.dirty {
+		s.unsynced[file.index] = true
+	}
+	return file.file.Close()
+}
+
+func (s *FileStorage) Flush() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.closed {
+		return ErrStorageClosed
+	}
+	return s.flush()
+}
+
+func (s *FileStorage) flush() error {
+	var errs []error
+	for element := s.lru.Front(); element != nil; element = element.Next() {
+		file := element.Value.(*openFile)
+		if !file.dirty {
+			continue
+		}
+		if err := file.file.Sync(); err != nil {
+			errs = append(errs, fmt.Errorf("Failed to sync %s: %w", s.layout.Files[file.index].Path, err))
+			continue
+		}
+		file.dirty = false
+	}
+
+	for index := range s.unsynced {
+		path := filepath.Join(s.config.Dir, s.layout.Files[index].Path)
+		f, err := os.OpenFile(path, os.O_RDWR, 0)
+		if err == nil {
+			err = f.Sync()
+			f.Close()
+		}
+		if err != nil {
+			errs = append(errs, fmt.Errorf("Failed to sync %s: %w", path, err))
+			continue
+		}
+		delete(s.unsynced, index)
+	}
+	return errors.Join(errs...)
+}
+
+func (s *FileStorage) Close() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.closed {
+		return nil
+	}
+	s.closed = true
+
+	errs := []error{s.flush()}
+	for s.lru.Len() > 0 {
+		errs = append(errs, s.closeFile(s.lru.Back()))
+	}
+	return errors.Join(errs...)
+}
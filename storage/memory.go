@@ -0,0 +1,70 @@
+package storage
+
+import (
+	"fmt"
+	"sync"
+
+	"github.com/dpnam2112/bittorrent-client/torrentparser"
+)
+
+// MemoryStorage keeps the content of a torrent in memory, for tests and small payloads. The
+// memory of a piece is allocated on its first write; reads of pieces that were never written fail.
+type MemoryStorage struct {
+	layout Layout
+
+	mu     sync.RWMutex
+	closed bool
+	pieces map[uint32][]byte
+}
+
+func NewMemoryStorage(info torrentparser.InfoDict) *MemoryStorage {
+	return &MemoryStorage{layout: pieceLayout(info), pieces: map[uint32][]byte{}}
+}
+
+func (s *MemoryStorage) ReadAt(p []byte, piece uint32, offset int64) (int, error) {
+	if err := s.layout.checkRange(piece, offset, len(p)); err != nil {
+		return 0, err
+	}
+
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	if s.closed {
+		return 0, ErrStorageClosed
+	}
+	data, ok := s.pieces[piece]
+	if !ok {
+		return 0, fmt.Errorf("Failed to read piece %d: %w", piece, ErrNotStored)
+	}
+	return copy(p, data[offset:]), nil
+}
+
+func (s *MemoryStorage) WriteAt(p []byte, piece uint32, offset int64) (int, error) {
+	if err := s.layout.checkRange(piece, offset, len(p)); err != nil {
+		return 0, err
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.closed {
+		return 0, ErrStorageClosed
+	}
+	data, ok := s.pieces[piece]
+	if !ok {
+		data = make([]byte, s.layout.PieceSize(piece))
+		s.pieces[piece] = data
+	}
+	return copy(data[offset:], p), nil
+}
+
+func (s *MemoryStorage) Flush() error {
+	return nil
+}
+
+// Close releases the memory of the pieces.
+func (s *MemoryStorage) Close() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.closed = true
+	s.pieces = nil
+	return nil
+}
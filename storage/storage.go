@@ -0,0 +1,219 @@
+package storage
+
+import (
+	"errors"
+	"fmt"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	"github.com/dpnam2112/bittorrent-client/torrentparser"
+)
+
+var (
+	// ErrOutOfRange is returned for reads and writes past the end of a piece or of the torrent.
+	ErrOutOfRange = errors.New("Out of the range of the torrent")
+	// ErrNotStored is returned for reads of pieces that were never written, by the storages that
+	// keep track of them.
+	ErrNotStored = errors.New("Piece is not stored")
+	// ErrStorageClosed is returned for reads and writes after Close.
+	ErrStorageClosed = errors.New("Storage is closed")
+)
+
+// Storage stores the content of a torrent, addressed by piece and by offset within the piece.
+// Implementations are safe for concurrent use.
+type Storage interface {
+	// ReadAt reads len(p) bytes of a piece, starting at offset. Depending on the storage, data
+	// that was never written fails to read, or reads as zeros.
+	ReadAt(p []byte, piece uint32, offset int64) (int, error)
+	// WriteAt writes p in a piece, starting at offset.
+	WriteAt(p []byte, piece uint32, offset int64) (int, error)
+	// Flush commits the written data to stable storage.
+	Flush() error
+	// Close flushes the data and releases the resources of the storage.
+	Close() error
+}
+
+// PieceChecker is implemented by the storages that only keep pieces matching their hash: the
+// pieces they have don't need to be downloaded, nor verified again.
+type PieceChecker interface {
+	// Has reports whether a complete and verified piece is stored.
+	Has(piece uint32) bool
+}
+
+// Backend is a kind of storage.
+type Backend string
+
+const (
+	// BackendFile saves the content in its files, laid out as in the torrent.
+	BackendFile Backend = "file"
+	// BackendBlob saves the content in a single sparse file.
+	BackendBlob Backend = "blob"
+	// BackendMemory keeps the content in memory, for tests and small payloads.
+	BackendMemory Backend = "memory"
+	// BackendContent saves the pieces in a content-addressed piece store, shared between
+	// torrents.
+	BackendContent Backend = "content"
+)
+
+// Config chooses the storage of a torrent.
+type Config struct {
+	// Backend defaults to BackendFile.
+	Backend Backend
+	// Dir is the directory of the file and blob backends. Defaults to the current directory.
+	Dir string
+	// MaxOpenFiles bounds the open files of the file backend.
+	MaxOpenFiles int
+	// Pieces is the piece store of the content backend, which requires it.
+	Pieces *PieceStore
+}
+
+// Open returns the storage of a torrent chosen by the config.
+func Open(info torrentparser.InfoDict, config Config) (Storage, error) {
+	switch config.Backend {
+	case BackendFile, "":
+		files, err := NewFileStorage(info, FileConfig{Dir: config.Dir, MaxOpenFiles: config.MaxOpenFiles})
+		if err != nil {
+			return nil, err
+		}
+		return files, nil
+	case BackendBlob:
+		// Named after the info hash: torrents with the same name don't share the blob.
+		blob, err := NewBlobStorage(info, BlobConfig{Path: filepath.Join(config.Dir, fmt.Sprintf("%x.blob", info.Hash()))})
+		if err != nil {
+			return nil, err
+		}
+		return blob, nil
+	case BackendMemory:
+		return NewMemoryStorage(info), nil
+	case BackendContent:
+		if config.Pieces == nil {
+			return nil, errors.New("Content storage requires a piece store")
+		}
+		return NewContentStorage(info, config.Pieces), nil
+	default:
+		return nil, fmt.Errorf("Unknown storage backend %q", config.Backend)
+	}
+}
+
+// File is a file of the torrent content.
+type File struct {
+	// Path is relative to the download directory, with the separators of the OS.
+	Path   string
+	Length int64
+	// Offset is the position of the file in the torrent content.
+	Offset int64
+}
+
+// Layout maps the pieces of a torrent to its files: the content of a torrent is its files
+// concatenated in order, cut into pieces.
+type Layout struct {
+	PieceLength int64
+	TotalLength int64
+	Files       []File
+}
+
+// NewLayout returns the layout of a torrent. A single-file torrent is saved as a file named after
+// the torrent, a multi-file torrent in a directory named after the torrent. The paths come from
+// the torrent file, which isn't trusted: paths escaping the download directory are refused.
+func NewLayout(info torrentparser.InfoDict) (Layout, error) {
+	layout := Layout{PieceLength: info.PieceLength(), TotalLength: info.TotalLength()}
+	if layout.PieceLength <= 0 {
+		return layout, fmt.Errorf("Invalid piece length %d", layout.PieceLength)
+	}
+	if err := checkPathComponent(info.Name()); err != nil {
+		return layout, fmt.Errorf("Invalid torrent name: %w", err)
+	}
+
+	if len(info.Files()) == 0 {
+		layout.Files = []File{{Path: info.Name(), Length: info.Length()}}
+		return layout, nil
+	}
+
+	var offset int64
+	for _, entry := range info.Files() {
+		if len(entry.Path()) == 0 {
+			return layout, errors.New("Invalid file path: empty")
+		}
+		for _, component := range entry.Path() {
+			if err := checkPathComponent(component); err != nil {
+				return layout, fmt.Errorf("Invalid file path %q: %w", strings.Join(entry.Path(), "/"), err)
+			}
+		}
+		layout.Files = append(layout.Files, File{
+			Path:   filepath.Join(append([]string{info.Name()}, entry.Path()...)...),
+			Length: entry.Length(),
+			Offset: offset,
+		})
+		offset += entry.Length()
+	}
+	return layout, nil
+}
+
+func checkPathComponent(component string) error {
+	switch {
+	case component == "", component == ".", component == "..":
+		return fmt.Errorf("%q is not a file name", component)
+	case strings.ContainsAny(component, `/\`) || strings.ContainsRune(component, 0):
+		return fmt.Errorf("%q contains a path separator", component)
+	case filepath.VolumeName(component) != "":
+		return fmt.Errorf("%q is a volume name", component)
+	}
+	return nil
+}
+
+// pieceLayout returns the layout of the pieces of a torrent, without its files.
+func pieceLayout(info torrentparser.InfoDict) Layout {
+	return Layout{PieceLength: info.PieceLength(), TotalLength: info.TotalLength()}
+}
+
+// NumPieces returns the number of pieces of the torrent.
+func (l Layout) NumPieces() int {
+	return int((l.TotalLength + l.PieceLength - 1) / l.PieceLength)
+}
+
+// PieceSize returns the size of a piece: the piece length, except for the last piece.
+func (l Layout) PieceSize(piece uint32) int64 {
+	begin := int64(piece) * l.PieceLength
+	return max(0, min(l.PieceLength, l.TotalLength-begin))
+}
+
+// segment is the part of a file covered by a read or write.
+type segment struct {
+	file   int
+	offset int64
+	// begin and end delimit the part of the buffer read or written in the file.
+	begin, end int
+}
+
+// checkRange checks that a read or write of n bytes at an offset stays in a piece.
+func (l Layout) checkRange(piece uint32, offset int64, n int) error {
+	if offset < 0 || offset+int64(n) > l.PieceSize(piece) {
+		return fmt.Errorf("%w: %d bytes at offset %d of piece %d", ErrOutOfRange, n, offset, piece)
+	}
+	return nil
+}
+
+// segments splits a read or write of n bytes of a piece into the files it spans.
+func (l Layout) segments(piece uint32, offset int64, n int) ([]segment, error) {
+	if err := l.checkRange(piece, offset, n); err != nil {
+		return nil, err
+	}
+
+	position := int64(piece)*l.PieceLength + offset
+	// The first file that ends after the position.
+	i := sort.Search(len(l.Files), func(i int) bool { return l.Files[i].Offset+l.Files[i].Length > position })
+
+	var segments []segment
+	for done := 0; done < n; i++ {
+		file := l.Files[i]
+		if file.Length == 0 {
+			continue
+		}
+		fileOffset := position + int64(done) - file.Offset
+		length := int(min(int64(n-done), file.Length-fileOffset))
+		segments = append(segments, segment{file: i, offset: fileOffset, begin: done, end: done + length})
+		done += length
+	}
+	return segments, nil
+}
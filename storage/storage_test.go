@@ -0,0 +1,310 @@
+package storage
+
+import (
+	"crypto/sha1"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/dpnam2112/bittorrent-client/torrentparser"
+	"github.com/stretchr/testify/assert"
+)
+
+// newInfo returns the info dictionary of a torrent with the given files, or a single file when no
+// file is given.
+func newInfo(t *testing.T, name string, pieceLength int, length int, files ...torrentparser.FileEntry) torrentparser.InfoDict {
+	var entries strings.Builder
+	for _, file := range files {
+		fmt.Fprintf(&entries, "d6:lengthi%de4:pathl", file.Length())
+		for _, component := range file.Path() {
+			fmt.Fprintf(&entries, "%d:%s", len(component), component)
+		}
+		entries.WriteString("ee")
+	}
+	for _, file := range files {
+		length += int(file.Length())
+	}
+
+	numPieces := (length + pieceLength - 1) / pieceLength
+	pieces := strings.Repeat("x", 20*numPieces)
+	var raw []byte
+	if len(files) == 0 {
+		raw = fmt.Appendf(nil, "d6:lengthi%de4:name%d:%s12:piece lengthi%de6:pieces%d:%se",
+			length, len(name), name, pieceLength, len(pieces), pieces)
+	} else {
+		raw = fmt.Appendf(nil, "d5:filesl%se4:name%d:%s12:piece lengthi%de6:pieces%d:%se",
+			entries.String(), len(name), name, pieceLength, len(pieces), pieces)
+	}
+
+	info, err := torrentparser.ParseInfoDict(raw)
+	assert.NoError(t, err)
+	return info
+}
+
+func multiFileInfo(t *testing.T) torrentparser.InfoDict {
+	return newInfo(t, "multi", 8, 0,
+		torrentparser.NewFileEntry(5, []string{"a"}),
+		torrentparser.NewFileEntry(0, []string{"empty"}),
+		torrentparser.NewFileEntry(20, []string{"dir", "b"}),
+		torrentparser.NewFileEntry(7, []string{"c"}),
+	)
+}
+
+func content(size int) []byte {
+	data := make([]byte, size)
+	for i := range data {
+		data[i] = byte(i + 1)
+	}
+	return data
+}
+
+func TestLayout(t *testing.T) {
+	layout, err := NewLayout(multiFileInfo(t))
+	assert.NoError(t, err)
+	assert.Equal(t, 4, layout.NumPieces())
+	assert.Equal(t, int64(8), layout.PieceSize(0))
+	assert.Equal(t, int64(8), layout.PieceSize(3))
+	assert.Equal(t, filepath.Join("multi", "dir", "b"), layout.Files[2].Path)
+	assert.Equal(t, int64(5), layout.Files[2].Offset)
+
+	// The first piece spans two files, skipping the empty one.
+	segments, err := layout.segments(0, 2, 6)
+	assert.NoError(t, err)
+	assert.Equal(t, []segment{{file: 0, offset: 2, begin: 0, end: 3}, {file: 2, offset: 0, begin: 3, end: 6}}, segments)
+
+	_, err = layout.segments(3, 4, 5)
+	assert.ErrorIs(t, err, ErrOutOfRange)
+	_, err = layout.segments(4, 0, 1)
+	assert.ErrorIs(t, err, ErrOutOfRange)
+
+	layout, err = NewLayout(newInfo(t, "single", 8, 20))
+	assert.NoError(t, err)
+	assert.Equal(t, []File{{Path: "single", Length: 20}}, layout.Files)
+	assert.Equal(t, int64(4), layout.PieceSize(2))
+
+	// Paths escaping the download directory are refused.
+	for _, path := range [][]string{{".."}, {"dir", "..", "..", "x"}, {"/etc"}, {""}} {
+		_, err = NewLayout(newInfo(t, "multi", 8, 0, torrentparser.NewFileEntry(1, path)))
+		assert.Error(t, err, path)
+	}
+	_, err = NewLayout(newInfo(t, "..", 8, 20))
+	assert.Error(t, err)
+}
+
+func TestFileStorage(t *testing.T) {
+	dir := t.TempDir()
+	info := multiFileInfo(t)
+	// A single open file at a time: every file change evicts the previous one.
+	s, err := NewFileStorage(info, FileConfig{Dir: dir, MaxOpenFiles: 1})
+	assert.NoError(t, err)
+
+	// Nothing is written yet.
+	_, err = s.ReadAt(make([]byte, 4), 0, 0)
+	assert.ErrorIs(t, err, os.ErrNotExist)
+	assert.FileExists(t, filepath.Join(dir, "multi", "empty"))
+
+	// The pieces are written out of order.
+	data := content(32)
+	for _, piece := range []uint32{2, 0, 3, 1} {
+		n, err := s.WriteAt(data[piece*8:piece*8+8], piece, 0)
+		assert.NoError(t, err)
+		assert.Equal(t, 8, n)
+		assert.LessOrEqual(t, s.lru.Len(), 1)
+	}
+	assert.NoError(t, s.Flush())
+	assert.Empty(t, s.unsynced)
+
+	block := make([]byte, 10)
+	n, err := s.ReadAt(block[:6], 0, 2)
+	assert.NoError(t, err)
+	assert.Equal(t, 6, n)
+	assert.Equal(t, data[2:8], block[:6])
+
+	_, err = s.WriteAt(block, 0, 0)
+	assert.ErrorIs(t, err, ErrOutOfRange)
+
+	assert.NoError(t, s.Close())
+	_, err = s.ReadAt(block[:1], 0, 0)
+	assert.ErrorIs(t, err, ErrStorageClosed)
+
+	for path, expected := range map[string][]byte{
+		filepath.Join("multi", "a"):        data[:5],
+		filepath.Join("multi", "dir", "b"): data[5:25],
+		filepath.Join("multi", "c"):        data[25:],
+	} {
+		written, err := os.ReadFile(filepath.Join(dir, path))
+		assert.NoError(t, err)
+		assert.Equal(t, expected, written, path)
+	}
+
+	// The data survives reopening the storage.
+	s, err = NewFileStorage(info, FileConfig{Dir: dir})
+	assert.NoError(t, err)
+	defer s.Close()
+	n, err = s.ReadAt(block[:8], 3, 0)
+	assert.NoError(t, err)
+	assert.Equal(t, 8, n)
+	assert.Equal(t, data[24:], block[:8])
+}
+
+func TestFileStorageSparse(t *testing.T) {
+	dir := t.TempDir()
+	s, err := NewFileStorage(newInfo(t, "single", 8, 20), FileConfig{Dir: dir})
+	assert.NoError(t, err)
+	defer s.Close()
+
+	// The last piece is written first: the earlier ones read as holes.
+	_, err = s.WriteAt([]byte{1, 2, 3, 4}, 2, 0)
+	assert.NoError(t, err)
+	block := make([]byte, 8)
+	_, err = s.ReadAt(block, 1, 0)
+	assert.NoError(t, err)
+	assert.Equal(t, make([]byte, 8), block)
+
+	// Until the end of the file only.
+	s, err = NewFileStorage(newInfo(t, "short", 8, 20), FileConfig{Dir: dir})
+	assert.NoError(t, err)
+	defer s.Close()
+	_, err = s.WriteAt([]byte{1}, 0, 0)
+	assert.NoError(t, err)
+	_, err = s.ReadAt(block, 0, 0)
+	assert.Error(t, err)
+}
+
+// testPieces writes the pieces of a single-file torrent of 20 bytes, in pieces of 8 bytes, and
+// reads them back.
+func testPieces(t *testing.T, s Storage) {
+	data := content(20)
+	for _, piece := range []uint32{2, 0, 1} {
+		n, err := s.WriteAt(data[piece*8:min(piece*8+8, 20)], piece, 0)
+		assert.NoError(t, err)
+		assert.Equal(t, int(min(8, 20-piece*8)), n)
+	}
+
+	block := make([]byte, 8)
+	n, err := s.ReadAt(block[:3], 1, 5)
+	assert.NoError(t, err)
+	assert.Equal(t, 3, n)
+	assert.Equal(t, data[13:16], block[:3])
+
+	_, err = s.ReadAt(block, 2, 0)
+	assert.ErrorIs(t, err, ErrOutOfRange)
+	_, err = s.WriteAt(block, 3, 0)
+	assert.ErrorIs(t, err, ErrOutOfRange)
+
+	assert.NoError(t, s.Flush())
+	assert.NoError(t, s.Close())
+	_, err = s.ReadAt(block[:1], 0, 0)
+	assert.ErrorIs(t, err, ErrStorageClosed)
+}
+
+func TestMemoryStorage(t *testing.T) {
+	info := newInfo(t, "memory", 8, 20)
+	s := NewMemoryStorage(info)
+	_, err := s.ReadAt(make([]byte, 8), 0, 0)
+	assert.ErrorIs(t, err, ErrNotStored)
+	testPieces(t, s)
+}
+
+func TestBlobStorage(t *testing.T) {
+	info := newInfo(t, "blob", 8, 20)
+	path := filepath.Join(t.TempDir(), "blobs", "blob")
+	s, err := NewBlobStorage(info, BlobConfig{Path: path})
+	assert.NoError(t, err)
+
+	// The blob is sparse: the pieces that were never written read as zeros.
+	block := make([]byte, 8)
+	_, err = s.ReadAt(block, 1, 0)
+	assert.NoError(t, err)
+	assert.Equal(t, make([]byte, 8), block)
+	testPieces(t, s)
+
+	written, err := os.ReadFile(path)
+	assert.NoError(t, err)
+	assert.Equal(t, content(20), written)
+}
+
+func TestContentStorage(t *testing.T) {
+	data := content(20)
+	raw := fmt.Appendf(nil, "d6:lengthi20e4:name5:first12:piece lengthi8e6:pieces60:%s%s%se",
+		hash(data[:8]), hash(data[8:16]), hash(data[16:]))
+	info, err := torrentparser.ParseInfoDict(raw)
+	assert.NoError(t, err)
+
+	store := NewPieceStore(t.TempDir())
+	s := NewContentStorage(info, store)
+	_, err = s.ReadAt(make([]byte, 8), 0, 0)
+	assert.ErrorIs(t, err, ErrNotStored)
+
+	// Pieces that don't match their hash are refused.
+	_, err = s.WriteAt(make([]byte, 8), 0, 0)
+	assert.ErrorIs(t, err, ErrHashMismatch)
+	assert.False(t, s.Has(0))
+
+	// A piece written in parts is stored once complete.
+	_, err = s.WriteAt(data[8:12], 1, 0)
+	assert.NoError(t, err)
+	assert.False(t, s.Has(1))
+	_, err = s.WriteAt(data[12:16], 1, 4)
+	assert.NoError(t, err)
+	assert.True(t, s.Has(1))
+	testPieces(t, s)
+
+	// Another torrent with the same piece finds it in the store.
+	other := fmt.Appendf(nil, "d6:lengthi16e4:name5:other12:piece lengthi8e6:pieces40:%s%se",
+		hash(make([]byte, 8)), hash(data[8:16]))
+	info, err = torrentparser.ParseInfoDict(other)
+	assert.NoError(t, err)
+	s = NewContentStorage(info, store)
+	defer s.Close()
+	assert.True(t, s.Has(1))
+	assert.False(t, s.Has(0))
+	block := make([]byte, 8)
+	_, err = s.ReadAt(block, 1, 0)
+	assert.NoError(t, err)
+	assert.Equal(t, data[8:16], block)
+
+	// A truncated piece file, left by a crash, isn't the piece: storing the piece replaces it.
+	path := store.path([20]byte(hash(data[8:16])))
+	assert.NoError(t, os.Truncate(path, 3))
+	assert.False(t, s.Has(1))
+	_, err = s.WriteAt(data[8:16], 1, 0)
+	assert.NoError(t, err)
+	assert.True(t, s.Has(1))
+}
+
+func hash(data []byte) []byte {
+	sum := sha1.Sum(data)
+	return sum[:]
+}
+
+func TestOpen(t *testing.T) {
+	dir := t.TempDir()
+	info := newInfo(t, "open", 8, 20)
+
+	s, err := Open(info, Config{Dir: dir})
+	assert.NoError(t, err)
+	assert.IsType(t, &FileStorage{}, s)
+	s.Close()
+
+	s, err = Open(info, Config{Backend: BackendBlob, Dir: dir})
+	assert.NoError(t, err)
+	assert.IsType(t, &BlobStorage{}, s)
+	assert.FileExists(t, filepath.Join(dir, fmt.Sprintf("%x.blob", info.Hash())))
+	s.Close()
+
+	s, err = Open(info, Config{Backend: BackendMemory})
+	assert.NoError(t, err)
+	assert.IsType(t, &MemoryStorage{}, s)
+
+	_, err = Open(info, Config{Backend: BackendContent})
+	assert.Error(t, err)
+	s, err = Open(info, Config{Backend: BackendContent, Pieces: NewPieceStore(dir)})
+	assert.NoError(t, err)
+	assert.Implements(t, (*PieceChecker)(nil), s)
+
+	_, err = Open(info, Config{Backend: "tape"})
+	assert.Error(t, err)
+}
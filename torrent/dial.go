@@ -0,0 +1,141 @@
+package torrentclient
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/dpnam2112/bittorrent-client/common"
+	"github.com/dpnam2112/bittorrent-client/peer"
+)
+
+const (
+	defaultMaxConnections = 50
+	// The discovered peers waiting for a connection slot are bounded: the peers discovered past
+	// the bound are dropped.
+	maxPeerCandidates = 1000
+	// A peer must accept the connection and send its handshake within this time.
+	connectTimeout = 10 * time.Second
+)
+
+// outgoingCapabilities are the capabilities advertised in the handshakes of the connections we
+// open.
+var outgoingCapabilities = peer.Capabilities{ExtensionProtocol: true, Fast: true}
+
+// connectPeers dials the discovered peers while connection slots are free. The peers that are
+// banned, connected, or being dialed already are skipped.
+func (c *torrentClientImpl) connectPeers() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	for len(c.candidates) > 0 && c.ctx != nil && !c.closed {
+		addr := c.candidates[0]
+		if c.bans.Banned(addr.Host) || c.dialing[addr] || c.connectedTo(addr) {
+			c.candidates = c.candidates[1:]
+			continue
+		}
+
+		release, ok := c.reserveConnection()
+		if !ok {
+			return
+		}
+		c.candidates = c.candidates[1:]
+		c.dialing[addr] = true
+		c.wg.Add(1)
+		go c.dial(addr, release)
+	}
+}
+
+// connectedTo reports whether a session runs with a peer address. c.mu must be held.
+func (c *torrentClientImpl) connectedTo(addr common.PeerAddr) bool {
+	for session, state := range c.sessions {
+		if session.Addr() == addr || (state.exchanged && state.listenAddr == addr) {
+			return true
+		}
+	}
+	return false
+}
+
+// reserveConnection takes a connection slot for an outgoing connection. With a listener, the
+// slots of the torrent are shared with the incoming connections. c.mu must be held.
+func (c *torrentClientImpl) reserveConnection() (release func(), ok bool) {
+	if c.listener != nil {
+		return c.listener.Reserve(c.metainfo.Info().Hash())
+	}
+	if c.connections >= c.maxConnections {
+		return nil, false
+	}
+	c.connections++
+	return sync.OnceFunc(func() {
+		c.mu.Lock()
+		defer c.mu.Unlock()
+		c.connections--
+	}), true
+}
+
+// dial connects to a peer and starts a session with it. On failure, the slot goes to the next
+// candidate.
+func (c *torrentClientImpl) dial(addr common.PeerAddr, release func()) {
+	defer c.wg.Done()
+
+	err := c.connect(addr, release)
+
+	c.mu.Lock()
+	delete(c.dialing, addr)
+	c.mu.Unlock()
+
+	if err != nil {
+		release()
+		c.Logger.Debug("Failed to connect to peer", "peer", addr, "err", err)
+		c.connectPeers()
+	}
+}
+
+func (c *torrentClientImpl) connect(addr common.PeerAddr, release func()) error {
+	ctx, cancel := context.WithTimeout(c.ctx, connectTimeout)
+	defer cancel()
+
+	var dialer net.Dialer
+	netConn, err := dialer.DialContext(ctx, "tcp", net.JoinHostPort(addr.Host, strconv.Itoa(int(addr.Port))))
+	if err != nil {
+		return err
+	}
+	// The handshake is bounded by the same timeout, and interrupted when the client is closed.
+	stop := context.AfterFunc(ctx, func() { netConn.Close() })
+	conn := &outboundConnection{PeerWireConnection: peer.NewPeerWireConnection(netConn, c.Logger), release: release}
+
+	result, err := conn.Negotiate(peer.HandshakeOptions{
+		PeerID:       c.peerID,
+		InfoHash:     c.metainfo.Info().Hash(),
+		Capabilities: outgoingCapabilities,
+	})
+	if !stop() && err == nil {
+		err = ctx.Err()
+	}
+	if err == nil && result.Handshake.PeerID() == c.peerID {
+		err = fmt.Errorf("Connected to ourselves")
+	}
+	if err != nil {
+		conn.Close()
+		return err
+	}
+
+	c.Logger.Debug("Connected to peer", "peer", addr, "peer_id", fmt.Sprintf("%x", result.Handshake.PeerID()))
+	return c.startSession(conn, result.Capabilities, true)
+}
+
+// outboundConnection frees its connection slot when closed.
+type outboundConnection struct {
+	peer.PeerWireConnection
+	release   func()
+	closeOnce sync.Once
+}
+
+func (c *outboundConnection) Close() error {
+	err := c.PeerWireConnection.Close()
+	c.closeOnce.Do(c.release)
+	return err
+}
@@ -0,0 +1,437 @@
+package torrentclient
+
+import (
+	"cmp"
+	"slices"
+	"strings"
+	"time"
+
+	"github.com/dpnam2112/bittorrent-client/common"
+	"github.com/dpnam2112/bittorrent-client/peer"
+	"github.com/dpnam2112/bittorrent-client/pex"
+	"github.com/dpnam2112/bittorrent-client/picker"
+	"github.com/dpnam2112/bittorrent-client/storage"
+	"github.com/dpnam2112/bittorrent-client/verifier"
+)
+
+const (
+	// The requests in flight are checked for timeouts at this interval.
+	requestExpiryInterval = time.Second
+	// The suggestions of a peer beyond this are dropped, oldest first.
+	maxSuggestedPieces = 32
+)
+
+// sessionState is the download state of a peer session.
+type sessionState struct {
+	picker   *picker.Peer
+	pipeline *peer.Pipeline
+	// extensions is nil when the peer doesn't support the extension protocol.
+	extensions *peer.ExtensionSession
+	// suggested are the pieces the peer suggested, most recent first: their blocks are requested
+	// before the others.
+	suggested []uint32
+	// listenAddr is the address the peer accepts connections on, set once it's announced
+	// through peer exchange. Guarded by the mutex of the client.
+	listenAddr common.PeerAddr
+	exchanged  bool
+}
+
+// runEvents processes the events of the peer sessions and the verification results until the
+// client is closed. The download state is only changed from here.
+func (c *torrentClientImpl) runEvents() {
+	defer c.wg.Done()
+
+	ticker := time.NewTicker(requestExpiryInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-c.ctx.Done():
+			return
+		case event := <-c.events:
+			c.handleSessionEvent(event)
+		case <-c.resultsReady:
+			c.handleVerificationResults()
+		case <-ticker.C:
+			c.expireRequests()
+		}
+	}
+}
+
+func (c *torrentClientImpl) handleSessionEvent(event peer.Event) {
+	session := event.Session
+
+	c.mu.Lock()
+	state, ok := c.sessions[session]
+	if ok && event.Type == peer.EventClosed {
+		delete(c.sessions, session)
+		c.forgetPeer(state)
+	} else if ok && !state.exchanged {
+		c.exchangeIncomingPeer(session, state)
+	}
+	c.mu.Unlock()
+	if !ok {
+		// Closed with the client.
+		return
+	}
+
+	switch event.Type {
+	case peer.EventClosed:
+		state.picker.Remove()
+		c.Logger.Debug("Peer session closed", "peer", session.Addr(), "err", event.Err)
+		// The connection slot of the session is free.
+		c.connectPeers()
+
+	case peer.EventBitfield, peer.EventHave:
+		if event.Type == peer.EventBitfield {
+			state.picker.SetBitfield(session.RemoteBitfield())
+		} else {
+			state.picker.Have(event.Index)
+		}
+		c.updateInterest(session, state)
+		c.requestBlocks(session, state)
+
+	case peer.EventUnchoked, peer.EventAllowedFast:
+		c.requestBlocks(session, state)
+
+	case peer.EventSuggest:
+		// The latest suggestions come first; the pieces we have are dropped.
+		var suggested []uint32
+		for _, index := range append(session.Suggestions(), state.suggested...) {
+			if len(suggested) < maxSuggestedPieces && !c.picker.Have(index) && !slices.Contains(suggested, index) {
+				suggested = append(suggested, index)
+			}
+		}
+		state.suggested = suggested
+		c.requestBlocks(session, state)
+
+	case peer.EventRejected:
+		state.pipeline.Rejected(event.Request)
+		state.picker.Abort(event.Request)
+		c.requestBlocks(session, state)
+
+	case peer.EventPiece:
+		c.handleBlock(session, state, event.Block)
+
+	case peer.EventRequest:
+		c.serveRequest(session, event.Request)
+
+	default:
+		c.Logger.Debug("Peer session event", "peer", session.Addr(), "type", event.Type.String())
+	}
+}
+
+// updateInterest tells the peer whether it has pieces we need.
+func (c *torrentClientImpl) updateInterest(session *peer.Session, state *sessionState) {
+	if interesting := state.picker.Interesting(); interesting != session.State().AmInterested {
+		session.SetInterested(interesting)
+	}
+}
+
+// requestBlocks fills the request pipeline of a session with the blocks chosen by the picker.
+// While the peer chokes us, only the pieces of its allowed fast set are requested.
+func (c *torrentClientImpl) requestBlocks(session *peer.Session, state *sessionState) {
+	sessionState := session.State()
+	if !sessionState.AmInterested {
+		return
+	}
+	var allowed []uint32
+	if sessionState.PeerChoking {
+		if allowed = session.AllowedFast(); len(allowed) == 0 {
+			return
+		}
+	}
+	if state.extensions != nil {
+		if handshake, ok := state.extensions.RemoteHandshake(); ok {
+			state.pipeline.SetPeerQueueLimit(handshake.Reqq)
+		}
+	}
+
+	var picked peer.Request
+	_, err := state.pipeline.Fill(func() (peer.Request, bool) {
+		var ok bool
+		if allowed != nil {
+			picked, ok = state.picker.PickFrom(allowed)
+			return picked, ok
+		}
+		if picked, ok = state.picker.PickFrom(state.suggested); ok {
+			return picked, true
+		}
+		picked, ok = state.picker.Pick()
+		return picked, ok
+	})
+	if err != nil {
+		// The last block picked wasn't requested: it goes back to the picker.
+		state.picker.Abort(picked)
+		c.Logger.Debug("Failed to request blocks", "peer", session.Addr(), "err", err)
+	}
+}
+
+// handleBlock records a block received from a peer, and submits its piece for verification once
+// complete. In endgame, the requests of the block sent to other peers are canceled.
+func (c *torrentClientImpl) handleBlock(session *peer.Session, state *sessionState, block peer.Piece) {
+	request := peer.Request{Index: block.Index, Begin: block.Begin, Length: uint32(len(block.Block))}
+	state.pipeline.Received(block)
+	accepted, _, duplicates := state.picker.Received(request)
+	for _, duplicate := range duplicates {
+		c.cancelDuplicate(duplicate)
+	}
+
+	// Blocks the picker doesn't expect are stale, e.g. requested before the piece was reset
+	// after failing verification: they must not be mixed with the blocks downloaded again.
+	if accepted {
+		if piece, ok := c.assembler.AddBlock(session.Addr(), block.Index, block.Begin, block.Block); ok {
+			if err := c.verifier.Submit(c.ctx, piece); err != nil {
+				c.Logger.Debug("Failed to submit piece for verification", "piece", piece.Index, "err", err)
+			}
+		}
+	}
+
+	c.requestBlocks(session, state)
+}
+
+// serveRequest sends a block of a verified piece to the peer. Requests of pieces we don't have
+// are refused.
+func (c *torrentClientImpl) serveRequest(session *peer.Session, request peer.Request) {
+	if c.storage == nil || !c.picker.Have(request.Index) {
+		session.RejectRequest(request)
+		return
+	}
+
+	block := make([]byte, request.Length)
+	if _, err := c.storage.ReadAt(block, request.Index, int64(request.Begin)); err != nil {
+		c.Logger.Error("Failed to read block", "piece", request.Index, "begin", request.Begin, "err", err)
+		session.RejectRequest(request)
+		return
+	}
+	session.SendBlock(request.Index, request.Begin, block)
+}
+
+func (c *torrentClientImpl) cancelDuplicate(duplicate picker.Duplicate) {
+	for session, state := range c.sessionStates() {
+		if state.picker == duplicate.Peer {
+			state.pipeline.Cancel(duplicate.Request)
+			c.requestBlocks(session, state)
+			return
+		}
+	}
+}
+
+// sessionStates returns a snapshot of the running sessions.
+func (c *torrentClientImpl) sessionStates() map[*peer.Session]*sessionState {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	sessions := make(map[*peer.Session]*sessionState, len(c.sessions))
+	for session, state := range c.sessions {
+		sessions[session] = state
+	}
+	return sessions
+}
+
+// expireRequests gives up the requests in flight for too long, so that their blocks are requested
+// again, possibly from other peers.
+func (c *torrentClientImpl) expireRequests() {
+	sessions := c.sessionStates()
+	for session, state := range sessions {
+		for _, request := range state.pipeline.Expire() {
+			c.Logger.Debug("Request timed out", "peer", session.Addr(), "piece", request.Index, "begin", request.Begin)
+			state.picker.Abort(request)
+		}
+	}
+	for session, state := range sessions {
+		c.requestBlocks(session, state)
+	}
+}
+
+// pieceResult is the verification result of a piece, and, for a good piece, the outcome of
+// writing it to the storage.
+type pieceResult struct {
+	verifier.Result
+	writeErr error
+}
+
+// loadStoredPieces marks the pieces already in the storage as downloaded, when the storage only
+// keeps verified pieces, like the pieces shared between torrents of a content-addressed store.
+func (c *torrentClientImpl) loadStoredPieces() {
+	checker, ok := c.storage.(storage.PieceChecker)
+	if !ok {
+		return
+	}
+
+	info := c.metainfo.Info()
+	loaded := 0
+	for index := range uint32(len(info.Pieces()) / 20) {
+		if !checker.Has(index) {
+			continue
+		}
+		c.picker.SetHave(index)
+		c.stats.AddLeft(-min(info.PieceLength(), info.TotalLength()-int64(index)*info.PieceLength()))
+		loaded++
+	}
+	if loaded > 0 {
+		c.Logger.Info("Loaded stored pieces", "name", info.Name(), "pieces", loaded)
+	}
+}
+
+// queueVerificationResult is called by the verifier workers: good pieces are written to the
+// storage from there, off the event loop, and the result is handled by the event loop.
+func (c *torrentClientImpl) queueVerificationResult(result verifier.Result) {
+	queued := pieceResult{Result: result}
+	if result.OK && c.storage != nil {
+		_, queued.writeErr = c.storage.WriteAt(result.Piece.Data, result.Piece.Index, 0)
+	}
+
+	c.mu.Lock()
+	c.results = append(c.results, queued)
+	c.mu.Unlock()
+
+	select {
+	case c.resultsReady <- struct{}{}:
+	default:
+	}
+}
+
+// handleVerificationResults announces the verified pieces to every peer. The pieces that failed
+// verification are downloaded again, and the trust of the peers is updated from the pieces they
+// sent.
+func (c *torrentClientImpl) handleVerificationResults() {
+	c.mu.Lock()
+	results := c.results
+	c.results = nil
+	c.mu.Unlock()
+
+	for _, result := range results {
+		index := result.Piece.Index
+		c.assembler.Discard(index)
+
+		if result.writeErr != nil {
+			// The peers aren't to blame: the piece is downloaded again.
+			c.Logger.Error("Failed to write piece", "piece", index, "err", result.writeErr)
+			c.picker.Reset(index)
+			continue
+		}
+
+		if result.OK {
+			c.picker.SetHave(index)
+			c.stats.AddLeft(-int64(len(result.Piece.Data)))
+			for session, state := range c.sessionStates() {
+				session.Have(index)
+				c.updateInterest(session, state)
+			}
+			c.Logger.Debug("Piece verified", "piece", index)
+
+			// The blocks received for the piece when it failed tell who corrupted it.
+			culprits := c.attributor.Verified(result.Piece)
+			for _, addr := range distinctPeerAddrs(result.Piece.Contributors) {
+				if !slices.Contains(culprits, addr) {
+					c.bans.GoodPiece(addr.Host)
+				}
+			}
+			c.penalize(index, culprits, true)
+			continue
+		}
+
+		culprits, suspects := c.attributor.Failed(result.Piece)
+		c.Logger.Warn("Piece failed verification", "piece", index, "culprits", culprits, "suspects", suspects)
+		c.penalize(index, culprits, true)
+		c.penalize(index, suspects, false)
+		c.picker.Reset(index)
+		if len(suspects) > 0 {
+			// Downloaded from a single peer, the piece either fails again and the peer is the
+			// culprit, or passes and shows which blocks were corrupt.
+			c.picker.SetExclusive(index)
+		}
+	}
+
+	if c.picker.Complete() {
+		c.Logger.Info("Download complete", "name", c.metainfo.Info().Name())
+		if err := c.storage.Flush(); err != nil {
+			c.Logger.Error("Failed to flush storage", "err", err)
+		}
+		return
+	}
+	// The sessions of the banned peers are gone: their requests go to the others.
+	for session, state := range c.sessionStates() {
+		c.requestBlocks(session, state)
+	}
+}
+
+// penalize lowers the trust of the peers that sent blocks of a corrupt piece, and disconnects the
+// peers that got banned.
+func (c *torrentClientImpl) penalize(index uint32, addrs []common.PeerAddr, culprit bool) {
+	for _, addr := range addrs {
+		banned, err := c.bans.BadPiece(addr.Host, culprit)
+		if err != nil {
+			c.Logger.Error("Failed to save ban list", "err", err)
+		}
+		if !banned {
+			continue
+		}
+
+		c.Logger.Warn("Banned peer for sending corrupt data", "peer", addr, "piece", index)
+		for session := range c.sessionStates() {
+			if session.Addr().Host == addr.Host {
+				c.closeSession(session)
+			}
+		}
+	}
+}
+
+// closeSession closes a running session. A closed session reports no EventClosed: it's removed
+// from the picker here, and its requests in flight are picked again for other peers.
+func (c *torrentClientImpl) closeSession(session *peer.Session) {
+	c.mu.Lock()
+	state, ok := c.sessions[session]
+	if ok {
+		delete(c.sessions, session)
+		c.forgetPeer(state)
+	}
+	c.mu.Unlock()
+	if !ok {
+		return
+	}
+
+	state.picker.Remove()
+	session.Close()
+	c.connectPeers()
+}
+
+// exchangeIncomingPeer announces a peer that connected to us through peer exchange. Peers
+// supporting the extension protocol are announced once their extension handshake tells their
+// listen port; the others by the address of the connection. c.mu must be held.
+func (c *torrentClientImpl) exchangeIncomingPeer(session *peer.Session, state *sessionState) {
+	addr := session.Addr()
+	if state.extensions != nil {
+		handshake, ok := state.extensions.RemoteHandshake()
+		if !ok {
+			return
+		}
+		if handshake.P != 0 {
+			addr.Port = handshake.P
+		}
+	}
+	c.exchangePeer(state, addr, 0)
+}
+
+// exchangePeer announces a connected peer, listening on addr, to the peers supporting ut_pex.
+// c.mu must be held.
+func (c *torrentClientImpl) exchangePeer(state *sessionState, addr common.PeerAddr, flags pex.Flags) {
+	state.listenAddr = addr
+	state.exchanged = true
+	c.peerExchange.AddPeer(addr, flags)
+}
+
+// forgetPeer announces that a peer disconnected, to the peers it was announced to. c.mu must be
+// held.
+func (c *torrentClientImpl) forgetPeer(state *sessionState) {
+	if state.exchanged {
+		c.peerExchange.RemovePeer(state.listenAddr)
+	}
+}
+
+func distinctPeerAddrs(addrs []common.PeerAddr) []common.PeerAddr {
+	return slices.Compact(slices.SortedFunc(slices.Values(addrs), func(a, b common.PeerAddr) int {
+		return cmp.Or(strings.Compare(a.Host, b.Host), cmp.Compare(a.Port, b.Port))
+	}))
+}
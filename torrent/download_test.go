@@ -0,0 +1,371 @@
+package torrentclient
+
+import (
+	"context"
+	"crypto/sha1"
+	"fmt"
+	"io"
+	"log/slog"
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/dpnam2112/bittorrent-client/banlist"
+	"github.com/dpnam2112/bittorrent-client/common"
+	"github.com/dpnam2112/bittorrent-client/listener"
+	"github.com/dpnam2112/bittorrent-client/peer"
+	"github.com/dpnam2112/bittorrent-client/pex"
+	"github.com/dpnam2112/bittorrent-client/storage"
+	"github.com/dpnam2112/bittorrent-client/torrentparser"
+	"github.com/stretchr/testify/assert"
+)
+
+// newTestTorrent creates a torrent of the given content, without trackers.
+func newTestTorrent(t *testing.T, content []byte, pieceLength int) *torrentparser.TorrentMetainfo {
+	var hashes []byte
+	for begin := 0; begin < len(content); begin += pieceLength {
+		sum := sha1.Sum(content[begin:min(begin+pieceLength, len(content))])
+		hashes = append(hashes, sum[:]...)
+	}
+	raw := fmt.Appendf(nil, "d6:lengthi%de4:name4:test12:piece lengthi%de6:pieces%d:%se",
+		len(content), pieceLength, len(hashes), hashes)
+
+	info, err := torrentparser.ParseInfoDict(raw)
+	assert.NoError(t, err)
+	metainfo := torrentparser.NewTorrentMetainfo("", nil, info)
+	return &metainfo
+}
+
+// seed connects to the listener from a local IP address, and serves the content. Blocks for
+// which corrupt returns true are sent garbled. The pieces announced by the client are sent on
+// haves.
+func seed(t *testing.T, l *listener.Listener, metainfo *torrentparser.TorrentMetainfo, content []byte, ip string,
+	corrupt func(peer.Request) bool, haves chan<- uint32) {
+	dialer := net.Dialer{LocalAddr: &net.TCPAddr{IP: net.ParseIP(ip)}}
+	netConn, err := dialer.Dial("tcp", l.Addr().String())
+	assert.NoError(t, err)
+	conn := peer.NewPeerWireConnection(netConn, *slog.New(slog.NewTextHandler(io.Discard, nil)))
+	t.Cleanup(func() { conn.Close() })
+
+	_, err = conn.Handshake(common.PeerID{'s', 'e', 'e', 'd'}, "", metainfo.Info().Hash())
+	assert.NoError(t, err)
+	serve(t, conn, metainfo, content, corrupt, haves)
+}
+
+// listeningSeed accepts a connection on a local port, and serves the content on it. The client
+// only knows of it from its address.
+func listeningSeed(t *testing.T, metainfo *torrentparser.TorrentMetainfo, content []byte) common.PeerAddr {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	assert.NoError(t, err)
+	t.Cleanup(func() { ln.Close() })
+
+	go func() {
+		netConn, err := ln.Accept()
+		if err != nil {
+			return
+		}
+		conn := peer.NewPeerWireConnection(netConn, *slog.New(slog.NewTextHandler(io.Discard, nil)))
+		t.Cleanup(func() { conn.Close() })
+		if _, err := conn.Handshake(common.PeerID{'s', 'e', 'e', 'd'}, "", metainfo.Info().Hash()); err != nil {
+			return
+		}
+		serve(t, conn, metainfo, content, func(peer.Request) bool { return false }, nil)
+	}()
+
+	addr := ln.Addr().(*net.TCPAddr)
+	return common.PeerAddr{Host: addr.IP.String(), Port: uint16(addr.Port)}
+}
+
+// serve sends a complete bitfield on a connection whose handshakes were exchanged, and answers
+// the requests of the client.
+func serve(t *testing.T, conn peer.PeerWireConnection, metainfo *torrentparser.TorrentMetainfo, content []byte,
+	corrupt func(peer.Request) bool, haves chan<- uint32) {
+	numPieces := len(metainfo.Info().Pieces()) / 20
+	bitfield := make([]byte, (numPieces+7)/8)
+	for i := range numPieces {
+		bitfield[i/8] |= 0x80 >> (i % 8)
+	}
+	assert.NoError(t, conn.SendPeerMessages([]peer.PeerMessage{peer.CreateBitfieldMessage(bitfield), peer.CreateUnchokeMessage()}))
+	go answer(conn, metainfo, content, corrupt, haves, nil, false)
+}
+
+// fastSeed accepts a connection on a local port, negotiates the Fast extension, sends messages,
+// and answers the requests of the client. The requests are reported on requests. With unchoke,
+// the client is unchoked once interested, after it handled the messages.
+func fastSeed(t *testing.T, metainfo *torrentparser.TorrentMetainfo, content []byte, messages []peer.PeerMessage,
+	unchoke bool, requests chan<- peer.Request) common.PeerAddr {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	assert.NoError(t, err)
+	t.Cleanup(func() { ln.Close() })
+
+	go func() {
+		netConn, err := ln.Accept()
+		if err != nil {
+			return
+		}
+		conn := peer.NewPeerWireConnection(netConn, *slog.New(slog.NewTextHandler(io.Discard, nil)))
+		t.Cleanup(func() { conn.Close() })
+		if _, err := conn.Negotiate(peer.HandshakeOptions{
+			PeerID:       common.PeerID{'s', 'e', 'e', 'd'},
+			InfoHash:     metainfo.Info().Hash(),
+			Capabilities: peer.Capabilities{Fast: true},
+		}); err != nil {
+			return
+		}
+		if err := conn.SendPeerMessages(messages); err != nil {
+			return
+		}
+		answer(conn, metainfo, content, func(peer.Request) bool { return false }, nil, requests, unchoke)
+	}()
+
+	addr := ln.Addr().(*net.TCPAddr)
+	return common.PeerAddr{Host: addr.IP.String(), Port: uint16(addr.Port)}
+}
+
+// answer serves the requests of the client until the connection is closed, unchoking it when it
+// gets interested if asked to.
+func answer(conn peer.PeerWireConnection, metainfo *torrentparser.TorrentMetainfo, content []byte,
+	corrupt func(peer.Request) bool, haves chan<- uint32, requests chan<- peer.Request, unchoke bool) {
+	pieceLength := uint32(metainfo.Info().PieceLength())
+	for {
+		msg, err := conn.ReadPeerMessage()
+		if err != nil {
+			return
+		}
+		decoded, err := peer.DecodeMessage(msg)
+		if err != nil {
+			return
+		}
+
+		switch m := decoded.(type) {
+		case peer.Interested:
+			if unchoke {
+				if err := conn.SendPeerMessages([]peer.PeerMessage{peer.CreateUnchokeMessage()}); err != nil {
+					return
+				}
+			}
+		case peer.Request:
+			if requests != nil {
+				requests <- m
+			}
+			offset := m.Index*pieceLength + m.Begin
+			block := append([]byte(nil), content[offset:offset+m.Length]...)
+			if corrupt(m) {
+				block[0] ^= 0xff
+			}
+			piece := peer.Piece{Index: m.Index, Begin: m.Begin, Block: block}
+			if err := conn.SendPeerMessages([]peer.PeerMessage{piece.Message()}); err != nil {
+				return
+			}
+		case peer.Have:
+			if haves != nil {
+				haves <- m.Index
+			}
+		}
+	}
+}
+
+func newTestClient(t *testing.T, metainfo *torrentparser.TorrentMetainfo, bans *banlist.List, store storage.Config) (*torrentClientImpl, *listener.Listener) {
+	logger := slog.New(slog.NewTextHandler(io.Discard, nil))
+	l := listener.NewListener(listener.Config{Addr: "127.0.0.1:0", PeerID: common.GeneratePeerID(), Logger: logger})
+	assert.NoError(t, l.Start(context.Background()))
+	t.Cleanup(func() { l.Close() })
+
+	client := NewTorrentClient(metainfo, Config{PeerID: common.GeneratePeerID(), Listener: l, BanList: bans, Storage: store}, *logger).(*torrentClientImpl)
+	assert.NoError(t, client.Start(context.Background()))
+	t.Cleanup(func() { client.Close() })
+	return client, l
+}
+
+func testContent(size int) []byte {
+	content := make([]byte, size)
+	for i := range content {
+		content[i] = byte(i * 7)
+	}
+	return content
+}
+
+func TestDownloadVerifiesPieces(t *testing.T) {
+	content := testContent(5 * int(peer.StandardBlockSize))
+	metainfo := newTestTorrent(t, content, 2*int(peer.StandardBlockSize))
+	dir := t.TempDir()
+	client, l := newTestClient(t, metainfo, nil, storage.Config{Dir: dir})
+
+	// The first copy of piece 1 is corrupt.
+	haves := make(chan uint32, 10)
+	corrupted := false
+	seed(t, l, metainfo, content, "127.0.0.1", func(request peer.Request) bool {
+		if request.Index != 1 || corrupted {
+			return false
+		}
+		corrupted = request.Begin > 0
+		return true
+	}, haves)
+
+	// Every piece is announced once verified, the corrupt one after being downloaded again.
+	announced := map[uint32]bool{}
+	for len(announced) < 3 {
+		select {
+		case index := <-haves:
+			announced[index] = true
+		case <-time.After(10 * time.Second):
+			t.Fatalf("Pieces announced: %v", announced)
+		}
+	}
+
+	select {
+	case <-client.stats.Completed():
+	case <-time.After(5 * time.Second):
+		t.Fatal("Download not completed")
+	}
+	assert.Zero(t, client.stats.Left())
+	// Without the extension protocol, the seed is announced by the address of its connection.
+	peers := client.peerExchange.Peers()
+	assert.Len(t, peers, 1)
+	for addr, flags := range peers {
+		assert.Equal(t, "127.0.0.1", addr.Host)
+		assert.Equal(t, pex.Flags(0), flags)
+	}
+
+	client.Close()
+	assert.Empty(t, client.peerExchange.Peers())
+	assert.True(t, client.picker.Complete())
+	// Three good pieces, and one corrupt piece it's known to have sent.
+	assert.Equal(t, 0, client.bans.Trust("127.0.0.1"))
+
+	// The verified pieces are saved.
+	saved, err := os.ReadFile(filepath.Join(dir, "test"))
+	assert.NoError(t, err)
+	assert.Equal(t, content, saved)
+}
+
+func TestDownloadBansCorruptPeers(t *testing.T) {
+	content := testContent(16 * int(peer.StandardBlockSize))
+	metainfo := newTestTorrent(t, content, 2*int(peer.StandardBlockSize))
+	path := filepath.Join(t.TempDir(), "bans.dat")
+	bans, err := banlist.Load(banlist.Config{Path: path})
+	assert.NoError(t, err)
+	client, l := newTestClient(t, metainfo, bans, storage.Config{Backend: storage.BackendMemory})
+
+	// Both peers contribute to the pieces; one of them corrupts every block it sends.
+	seed(t, l, metainfo, content, "127.0.0.2", func(peer.Request) bool { return false }, nil)
+	seed(t, l, metainfo, content, "127.0.0.3", func(peer.Request) bool { return true }, nil)
+
+	select {
+	case <-client.stats.Completed():
+	case <-time.After(10 * time.Second):
+		t.Fatal("Download not completed")
+	}
+	client.Close()
+
+	assert.False(t, bans.Banned("127.0.0.2"))
+	assert.True(t, bans.Banned("127.0.0.3"))
+	// The banned peer was removed from the picker when disconnected.
+	assert.Equal(t, 1, client.picker.Availability(0))
+
+	// The ban survives restarts.
+	bans, err = banlist.Load(banlist.Config{Path: path})
+	assert.NoError(t, err)
+	assert.True(t, bans.Banned("127.0.0.3"))
+}
+
+func TestDownloadSharesPieces(t *testing.T) {
+	content := testContent(6 * int(peer.StandardBlockSize))
+	metainfo := newTestTorrent(t, content, 2*int(peer.StandardBlockSize))
+	pieces := storage.NewPieceStore(t.TempDir())
+	client, l := newTestClient(t, metainfo, nil, storage.Config{Backend: storage.BackendContent, Pieces: pieces})
+	seed(t, l, metainfo, content, "127.0.0.1", func(peer.Request) bool { return false }, nil)
+
+	select {
+	case <-client.stats.Completed():
+	case <-time.After(10 * time.Second):
+		t.Fatal("Download not completed")
+	}
+	client.Close()
+
+	// Another torrent made of the first two pieces has them already, without any peer.
+	other := newTestTorrent(t, content[:4*peer.StandardBlockSize], 2*int(peer.StandardBlockSize))
+	client, _ = newTestClient(t, other, nil, storage.Config{Backend: storage.BackendContent, Pieces: pieces})
+	assert.True(t, client.picker.Complete())
+	assert.Zero(t, client.stats.Left())
+
+	block := make([]byte, peer.StandardBlockSize)
+	_, err := client.storage.ReadAt(block, 1, int64(peer.StandardBlockSize))
+	assert.NoError(t, err)
+	assert.Equal(t, content[3*peer.StandardBlockSize:4*peer.StandardBlockSize], block)
+}
+
+func TestDownloadFromDiscoveredPeers(t *testing.T) {
+	content := testContent(6 * int(peer.StandardBlockSize))
+	metainfo := newTestTorrent(t, content, 2*int(peer.StandardBlockSize))
+	client, _ := newTestClient(t, metainfo, nil, storage.Config{Backend: storage.BackendMemory})
+
+	// The seed doesn't connect: the client dials it.
+	addr := listeningSeed(t, metainfo, content)
+	client.AddPeers(addr)
+
+	select {
+	case <-client.stats.Completed():
+	case <-time.After(10 * time.Second):
+		t.Fatal("Download not completed")
+	}
+	// The seed accepted our connection on its listen address: it's announced as reachable.
+	assert.Equal(t, map[common.PeerAddr]pex.Flags{addr: pex.FlagReachable}, client.peerExchange.Peers())
+
+	client.Close()
+	assert.True(t, client.picker.Complete())
+	assert.Empty(t, client.peerExchange.Peers())
+}
+
+func TestDownloadRequestsSuggestedPieces(t *testing.T) {
+	content := testContent(16 * int(peer.StandardBlockSize))
+	metainfo := newTestTorrent(t, content, 2*int(peer.StandardBlockSize))
+	client, _ := newTestClient(t, metainfo, nil, storage.Config{Backend: storage.BackendMemory})
+
+	requests := make(chan peer.Request, 100)
+	client.AddPeers(fastSeed(t, metainfo, content, []peer.PeerMessage{
+		peer.CreateHaveAllMessage(),
+		peer.CreateSuggestPieceMessage(5),
+	}, true, requests))
+
+	// The suggested piece is downloaded first, instead of a random one.
+	for begin := uint32(0); begin < 2*peer.StandardBlockSize; begin += peer.StandardBlockSize {
+		select {
+		case request := <-requests:
+			assert.Equal(t, peer.Request{Index: 5, Begin: begin, Length: peer.StandardBlockSize}, request)
+		case <-time.After(10 * time.Second):
+			t.Fatal("No request received")
+		}
+	}
+
+	select {
+	case <-client.stats.Completed():
+	case <-time.After(10 * time.Second):
+		t.Fatal("Download not completed")
+	}
+}
+
+func TestDownloadAllowedFastWhileChoked(t *testing.T) {
+	content := testContent(8 * int(peer.StandardBlockSize))
+	metainfo := newTestTorrent(t, content, 2*int(peer.StandardBlockSize))
+	client, _ := newTestClient(t, metainfo, nil, storage.Config{Backend: storage.BackendMemory})
+
+	// The seed never unchokes us, but lets us download two pieces.
+	requests := make(chan peer.Request, 100)
+	client.AddPeers(fastSeed(t, metainfo, content, []peer.PeerMessage{
+		peer.CreateHaveAllMessage(),
+		peer.CreateAllowedFastMessage(1),
+		peer.CreateAllowedFastMessage(3),
+	}, false, requests))
+
+	assert.Eventually(t, func() bool { return client.picker.Have(1) && client.picker.Have(3) }, 10*time.Second, 10*time.Millisecond)
+	assert.False(t, client.picker.Have(0))
+	assert.False(t, client.picker.Have(2))
+
+	client.Close()
+	for len(requests) > 0 {
+		assert.Contains(t, []uint32{1, 3}, (<-requests).Index)
+	}
+}
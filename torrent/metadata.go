@@ -0,0 +1,258 @@
+package torrentclient
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"net"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/dpnam2112/bittorrent-client/common"
+	"github.com/dpnam2112/bittorrent-client/dht"
+	"github.com/dpnam2112/bittorrent-client/metadata"
+	"github.com/dpnam2112/bittorrent-client/peer"
+	"github.com/dpnam2112/bittorrent-client/torrentparser"
+	"github.com/dpnam2112/bittorrent-client/trackerclient"
+)
+
+const (
+	defaultMetadataConnections = 20
+	// A peer that didn't help fetching the metadata after this long is dropped, to make room for
+	// another one.
+	metadataPeerTimeout = time.Minute
+)
+
+type MetadataFetchConfig struct {
+	PeerID common.PeerID
+	// Port is the port advertised to the trackers, the DHT and the peers.
+	Port uint16
+	// DHT, when set, is used to find peers in addition to the trackers and the x.pe hints of the
+	// magnet link. The node is owned and started by the caller.
+	DHT *dht.Node
+	// MaxConnections is the maximum number of peers connected at once. Defaults to 20.
+	MaxConnections int
+	Logger         *slog.Logger
+}
+
+// FetchMetadata fetches the info dictionary of a magnet link from the peers of the torrent
+// (BEP 9), and returns the complete metainfo. It returns when the metadata was fetched and
+// verified, or when ctx is done.
+func FetchMetadata(ctx context.Context, magnet torrentparser.Magnet, config MetadataFetchConfig) (*torrentparser.TorrentMetainfo, error) {
+	if config.Logger == nil {
+		config.Logger = slog.Default()
+	}
+	if config.MaxConnections <= 0 {
+		config.MaxConnections = defaultMetadataConnections
+	}
+
+	metainfo := magnet.Metainfo()
+	fetcher := &metadataFetcher{
+		infoHash:   magnet.InfoHash,
+		config:     config,
+		logger:     config.Logger.With("info_hash", fmt.Sprintf("%x", magnet.InfoHash)),
+		exchange:   metadata.NewExchange(magnet.InfoHash, metadata.Config{Logger: config.Logger}),
+		extensions: peer.NewExtensionRegistry(),
+		slots:      make(chan struct{}, config.MaxConnections),
+	}
+	if _, err := fetcher.extensions.Register(fetcher.exchange.Extension()); err != nil {
+		return nil, err
+	}
+
+	var sources []common.PeerSource
+	if len(magnet.Trackers) > 0 {
+		resolver := trackerclient.NewTrackerPeerResolver(&metainfo, -1, trackerclient.TrackerPeerResolverConfig{
+			PeerID: config.PeerID,
+			Port:   config.Port,
+			Logger: config.Logger,
+		})
+		sources = append(sources, newHandlerPeerSource(common.PeerSourceTracker, resolver,
+			func(handler func([]common.PeerAddr) error) { resolver.RegisterHandler(handler) }))
+	}
+	if config.DHT != nil {
+		resolver := dht.NewPeerResolver(config.DHT, magnet.InfoHash, dht.PeerResolverConfig{
+			Port:   config.Port,
+			Logger: config.Logger,
+		})
+		sources = append(sources, newHandlerPeerSource(common.PeerSourceDHT, resolver,
+			func(handler func([]common.PeerAddr) error) { resolver.RegisterHandler(handler) }))
+	}
+	if len(magnet.Peers) > 0 {
+		sources = append(sources, NewStaticPeerSource(common.PeerSourceMagnet, magnet.Peers...))
+	}
+	if len(sources) == 0 {
+		return nil, fmt.Errorf("Magnet link has no tracker nor peer, and the DHT is disabled")
+	}
+
+	ctx, cancel := context.WithCancel(ctx)
+	fetcher.ctx = ctx
+	merger := newPeerMerger(defaultPeerSourceQuotas, fetcher.handlePeerDiscovery)
+	defer func() {
+		for _, source := range sources {
+			if err := source.Close(); err != nil {
+				fetcher.logger.Debug("Error when closing peer source:", "source", source.Tag(), "err", err)
+			}
+		}
+		cancel()
+		merger.Wait()
+		fetcher.wg.Wait()
+	}()
+
+	for _, source := range sources {
+		merger.Run(ctx, source)
+		if err := source.Start(ctx); err != nil {
+			return nil, fmt.Errorf("Error when starting %s peer source: %w", source.Tag(), err)
+		}
+	}
+
+	select {
+	case <-fetcher.exchange.Done():
+	case <-ctx.Done():
+		return nil, fmt.Errorf("Failed to fetch metadata: %w", ctx.Err())
+	}
+
+	info, err := torrentparser.ParseInfoDict(fetcher.exchange.Metadata())
+	if err != nil {
+		return nil, fmt.Errorf("Failed to parse fetched metadata: %w", err)
+	}
+	complete := metainfo.WithInfo(info)
+	return &complete, nil
+}
+
+type metadataFetcher struct {
+	infoHash   [20]byte
+	config     MetadataFetchConfig
+	logger     *slog.Logger
+	exchange   *metadata.Exchange
+	extensions *peer.ExtensionRegistry
+	ctx        context.Context
+	// slots bounds the number of peers connected at once.
+	slots chan struct{}
+	wg    sync.WaitGroup
+}
+
+func (f *metadataFetcher) handlePeerDiscovery(source common.PeerSourceTag, peers []common.PeerAddr) {
+	f.logger.Debug("Discovered peers", "source", source, "new_peer_count", len(peers))
+
+	for _, addr := range peers {
+		f.wg.Add(1)
+		go func() {
+			defer f.wg.Done()
+
+			select {
+			case f.slots <- struct{}{}:
+			case <-f.ctx.Done():
+				return
+			}
+			defer func() { <-f.slots }()
+
+			if err := f.fetchFrom(addr); err != nil {
+				f.logger.Debug("Failed to fetch metadata from peer", "peer", addr, "err", err)
+			}
+		}()
+	}
+}
+
+// fetchFrom connects to a peer and runs the extension protocol on the connection until the
+// metadata is known, the peer turns out not to support ut_metadata, or the connection fails.
+func (f *metadataFetcher) fetchFrom(addr common.PeerAddr) error {
+	select {
+	case <-f.exchange.Done():
+		return nil
+	default:
+	}
+
+	ctx, cancel := context.WithTimeout(f.ctx, metadataPeerTimeout)
+	defer cancel()
+
+	var dialer net.Dialer
+	netConn, err := dialer.DialContext(ctx, "tcp", net.JoinHostPort(addr.Host, strconv.Itoa(int(addr.Port))))
+	if err != nil {
+		return err
+	}
+	conn := peer.NewPeerWireConnection(netConn, *f.logger)
+
+	// The exchange also sends requests from the goroutines of other connections, possibly after
+	// this one is closed.
+	var sendMu sync.Mutex
+	closed := false
+	defer func() {
+		sendMu.Lock()
+		defer sendMu.Unlock()
+		closed = true
+		conn.Close()
+	}()
+
+	// Reads and writes don't time out on their own: closing the socket unblocks them.
+	go func() {
+		select {
+		case <-ctx.Done():
+		case <-f.exchange.Done():
+		}
+		netConn.Close()
+	}()
+
+	result, err := conn.Negotiate(peer.HandshakeOptions{
+		PeerID:       f.config.PeerID,
+		InfoHash:     f.infoHash,
+		Capabilities: peer.Capabilities{ExtensionProtocol: true},
+	})
+	if err != nil {
+		return err
+	}
+	if !result.Capabilities.ExtensionProtocol {
+		return fmt.Errorf("Peer doesn't support the extension protocol")
+	}
+
+	session := peer.NewExtensionSession(f.extensions, peer.ExtensionSessionConfig{
+		Port:       f.config.Port,
+		RemoteAddr: conn.RemoteAddr(),
+		Send: func(msg peer.PeerMessage) error {
+			sendMu.Lock()
+			defer sendMu.Unlock()
+			if closed {
+				return net.ErrClosed
+			}
+			return conn.SendPeerMessages([]peer.PeerMessage{msg})
+		},
+	})
+	defer session.Close()
+
+	if err := session.SendHandshake(); err != nil {
+		return err
+	}
+
+	for {
+		msg, err := conn.ReadPeerMessage()
+		if err != nil {
+			select {
+			case <-ctx.Done():
+				return nil
+			case <-f.exchange.Done():
+				return nil
+			default:
+				return err
+			}
+		}
+
+		decoded, err := peer.DecodeMessage(msg)
+		if err != nil {
+			return err
+		}
+
+		extended, ok := decoded.(peer.Extended)
+		if !ok {
+			// Other messages, like the bitfield, don't matter before we have the metadata.
+			peer.ReleaseMessage(msg)
+			continue
+		}
+		if err := session.HandleMessage(extended); err != nil {
+			return err
+		}
+
+		if remote, received := session.RemoteHandshake(); received && (!session.Supports(metadata.ExtensionName) || remote.MetadataSize == 0) {
+			return fmt.Errorf("Peer doesn't serve the metadata")
+		}
+	}
+}
@@ -0,0 +1,111 @@
+package torrentclient
+
+import (
+	"context"
+	"crypto/sha1"
+	"io"
+	"log/slog"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/dpnam2112/bittorrent-client/common"
+	"github.com/dpnam2112/bittorrent-client/metadata"
+	"github.com/dpnam2112/bittorrent-client/peer"
+	"github.com/dpnam2112/bittorrent-client/torrentparser"
+	"github.com/stretchr/testify/assert"
+)
+
+// serveMetadata accepts connections on a local listener and serves the metadata over ut_metadata
+// on each of them.
+func serveMetadata(t *testing.T, raw []byte) common.PeerAddr {
+	infoHash := sha1.Sum(raw)
+	exchange := metadata.NewExchange(infoHash, metadata.Config{})
+	assert.NoError(t, exchange.SetMetadata(raw))
+	registry := peer.NewExtensionRegistry()
+	_, err := registry.Register(exchange.Extension())
+	assert.NoError(t, err)
+
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	assert.NoError(t, err)
+	t.Cleanup(func() { ln.Close() })
+
+	logger := *slog.New(slog.NewTextHandler(io.Discard, nil))
+	go func() {
+		for {
+			netConn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				conn := peer.NewPeerWireConnection(netConn, logger)
+				defer conn.Close()
+
+				if _, err := conn.ReadHandshake(); err != nil {
+					return
+				}
+				options := peer.HandshakeOptions{PeerID: [20]byte{1}, InfoHash: infoHash, Capabilities: peer.Capabilities{ExtensionProtocol: true}}
+				if err := conn.SendHandshake(options); err != nil {
+					return
+				}
+
+				session := peer.NewExtensionSession(registry, peer.ExtensionSessionConfig{
+					RemoteAddr: conn.RemoteAddr(),
+					Send: func(msg peer.PeerMessage) error {
+						return conn.SendPeerMessages([]peer.PeerMessage{msg})
+					},
+				})
+				defer session.Close()
+				if err := session.SendHandshake(); err != nil {
+					return
+				}
+
+				for {
+					msg, err := conn.ReadPeerMessage()
+					if err != nil {
+						return
+					}
+					decoded, err := peer.DecodeMessage(msg)
+					if err != nil {
+						return
+					}
+					if extended, ok := decoded.(peer.Extended); ok {
+						if err := session.HandleMessage(extended); err != nil {
+							return
+						}
+					}
+				}
+			}()
+		}
+	}()
+
+	port := ln.Addr().(*net.TCPAddr).Port
+	return common.PeerAddr{Host: "127.0.0.1", Port: uint16(port)}
+}
+
+func TestFetchMetadata(t *testing.T) {
+	raw := []byte("d4:name4:test12:piece lengthi16384e6:pieces20:aaaaaaaaaaaaaaaaaaaae")
+	seeder := serveMetadata(t, raw)
+
+	magnet := torrentparser.Magnet{
+		InfoHash: sha1.Sum(raw),
+		// The first peer doesn't exist.
+		Peers: []common.PeerAddr{{Host: "127.0.0.1", Port: 1}, seeder},
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	metainfo, err := FetchMetadata(ctx, magnet, MetadataFetchConfig{
+		PeerID: common.GeneratePeerID(),
+		Logger: slog.New(slog.NewTextHandler(io.Discard, nil)),
+	})
+	assert.NoError(t, err)
+	assert.True(t, metainfo.Info().HasMetadata())
+	assert.Equal(t, "test", metainfo.Info().Name())
+	assert.Equal(t, magnet.InfoHash, metainfo.Info().Hash())
+
+	// Without any way of finding peers, there's nothing to wait for.
+	_, err = FetchMetadata(ctx, torrentparser.Magnet{InfoHash: magnet.InfoHash}, MetadataFetchConfig{})
+	assert.Error(t, err)
+}
@@ -0,0 +1,312 @@
+package torrentclient
+
+import (
+	"context"
+	"fmt"
+	"sync"
+
+	"github.com/dpnam2112/bittorrent-client/common"
+	"github.com/dpnam2112/bittorrent-client/lsd"
+)
+
+// Maximum number of distinct peers accepted from each source. Sources that aren't listed, like
+// manually added peers, are unlimited.
+var defaultPeerSourceQuotas = map[common.PeerSourceTag]int{
+	common.PeerSourceTracker: 1000,
+	common.PeerSourceDHT:     500,
+	common.PeerSourcePEX:     1000,
+	common.PeerSourceLSD:     100,
+	common.PeerSourceMagnet:  200,
+}
+
+// handlerPeerSource adapts the components reporting peers through a discovery handler (tracker
+// and DHT resolvers, peer exchange) to common.PeerSource.
+type handlerPeerSource struct {
+	tag       common.PeerSourceTag
+	lifecycle common.LifeCycle
+	peers     chan []common.PeerAddr
+	closed    chan struct{}
+	closeOnce sync.Once
+}
+
+var _ common.PeerSource = (*handlerPeerSource)(nil)
+
+// newHandlerPeerSource wraps lifecycle, whose discovered peers are passed to the handler given to
+// register.
+func newHandlerPeerSource(
+	tag common.PeerSourceTag,
+	lifecycle common.LifeCycle,
+	register func(handler func(peers []common.PeerAddr) error),
+) *handlerPeerSource {
+	source := &handlerPeerSource{
+		tag:       tag,
+		lifecycle: lifecycle,
+		peers:     make(chan []common.PeerAddr),
+		closed:    make(chan struct{}),
+	}
+	register(source.handle)
+	return source
+}
+
+func (s *handlerPeerSource) Start(ctx context.Context) error {
+	return s.lifecycle.Start(ctx)
+}
+
+func (s *handlerPeerSource) Close() error {
+	// Unblock the handler first: the component may wait for it while closing.
+	s.closeOnce.Do(func() { close(s.closed) })
+	return s.lifecycle.Close()
+}
+
+func (s *handlerPeerSource) Tag() common.PeerSourceTag {
+	return s.tag
+}
+
+func (s *handlerPeerSource) Peers() <-chan []common.PeerAddr {
+	return s.peers
+}
+
+func (s *handlerPeerSource) handle(peers []common.PeerAddr) error {
+	select {
+	case s.peers <- peers:
+		return nil
+	case <-s.closed:
+		return fmt.Errorf("Peer source '%s' is closed.", s.tag)
+	}
+}
+
+// lsdLifeCycle registers a torrent to the shared LSD service while it's started.
+type lsdLifeCycle struct {
+	service  *lsd.Service
+	infoHash common.InfoHash
+	handler  lsd.PeerDiscoveryHandler
+}
+
+func newLSDPeerSource(service *lsd.Service, infoHash common.InfoHash) *handlerPeerSource {
+	lifecycle := &lsdLifeCycle{service: service, infoHash: infoHash}
+	return newHandlerPeerSource(common.PeerSourceLSD, lifecycle, func(handler func([]common.PeerAddr) error) {
+		lifecycle.handler = handler
+	})
+}
+
+func (l *lsdLifeCycle) Start(context.Context) error {
+	l.service.AddTorrent(l.infoHash, l.handler)
+	return nil
+}
+
+func (l *lsdLifeCycle) Close() error {
+	l.service.RemoveTorrent(l.infoHash)
+	return nil
+}
+
+// StaticPeerSource reports peers known up front, like the x.pe hints of a magnet link, and the
+// peers added later with Add, like the peers added by the user.
+type StaticPeerSource struct {
+	tag    common.PeerSourceTag
+	peers  chan []common.PeerAddr
+	closed chan struct{}
+
+	mu      sync.Mutex
+	started bool
+	pending []common.PeerAddr
+	// kick wakes up the goroutine sending the pending peers.
+	kick      chan struct{}
+	closeOnce sync.Once
+	wg        sync.WaitGroup
+}
+
+var _ common.PeerSource = (*StaticPeerSource)(nil)
+
+func NewStaticPeerSource(tag common.PeerSourceTag, peers ...common.PeerAddr) *StaticPeerSource {
+	return &StaticPeerSource{
+		tag:     tag,
+		peers:   make(chan []common.PeerAddr),
+		closed:  make(chan struct{}),
+		pending: append([]common.PeerAddr(nil), peers...),
+		kick:    make(chan struct{}, 1),
+	}
+}
+
+func (s *StaticPeerSource) Start(ctx context.Context) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.started {
+		return fmt.Errorf("Peer source '%s' is already started.", s.tag)
+	}
+	s.started = true
+
+	s.wg.Add(1)
+	go func() {
+		defer s.wg.Done()
+		s.run(ctx)
+	}()
+
+	s.wake()
+	return nil
+}
+
+func (s *StaticPeerSource) Close() error {
+	s.closeOnce.Do(func() { close(s.closed) })
+	s.wg.Wait()
+	return nil
+}
+
+func (s *StaticPeerSource) Tag() common.PeerSourceTag {
+	return s.tag
+}
+
+func (s *StaticPeerSource) Peers() <-chan []common.PeerAddr {
+	return s.peers
+}
+
+// Add reports more peers. Peers added before Start are reported once the source is started.
+func (s *StaticPeerSource) Add(peers ...common.PeerAddr) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.pending = append(s.pending, peers...)
+	if s.started {
+		s.wake()
+	}
+}
+
+func (s *StaticPeerSource) wake() {
+	select {
+	case s.kick <- struct{}{}:
+	default:
+	}
+}
+
+func (s *StaticPeerSource) run(ctx context.Context) {
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-s.closed:
+			return
+		case <-s.kick:
+		}
+
+		s.mu.Lock()
+		peers := s.pending
+		s.pending = nil
+		s.mu.Unlock()
+		if len(peers) == 0 {
+			continue
+		}
+
+		select {
+		case s.peers <- peers:
+		case <-ctx.Done():
+			return
+		case <-s.closed:
+			return
+		}
+	}
+}
+
+// peerMerger merges the peers of every source of a torrent: it deduplicates them by address,
+// remembers the sources each peer was reported by, and stops accepting new peers from a source
+// once its quota is reached.
+type peerMerger struct {
+	quotas  map[common.PeerSourceTag]int
+	handler func(source common.PeerSourceTag, peers []common.PeerAddr)
+
+	mu       sync.Mutex
+	peers    map[common.PeerAddr][]common.PeerSourceTag
+	accepted map[common.PeerSourceTag]int
+	wg       sync.WaitGroup
+}
+
+// newPeerMerger creates a merger calling handler with the new peers of every batch. A quota of 0
+// or less means unlimited.
+func newPeerMerger(
+	quotas map[common.PeerSourceTag]int,
+	handler func(source common.PeerSourceTag, peers []common.PeerAddr),
+) *peerMerger {
+	return &peerMerger{
+		quotas:   quotas,
+		handler:  handler,
+		peers:    make(map[common.PeerAddr][]common.PeerSourceTag),
+		accepted: make(map[common.PeerSourceTag]int),
+	}
+}
+
+// Run reads the peers of source until ctx is cancelled.
+func (m *peerMerger) Run(ctx context.Context, source common.PeerSource) {
+	m.wg.Add(1)
+	go func() {
+		defer m.wg.Done()
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case peers := <-source.Peers():
+				if fresh := m.Add(source.Tag(), peers); len(fresh) > 0 && m.handler != nil {
+					m.handler(source.Tag(), fresh)
+				}
+			}
+		}
+	}()
+}
+
+// Wait waits for every Run goroutine to return.
+func (m *peerMerger) Wait() {
+	m.wg.Wait()
+}
+
+// Add records peers reported by source, and returns those that weren't known yet. Known peers
+// only get source added to their sources; they don't count towards its quota.
+func (m *peerMerger) Add(source common.PeerSourceTag, peers []common.PeerAddr) []common.PeerAddr {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	quota := m.quotas[source]
+
+	var fresh []common.PeerAddr
+	for _, addr := range peers {
+		if sources, ok := m.peers[addr]; ok {
+			if !containsTag(sources, source) {
+				m.peers[addr] = append(sources, source)
+			}
+			continue
+		}
+
+		if quota > 0 && m.accepted[source] >= quota {
+			continue
+		}
+		m.accepted[source]++
+		m.peers[addr] = []common.PeerSourceTag{source}
+		fresh = append(fresh, addr)
+	}
+	return fresh
+}
+
+// Sources returns the sources that reported addr, first one first.
+func (m *peerMerger) Sources(addr common.PeerAddr) []common.PeerSourceTag {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return append([]common.PeerSourceTag(nil), m.peers[addr]...)
+}
+
+// Len returns the number of distinct peers known.
+func (m *peerMerger) Len() int {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return len(m.peers)
+}
+
+// Accepted returns the number of peers first reported by source.
+func (m *peerMerger) Accepted(source common.PeerSourceTag) int {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return m.accepted[source]
+}
+
+func containsTag(tags []common.PeerSourceTag, tag common.PeerSourceTag) bool {
+	for _, t := range tags {
+		if t == tag {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,113 @@
+package torrentclient
+
+import (
+	"context"
+	"fmt"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/dpnam2112/bittorrent-client/common"
+	"github.com/stretchr/testify/assert"
+)
+
+func addr(i int) common.PeerAddr {
+	return common.PeerAddr{Host: fmt.Sprintf("10.0.%d.%d", i/256, i%256), Port: 6881}
+}
+
+func addrs(from, to int) []common.PeerAddr {
+	var peers []common.PeerAddr
+	for i := from; i < to; i++ {
+		peers = append(peers, addr(i))
+	}
+	return peers
+}
+
+func TestPeerMergerDedupesAndEnforcesQuotas(t *testing.T) {
+	merger := newPeerMerger(map[common.PeerSourceTag]int{
+		common.PeerSourceLSD: 3,
+	}, nil)
+
+	assert.Equal(t, addrs(0, 5), merger.Add(common.PeerSourceTracker, addrs(0, 5)))
+	assert.Equal(t, addrs(5, 10), merger.Add(common.PeerSourceTracker, addrs(0, 10)))
+
+	// Known peers aren't reported again, but their new source is remembered, without counting
+	// towards its quota.
+	assert.Equal(t, addrs(10, 13), merger.Add(common.PeerSourceLSD, addrs(8, 20)))
+	assert.Equal(t, []common.PeerSourceTag{common.PeerSourceTracker, common.PeerSourceLSD}, merger.Sources(addr(8)))
+	assert.Equal(t, []common.PeerSourceTag{common.PeerSourceLSD}, merger.Sources(addr(12)))
+	assert.Empty(t, merger.Sources(addr(13)))
+	assert.Equal(t, 3, merger.Accepted(common.PeerSourceLSD))
+
+	// The quota is reached: new peers are dropped, and can still come from other sources.
+	assert.Empty(t, merger.Add(common.PeerSourceLSD, addrs(13, 20)))
+	assert.Equal(t, addrs(13, 20), merger.Add(common.PeerSourceDHT, addrs(13, 20)))
+
+	assert.Equal(t, 20, merger.Len())
+	assert.Equal(t, 10, merger.Accepted(common.PeerSourceTracker))
+}
+
+// fakeLifeCycle stands for a resolver reporting peers through a discovery handler.
+type fakeLifeCycle struct {
+	handler func([]common.PeerAddr) error
+	started bool
+	closed  bool
+}
+
+func (f *fakeLifeCycle) Start(context.Context) error { f.started = true; return nil }
+func (f *fakeLifeCycle) Close() error                { f.closed = true; return nil }
+
+func TestPeerMergerRunsSources(t *testing.T) {
+	var mu sync.Mutex
+	discovered := map[common.PeerSourceTag][]common.PeerAddr{}
+	merger := newPeerMerger(nil, func(source common.PeerSourceTag, peers []common.PeerAddr) {
+		mu.Lock()
+		defer mu.Unlock()
+		discovered[source] = append(discovered[source], peers...)
+	})
+
+	resolver := &fakeLifeCycle{}
+	tracker := newHandlerPeerSource(common.PeerSourceTracker, resolver, func(handler func([]common.PeerAddr) error) {
+		resolver.handler = handler
+	})
+	magnet := NewStaticPeerSource(common.PeerSourceMagnet, addr(1), addr(2))
+	manual := NewStaticPeerSource(common.PeerSourceManual)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	for _, source := range []common.PeerSource{tracker, magnet, manual} {
+		merger.Run(ctx, source)
+		assert.NoError(t, source.Start(ctx))
+	}
+	assert.True(t, resolver.started)
+	assert.Error(t, magnet.Start(ctx))
+
+	assert.NoError(t, resolver.handler([]common.PeerAddr{addr(3), addr(4)}))
+	manual.Add(addr(4), addr(5))
+
+	// Every peer is reported once, whichever source reported it first.
+	assert.Eventually(t, func() bool {
+		mu.Lock()
+		defer mu.Unlock()
+		reported := 0
+		for _, peers := range discovered {
+			reported += len(peers)
+		}
+		return len(merger.Sources(addr(4))) == 2 && reported == 5
+	}, 5*time.Second, 10*time.Millisecond)
+	assert.Equal(t, []common.PeerSourceTag{common.PeerSourceMagnet}, merger.Sources(addr(1)))
+
+	mu.Lock()
+	assert.ElementsMatch(t, []common.PeerAddr{addr(1), addr(2)}, discovered[common.PeerSourceMagnet])
+	assert.ElementsMatch(t, addrs(1, 6), append(append(discovered[common.PeerSourceMagnet],
+		discovered[common.PeerSourceTracker]...), discovered[common.PeerSourceManual]...))
+	mu.Unlock()
+
+	// Once closed, a source doesn't block its resolver anymore.
+	for _, source := range []common.PeerSource{tracker, magnet, manual} {
+		assert.NoError(t, source.Close())
+	}
+	cancel()
+	merger.Wait()
+	assert.True(t, resolver.closed)
+	assert.Error(t, resolver.handler([]common.PeerAddr{addr(5)}))
+}
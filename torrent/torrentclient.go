@@ -4,69 +4,379 @@ import (
 	"context"
 	"fmt"
 	"log/slog"
+	"maps"
+	"net"
+	"sync"
 
+	"github.com/dpnam2112/bittorrent-client/banlist"
 	"github.com/dpnam2112/bittorrent-client/common"
+	"github.com/dpnam2112/bittorrent-client/dht"
+	"github.com/dpnam2112/bittorrent-client/listener"
+	"github.com/dpnam2112/bittorrent-client/lsd"
+	"github.com/dpnam2112/bittorrent-client/metadata"
 	"github.com/dpnam2112/bittorrent-client/peer"
+	"github.com/dpnam2112/bittorrent-client/pex"
+	"github.com/dpnam2112/bittorrent-client/picker"
+	"github.com/dpnam2112/bittorrent-client/storage"
 	"github.com/dpnam2112/bittorrent-client/torrentparser"
 	"github.com/dpnam2112/bittorrent-client/trackerclient"
+	"github.com/dpnam2112/bittorrent-client/verifier"
 )
 
 type TorrentClient interface {
 	common.LifeCycle
+
+	// TrackerStatuses returns the status of every tracker of the torrent.
+	TrackerStatuses() []trackerclient.TrackerStatus
+
+	// AddPeers adds peers manually, like the peers given on the command line. They aren't
+	// subject to any source quota.
+	AddPeers(peers ...common.PeerAddr)
+}
+
+type Config struct {
+	PeerID common.PeerID
+	// Port is the port we are listening on for incoming peer connections. When zero, the port of
+	// Listener is advertised.
+	Port uint16
+	// Listener, when set, hands over the incoming connections for the torrent. It's shared
+	// between torrents, and must be started before the client is created.
+	Listener *listener.Listener
+	// DHT, when set, is used to find peers in addition to the trackers. The node is owned by the
+	// caller, which starts it and can share it between torrents.
+	DHT *dht.Node
+	// LSD, when set, announces the torrent on the local network and reports the local peers.
+	// Like the DHT node, it's owned and started by the caller.
+	LSD *lsd.Service
+	// MagnetPeers are the peer addresses given by the x.pe parameters of a magnet link.
+	MagnetPeers []common.PeerAddr
+	// PeerSourceQuotas overrides the maximum number of distinct peers accepted from each source.
+	// A quota of 0 or less means unlimited.
+	PeerSourceQuotas map[common.PeerSourceTag]int
+	// BanList, when set, keeps the trust of the peers and the bans. It can be shared between
+	// torrents, and saved between runs. When nil, the bans only last as long as the client.
+	BanList *banlist.List
+	// Storage chooses where the content is saved: by default, in its files in the current
+	// directory.
+	Storage storage.Config
+	// MaxConnections is the maximum number of peers connected at once when there is no Listener.
+	// With a Listener, its per-torrent limit applies to the incoming and outgoing connections
+	// together. Defaults to 50.
+	MaxConnections int
 }
 
 type torrentClientImpl struct {
 	metainfo            *torrentparser.TorrentMetainfo
 	trackerPeerResolver trackerclient.TrackerPeerResolver
-	connectedPeers      []peer.Peer
-	ctx                 context.Context
-	Logger              slog.Logger
+	// peerExchange learns peers from the connected peers that support ut_pex, and tells them
+	// about ours.
+	peerExchange *pex.Exchange
+	// extensions are the BEP 10 extensions advertised to the peers of the torrent.
+	extensions  *peer.ExtensionRegistry
+	manualPeers *StaticPeerSource
+	// sources are all the peer sources of the torrent: trackers, peer exchange, manually added
+	// peers, and, when enabled, the DHT, LSD and magnet hints.
+	sources []common.PeerSource
+	merger  *peerMerger
+	// stats counts the bytes transferred by the peer sessions. Trackers receive them on every
+	// announce.
+	stats  *common.TransferStats
+	ctx    context.Context
+	cancel context.CancelFunc
+	Logger slog.Logger
+	// listener is nil when incoming connections are disabled.
+	listener *listener.Listener
+	port     uint16
+	peerID   common.PeerID
+
+	// picker tracks the pieces of the peers, and picks the blocks to request from them.
+	picker *picker.Picker
+	// assembler collects the blocks received into pieces, which the verifier checks.
+	assembler *verifier.Assembler
+	verifier  *verifier.Verifier
+	// attributor finds the peers that sent the corrupt blocks of the pieces that failed
+	// verification; bans keeps the trust of the peers and bans the culprits.
+	attributor *verifier.Attributor
+	bans       *banlist.List
+	// storage holds the verified pieces. It's nil until the client is started, and for torrents
+	// without metadata.
+	storage       storage.Storage
+	storageConfig storage.Config
+
+	// events receives the events of every peer session of the torrent.
+	events chan peer.Event
+	// results holds the verification results until the event loop handles them; resultsReady
+	// wakes it up.
+	results      []pieceResult
+	resultsReady chan struct{}
+	mu           sync.Mutex
+	sessions     map[*peer.Session]*sessionState
+	// candidates are the discovered peers waiting for a connection slot, and dialing the peers
+	// being connected to.
+	candidates []common.PeerAddr
+	dialing    map[common.PeerAddr]bool
+	// connections counts the outgoing connections when there is no listener to share the
+	// connection slots of the torrent with.
+	connections    int
+	maxConnections int
+	// closed is set by Close: no session or connection is started afterwards.
+	closed bool
+	wg     sync.WaitGroup
 }
 
-func (c *torrentClientImpl) NewTorrentClient(metainfo *torrentparser.TorrentMetainfo, logger slog.Logger) TorrentClient {
+func NewTorrentClient(metainfo *torrentparser.TorrentMetainfo, config Config, logger slog.Logger) TorrentClient {
 	client := torrentClientImpl{}
 
 	client.metainfo = metainfo
-	client.trackerPeerResolver = trackerclient.NewTrackerPeerResolver(client.metainfo, -1)
-
-	// the handling logic is triggerred whenever the resolver discovers new peers.
-	client.trackerPeerResolver.RegisterHandler(c.handlePeerDiscovery)
 	client.Logger = logger
+	client.stats = common.NewTransferStats(metainfo.Info().TotalLength())
+
+	client.listener = config.Listener
+	if config.Port == 0 && config.Listener != nil {
+		config.Port = config.Listener.Port()
+	}
+	client.port = config.Port
+	client.peerID = config.PeerID
+	client.maxConnections = config.MaxConnections
+	if client.maxConnections <= 0 {
+		client.maxConnections = defaultMaxConnections
+	}
+	client.dialing = make(map[common.PeerAddr]bool)
+	client.events = make(chan peer.Event, 64)
+	client.sessions = make(map[*peer.Session]*sessionState)
+	client.resultsReady = make(chan struct{}, 1)
+
+	info := metainfo.Info()
+	numPieces := len(info.Pieces()) / 20
+	client.picker = picker.New(picker.Config{
+		NumPieces:   numPieces,
+		PieceLength: info.PieceLength(),
+		TotalLength: info.TotalLength(),
+	})
+	client.assembler = verifier.NewAssembler(numPieces, info.PieceLength(), info.TotalLength())
+	client.verifier = verifier.New(info.Pieces(), verifier.Config{
+		OnResult: client.queueVerificationResult,
+		Logger:   &client.Logger,
+	})
+	client.attributor = verifier.NewAttributor()
+	client.bans = config.BanList
+	if client.bans == nil {
+		client.bans, _ = banlist.Load(banlist.Config{})
+	}
+	client.storageConfig = config.Storage
+
+	quotas := maps.Clone(defaultPeerSourceQuotas)
+	maps.Copy(quotas, config.PeerSourceQuotas)
+	client.merger = newPeerMerger(quotas, client.handlePeerDiscovery)
+
+	client.trackerPeerResolver = trackerclient.NewTrackerPeerResolver(client.metainfo, -1, trackerclient.TrackerPeerResolverConfig{
+		PeerID: config.PeerID,
+		Port:   config.Port,
+		Logger: &client.Logger,
+		Stats:  client.stats,
+	})
+	client.sources = append(client.sources, newHandlerPeerSource(common.PeerSourceTracker, client.trackerPeerResolver,
+		func(handler func([]common.PeerAddr) error) { client.trackerPeerResolver.RegisterHandler(handler) }))
+
+	client.peerExchange = pex.NewExchange(pex.Config{Logger: &client.Logger})
+	client.extensions = peer.NewExtensionRegistry()
+	client.registerExtension(client.peerExchange.Extension())
+
+	// Serve the metadata to the peers that joined from a magnet link.
+	if info := metainfo.Info(); info.HasMetadata() {
+		exchange := metadata.NewExchange(info.Hash(), metadata.Config{Logger: &client.Logger})
+		if err := exchange.SetMetadata(info.Raw()); err == nil {
+			client.registerExtension(exchange.Extension())
+		}
+	}
+	client.sources = append(client.sources, newHandlerPeerSource(common.PeerSourcePEX, client.peerExchange,
+		func(handler func([]common.PeerAddr) error) { client.peerExchange.RegisterHandler(handler) }))
+
+	if config.DHT != nil {
+		config.DHT.AddBootstrapAddrs(metainfo.Nodes()...)
+		resolver := dht.NewPeerResolver(config.DHT, metainfo.Info().Hash(), dht.PeerResolverConfig{
+			Port:   config.Port,
+			Logger: &client.Logger,
+		})
+		client.sources = append(client.sources, newHandlerPeerSource(common.PeerSourceDHT, resolver,
+			func(handler func([]common.PeerAddr) error) { resolver.RegisterHandler(handler) }))
+	}
+
+	if config.LSD != nil {
+		client.sources = append(client.sources, newLSDPeerSource(config.LSD, metainfo.Info().Hash()))
+	}
+
+	if len(config.MagnetPeers) > 0 {
+		client.sources = append(client.sources, NewStaticPeerSource(common.PeerSourceMagnet, config.MagnetPeers...))
+	}
+
+	client.manualPeers = NewStaticPeerSource(common.PeerSourceManual)
+	client.sources = append(client.sources, client.manualPeers)
 
 	return &client
 }
 
-func (c *torrentClientImpl) Start(context context.Context) error {
-	c.ctx = context
-	if err := c.trackerPeerResolver.Start(context); err != nil {
-		return fmt.Errorf("Error when starting tracker peer resolver: %w", err)
+// registerExtension advertises an extension to the peers of the torrent. The extension is left
+// out if it can't be registered.
+func (c *torrentClientImpl) registerExtension(extension peer.Extension) {
+	if _, err := c.extensions.Register(extension); err != nil {
+		c.Logger.Error("Failed to register extension", "extension", extension.Name(), "err", err)
 	}
-
-	return nil
 }
 
-// handlePeerDiscovery is used as callback for PeerResolver component.
-// every time new peers are discovered, this function is invoked for establishing peer connections.
-func (c *torrentClientImpl) handlePeerDiscovery(peers []peer.Peer) error {
-	for _, peer := range peers {
-		go c.connectPeer(peer)
+func (c *torrentClientImpl) Start(ctx context.Context) error {
+	if c.cancel != nil {
+		return fmt.Errorf("Torrent client is already started.")
+	}
+	c.ctx, c.cancel = context.WithCancel(ctx)
+
+	if info := c.metainfo.Info(); info.HasMetadata() {
+		store, err := storage.Open(info, c.storageConfig)
+		if err != nil {
+			return fmt.Errorf("Failed to open storage: %w", err)
+		}
+		c.storage = store
+		c.loadStoredPieces()
+	}
+	if err := c.verifier.Start(c.ctx); err != nil {
+		return err
+	}
+	c.wg.Add(1)
+	go c.runEvents()
+
+	if c.listener != nil {
+		c.listener.RegisterTorrent(c.metainfo.Info().Hash(), c.handleIncomingConnection)
+	}
+
+	for _, source := range c.sources {
+		c.merger.Run(c.ctx, source)
+		if err := source.Start(c.ctx); err != nil {
+			return fmt.Errorf("Error when starting %s peer source: %w", source.Tag(), err)
+		}
 	}
 
 	return nil
 }
 
-func (c *torrentClientImpl) connectPeer(peer peer.Peer) {
-	if err := peer.Start(c.ctx); err != nil {
-		c.Logger.Error("Error when connecting to peer:", "err", err)
+func (c *torrentClientImpl) TrackerStatuses() []trackerclient.TrackerStatus {
+	return c.trackerPeerResolver.Statuses()
+}
+
+func (c *torrentClientImpl) AddPeers(peers ...common.PeerAddr) {
+	c.manualPeers.Add(peers...)
+}
+
+// handlePeerDiscovery is called by the peer merger with the peers that weren't known yet, every
+// time a source discovers peers. They are connected to as connection slots get free.
+func (c *torrentClientImpl) handlePeerDiscovery(source common.PeerSourceTag, peers []common.PeerAddr) {
+	c.Logger.Debug("Discovered peers", "source", source, "new_peer_count", len(peers), "known_peer_count", c.merger.Len())
+
+	c.mu.Lock()
+	c.candidates = append(c.candidates, peers[:min(len(peers), maxPeerCandidates-len(c.candidates))]...)
+	c.mu.Unlock()
+	c.connectPeers()
+}
+
+// handleIncomingConnection is called by the listener with the connections for this torrent.
+func (c *torrentClientImpl) handleIncomingConnection(conn peer.PeerWireConnection, result peer.HandshakeResult) {
+	if tcpAddr, ok := conn.RemoteAddr().(*net.TCPAddr); ok && c.bans.Banned(tcpAddr.IP.String()) {
+		c.Logger.Debug("Rejected connection from banned peer", "remote_addr", tcpAddr.String())
+		conn.Close()
+		return
+	}
+	c.Logger.Debug("Accepted incoming peer connection", "remote_addr", conn.RemoteAddr().String(), "peer_id", fmt.Sprintf("%x", result.Handshake.PeerID()))
+	if err := c.startSession(conn, result.Capabilities, false); err != nil {
+		c.Logger.Debug("Failed to start peer session", "remote_addr", conn.RemoteAddr().String(), "err", err)
+	}
+}
+
+// startSession runs a peer session on a connection whose handshakes were exchanged. The peers we
+// connected to are announced through peer exchange right away: they listen on the address we
+// dialed.
+func (c *torrentClientImpl) startSession(conn peer.PeerWireConnection, capabilities peer.Capabilities, outgoing bool) error {
+	info := c.metainfo.Info()
+	numPieces := len(info.Pieces()) / 20
+
+	var addr common.PeerAddr
+	var remoteIP net.IP
+	if tcpAddr, ok := conn.RemoteAddr().(*net.TCPAddr); ok {
+		remoteIP = tcpAddr.IP
+		addr = common.PeerAddr{Host: tcpAddr.IP.String(), Port: uint16(tcpAddr.Port)}
+	}
+
+	config := peer.SessionConfig{
+		Addr:         addr,
+		Capabilities: capabilities,
+		NumPieces:    numPieces,
+		Bitfield:     c.picker.Bitfield(),
+		Events:       c.events,
+		Stats:        c.stats,
+		Logger:       &c.Logger,
+	}
+	if capabilities.Fast {
+		config.AllowedFast = peer.AllowedFastSet(peer.DefaultAllowedFastCount, uint32(numPieces), info.Hash(), remoteIP)
 	}
 
-	// TODO: Avoid race condition here
-	c.connectedPeers = append(c.connectedPeers, peer)
+	session := peer.NewSession(conn, config)
+	state := &sessionState{
+		picker:   c.picker.NewPeer(),
+		pipeline: peer.NewPipeline(session, peer.PipelineConfig{}),
+	}
+	if capabilities.ExtensionProtocol {
+		state.extensions = session.EnableExtensions(c.extensions, peer.ExtensionSessionConfig{Port: c.port, RemoteIP: remoteIP})
+	}
+
+	c.mu.Lock()
+	if c.ctx == nil || c.ctx.Err() != nil || c.closed {
+		c.mu.Unlock()
+		conn.Close()
+		return fmt.Errorf("Torrent client is not running.")
+	}
+	c.sessions[session] = state
+	if outgoing {
+		c.exchangePeer(state, addr, pex.FlagReachable)
+	}
+	c.mu.Unlock()
+
+	return session.Start(c.ctx)
 }
 
 func (c *torrentClientImpl) Close() error {
-	if err := c.trackerPeerResolver.Close(); err != nil {
-		c.Logger.Error("Error when closing trackerPeerResolver:", "err", err)
+	if c.listener != nil {
+		c.listener.UnregisterTorrent(c.metainfo.Info().Hash())
+	}
+
+	c.mu.Lock()
+	c.closed = true
+	c.candidates = nil
+	sessions := make([]*peer.Session, 0, len(c.sessions))
+	for session, state := range c.sessions {
+		sessions = append(sessions, session)
+		c.forgetPeer(state)
+	}
+	c.sessions = make(map[*peer.Session]*sessionState)
+	c.mu.Unlock()
+
+	for _, session := range sessions {
+		session.Close()
+	}
+
+	for _, source := range c.sources {
+		if err := source.Close(); err != nil {
+			c.Logger.Error("Error when closing peer source:", "source", source.Tag(), "err", err)
+		}
+	}
+
+	if c.cancel != nil {
+		c.cancel()
+		c.merger.Wait()
+		c.wg.Wait()
+	}
+	c.verifier.Close()
+	if c.storage != nil {
+		if err := c.storage.Close(); err != nil {
+			c.Logger.Error("Error when closing storage", "err", err)
+		}
 	}
 
 	return nil
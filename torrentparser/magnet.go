@@ -0,0 +1,118 @@
+package torrentparser
+
+import (
+	"encoding/base32"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"net"
+	"net/url"
+	"strconv"
+	"strings"
+
+	"github.com/dpnam2112/bittorrent-client/common"
+)
+
+// Magnet is a parsed magnet link (BEP 9):
+//
+//	magnet:?xt=urn:btih:<info hash>&dn=<name>&tr=<tracker>&x.pe=<host:port>
+//
+// The info hash is 40 hex digits or 32 base32 characters. tr and x.pe may be repeated.
+type Magnet struct {
+	InfoHash    [20]byte
+	DisplayName string
+	Trackers    []string
+	// Peers are the x.pe peer addresses.
+	Peers []common.PeerAddr
+}
+
+func ParseMagnet(uri string) (Magnet, error) {
+	var m Magnet
+
+	u, err := url.Parse(uri)
+	if err != nil {
+		return m, fmt.Errorf("failed to parse magnet link: %w", err)
+	}
+	if u.Scheme != "magnet" {
+		return m, fmt.Errorf("not a magnet link: %s", uri)
+	}
+
+	query := u.Query()
+
+	found := false
+	for _, xt := range query["xt"] {
+		encoded, ok := strings.CutPrefix(xt, "urn:btih:")
+		if !ok {
+			continue
+		}
+		infoHash, err := decodeInfoHash(encoded)
+		if err != nil {
+			return m, err
+		}
+		m.InfoHash = infoHash
+		found = true
+		break
+	}
+	if !found {
+		return m, errors.New("magnet link has no urn:btih info hash")
+	}
+
+	m.DisplayName = query.Get("dn")
+	m.Trackers = query["tr"]
+
+	for _, pe := range query["x.pe"] {
+		host, portStr, err := net.SplitHostPort(pe)
+		if err != nil {
+			continue
+		}
+		port, err := strconv.ParseUint(portStr, 10, 16)
+		if err != nil || port == 0 {
+			continue
+		}
+		m.Peers = append(m.Peers, common.PeerAddr{Host: host, Port: uint16(port)})
+	}
+
+	return m, nil
+}
+
+func decodeInfoHash(encoded string) ([20]byte, error) {
+	var infoHash [20]byte
+
+	var decoded []byte
+	var err error
+	switch len(encoded) {
+	case 40:
+		decoded, err = hex.DecodeString(encoded)
+	case 32:
+		decoded, err = base32.StdEncoding.DecodeString(strings.ToUpper(encoded))
+	default:
+		err = fmt.Errorf("unexpected length %d", len(encoded))
+	}
+	if err != nil {
+		return infoHash, fmt.Errorf("invalid magnet info hash '%s': %w", encoded, err)
+	}
+
+	copy(infoHash[:], decoded)
+	return infoHash, nil
+}
+
+// Metainfo returns the metainfo of the torrent as far as the magnet link knows it: its trackers,
+// each in its own tier, and its info hash. The info dictionary must be fetched from peers.
+func (m Magnet) Metainfo() TorrentMetainfo {
+	var announce string
+	var announceList [][]string
+	for _, tracker := range m.Trackers {
+		announceList = append(announceList, []string{tracker})
+	}
+	if len(m.Trackers) > 0 {
+		announce = m.Trackers[0]
+	}
+
+	return NewTorrentMetainfo(announce, announceList, InfoDict{name: m.DisplayName, hash: m.InfoHash})
+}
+
+// WithInfo returns the metainfo completed with the info dictionary fetched from peers.
+func (t TorrentMetainfo) WithInfo(info InfoDict) TorrentMetainfo {
+	t.info = info
+	return t
+}
@@ -1,10 +1,13 @@
 package torrentparser
 
 import (
+	"bytes"
 	"errors"
 	"fmt"
 	"io"
 	"log/slog"
+	"net"
+	"strconv"
 
 	"github.com/dpnam2112/bittorrent-client/bencode"
 )
@@ -54,6 +57,22 @@ func ParseTorrent(reader io.Reader) (*TorrentMetainfo, error) {
 		}
 	}
 
+	// Parse DHT nodes (optional): a list of [host, port] pairs.
+	var nodes []string
+	if nodesVal, ok := dict.Dict["nodes"].(*bencode.BList); ok {
+		for _, nodeVal := range nodesVal.Values {
+			pair, ok := nodeVal.(*bencode.BList)
+			if !ok || len(pair.Values) != 2 {
+				continue
+			}
+			host, okHost := pair.Values[0].(*bencode.BString)
+			port, okPort := pair.Values[1].(*bencode.BInt)
+			if okHost && okPort {
+				nodes = append(nodes, net.JoinHostPort(string(host.Value), strconv.FormatInt(port.Value, 10)))
+			}
+		}
+	}
+
 	// Parse info dictionary.
 	infoVal, ok := dict.Dict["info"].(*bencode.BDict)
 	if !ok {
@@ -62,9 +81,33 @@ func ParseTorrent(reader io.Reader) (*TorrentMetainfo, error) {
 	info = parseInfoDict(infoVal)
 
 	torrent := NewTorrentMetainfo(announce, announceList, info)
+	torrent.nodes = nodes
 	return &torrent, nil
 }
 
+// ParseInfoDict parses a bencoded info dictionary on its own, like the metadata fetched from
+// peers for a magnet link (BEP 9).
+func ParseInfoDict(raw []byte) (InfoDict, error) {
+	remaining, value, err := bencode.ParseBencode(raw)
+	if err != nil {
+		return InfoDict{}, fmt.Errorf("failed to parse info dictionary: %w", err)
+	}
+	if len(remaining) > 0 {
+		return InfoDict{}, errors.New("unexpected extra data after the info dictionary")
+	}
+
+	dict, ok := value.(*bencode.BDict)
+	if !ok {
+		return InfoDict{}, errors.New("info dictionary is not a dictionary")
+	}
+
+	info := parseInfoDict(dict)
+	if info.pieceLength <= 0 || len(info.pieces) == 0 || len(info.pieces)%20 != 0 {
+		return InfoDict{}, errors.New("info dictionary has no valid pieces")
+	}
+	return info, nil
+}
+
 // parseInfoDict parses the "info" dictionary from a torrent file.
 func parseInfoDict(infoDict *bencode.BDict) InfoDict {
 	var (
@@ -128,3 +171,59 @@ func parseInfoDict(infoDict *bencode.BDict) InfoDict {
 		rawBencode:  infoDict.GetRawBencode(),
 	}
 }
+
+// MarshalTorrent encodes the metainfo as the content of a .torrent file. The info dictionary is
+// written as it was parsed: encoding it again could change the info hash.
+func MarshalTorrent(t TorrentMetainfo) ([]byte, error) {
+	if !t.info.HasMetadata() {
+		return nil, errors.New("torrent has no info dictionary")
+	}
+
+	var announceList []bencode.BValue
+	for _, tier := range t.announceList {
+		var trackers []bencode.BValue
+		for _, tracker := range tier {
+			trackers = append(trackers, &bencode.BString{Value: []byte(tracker)})
+		}
+		announceList = append(announceList, &bencode.BList{Values: trackers})
+	}
+
+	var nodes []bencode.BValue
+	for _, node := range t.nodes {
+		host, portStr, err := net.SplitHostPort(node)
+		if err != nil {
+			continue
+		}
+		port, err := strconv.ParseInt(portStr, 10, 64)
+		if err != nil {
+			continue
+		}
+		nodes = append(nodes, &bencode.BList{Values: []bencode.BValue{
+			&bencode.BString{Value: []byte(host)},
+			&bencode.BInt{Value: port},
+		}})
+	}
+
+	// Keys in sorted order.
+	var buf bytes.Buffer
+	buf.WriteByte('d')
+	if t.announce != "" {
+		writeKey(&buf, "announce", &bencode.BString{Value: []byte(t.announce)})
+	}
+	if len(announceList) > 0 {
+		writeKey(&buf, "announce-list", &bencode.BList{Values: announceList})
+	}
+	buf.Write(bencode.Encode(&bencode.BString{Value: []byte("info")}))
+	buf.Write(t.info.rawBencode)
+	if len(nodes) > 0 {
+		writeKey(&buf, "nodes", &bencode.BList{Values: nodes})
+	}
+	buf.WriteByte('e')
+
+	return buf.Bytes(), nil
+}
+
+func writeKey(buf *bytes.Buffer, key string, value bencode.BValue) {
+	buf.Write(bencode.Encode(&bencode.BString{Value: []byte(key)}))
+	buf.Write(bencode.Encode(value))
+}
@@ -3,10 +3,13 @@ package torrentparser
 import (
 	"bytes"
 	"crypto/sha1"
+	"encoding/base32"
 	"fmt"
 	"reflect"
+	"strings"
 	"testing"
 
+	"github.com/dpnam2112/bittorrent-client/common"
 	"github.com/stretchr/testify/assert"
 )
 
@@ -61,3 +64,76 @@ func TestParseInvalidTorrent(t *testing.T) {
 	_, err := ParseTorrent(reader)
 	assert.Error(t, err)
 }
+
+func TestParseTrackerlessTorrent(t *testing.T) {
+	// The third node is malformed and skipped.
+	data := []byte("d5:nodesll9:127.0.0.1i6881eel7:2001::1i6882eel3:badee" +
+		"4:infod4:name4:test12:piece lengthi16384e6:pieces20:aaaaaaaaaaaaaaaaaaaaee")
+
+	torrent, err := ParseTorrent(bytes.NewReader(data))
+	assert.NoError(t, err)
+	assert.Equal(t, "", torrent.Announce())
+	assert.Equal(t, []string{"127.0.0.1:6881", "[2001::1]:6882"}, torrent.Nodes())
+}
+
+func TestParseMagnet(t *testing.T) {
+	infoHash := sha1.Sum([]byte("info"))
+
+	hexLink := fmt.Sprintf("magnet:?xt=urn:btih:%x&dn=Sintel&tr=udp%%3A%%2F%%2Ftracker.example%%3A6969"+
+		"&tr=http%%3A%%2F%%2Ftracker.example%%2Fannounce&x.pe=10.0.0.1%%3A6881&x.pe=invalid&x.pe=%%5B2001%%3A%%3A1%%5D%%3A6882", infoHash)
+	magnet, err := ParseMagnet(hexLink)
+	assert.NoError(t, err)
+	assert.Equal(t, infoHash, magnet.InfoHash)
+	assert.Equal(t, "Sintel", magnet.DisplayName)
+	assert.Equal(t, []string{"udp://tracker.example:6969", "http://tracker.example/announce"}, magnet.Trackers)
+	assert.Equal(t, []common.PeerAddr{{Host: "10.0.0.1", Port: 6881}, {Host: "2001::1", Port: 6882}}, magnet.Peers)
+
+	metainfo := magnet.Metainfo()
+	assert.Equal(t, "udp://tracker.example:6969", metainfo.Announce())
+	assert.Equal(t, [][]string{{"udp://tracker.example:6969"}, {"http://tracker.example/announce"}}, metainfo.AnnounceList())
+	assert.False(t, metainfo.Info().HasMetadata())
+	assert.Equal(t, infoHash, metainfo.Info().Hash())
+
+	base32Link := "magnet:?xt=urn:btih:" + strings.ToLower(base32.StdEncoding.EncodeToString(infoHash[:]))
+	magnet, err = ParseMagnet(base32Link)
+	assert.NoError(t, err)
+	assert.Equal(t, infoHash, magnet.InfoHash)
+
+	for _, invalid := range []string{
+		"http://example.com",
+		"magnet:?dn=no-hash",
+		"magnet:?xt=urn:btih:1234",
+		"magnet:?xt=urn:btih:" + strings.Repeat("z", 40),
+	} {
+		_, err := ParseMagnet(invalid)
+		assert.Error(t, err, invalid)
+	}
+}
+
+func TestParseInfoDictAndMarshal(t *testing.T) {
+	raw := []byte("d4:name4:test12:piece lengthi16384e6:pieces20:aaaaaaaaaaaaaaaaaaaae")
+
+	info, err := ParseInfoDict(raw)
+	assert.NoError(t, err)
+	assert.True(t, info.HasMetadata())
+	assert.Equal(t, "test", info.Name())
+	assert.Equal(t, sha1.Sum(raw), info.Hash())
+
+	for _, invalid := range []string{"le", "d4:name4:teste", string(raw) + "i0e"} {
+		_, err := ParseInfoDict([]byte(invalid))
+		assert.Error(t, err, invalid)
+	}
+
+	magnet := Magnet{InfoHash: sha1.Sum(raw), Trackers: []string{"http://tracker.com"}}
+	metainfo := magnet.Metainfo().WithInfo(info)
+	encoded, err := MarshalTorrent(metainfo)
+	assert.NoError(t, err)
+	assert.Equal(t, "d8:announce18:http://tracker.com13:announce-listll18:http://tracker.comee4:info"+string(raw)+"e", string(encoded))
+
+	parsed, err := ParseTorrent(bytes.NewReader(encoded))
+	assert.NoError(t, err)
+	assert.Equal(t, info.Hash(), parsed.Info().Hash())
+
+	_, err = MarshalTorrent(magnet.Metainfo())
+	assert.Error(t, err)
+}
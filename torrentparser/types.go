@@ -10,7 +10,9 @@ import (
 type TorrentMetainfo struct {
 	announce     string
 	announceList [][]string
-	info         InfoDict
+	// nodes are the "host:port" addresses of DHT nodes listed by trackerless torrents (BEP 5).
+	nodes []string
+	info  InfoDict
 }
 
 func NewTorrentMetainfo(announce string, announceList [][]string, info InfoDict) TorrentMetainfo {
@@ -29,6 +31,11 @@ func (t TorrentMetainfo) AnnounceList() [][]string {
 	return t.announceList
 }
 
+// Nodes returns the DHT nodes listed in the torrent, as "host:port" addresses.
+func (t TorrentMetainfo) Nodes() []string {
+	return t.nodes
+}
+
 func (t TorrentMetainfo) Info() InfoDict {
 	return t.info
 }
@@ -41,7 +48,9 @@ type InfoDict struct {
 	length      int64
 	files       []FileEntry
 	rawBencode  []byte // raw bencode representation of the info dictionary. This is used to compute SHA-1 hash of the torrent.
-	hash        [20]byte
+	// hash is the info hash of torrents whose info dictionary isn't known yet, like those added
+	// from a magnet link.
+	hash [20]byte
 }
 
 func (i InfoDict) Name() string {
@@ -64,7 +73,36 @@ func (i InfoDict) Files() []FileEntry {
 	return i.files
 }
 
+// TotalLength returns the size of the torrent's content: the length of the file for single-file
+// torrents, the sum of the files' lengths for multi-file torrents.
+func (i InfoDict) TotalLength() int64 {
+	if len(i.files) == 0 {
+		return i.length
+	}
+
+	var total int64
+	for _, f := range i.files {
+		total += f.length
+	}
+	return total
+}
+
+// HasMetadata reports whether the info dictionary is known. Torrents added from a magnet link
+// only know their info hash until the metadata is fetched from peers.
+func (i InfoDict) HasMetadata() bool {
+	return i.rawBencode != nil
+}
+
+// Raw returns the bencoded info dictionary, which is served to peers fetching the metadata.
+func (i InfoDict) Raw() []byte {
+	return i.rawBencode
+}
+
 func (i InfoDict) Hash() [20]byte {
+	if !i.HasMetadata() {
+		return i.hash
+	}
+
 	// Calculate SHA-1 hash of the info dictionary.
 	rawBencode := i.rawBencode
 	hash := sha1.Sum(rawBencode)
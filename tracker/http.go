@@ -0,0 +1,148 @@
+package tracker
+
+import (
+	"net"
+	"net/http"
+	"net/url"
+	"strconv"
+	"time"
+
+	"github.com/dpnam2112/bittorrent-client/common"
+	"github.com/dpnam2112/bittorrent-client/trackerclient"
+)
+
+// newHTTPHandler serves the HTTP tracker endpoints: '/announce' and '/scrape'.
+func newHTTPHandler(s *Server) http.Handler {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/announce", s.handleHTTPAnnounce)
+	mux.HandleFunc("/scrape", s.handleHTTPScrape)
+	return mux
+}
+
+func (s *Server) handleHTTPAnnounce(w http.ResponseWriter, r *http.Request) {
+	query := r.URL.Query()
+
+	infoHash, ok := queryHash(query, "info_hash")
+	if !ok {
+		writeHTTPFailure(w, "Missing or invalid info_hash.")
+		return
+	}
+
+	peerID, ok := queryHash(query, "peer_id")
+	if !ok {
+		writeHTTPFailure(w, "Missing or invalid peer_id.")
+		return
+	}
+
+	port, err := strconv.ParseUint(query.Get("port"), 10, 16)
+	if err != nil || port == 0 {
+		writeHTTPFailure(w, "Missing or invalid port.")
+		return
+	}
+
+	if !s.allowed(infoHash) {
+		writeHTTPFailure(w, errNotWhitelisted.Error())
+		return
+	}
+
+	left, _ := strconv.ParseInt(query.Get("left"), 10, 64)
+	numWant, _ := strconv.Atoi(query.Get("numwant"))
+
+	remoteIP := remoteIP(r)
+	if remoteIP == nil {
+		writeHTTPFailure(w, "Unable to determine the client's address.")
+		return
+	}
+
+	// Besides the source address, a dual-stack client may tell its address in the other family
+	// through the 'ipv4' and 'ipv6' parameters (BEP 7).
+	addrs := []trackerclient.PeerAddr{{IP: remoteIP, Port: uint16(port)}}
+	if ip := net.ParseIP(query.Get("ipv4")); ip != nil && ip.To4() != nil && !ip.Equal(remoteIP) {
+		addrs = append(addrs, trackerclient.PeerAddr{IP: ip.To4(), Port: uint16(port)})
+	}
+	if ip := net.ParseIP(query.Get("ipv6")); ip != nil && ip.To4() == nil && !ip.Equal(remoteIP) {
+		addrs = append(addrs, trackerclient.PeerAddr{IP: ip, Port: uint16(port)})
+	}
+
+	peers, stats := s.swarms.Announce(announce{
+		infoHash: infoHash,
+		peerID:   peerID,
+		addrs:    addrs,
+		event:    parseHTTPEvent(query.Get("event")),
+		left:     left,
+		numWant:  s.numWant(numWant),
+	}, "")
+
+	resp := trackerclient.TrackerHTTPAnnounceResponse{
+		Interval:      int32(s.config.Interval / time.Second),
+		MinInterval:   int32(s.config.MinInterval / time.Second),
+		Complete:      stats.Seeders,
+		Incomplete:    stats.Leechers,
+		PeerAddresses: peers,
+	}
+
+	w.Header().Set("Content-Type", "text/plain")
+	w.Write(resp.Marshal())
+}
+
+func (s *Server) handleHTTPScrape(w http.ResponseWriter, r *http.Request) {
+	resp := trackerclient.TrackerHTTPScrapeResponse{Files: map[[20]byte]trackerclient.ScrapeStats{}}
+
+	for _, raw := range r.URL.Query()["info_hash"] {
+		if len(raw) != 20 {
+			continue
+		}
+
+		infoHash := common.InfoHash([]byte(raw))
+		if !s.allowed(infoHash) {
+			continue
+		}
+		resp.Files[infoHash] = s.swarms.Scrape(infoHash)
+	}
+
+	w.Header().Set("Content-Type", "text/plain")
+	w.Write(resp.Marshal())
+}
+
+func writeHTTPFailure(w http.ResponseWriter, reason string) {
+	w.Header().Set("Content-Type", "text/plain")
+	w.Write(trackerclient.MarshalTrackerHTTPFailure(reason))
+}
+
+// queryHash returns a 20-byte binary parameter, such as info_hash or peer_id.
+func queryHash(query url.Values, key string) ([20]byte, bool) {
+	var hash [20]byte
+	raw := query.Get(key)
+	if len(raw) != 20 {
+		return hash, false
+	}
+
+	copy(hash[:], raw)
+	return hash, true
+}
+
+func remoteIP(r *http.Request) net.IP {
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		return nil
+	}
+
+	ip := net.ParseIP(host)
+	if ip4 := ip.To4(); ip4 != nil {
+		return ip4
+	}
+	return ip
+}
+
+func parseHTTPEvent(event string) trackerclient.AnnounceEvent {
+	switch event {
+	case "started":
+		return trackerclient.AnnounceEventStarted
+	case "completed":
+		return trackerclient.AnnounceEventCompleted
+	case "stopped":
+		return trackerclient.AnnounceEventStopped
+	default:
+		return trackerclient.AnnounceEventNone
+	}
+}
@@ -0,0 +1,242 @@
+package tracker
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/dpnam2112/bittorrent-client/common"
+)
+
+const (
+	defaultInterval       = 30 * time.Minute
+	defaultMinInterval    = 1 * time.Minute
+	defaultNumWant        = 50
+	defaultMaxNumWant     = 200
+	defaultExpiryInterval = 1 * time.Minute
+)
+
+// Config controls the behaviour of the tracker server. Zero values are replaced with defaults by
+// NewServer, except for the listen addresses: an empty UDPAddr or HTTPAddr disables that
+// transport.
+type Config struct {
+	UDPAddr  string
+	HTTPAddr string
+
+	// Interval is the time clients are asked to wait between announces. MinInterval is only
+	// sent to HTTP clients.
+	Interval    time.Duration
+	MinInterval time.Duration
+
+	// DefaultNumWant is used when a client doesn't tell how many peers it wants. MaxNumWant caps
+	// the number of peers returned in a single announce response.
+	DefaultNumWant int
+	MaxNumWant     int
+
+	// PeerTTL is the time after which a peer that stopped announcing is dropped from its swarm.
+	// Defaults to twice the announce interval.
+	PeerTTL time.Duration
+
+	// Whitelist restricts the tracker to the listed info hashes. An empty whitelist allows every
+	// torrent.
+	Whitelist []common.InfoHash
+}
+
+func (cfg *Config) setDefaults() {
+	if cfg.Interval <= 0 {
+		cfg.Interval = defaultInterval
+	}
+
+	if cfg.MinInterval <= 0 {
+		cfg.MinInterval = min(defaultMinInterval, cfg.Interval)
+	}
+
+	if cfg.MaxNumWant <= 0 {
+		cfg.MaxNumWant = defaultMaxNumWant
+	}
+
+	if cfg.DefaultNumWant <= 0 {
+		cfg.DefaultNumWant = min(defaultNumWant, cfg.MaxNumWant)
+	}
+
+	if cfg.PeerTTL <= 0 {
+		cfg.PeerTTL = 2 * cfg.Interval
+	}
+}
+
+// Server is a BitTorrent tracker speaking both the UDP (BEP 15) and the HTTP (BEP 3, BEP 48)
+// tracker protocols. All state is kept in memory.
+type Server struct {
+	config    Config
+	whitelist map[common.InfoHash]struct{}
+	swarms    *swarmStore
+	logger    *slog.Logger
+
+	udpConn    net.PacketConn
+	udp        *udpServer
+	httpLis    net.Listener
+	httpServer *http.Server
+
+	cancel context.CancelFunc
+	wg     sync.WaitGroup
+}
+
+var _ common.LifeCycle = (*Server)(nil)
+
+var errNotWhitelisted = errors.New("Requested torrent is not served by this tracker.")
+
+func NewServer(config Config, logger *slog.Logger) *Server {
+	config.setDefaults()
+
+	whitelist := make(map[common.InfoHash]struct{}, len(config.Whitelist))
+	for _, infoHash := range config.Whitelist {
+		whitelist[infoHash] = struct{}{}
+	}
+
+	return &Server{
+		config:    config,
+		whitelist: whitelist,
+		swarms:    newSwarmStore(),
+		logger:    logger,
+	}
+}
+
+// Start binds the configured listeners and serves requests in background goroutines until
+// Close is called or ctx is cancelled.
+func (s *Server) Start(ctx context.Context) error {
+	if s.config.UDPAddr == "" && s.config.HTTPAddr == "" {
+		return errors.New("At least one of the UDP and HTTP listen addresses must be set.")
+	}
+
+	ctx, s.cancel = context.WithCancel(ctx)
+
+	if s.config.UDPAddr != "" {
+		conn, err := net.ListenPacket("udp", s.config.UDPAddr)
+		if err != nil {
+			s.cancel()
+			return fmt.Errorf("Failed to listen on UDP address %s: %w", s.config.UDPAddr, err)
+		}
+
+		s.udpConn = conn
+		s.udp = newUDPServer(s, conn)
+		s.logger.Info("UDP tracker listening", "addr", conn.LocalAddr().String())
+
+		s.wg.Add(1)
+		go func() {
+			defer s.wg.Done()
+			s.udp.serve()
+		}()
+	}
+
+	if s.config.HTTPAddr != "" {
+		lis, err := net.Listen("tcp", s.config.HTTPAddr)
+		if err != nil {
+			s.Close()
+			return fmt.Errorf("Failed to listen on HTTP address %s: %w", s.config.HTTPAddr, err)
+		}
+
+		s.httpLis = lis
+		s.httpServer = &http.Server{Handler: newHTTPHandler(s)}
+		s.logger.Info("HTTP tracker listening", "addr", lis.Addr().String())
+
+		s.wg.Add(1)
+		go func() {
+			defer s.wg.Done()
+			if err := s.httpServer.Serve(lis); err != nil && !errors.Is(err, http.ErrServerClosed) {
+				s.logger.Error("HTTP tracker stopped", "err", err)
+			}
+		}()
+	}
+
+	s.wg.Add(1)
+	go func() {
+		defer s.wg.Done()
+		s.expireLoop(ctx)
+	}()
+
+	go func() {
+		<-ctx.Done()
+		s.shutdown()
+	}()
+
+	return nil
+}
+
+// Close stops the listeners and waits for the background goroutines to exit.
+func (s *Server) Close() error {
+	if s.cancel != nil {
+		s.cancel()
+	}
+	s.shutdown()
+	s.wg.Wait()
+	return nil
+}
+
+func (s *Server) shutdown() {
+	if s.udpConn != nil {
+		s.udpConn.Close()
+	}
+
+	if s.httpServer != nil {
+		s.httpServer.Close()
+	}
+}
+
+// UDPAddr returns the address the UDP tracker is bound to, or nil if it's disabled.
+func (s *Server) UDPAddr() net.Addr {
+	if s.udpConn == nil {
+		return nil
+	}
+	return s.udpConn.LocalAddr()
+}
+
+// HTTPAddr returns the address the HTTP tracker is bound to, or nil if it's disabled.
+func (s *Server) HTTPAddr() net.Addr {
+	if s.httpLis == nil {
+		return nil
+	}
+	return s.httpLis.Addr()
+}
+
+func (s *Server) expireLoop(ctx context.Context) {
+	ticker := time.NewTicker(min(defaultExpiryInterval, s.config.PeerTTL))
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			if removed := s.swarms.Expire(s.config.PeerTTL); removed > 0 {
+				s.logger.Debug("Expired peers", "count", removed)
+			}
+
+			if s.udp != nil {
+				s.udp.expireConnections()
+			}
+		}
+	}
+}
+
+// allowed reports whether the tracker serves infoHash.
+func (s *Server) allowed(infoHash common.InfoHash) bool {
+	if len(s.whitelist) == 0 {
+		return true
+	}
+
+	_, ok := s.whitelist[infoHash]
+	return ok
+}
+
+// numWant clamps the number of peers requested by a client.
+func (s *Server) numWant(requested int) int {
+	if requested <= 0 {
+		return s.config.DefaultNumWant
+	}
+	return min(requested, s.config.MaxNumWant)
+}
@@ -0,0 +1,339 @@
+package tracker
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"log/slog"
+	"net"
+	"net/http"
+	"net/url"
+	"testing"
+	"time"
+
+	"github.com/dpnam2112/bittorrent-client/common"
+	"github.com/dpnam2112/bittorrent-client/torrentparser"
+	"github.com/dpnam2112/bittorrent-client/trackerclient"
+	"github.com/stretchr/testify/assert"
+)
+
+var testLogger = slog.New(slog.NewTextHandler(io.Discard, nil))
+
+func startTestServer(t *testing.T, config Config) *Server {
+	config.UDPAddr = "127.0.0.1:0"
+	config.HTTPAddr = "127.0.0.1:0"
+
+	server := NewServer(config, testLogger)
+	assert.NoError(t, server.Start(context.Background()))
+	t.Cleanup(func() { server.Close() })
+	return server
+}
+
+func udpAnnounce(t *testing.T, server *Server, infoHash [20]byte, port uint16, left int64) (*trackerclient.TrackerUDPAnnounceResponse, error) {
+	addr := server.UDPAddr().(*net.UDPAddr)
+	client := trackerclient.TrackerUDPClient{Logger: testLogger}
+
+	connResp, err := client.SendConnectRequest(addr.IP, addr.Port, 2*time.Second)
+	assert.NoError(t, err)
+
+	return client.SendAnnounceRequest(addr.IP, addr.Port, 2*time.Second, &trackerclient.TrackerUDPAnnounceRequest{
+		ConnectionID: connResp.ConnectionID,
+		TxnID:        int32(port),
+		InfoHash:     infoHash,
+		Left:         left,
+		Event:        trackerclient.AnnounceEventStarted,
+		Port:         port,
+		NumWant:      -1,
+	})
+}
+
+func TestUDPAnnounce(t *testing.T) {
+	server := startTestServer(t, Config{Interval: 10 * time.Minute})
+	infoHash := [20]byte{1}
+
+	resp, err := udpAnnounce(t, server, infoHash, 1000, 0)
+	assert.NoError(t, err)
+	assert.Empty(t, resp.PeerAddresses)
+	assert.Equal(t, int32(600), resp.Interval)
+	assert.Equal(t, int32(1), resp.Seeders)
+
+	resp, err = udpAnnounce(t, server, infoHash, 1001, 100)
+	assert.NoError(t, err)
+	assert.Equal(t, int32(1), resp.Seeders)
+	assert.Equal(t, int32(1), resp.Leechers)
+	assert.Len(t, resp.PeerAddresses, 1)
+	assert.Equal(t, "127.0.0.1:1000", resp.PeerAddresses[0].String())
+}
+
+func TestUDPRejectsUnknownConnectionID(t *testing.T) {
+	server := startTestServer(t, Config{})
+	addr := server.UDPAddr().(*net.UDPAddr)
+	client := trackerclient.TrackerUDPClient{Logger: testLogger}
+
+	_, err := client.SendAnnounceRequest(addr.IP, addr.Port, 2*time.Second, &trackerclient.TrackerUDPAnnounceRequest{
+		ConnectionID: 42,
+		Port:         1000,
+	})
+	assert.ErrorContains(t, err, "Connection ID")
+}
+
+func TestUDPScrape(t *testing.T) {
+	server := startTestServer(t, Config{})
+	infoHash := [20]byte{2}
+
+	_, err := udpAnnounce(t, server, infoHash, 1000, 10)
+	assert.NoError(t, err)
+
+	resp := udpScrape(t, server, infoHash, [20]byte{3})
+	assert.Equal(t, []trackerclient.ScrapeStats{{Leechers: 1}, {}}, resp.Stats)
+}
+
+func udpScrape(t *testing.T, server *Server, infoHashes ...[20]byte) *trackerclient.TrackerUDPScrapeResponse {
+	addr := server.UDPAddr().(*net.UDPAddr)
+	client := trackerclient.TrackerUDPClient{Logger: testLogger}
+	connResp, err := client.SendConnectRequest(addr.IP, addr.Port, 2*time.Second)
+	assert.NoError(t, err)
+
+	conn, err := net.DialUDP("udp", nil, addr)
+	assert.NoError(t, err)
+	defer conn.Close()
+
+	req := trackerclient.TrackerUDPScrapeRequest{
+		ConnectionID: connResp.ConnectionID,
+		TxnID:        5,
+		InfoHashes:   infoHashes,
+	}
+	_, err = conn.Write(req.Marshal())
+	assert.NoError(t, err)
+
+	buf := make([]byte, 512)
+	conn.SetReadDeadline(time.Now().Add(2 * time.Second))
+	n, err := conn.Read(buf)
+	assert.NoError(t, err)
+
+	resp, err := trackerclient.UnmarshalTrackerUDPScrapeResponse(buf[:n])
+	assert.NoError(t, err)
+	assert.Equal(t, int32(5), resp.TxnID)
+	return resp
+}
+
+func TestWhitelist(t *testing.T) {
+	allowed := common.InfoHash{9}
+	server := startTestServer(t, Config{Whitelist: []common.InfoHash{allowed}})
+
+	_, err := udpAnnounce(t, server, allowed, 1000, 0)
+	assert.NoError(t, err)
+
+	_, err = udpAnnounce(t, server, [20]byte{8}, 1000, 0)
+	assert.ErrorContains(t, err, "not served")
+
+	client := trackerclient.TrackerHTTPClient{Logger: testLogger}
+	announceURL := fmt.Sprintf("http://%s/announce", server.HTTPAddr().String())
+	_, err = client.SendAnnounceRequest(announceURL, "tcp", 2*time.Second, &trackerclient.TrackerHTTPAnnounceRequest{
+		InfoHash: [20]byte{8},
+		Port:     1000,
+	})
+	assert.ErrorContains(t, err, "not served")
+
+	// Scrapes don't reveal the swarms of the torrents that aren't served.
+	server.swarms.Announce(announce{
+		infoHash: common.InfoHash{8},
+		addrs:    []trackerclient.PeerAddr{{IP: net.ParseIP("10.0.0.1").To4(), Port: 1}},
+		numWant:  10,
+	}, "")
+	resp := udpScrape(t, server, allowed, [20]byte{8})
+	assert.Equal(t, []trackerclient.ScrapeStats{{Seeders: 1}, {}}, resp.Stats)
+}
+
+func TestHTTPAnnounceAndScrape(t *testing.T) {
+	server := startTestServer(t, Config{MaxNumWant: 2})
+	infoHash := [20]byte{' ', '+', '%'}
+	client := trackerclient.TrackerHTTPClient{Logger: testLogger}
+	announceURL := fmt.Sprintf("http://%s/announce", server.HTTPAddr().String())
+
+	for port := uint16(2000); port < 2004; port++ {
+		_, err := client.SendAnnounceRequest(announceURL, "tcp", 2*time.Second, &trackerclient.TrackerHTTPAnnounceRequest{
+			InfoHash: infoHash,
+			PeerID:   [20]byte{byte(port)},
+			Port:     port,
+			Left:     1,
+			NumWant:  50,
+			IPv6:     net.ParseIP("2001:db8::1"),
+		})
+		assert.NoError(t, err)
+	}
+
+	resp, err := client.SendAnnounceRequest(announceURL, "tcp", 2*time.Second, &trackerclient.TrackerHTTPAnnounceRequest{
+		InfoHash: infoHash,
+		Port:     3000,
+		NumWant:  50,
+	})
+	assert.NoError(t, err)
+	assert.Len(t, resp.PeerAddresses, 2, "numwant must be capped by MaxNumWant")
+	assert.Equal(t, int32(1), resp.Complete)
+	assert.Equal(t, int32(8), resp.Incomplete, "each leecher is registered once per address family")
+
+	scrapeURL := fmt.Sprintf("http://%s/scrape?info_hash=%s", server.HTTPAddr().String(), url.QueryEscape(string(infoHash[:])))
+	httpResp, err := http.Get(scrapeURL)
+	assert.NoError(t, err)
+	defer httpResp.Body.Close()
+
+	body, err := io.ReadAll(httpResp.Body)
+	assert.NoError(t, err)
+	scrape, err := trackerclient.UnmarshalTrackerHTTPScrapeResponse(body)
+	assert.NoError(t, err)
+	assert.Equal(t, trackerclient.ScrapeStats{Seeders: 1, Leechers: 8}, scrape.Files[infoHash])
+}
+
+func TestPeerExpiry(t *testing.T) {
+	store := newSwarmStore()
+	now := time.Now()
+	store.now = func() time.Time { return now }
+
+	infoHash := common.InfoHash{1}
+	store.Announce(announce{
+		infoHash: infoHash,
+		addrs:    []trackerclient.PeerAddr{{IP: net.ParseIP("10.0.0.1").To4(), Port: 1}},
+		left:     5,
+		numWant:  10,
+	}, "")
+
+	now = now.Add(time.Minute)
+	assert.Equal(t, 0, store.Expire(2*time.Minute))
+
+	now = now.Add(2 * time.Minute)
+	assert.Equal(t, 1, store.Expire(2*time.Minute))
+	assert.Equal(t, trackerclient.ScrapeStats{}, store.Scrape(infoHash))
+}
+
+type staticResolver []net.IP
+
+func (r staticResolver) LookupIP(ctx context.Context, network, host string) ([]net.IP, error) {
+	return r, nil
+}
+
+func TestUDPAnnounceToURL(t *testing.T) {
+	server := startTestServer(t, Config{})
+	client := trackerclient.TrackerUDPClient{
+		Logger:   testLogger,
+		Resolver: staticResolver{net.ParseIP("127.0.0.1")},
+	}
+
+	trackerURL, err := trackerclient.ParseTrackerURL(
+		fmt.Sprintf("udp://tracker.test:%d/announce?passkey=secret", server.UDPAddr().(*net.UDPAddr).Port),
+	)
+	assert.NoError(t, err)
+
+	resp, err := client.SendAnnounceRequestToURL(context.Background(), trackerURL, 2*time.Second, &trackerclient.TrackerUDPAnnounceRequest{
+		InfoHash: [20]byte{4},
+		Port:     1000,
+		Left:     1,
+		NumWant:  -1,
+	})
+	assert.NoError(t, err)
+	assert.Equal(t, int32(1), resp.Leechers)
+}
+
+func TestTrackerPeerResolverStatuses(t *testing.T) {
+	server := startTestServer(t, Config{Interval: time.Hour})
+	refusing := startTestServer(t, Config{Whitelist: []common.InfoHash{{0xff}}})
+
+	// A closed UDP port: the announce fails with 'connection refused'.
+	closedConn, err := net.ListenPacket("udp", "127.0.0.1:0")
+	assert.NoError(t, err)
+	closedAddr := closedConn.LocalAddr().String()
+	closedConn.Close()
+
+	metainfo := torrentparser.NewTorrentMetainfo("", [][]string{
+		{fmt.Sprintf("udp://%s/announce", server.UDPAddr().String())},
+		{fmt.Sprintf("http://%s/announce", refusing.HTTPAddr().String()), "udp://" + closedAddr},
+		{"wss://tracker.example"},
+	}, torrentparser.InfoDict{})
+
+	resolver := trackerclient.NewTrackerPeerResolver(&metainfo, -1, trackerclient.TrackerPeerResolverConfig{
+		PeerID:  common.GeneratePeerID(),
+		Port:    6881,
+		Logger:  testLogger,
+		Timeout: time.Second,
+	})
+	assert.NoError(t, resolver.Start(context.Background()))
+	defer resolver.Close()
+
+	assert.Eventually(t, func() bool {
+		for _, status := range resolver.Statuses() {
+			if status.State == trackerclient.TrackerStateNotContacted || status.State == trackerclient.TrackerStateUpdating {
+				return false
+			}
+		}
+		return true
+	}, 5*time.Second, 10*time.Millisecond)
+
+	statuses := resolver.Statuses()
+	assert.Len(t, statuses, 4)
+	assert.Equal(t, trackerclient.TrackerStateWorking, statuses[0].State)
+	assert.Equal(t, trackerclient.TrackerStateFailed, statuses[1].State)
+	assert.Equal(t, "tracker says: "+errNotWhitelisted.Error(), statuses[1].Message())
+	assert.Equal(t, trackerclient.TrackerStateUnreachable, statuses[2].State)
+	assert.Equal(t, 1, statuses[2].Failures)
+	assert.True(t, statuses[2].NextAnnounce.After(statuses[2].LastAnnounce))
+	assert.Equal(t, trackerclient.TrackerStateProtocolError, statuses[3].State)
+	assert.Equal(t, 2, statuses[3].Tier)
+}
+
+func TestTrackerPeerResolverWithoutMetadata(t *testing.T) {
+	server := startTestServer(t, Config{Interval: time.Hour})
+	magnet := torrentparser.Magnet{InfoHash: [20]byte{7}, Trackers: []string{fmt.Sprintf("udp://%s", server.UDPAddr().String())}}
+	metainfo := magnet.Metainfo()
+
+	resolver := trackerclient.NewTrackerPeerResolver(&metainfo, -1, trackerclient.TrackerPeerResolverConfig{
+		PeerID:  common.GeneratePeerID(),
+		Port:    6881,
+		Logger:  testLogger,
+		Timeout: time.Second,
+	})
+	assert.NoError(t, resolver.Start(context.Background()))
+	defer resolver.Close()
+
+	// The size is unknown until the metadata is fetched: we are a leecher, not a seed.
+	assert.Eventually(t, func() bool {
+		return server.swarms.Scrape(magnet.InfoHash) == trackerclient.ScrapeStats{Leechers: 1}
+	}, 5*time.Second, 10*time.Millisecond)
+}
+
+func TestTrackerPeerResolverLifecycleEvents(t *testing.T) {
+	server := startTestServer(t, Config{Interval: time.Hour})
+	infoHash := common.InfoHash(torrentparser.InfoDict{}.Hash())
+
+	metainfo := torrentparser.NewTorrentMetainfo(fmt.Sprintf("udp://%s", server.UDPAddr().String()), nil, torrentparser.InfoDict{})
+	stats := common.NewTransferStats(6 << 30)
+
+	resolver := trackerclient.NewTrackerPeerResolver(&metainfo, -1, trackerclient.TrackerPeerResolverConfig{
+		PeerID:  common.GeneratePeerID(),
+		Port:    6881,
+		Logger:  testLogger,
+		Timeout: time.Second,
+		Stats:   stats,
+	})
+	assert.NoError(t, resolver.Start(context.Background()))
+
+	// 'started' with 64-bit counters
+	assert.Eventually(t, func() bool {
+		return server.swarms.Scrape(infoHash) == trackerclient.ScrapeStats{Leechers: 1}
+	}, 5*time.Second, 10*time.Millisecond)
+
+	// The resolver sends 'started' and 'stopped' itself.
+	assert.Error(t, resolver.Announce(trackerclient.AnnounceData{Event: trackerclient.AnnounceEventStopped}))
+	assert.Error(t, resolver.Announce(trackerclient.AnnounceData{Event: trackerclient.AnnounceEventStarted}))
+
+	stats.AddDownloaded(6 << 30)
+	stats.SetLeft(0)
+
+	// 'completed' is sent on the transition to finished, and counted once by the tracker.
+	assert.Eventually(t, func() bool {
+		return server.swarms.Scrape(infoHash) == trackerclient.ScrapeStats{Seeders: 1, Completed: 1}
+	}, 5*time.Second, 10*time.Millisecond)
+
+	// 'stopped' removes us from the swarm.
+	assert.NoError(t, resolver.Close())
+	assert.Equal(t, trackerclient.ScrapeStats{}, server.swarms.Scrape(infoHash))
+}
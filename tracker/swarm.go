@@ -0,0 +1,192 @@
+package tracker
+
+import (
+	"math/rand"
+	"net"
+	"sync"
+	"time"
+
+	"github.com/dpnam2112/bittorrent-client/common"
+	"github.com/dpnam2112/bittorrent-client/trackerclient"
+)
+
+// peerEntry is the state a tracker keeps about a single peer of a swarm.
+type peerEntry struct {
+	addr     trackerclient.PeerAddr
+	peerID   common.PeerID
+	left     int64
+	lastSeen time.Time
+}
+
+func (p *peerEntry) isSeeder() bool {
+	return p.left == 0
+}
+
+// swarm holds the peers announcing a single info hash, keyed by "ip:port".
+type swarm struct {
+	peers     map[string]*peerEntry
+	completed int32
+}
+
+// announce describes an announce request, regardless of the transport it was received from.
+type announce struct {
+	infoHash common.InfoHash
+	peerID   common.PeerID
+	addrs    []trackerclient.PeerAddr
+	event    trackerclient.AnnounceEvent
+	left     int64
+	numWant  int
+}
+
+// swarmStore keeps the in-memory state of every swarm known to the tracker.
+type swarmStore struct {
+	mu     sync.Mutex
+	swarms map[common.InfoHash]*swarm
+	rng    *rand.Rand
+	now    func() time.Time
+}
+
+func newSwarmStore() *swarmStore {
+	return &swarmStore{
+		swarms: map[common.InfoHash]*swarm{},
+		rng:    rand.New(rand.NewSource(time.Now().UnixNano())),
+		now:    time.Now,
+	}
+}
+
+// Announce records the announcing peer and returns up to numWant other peers of the swarm,
+// together with the swarm's current statistics. Only peers of the same address family as
+// family are returned ("tcp4", "tcp6"); an empty family returns peers of both families.
+func (s *swarmStore) Announce(a announce, family string) ([]trackerclient.PeerAddr, trackerclient.ScrapeStats) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	sw, ok := s.swarms[a.infoHash]
+	if !ok {
+		sw = &swarm{peers: map[string]*peerEntry{}}
+		s.swarms[a.infoHash] = sw
+	}
+
+	requester := map[string]struct{}{}
+	for _, addr := range a.addrs {
+		key := addr.String()
+		requester[key] = struct{}{}
+
+		if a.event == trackerclient.AnnounceEventStopped {
+			delete(sw.peers, key)
+			continue
+		}
+
+		entry, known := sw.peers[key]
+		if !known {
+			entry = &peerEntry{addr: addr}
+			sw.peers[key] = entry
+		}
+
+		// Count a completion only once per peer, on its transition to seeder.
+		if a.event == trackerclient.AnnounceEventCompleted && (!known || !entry.isSeeder()) {
+			sw.completed++
+		}
+
+		entry.peerID = a.peerID
+		entry.left = a.left
+		entry.lastSeen = s.now()
+	}
+
+	var peers []trackerclient.PeerAddr
+	if a.event != trackerclient.AnnounceEventStopped {
+		peers = s.pickPeers(sw, requester, a.numWant, family)
+	}
+
+	stats := sw.stats()
+	if len(sw.peers) == 0 {
+		delete(s.swarms, a.infoHash)
+	}
+
+	return peers, stats
+}
+
+// pickPeers returns a random subset of the swarm, excluding the requester.
+func (s *swarmStore) pickPeers(sw *swarm, exclude map[string]struct{}, numWant int, family string) []trackerclient.PeerAddr {
+	candidates := make([]trackerclient.PeerAddr, 0, len(sw.peers))
+	for key, entry := range sw.peers {
+		if _, ok := exclude[key]; ok {
+			continue
+		}
+
+		if !matchFamily(entry.addr.IP, family) {
+			continue
+		}
+
+		candidates = append(candidates, entry.addr)
+	}
+
+	s.rng.Shuffle(len(candidates), func(i, j int) {
+		candidates[i], candidates[j] = candidates[j], candidates[i]
+	})
+
+	if len(candidates) > numWant {
+		candidates = candidates[:numWant]
+	}
+
+	return candidates
+}
+
+func matchFamily(ip net.IP, family string) bool {
+	switch family {
+	case "tcp4":
+		return ip.To4() != nil
+	case "tcp6":
+		return ip.To4() == nil
+	default:
+		return true
+	}
+}
+
+// Scrape returns the statistics of the swarm of infoHash. Unknown info hashes yield zero stats.
+func (s *swarmStore) Scrape(infoHash common.InfoHash) trackerclient.ScrapeStats {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	sw, ok := s.swarms[infoHash]
+	if !ok {
+		return trackerclient.ScrapeStats{}
+	}
+
+	return sw.stats()
+}
+
+// Expire removes peers that haven't announced for longer than ttl, and swarms left empty.
+func (s *swarmStore) Expire(ttl time.Duration) int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	deadline := s.now().Add(-ttl)
+	removed := 0
+	for infoHash, sw := range s.swarms {
+		for key, entry := range sw.peers {
+			if entry.lastSeen.Before(deadline) {
+				delete(sw.peers, key)
+				removed++
+			}
+		}
+
+		if len(sw.peers) == 0 {
+			delete(s.swarms, infoHash)
+		}
+	}
+
+	return removed
+}
+
+func (sw *swarm) stats() trackerclient.ScrapeStats {
+	stats := trackerclient.ScrapeStats{Completed: sw.completed}
+	for _, entry := range sw.peers {
+		if entry.isSeeder() {
+			stats.Seeders++
+		} else {
+			stats.Leechers++
+		}
+	}
+	return stats
+}
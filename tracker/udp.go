@@ -0,0 +1,201 @@
+package tracker
+
+import (
+	"crypto/rand"
+	"encoding/binary"
+	"errors"
+	"net"
+	"sync"
+	"time"
+
+	"github.com/dpnam2112/bittorrent-client/common"
+	"github.com/dpnam2112/bittorrent-client/trackerclient"
+)
+
+// A connection ID can be used by a client for two minutes after it was handed out (BEP 15).
+const connectionIDTTL = 2 * time.Minute
+
+// udpServer implements the UDP tracker protocol on top of a packet connection.
+type udpServer struct {
+	server *Server
+	conn   net.PacketConn
+
+	mu          sync.Mutex
+	connections map[int64]connectionInfo
+}
+
+// connectionInfo records who a connection ID was issued to, and when it expires. A connection ID
+// is only accepted from the address it was issued to, so that clients can't spoof their source
+// address.
+type connectionInfo struct {
+	addr    string
+	expires time.Time
+}
+
+func newUDPServer(server *Server, conn net.PacketConn) *udpServer {
+	return &udpServer{
+		server:      server,
+		conn:        conn,
+		connections: map[int64]connectionInfo{},
+	}
+}
+
+func (u *udpServer) serve() {
+	// Max size of an IP packet is 65535 bytes
+	buf := make([]byte, 65535)
+	for {
+		n, addr, err := u.conn.ReadFrom(buf)
+		if err != nil {
+			if !errors.Is(err, net.ErrClosed) {
+				u.server.logger.Error("Failed to read UDP packet", "err", err)
+			}
+			return
+		}
+
+		resp := u.handlePacket(buf[:n], addr)
+		if resp == nil {
+			continue
+		}
+
+		if _, err := u.conn.WriteTo(resp, addr); err != nil {
+			u.server.logger.Debug("Failed to send UDP response", "addr", addr.String(), "err", err)
+		}
+	}
+}
+
+// handlePacket processes a single request and returns the raw response to send back, or nil if
+// the packet must be dropped.
+func (u *udpServer) handlePacket(packet []byte, addr net.Addr) []byte {
+	udpAddr, ok := addr.(*net.UDPAddr)
+	if !ok {
+		return nil
+	}
+
+	switch trackerclient.GetActionFromRawRequest(packet) {
+	case trackerclient.TrackerActionConnect:
+		req, err := trackerclient.UnmarshalTrackerUDPConnectRequest(packet)
+		if err != nil {
+			return nil
+		}
+
+		return trackerclient.TrackerUDPConnectResponse{
+			TxnID:        req.TxnID,
+			ConnectionID: u.issueConnectionID(udpAddr),
+		}.Marshal()
+
+	case trackerclient.TrackerActionAnnounce:
+		req, err := trackerclient.UnmarshalTrackerUDPAnnounceRequest(packet)
+		if err != nil {
+			return nil
+		}
+
+		if !u.validConnectionID(req.ConnectionID, udpAddr) {
+			return errorResponse(req.TxnID, "Connection ID is invalid or expired.")
+		}
+
+		return u.handleAnnounce(req, udpAddr)
+
+	case trackerclient.TrackerActionScrape:
+		req, err := trackerclient.UnmarshalTrackerUDPScrapeRequest(packet)
+		if err != nil {
+			return nil
+		}
+
+		if !u.validConnectionID(req.ConnectionID, udpAddr) {
+			return errorResponse(req.TxnID, "Connection ID is invalid or expired.")
+		}
+
+		// The stats are matched to the info hashes by position: the torrents that aren't served
+		// get zeroed stats.
+		resp := trackerclient.TrackerUDPScrapeResponse{TxnID: req.TxnID}
+		for _, infoHash := range req.InfoHashes {
+			var stats trackerclient.ScrapeStats
+			if u.server.allowed(infoHash) {
+				stats = u.server.swarms.Scrape(infoHash)
+			}
+			resp.Stats = append(resp.Stats, stats)
+		}
+		return resp.Marshal()
+
+	default:
+		return nil
+	}
+}
+
+func (u *udpServer) handleAnnounce(req *trackerclient.TrackerUDPAnnounceRequest, addr *net.UDPAddr) []byte {
+	if !u.server.allowed(req.InfoHash) {
+		return errorResponse(req.TxnID, errNotWhitelisted.Error())
+	}
+
+	u.server.logger.Debug("UDP announce", "addr", addr.String(), "url_data", req.URLData)
+
+	// The IP address field of the request is ignored, the peer is registered with the source
+	// address of the packet.
+	ip := addr.IP
+	family := "tcp6"
+	if ip.To4() != nil {
+		ip = ip.To4()
+		family = "tcp4"
+	}
+
+	peers, stats := u.server.swarms.Announce(announce{
+		infoHash: common.InfoHash(req.InfoHash),
+		peerID:   common.PeerID(req.PeerID),
+		addrs:    []trackerclient.PeerAddr{{IP: ip, Port: req.Port}},
+		event:    req.Event,
+		left:     req.Left,
+		numWant:  u.server.numWant(int(req.NumWant)),
+	}, family)
+
+	resp := trackerclient.TrackerUDPAnnounceResponse{
+		TxnID:         req.TxnID,
+		Interval:      int32(u.server.config.Interval / time.Second),
+		Leechers:      stats.Leechers,
+		Seeders:       stats.Seeders,
+		PeerAddresses: peers,
+	}
+
+	if family == "tcp6" {
+		return resp.Marshal6()
+	}
+	return resp.Marshal()
+}
+
+func (u *udpServer) issueConnectionID(addr *net.UDPAddr) int64 {
+	var raw [8]byte
+	rand.Read(raw[:])
+	connID := int64(binary.BigEndian.Uint64(raw[:]))
+
+	u.mu.Lock()
+	defer u.mu.Unlock()
+	u.connections[connID] = connectionInfo{
+		addr:    addr.IP.String(),
+		expires: time.Now().Add(connectionIDTTL),
+	}
+
+	return connID
+}
+
+func (u *udpServer) validConnectionID(connID int64, addr *net.UDPAddr) bool {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+
+	info, ok := u.connections[connID]
+	return ok && info.addr == addr.IP.String() && time.Now().Before(info.expires)
+}
+
+func (u *udpServer) expireConnections() {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+
+	now := time.Now()
+	for connID, info := range u.connections {
+		if now.After(info.expires) {
+			delete(u.connections, connID)
+		}
+	}
+}
+
+func errorResponse(txnID int32, message string) []byte {
+	return trackerclient.TrackerUDPErrorResponse{TxnID: txnID, Message: message}.Marshal()
+}
@@ -0,0 +1,65 @@
+package trackerclient
+
+import (
+	"math/rand"
+	"time"
+)
+
+const (
+	defaultBackoffInitial = 15 * time.Second
+	defaultBackoffMax     = 30 * time.Minute
+)
+
+// Backoff computes exponentially growing delays between retries to a failing tracker:
+// Initial, 2*Initial, 4*Initial... up to Max. A random jitter of up to 10% is added so that
+// trackers failing at the same time are not retried in lockstep.
+type Backoff struct {
+	Initial time.Duration
+	Max     time.Duration
+
+	failures int
+	rng      *rand.Rand
+}
+
+// NewBackoff creates a back-off. Zero durations are replaced by defaults.
+func NewBackoff(initial, max time.Duration) *Backoff {
+	if initial <= 0 {
+		initial = defaultBackoffInitial
+	}
+
+	if max <= 0 {
+		max = defaultBackoffMax
+	}
+
+	return &Backoff{
+		Initial: initial,
+		Max:     max,
+		rng:     rand.New(rand.NewSource(time.Now().UnixNano())),
+	}
+}
+
+// Next records a failure and returns the delay to wait before the next attempt.
+func (b *Backoff) Next() time.Duration {
+	delay := b.Initial
+	for i := 0; i < b.failures && delay < b.Max; i++ {
+		delay *= 2
+	}
+	delay = min(delay, b.Max)
+	b.failures++
+
+	if b.rng != nil {
+		delay += time.Duration(b.rng.Int63n(int64(delay)/10 + 1))
+	}
+
+	return delay
+}
+
+// Reset is called after a successful attempt.
+func (b *Backoff) Reset() {
+	b.failures = 0
+}
+
+// Failures returns the number of consecutive failures since the last Reset.
+func (b *Backoff) Failures() int {
+	return b.failures
+}
@@ -0,0 +1,93 @@
+package trackerclient
+
+import (
+	"errors"
+	"fmt"
+	"net"
+)
+
+// TrackerFailure is returned when the tracker was reached and explicitly refused the request:
+// an error response (UDP) or a 'failure reason' (HTTP), e.g. "unregistered torrent".
+type TrackerFailure struct {
+	Tracker string
+	Reason  string
+}
+
+func (e *TrackerFailure) Error() string {
+	if e.Tracker == "" {
+		return fmt.Sprintf("tracker says: %s", e.Reason)
+	}
+	return fmt.Sprintf("tracker %s says: %s", e.Tracker, e.Reason)
+}
+
+// TrackerTimeout is returned when the tracker could not be reached: it didn't answer in time,
+// or the connection to it failed.
+type TrackerTimeout struct {
+	Tracker string
+	Err     error
+}
+
+func (e *TrackerTimeout) Error() string {
+	return fmt.Sprintf("tracker %s is unreachable: %v", e.Tracker, e.Err)
+}
+
+func (e *TrackerTimeout) Unwrap() error {
+	return e.Err
+}
+
+// TrackerProtocolError is returned when the tracker answered with something that doesn't follow
+// the protocol: malformed or truncated responses, mismatching transaction IDs, unexpected HTTP
+// status codes...
+type TrackerProtocolError struct {
+	Tracker string
+	Err     error
+}
+
+func (e *TrackerProtocolError) Error() string {
+	return fmt.Sprintf("tracker %s sent an invalid response: %v", e.Tracker, e.Err)
+}
+
+func (e *TrackerProtocolError) Unwrap() error {
+	return e.Err
+}
+
+// wrapNetworkError classifies an error returned by a network operation. Errors that are already
+// typed are returned as is.
+func wrapNetworkError(tracker string, err error) error {
+	var failure *TrackerFailure
+	var timeout *TrackerTimeout
+	var protocolErr *TrackerProtocolError
+	if errors.As(err, &failure) || errors.As(err, &timeout) || errors.As(err, &protocolErr) {
+		return err
+	}
+
+	var netErr net.Error
+	var opErr *net.OpError
+	var dnsErr *net.DNSError
+	if errors.As(err, &netErr) || errors.As(err, &opErr) || errors.As(err, &dnsErr) {
+		return &TrackerTimeout{Tracker: tracker, Err: err}
+	}
+
+	return &TrackerProtocolError{Tracker: tracker, Err: err}
+}
+
+// mostRelevantError picks the error to report when several attempts to reach the same tracker
+// failed (e.g. once per address family). An explicit refusal from the tracker says more than an
+// invalid response, which says more than no response at all.
+func mostRelevantError(errs []error) error {
+	var failure *TrackerFailure
+	for _, err := range errs {
+		if errors.As(err, &failure) {
+			return err
+		}
+	}
+
+	var protocolErr *TrackerProtocolError
+	for _, err := range errs {
+		if errors.As(err, &protocolErr) {
+			return err
+		}
+	}
+
+	return errs[0]
+}
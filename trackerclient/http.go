@@ -0,0 +1,397 @@
+package trackerclient
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"net"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/dpnam2112/bittorrent-client/bencode"
+)
+
+// TrackerHTTPAnnounceRequest holds the parameters of an HTTP announce (GET) request.
+// IPv4 and IPv6 are optional; when set, they are sent as the 'ipv4'/'ipv6' parameters from BEP 7
+// so that the tracker learns our address in the family we are not announcing over.
+type TrackerHTTPAnnounceRequest struct {
+	InfoHash   [20]byte
+	PeerID     [20]byte
+	Port       uint16
+	Uploaded   int64
+	Downloaded int64
+	Left       int64
+	Event      AnnounceEvent
+	NumWant    int32
+	Key        int32
+	IPv4       net.IP
+	IPv6       net.IP
+}
+
+// Schema for the bencoded response of an HTTP announce request. Peers from the 'peers' (IPv4)
+// and 'peers6' (IPv6) keys are both collected into PeerAddresses.
+type TrackerHTTPAnnounceResponse struct {
+	WarningMessage string
+	Interval       int32
+	MinInterval    int32
+	TrackerID      string
+	Complete       int32
+	Incomplete     int32
+	PeerAddresses  []PeerAddr
+}
+
+// String returns the value of the 'event' parameter of HTTP announce requests.
+func (e AnnounceEvent) String() string {
+	switch e {
+	case AnnounceEventCompleted:
+		return "completed"
+	case AnnounceEventStarted:
+		return "started"
+	case AnnounceEventStopped:
+		return "stopped"
+	default:
+		return ""
+	}
+}
+
+// URL appends the request's parameters to the tracker's announce URL. Parameters already present
+// in the announce URL (e.g. a passkey) are kept.
+func (req TrackerHTTPAnnounceRequest) URL(announceURL string) (string, error) {
+	u, err := url.Parse(announceURL)
+	if err != nil {
+		return "", fmt.Errorf("Invalid announce URL '%s': %w", announceURL, err)
+	}
+
+	params := []string{
+		"info_hash=" + escapeBytes(req.InfoHash[:]),
+		"peer_id=" + escapeBytes(req.PeerID[:]),
+		"port=" + strconv.Itoa(int(req.Port)),
+		"uploaded=" + strconv.FormatInt(req.Uploaded, 10),
+		"downloaded=" + strconv.FormatInt(req.Downloaded, 10),
+		"left=" + strconv.FormatInt(req.Left, 10),
+		"compact=1",
+		"numwant=" + strconv.Itoa(int(req.NumWant)),
+		"key=" + strconv.FormatUint(uint64(uint32(req.Key)), 16),
+	}
+
+	if req.Event != AnnounceEventNone {
+		params = append(params, "event="+req.Event.String())
+	}
+
+	if req.IPv4 != nil && req.IPv4.To4() != nil {
+		params = append(params, "ipv4="+req.IPv4.String())
+	}
+
+	if req.IPv6 != nil && req.IPv6.To4() == nil {
+		params = append(params, "ipv6="+url.QueryEscape(req.IPv6.String()))
+	}
+
+	query := strings.Join(params, "&")
+	if u.RawQuery != "" {
+		query = u.RawQuery + "&" + query
+	}
+	u.RawQuery = query
+
+	return u.String(), nil
+}
+
+// escapeBytes percent-encodes every byte that is not an unreserved character. url.QueryEscape is
+// not used because it encodes spaces as '+', which some trackers don't decode in binary fields.
+func escapeBytes(raw []byte) string {
+	const hex = "0123456789ABCDEF"
+
+	var sb strings.Builder
+	for _, b := range raw {
+		if ('a' <= b && b <= 'z') || ('A' <= b && b <= 'Z') || ('0' <= b && b <= '9') ||
+			b == '-' || b == '_' || b == '.' || b == '~' {
+			sb.WriteByte(b)
+			continue
+		}
+		sb.WriteByte('%')
+		sb.WriteByte(hex[b>>4])
+		sb.WriteByte(hex[b&0x0f])
+	}
+
+	return sb.String()
+}
+
+// UnmarshalTrackerHTTPAnnounceResponse parses the bencoded body of an HTTP announce response.
+// Both the compact and the dictionary peer formats are accepted for 'peers'; 'peers6' is always
+// compact.
+func UnmarshalTrackerHTTPAnnounceResponse(body []byte) (*TrackerHTTPAnnounceResponse, error) {
+	_, value, err := bencode.ParseBencode(body)
+	if err != nil {
+		return nil, fmt.Errorf("Failed to parse announce response: %w", err)
+	}
+
+	dict, ok := value.(*bencode.BDict)
+	if !ok {
+		return nil, errors.New("Announce response is not a dictionary.")
+	}
+
+	if reason, ok := dict.Dict["failure reason"].(*bencode.BString); ok {
+		return nil, &TrackerFailure{Reason: string(reason.Value)}
+	}
+
+	resp := &TrackerHTTPAnnounceResponse{}
+
+	if warning, ok := dict.Dict["warning message"].(*bencode.BString); ok {
+		resp.WarningMessage = string(warning.Value)
+	}
+
+	if trackerID, ok := dict.Dict["tracker id"].(*bencode.BString); ok {
+		resp.TrackerID = string(trackerID.Value)
+	}
+
+	resp.Interval = int32(dictInt(dict, "interval"))
+	resp.MinInterval = int32(dictInt(dict, "min interval"))
+	resp.Complete = int32(dictInt(dict, "complete"))
+	resp.Incomplete = int32(dictInt(dict, "incomplete"))
+
+	switch peers := dict.Dict["peers"].(type) {
+	case *bencode.BString:
+		addrs, err := UnmarshalCompactPeers(peers.Value, false)
+		if err != nil {
+			return nil, fmt.Errorf("Invalid 'peers' in announce response: %w", err)
+		}
+		resp.PeerAddresses = append(resp.PeerAddresses, addrs...)
+	case *bencode.BList:
+		for _, elem := range peers.Values {
+			peerDict, ok := elem.(*bencode.BDict)
+			if !ok {
+				continue
+			}
+
+			ipVal, ok := peerDict.Dict["ip"].(*bencode.BString)
+			if !ok {
+				continue
+			}
+
+			// Non-compact peer entries may carry a hostname instead of an address, those are
+			// skipped since resolving them would block the response handling.
+			ip := net.ParseIP(string(ipVal.Value))
+			if ip == nil {
+				continue
+			}
+
+			resp.PeerAddresses = append(resp.PeerAddresses, PeerAddr{
+				IP:   ip,
+				Port: uint16(dictInt(peerDict, "port")),
+			})
+		}
+	}
+
+	if peers6, ok := dict.Dict["peers6"].(*bencode.BString); ok {
+		addrs, err := UnmarshalCompactPeers(peers6.Value, true)
+		if err != nil {
+			return nil, fmt.Errorf("Invalid 'peers6' in announce response: %w", err)
+		}
+		resp.PeerAddresses = append(resp.PeerAddresses, addrs...)
+	}
+
+	return resp, nil
+}
+
+func dictInt(dict *bencode.BDict, key string) int64 {
+	if v, ok := dict.Dict[key].(*bencode.BInt); ok {
+		return v.Value
+	}
+	return 0
+}
+
+type TrackerHTTPClient struct {
+	Logger *slog.Logger
+}
+
+// SendAnnounceRequest sends an announce request to an HTTP(S) tracker. network is either "tcp",
+// "tcp4" or "tcp6" and controls which address family is used to reach the tracker. Errors are one
+// of TrackerFailure, TrackerTimeout and TrackerProtocolError.
+func (client *TrackerHTTPClient) SendAnnounceRequest(
+	announceURL string,
+	network string,
+	timeout time.Duration,
+	r *TrackerHTTPAnnounceRequest,
+) (*TrackerHTTPAnnounceResponse, error) {
+	reqURL, err := r.URL(announceURL)
+	if err != nil {
+		return nil, &TrackerProtocolError{Tracker: announceURL, Err: err}
+	}
+
+	dialer := &net.Dialer{Timeout: timeout}
+	httpClient := &http.Client{
+		Timeout: timeout,
+		Transport: &http.Transport{
+			Proxy: http.ProxyFromEnvironment,
+			DialContext: func(ctx context.Context, _, addr string) (net.Conn, error) {
+				return dialer.DialContext(ctx, network, addr)
+			},
+		},
+	}
+	defer httpClient.CloseIdleConnections()
+
+	client.Logger.Debug("Send an HTTP announce request to the tracker", "url", reqURL, "network", network)
+	httpResp, err := httpClient.Get(reqURL)
+	if err != nil {
+		return nil, &TrackerTimeout{Tracker: announceURL, Err: err}
+	}
+	defer httpResp.Body.Close()
+
+	body, err := io.ReadAll(httpResp.Body)
+	if err != nil {
+		return nil, &TrackerTimeout{Tracker: announceURL, Err: err}
+	}
+
+	resp, err := UnmarshalTrackerHTTPAnnounceResponse(body)
+	var failure *TrackerFailure
+	if errors.As(err, &failure) {
+		failure.Tracker = announceURL
+		return nil, failure
+	}
+
+	if httpResp.StatusCode != http.StatusOK {
+		return nil, &TrackerProtocolError{Tracker: announceURL, Err: fmt.Errorf("unexpected HTTP status %d", httpResp.StatusCode)}
+	}
+
+	if err != nil {
+		return nil, &TrackerProtocolError{Tracker: announceURL, Err: err}
+	}
+
+	client.Logger.Debug("Received HTTP announce response", "peer_count", len(resp.PeerAddresses))
+	return resp, nil
+}
+
+// SendAnnounceRequestDualStack announces to an HTTP tracker once over IPv4 and once over IPv6,
+// and merges the peers of both responses. An error is only returned if both announces failed.
+func (client *TrackerHTTPClient) SendAnnounceRequestDualStack(
+	announceURL string,
+	timeout time.Duration,
+	r *TrackerHTTPAnnounceRequest,
+) (*TrackerHTTPAnnounceResponse, error) {
+	var errs []error
+	var merged *TrackerHTTPAnnounceResponse
+
+	for _, network := range []string{"tcp4", "tcp6"} {
+		resp, err := client.SendAnnounceRequest(announceURL, network, timeout, r)
+		if err != nil {
+			client.Logger.Debug("Announce failed", "network", network, "err", err)
+			errs = append(errs, err)
+			continue
+		}
+
+		if merged == nil {
+			merged = resp
+			continue
+		}
+
+		if resp.Interval < merged.Interval {
+			merged.Interval = resp.Interval
+		}
+		merged.MinInterval = max(merged.MinInterval, resp.MinInterval)
+		merged.Complete = max(merged.Complete, resp.Complete)
+		merged.Incomplete = max(merged.Incomplete, resp.Incomplete)
+		merged.PeerAddresses = mergePeerAddresses(merged.PeerAddresses, resp.PeerAddresses)
+	}
+
+	if merged == nil {
+		return nil, mostRelevantError(errs)
+	}
+
+	return merged, nil
+}
+
+// Marshal encodes the response as a tracker would send it. Peers are written in the compact
+// format, IPv4 peers under 'peers' and IPv6 peers under 'peers6'.
+func (resp TrackerHTTPAnnounceResponse) Marshal() []byte {
+	dict := map[string]bencode.BValue{
+		"interval":   &bencode.BInt{Value: int64(resp.Interval)},
+		"complete":   &bencode.BInt{Value: int64(resp.Complete)},
+		"incomplete": &bencode.BInt{Value: int64(resp.Incomplete)},
+		"peers":      &bencode.BString{Value: MarshalCompactPeers(resp.PeerAddresses, false)},
+		"peers6":     &bencode.BString{Value: MarshalCompactPeers(resp.PeerAddresses, true)},
+	}
+
+	if resp.MinInterval > 0 {
+		dict["min interval"] = &bencode.BInt{Value: int64(resp.MinInterval)}
+	}
+
+	if resp.WarningMessage != "" {
+		dict["warning message"] = &bencode.BString{Value: []byte(resp.WarningMessage)}
+	}
+
+	if resp.TrackerID != "" {
+		dict["tracker id"] = &bencode.BString{Value: []byte(resp.TrackerID)}
+	}
+
+	return bencode.Encode(&bencode.BDict{Dict: dict})
+}
+
+// MarshalTrackerHTTPFailure encodes a response carrying only a 'failure reason'.
+func MarshalTrackerHTTPFailure(reason string) []byte {
+	return bencode.Encode(&bencode.BDict{Dict: map[string]bencode.BValue{
+		"failure reason": &bencode.BString{Value: []byte(reason)},
+	}})
+}
+
+// Schema for the bencoded response of an HTTP scrape request, keyed by info hash.
+type TrackerHTTPScrapeResponse struct {
+	Files map[[20]byte]ScrapeStats
+}
+
+func (resp TrackerHTTPScrapeResponse) Marshal() []byte {
+	files := make(map[string]bencode.BValue, len(resp.Files))
+	for infoHash, stats := range resp.Files {
+		files[string(infoHash[:])] = &bencode.BDict{Dict: map[string]bencode.BValue{
+			"complete":   &bencode.BInt{Value: int64(stats.Seeders)},
+			"downloaded": &bencode.BInt{Value: int64(stats.Completed)},
+			"incomplete": &bencode.BInt{Value: int64(stats.Leechers)},
+		}}
+	}
+
+	return bencode.Encode(&bencode.BDict{Dict: map[string]bencode.BValue{
+		"files": &bencode.BDict{Dict: files},
+	}})
+}
+
+func UnmarshalTrackerHTTPScrapeResponse(body []byte) (*TrackerHTTPScrapeResponse, error) {
+	_, value, err := bencode.ParseBencode(body)
+	if err != nil {
+		return nil, fmt.Errorf("Failed to parse scrape response: %w", err)
+	}
+
+	dict, ok := value.(*bencode.BDict)
+	if !ok {
+		return nil, errors.New("Scrape response is not a dictionary.")
+	}
+
+	if reason, ok := dict.Dict["failure reason"].(*bencode.BString); ok {
+		return nil, &TrackerFailure{Reason: string(reason.Value)}
+	}
+
+	resp := &TrackerHTTPScrapeResponse{Files: map[[20]byte]ScrapeStats{}}
+	files, _ := dict.Dict["files"].(*bencode.BDict)
+	if files == nil {
+		return resp, nil
+	}
+
+	for key, value := range files.Dict {
+		stats, ok := value.(*bencode.BDict)
+		if !ok || len(key) != 20 {
+			continue
+		}
+
+		var infoHash [20]byte
+		copy(infoHash[:], key)
+		resp.Files[infoHash] = ScrapeStats{
+			Seeders:   int32(dictInt(stats, "complete")),
+			Completed: int32(dictInt(stats, "downloaded")),
+			Leechers:  int32(dictInt(stats, "incomplete")),
+		}
+	}
+
+	return resp, nil
+}
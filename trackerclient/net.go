@@ -1,6 +1,8 @@
 package trackerclient
 
 import (
+	"context"
+	"errors"
 	"fmt"
 	"log/slog"
 	"net"
@@ -9,21 +11,27 @@ import (
 
 type TrackerUDPClient struct {
 	Logger *slog.Logger
+
+	// Resolver is used to resolve tracker hostnames. If nil, net.DefaultResolver is used.
+	Resolver Resolver
 }
 
+// SendConnectRequest obtains a connection ID from a tracker. Errors are one of TrackerFailure,
+// TrackerTimeout and TrackerProtocolError.
 func (client *TrackerUDPClient) SendConnectRequest(trackerIP net.IP, trackerPort int, readTimeout time.Duration) (*TrackerUDPConnectResponse, error) {
 	// remote address
 	raddr := net.UDPAddr{
 		Port: trackerPort,
 		IP:   trackerIP,
 	}
+	tracker := raddr.String()
 
 	conn, err := net.DialUDP("udp", nil, &raddr)
 	if err != nil {
-		return nil, fmt.Errorf("Failed to create an UDP socket to %s: %w", raddr.IP.String(), err)
+		return nil, wrapNetworkError(tracker, fmt.Errorf("Failed to create an UDP socket to %s: %w", raddr.IP.String(), err))
 	}
 
-	conn.SetReadDeadline(time.Now().Add(readTimeout * time.Second))
+	conn.SetReadDeadline(time.Now().Add(readTimeout))
 	defer conn.Close()
 
 	// Generate a UDP connection request with transaction ID randomly generated.
@@ -38,7 +46,7 @@ func (client *TrackerUDPClient) SendConnectRequest(trackerIP net.IP, trackerPort
 
 	_, err = conn.Write(connectRequest.Marshal())
 	if err != nil {
-		return nil, fmt.Errorf("Failed to send a Tracker connect request: %w", err)
+		return nil, wrapNetworkError(tracker, fmt.Errorf("Failed to send a Tracker connect request: %w", err))
 	}
 
 	// buffer to store the response
@@ -46,15 +54,7 @@ func (client *TrackerUDPClient) SendConnectRequest(trackerIP net.IP, trackerPort
 	n, _, err := conn.ReadFromUDP(buf)
 
 	if err != nil {
-		return nil, fmt.Errorf("Failed to send a Tracker connect request: %w", err)
-	}
-
-	if n != UDPConnectResponseSize {
-		return nil, fmt.Errorf(
-			"Failed to send a Tracker connect request: the response size is invalid. Expect %d, but got %d.",
-			UDPConnectResponseSize,
-			n,
-		)
+		return nil, wrapNetworkError(tracker, fmt.Errorf("Failed to send a Tracker connect request: %w", err))
 	}
 
 	client.Logger.Debug(
@@ -62,15 +62,33 @@ func (client *TrackerUDPClient) SendConnectRequest(trackerIP net.IP, trackerPort
 		"raw_payload", fmt.Sprintf("% x\n", buf[:n]),
 	)
 
+	if err := checkErrorResponse(tracker, buf[:n], connectRequest.TxnID); err != nil {
+		return nil, err
+	}
+
+	if n != UDPConnectResponseSize {
+		return nil, &TrackerProtocolError{Tracker: tracker, Err: fmt.Errorf(
+			"the connect response size is invalid. Expect %d, but got %d.",
+			UDPConnectResponseSize,
+			n,
+		)}
+	}
+
 	connectResp, err := UnmarshalTrackerUDPConnectResponse(buf[:UDPConnectResponseSize])
 	if err != nil {
-		return nil, fmt.Errorf("Failed to unmarshal connect response: %w", err)
+		return nil, &TrackerProtocolError{Tracker: tracker, Err: err}
+	}
+
+	if connectResp.TxnID != connectRequest.TxnID {
+		return nil, &TrackerProtocolError{Tracker: tracker, Err: errors.New("transaction ID of the connect response doesn't match the request")}
 	}
 
 	client.Logger.Debug("Received connect response from the tracker", "response_payload", connectResp)
 	return connectResp, nil
 }
 
+// SendAnnounceRequest sends an announce request using a connection ID previously obtained with
+// SendConnectRequest. Errors are one of TrackerFailure, TrackerTimeout and TrackerProtocolError.
 func (client *TrackerUDPClient) SendAnnounceRequest(
 	trackerIP net.IP,
 	trackerPort int,
@@ -81,46 +99,206 @@ func (client *TrackerUDPClient) SendAnnounceRequest(
 		IP:   trackerIP,
 		Port: trackerPort,
 	}
+	tracker := raddr.String()
 
 	conn, err := net.DialUDP("udp", nil, &raddr)
 	if err != nil {
-		return nil, fmt.Errorf("Failed to open an UDP socket to %s: %w", raddr.String(), err)
+		return nil, wrapNetworkError(tracker, fmt.Errorf("Failed to open an UDP socket to %s: %w", raddr.String(), err))
 	}
+	defer conn.Close()
 
 	request := r.Marshal()
 	client.Logger.Debug("Send an announce request to the tracker", "raw_payload", fmt.Sprintf("% x\n", request))
 	_, err = conn.Write(request)
 
 	if err != nil {
-		return nil, fmt.Errorf("Failed to send an UDP packet to %s: %w", raddr.String(), err)
+		return nil, wrapNetworkError(tracker, fmt.Errorf("Failed to send an UDP packet to %s: %w", raddr.String(), err))
 	}
 
 	// Max size of an IP packet is 65535 bytes
 	// An UDP packet is just a thin wrapper of an IP packet
 	responseBuf := make([]byte, 65535)
-	conn.SetReadDeadline(time.Now().Add(readTimeout * time.Second))
+	conn.SetReadDeadline(time.Now().Add(readTimeout))
 	n, _, err := conn.ReadFromUDP(responseBuf)
 
 	if err != nil {
-		return nil, fmt.Errorf("Failed to read UDP announce response from %s: %w", raddr.String(), err)
+		return nil, wrapNetworkError(tracker, fmt.Errorf("Failed to read UDP announce response from %s: %w", raddr.String(), err))
 	}
 
 	client.Logger.Debug("Received response", "response_size", n, "raw_payload", fmt.Sprintf("% x", responseBuf[:n]))
-	action := getActionFromRawResp(responseBuf[:n])
+	if err := checkErrorResponse(tracker, responseBuf[:n], r.TxnID); err != nil {
+		return nil, err
+	}
+
+	// Trackers reply with 18-byte peer entries when the announce was sent over IPv6.
+	unmarshal := UnmarshalTrackerUDPAnnounceResponse
+	if trackerIP.To4() == nil {
+		unmarshal = UnmarshalTrackerUDPAnnounceResponse6
+	}
+
+	announceResp, err := unmarshal(responseBuf[:n])
+	if err != nil {
+		return nil, &TrackerProtocolError{Tracker: tracker, Err: err}
+	}
+
+	if announceResp.TxnID != r.TxnID {
+		return nil, &TrackerProtocolError{Tracker: tracker, Err: errors.New("transaction ID of the announce response doesn't match the request")}
+	}
+
+	return announceResp, nil
+}
+
+// checkErrorResponse returns a TrackerFailure if the response is an error response, and a
+// TrackerProtocolError if it is too short to carry an action.
+func checkErrorResponse(tracker string, resp []byte, txnID int32) error {
+	if len(resp) < 4 {
+		return &TrackerProtocolError{Tracker: tracker, Err: errors.New("response is too short")}
+	}
+
+	if getActionFromRawResp(resp) != TrackerActionError {
+		return nil
+	}
+
+	errResp, err := UnmarshalTrackerUDPErrorResponse(resp)
+	if err != nil {
+		return &TrackerProtocolError{Tracker: tracker, Err: err}
+	}
+
+	if errResp.TxnID != txnID {
+		return &TrackerProtocolError{Tracker: tracker, Err: errors.New("transaction ID of the error response doesn't match the request")}
+	}
+
+	return &TrackerFailure{Tracker: tracker, Reason: errResp.Message}
+}
+
+// SendAnnounceRequestToURL resolves the tracker's host and announces to it over both address
+// families. The path and query of the URL are sent to the tracker as BEP 41 URLData.
+func (client *TrackerUDPClient) SendAnnounceRequestToURL(
+	ctx context.Context,
+	trackerURL *TrackerURL,
+	readTimeout time.Duration,
+	r *TrackerUDPAnnounceRequest,
+) (*TrackerUDPAnnounceResponse, error) {
+	if trackerURL.Scheme != "udp" {
+		return nil, fmt.Errorf("'%s' is not a UDP tracker.", trackerURL.String())
+	}
+
+	ips, err := trackerURL.Resolve(ctx, client.Resolver)
+	if err != nil {
+		return nil, wrapNetworkError(trackerURL.String(), err)
+	}
+
+	req := *r
+	req.URLData = trackerURL.URLData()
+	return client.SendAnnounceRequestDualStack(ips, trackerURL.Port, readTimeout, &req)
+}
+
+// SendAnnounceRequestDualStack announces to a tracker over both IPv4 and IPv6, so that peers of
+// both address families are learned. trackerIPs is usually the result of resolving the tracker's
+// hostname: the first IPv4 and the first IPv6 address are used, each with its own connect request.
+//
+// The peers of both responses are merged. The merged response carries the shortest interval and
+// the largest swarm counts reported. An error is only returned if no address family succeeded, in
+// which case the most relevant error is returned (see mostRelevantError).
+func (client *TrackerUDPClient) SendAnnounceRequestDualStack(
+	trackerIPs []net.IP,
+	trackerPort int,
+	readTimeout time.Duration,
+	r *TrackerUDPAnnounceRequest,
+) (*TrackerUDPAnnounceResponse, error) {
+	var errs []error
+	var merged *TrackerUDPAnnounceResponse
 
-	if action == TrackerActionError {
-		errResp, err := UnmarshalTrackerUDPErrorResponse(responseBuf[:n])
+	for _, trackerIP := range pickAddressPerFamily(trackerIPs) {
+		resp, err := client.announceOverUDP(trackerIP, trackerPort, readTimeout, *r)
 		if err != nil {
-			return nil, fmt.Errorf("Failed to read UDP error response from %s: %w", raddr.String(), err)
+			client.Logger.Debug("Announce failed", "tracker_ip", trackerIP.String(), "err", err)
+			errs = append(errs, err)
+			continue
 		}
 
-		return nil, fmt.Errorf("Error response from %s: %s", raddr.String(), errResp.Message)
+		merged = mergeAnnounceResponses(merged, resp)
 	}
 
-	announceResp, err := UnmarshalTrackerUDPAnnounceResponse(responseBuf[:n])
+	if merged == nil {
+		if len(errs) == 0 {
+			return nil, &TrackerProtocolError{Tracker: fmt.Sprintf("port %d", trackerPort), Err: errors.New("no tracker address to announce to")}
+		}
+		return nil, mostRelevantError(errs)
+	}
+
+	return merged, nil
+}
+
+// announceOverUDP runs the connect/announce exchange against a single tracker address.
+func (client *TrackerUDPClient) announceOverUDP(
+	trackerIP net.IP,
+	trackerPort int,
+	readTimeout time.Duration,
+	r TrackerUDPAnnounceRequest,
+) (*TrackerUDPAnnounceResponse, error) {
+	connResp, err := client.SendConnectRequest(trackerIP, trackerPort, readTimeout)
 	if err != nil {
-		return nil, fmt.Errorf("Failed to read UDP announce response from %s: %w", raddr.String(), err)
+		return nil, err
 	}
 
-	return announceResp, nil
+	r.ConnectionID = connResp.ConnectionID
+	return client.SendAnnounceRequest(trackerIP, trackerPort, readTimeout, &r)
+}
+
+// pickAddressPerFamily returns at most two addresses: the first IPv4 and the first IPv6 address.
+func pickAddressPerFamily(ips []net.IP) []net.IP {
+	var ipv4, ipv6 net.IP
+	for _, ip := range ips {
+		if ip.To4() != nil {
+			if ipv4 == nil {
+				ipv4 = ip
+			}
+		} else if ipv6 == nil {
+			ipv6 = ip
+		}
+	}
+
+	picked := []net.IP{}
+	if ipv4 != nil {
+		picked = append(picked, ipv4)
+	}
+	if ipv6 != nil {
+		picked = append(picked, ipv6)
+	}
+
+	return picked
+}
+
+func mergeAnnounceResponses(merged, resp *TrackerUDPAnnounceResponse) *TrackerUDPAnnounceResponse {
+	if merged == nil {
+		return resp
+	}
+
+	if resp.Interval < merged.Interval {
+		merged.Interval = resp.Interval
+	}
+	merged.Leechers = max(merged.Leechers, resp.Leechers)
+	merged.Seeders = max(merged.Seeders, resp.Seeders)
+	merged.PeerAddresses = mergePeerAddresses(merged.PeerAddresses, resp.PeerAddresses)
+
+	return merged
+}
+
+// mergePeerAddresses appends the peers of b to a, skipping those already present.
+func mergePeerAddresses(a, b []PeerAddr) []PeerAddr {
+	seen := make(map[string]struct{}, len(a)+len(b))
+	for _, p := range a {
+		seen[p.String()] = struct{}{}
+	}
+
+	for _, p := range b {
+		if _, ok := seen[p.String()]; ok {
+			continue
+		}
+		seen[p.String()] = struct{}{}
+		a = append(a, p)
+	}
+
+	return a
 }
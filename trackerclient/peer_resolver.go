@@ -1,38 +1,533 @@
 package trackerclient
 
 import (
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"math/rand"
+	"sync"
+	"time"
+
 	"github.com/dpnam2112/bittorrent-client/common"
-	"github.com/dpnam2112/bittorrent-client/peer"
 	"github.com/dpnam2112/bittorrent-client/torrentparser"
 )
 
+const (
+	defaultAnnounceInterval = 30 * time.Minute
+	defaultAnnounceTimeout  = 15 * time.Second
+	// unknownLeft is announced as 'left' while the size of the torrent isn't known, e.g. while
+	// fetching the metadata of a magnet link: with 0, trackers would take us for a seed, and
+	// wouldn't return the other seeds.
+	unknownLeft = 16 * 1024
+)
+
+// AnnounceData holds the byte counters sent to trackers. Counters are 64-bit as in the UDP
+// tracker protocol, so torrents larger than 2 GiB are reported correctly.
 type AnnounceData struct {
-	Uploaded   int
-	Downloaded int
-	Left       int
+	Uploaded   int64
+	Downloaded int64
+	Left       int64
 	Event      AnnounceEvent
 }
 
-type PeerDiscoveryHandler func(peers []peer.Peer) error
+type PeerDiscoveryHandler func(peers []common.PeerAddr) error
 
 // TrackerPeerResolver resolves peers by sending announcement requests to trackers.
 // For each announcement request, trackers only returns a subset of peers. It's the
 // responsibility of the user (caller) to manage peer connections and to track which peers are
 // already connected to, which are not.
+//
+// Events are driven by the resolver's lifecycle: 'started' is sent with the first announce to
+// each tracker, 'stopped' when the resolver is closed, and 'completed' once per tracker when the
+// download finishes.
 type TrackerPeerResolver interface {
 	common.LifeCycle
 
-	// Set data for tracker announcement, including metric: uploaded, downloaded, left
+	// Set data for tracker announcement, including metric: uploaded, downloaded, left.
+	// The counters are ignored when the resolver was configured with TransferStats. Passing
+	// AnnounceEventCompleted marks the download as finished, and announces it right away to
+	// every tracker. The other events are refused: the resolver sends 'started' and 'stopped'
+	// itself, from Start and Close.
 	Announce(AnnounceData) error
 
 	// Register handler function that would be called after the announce request is sent to the
 	// tracker(s).
 	RegisterHandler(handler PeerDiscoveryHandler)
+
+	// Statuses returns a snapshot of the status of every tracker, in announce-list order.
+	Statuses() []TrackerStatus
+
+	// Register handler function that would be called every time the status of a tracker
+	// changes.
+	RegisterStatusHandler(handler TrackerStatusHandler)
+}
+
+type TrackerPeerResolverConfig struct {
+	PeerID common.PeerID
+	// Port is the port we are listening on for incoming peer connections.
+	Port   uint16
+	Logger *slog.Logger
+	// Resolver is used to resolve tracker hostnames. If nil, net.DefaultResolver is used.
+	Resolver Resolver
+	// Timeout of a single announce. Defaults to 15 seconds.
+	Timeout time.Duration
+	// Bounds of the exponential back-off applied to failing trackers.
+	BackoffInitial time.Duration
+	BackoffMax     time.Duration
+	// Stats, when set, supplies the counters of every announce. The download is considered
+	// finished when Stats reports its completion.
+	Stats *common.TransferStats
+}
+
+// trackerEntry is the announce state of a single tracker.
+type trackerEntry struct {
+	rawURL  string
+	url     *TrackerURL
+	backoff *Backoff
+	status  TrackerStatus
+	// wake triggers an announce before the next scheduled one.
+	wake chan struct{}
+	// started is set once the tracker acknowledged the 'started' event, completedSent once it
+	// acknowledged 'completed'. Both are only accessed by the tracker's goroutine, or after it
+	// exited.
+	started       bool
+	completedSent bool
+}
+
+type trackerPeerResolver struct {
+	infoHash     [20]byte
+	maxPeerCount int
+	config       TrackerPeerResolverConfig
+	key          int32
+	udpClient    *TrackerUDPClient
+	httpClient   *TrackerHTTPClient
+	logger       *slog.Logger
+
+	mu             sync.Mutex
+	trackers       []*trackerEntry
+	data           AnnounceData
+	completed      bool
+	handlers       []PeerDiscoveryHandler
+	statusHandlers []TrackerStatusHandler
+
+	cancel context.CancelFunc
+	wg     sync.WaitGroup
 }
 
-func NewTrackerPeerResolver(metainfo *torrentparser.TorrentMetainfo, maxPeerCount int) TrackerPeerResolver {
-	// TODO: Implement construction logic
+func NewTrackerPeerResolver(
+	metainfo *torrentparser.TorrentMetainfo,
+	maxPeerCount int,
+	config TrackerPeerResolverConfig,
+) TrackerPeerResolver {
 	// maxPeerCount is the maximum number of peers the resolver is able to resolve
 	// maxPeerCount = -1 is equivalent to no upper threshold.
+	if config.Logger == nil {
+		config.Logger = slog.Default()
+	}
+
+	if config.Timeout <= 0 {
+		config.Timeout = defaultAnnounceTimeout
+	}
+
+	left := metainfo.Info().TotalLength()
+	if !metainfo.Info().HasMetadata() {
+		left = unknownLeft
+	}
+
+	r := &trackerPeerResolver{
+		infoHash:     metainfo.Info().Hash(),
+		maxPeerCount: maxPeerCount,
+		config:       config,
+		key:          rand.Int31(),
+		udpClient:    &TrackerUDPClient{Logger: config.Logger, Resolver: config.Resolver},
+		httpClient:   &TrackerHTTPClient{Logger: config.Logger},
+		logger:       config.Logger,
+		data:         AnnounceData{Left: left},
+	}
+
+	seen := map[string]struct{}{}
+	for _, rawURL := range trackerURLs(metainfo) {
+		if _, ok := seen[rawURL.url]; ok {
+			continue
+		}
+		seen[rawURL.url] = struct{}{}
+
+		entry := &trackerEntry{
+			rawURL:  rawURL.url,
+			backoff: NewBackoff(config.BackoffInitial, config.BackoffMax),
+			status:  TrackerStatus{URL: rawURL.url, Tier: rawURL.tier},
+			wake:    make(chan struct{}, 1),
+		}
+
+		trackerURL, err := ParseTrackerURL(rawURL.url)
+		if err != nil {
+			entry.status.State = TrackerStateProtocolError
+			entry.status.LastError = &TrackerProtocolError{Tracker: rawURL.url, Err: err}
+		}
+		entry.url = trackerURL
+
+		r.trackers = append(r.trackers, entry)
+	}
+
+	return r
+}
+
+type tieredURL struct {
+	url  string
+	tier int
+}
+
+// trackerURLs lists the trackers of a torrent. 'announce-list' (BEP 12) takes precedence over
+// 'announce' when present.
+func trackerURLs(metainfo *torrentparser.TorrentMetainfo) []tieredURL {
+	var urls []tieredURL
+	for tier, trackers := range metainfo.AnnounceList() {
+		for _, url := range trackers {
+			urls = append(urls, tieredURL{url: url, tier: tier})
+		}
+	}
+
+	if len(urls) == 0 && metainfo.Announce() != "" {
+		urls = append(urls, tieredURL{url: metainfo.Announce()})
+	}
+
+	return urls
+}
+
+func (r *trackerPeerResolver) Start(ctx context.Context) error {
+	if r.cancel != nil {
+		return fmt.Errorf("Tracker peer resolver is already started.")
+	}
+
+	ctx, r.cancel = context.WithCancel(ctx)
+
+	if r.config.Stats != nil {
+		r.wg.Add(1)
+		go func() {
+			defer r.wg.Done()
+			select {
+			case <-ctx.Done():
+			case <-r.config.Stats.Completed():
+				r.markCompleted()
+			}
+		}()
+	}
+
+	for _, t := range r.trackers {
+		if t.url == nil {
+			continue
+		}
+
+		r.wg.Add(1)
+		go func() {
+			defer r.wg.Done()
+			r.runTracker(ctx, t)
+		}()
+	}
+
+	return nil
+}
+
+// Close stops announcing and sends the 'stopped' event to every tracker that knows about us.
+func (r *trackerPeerResolver) Close() error {
+	if r.cancel == nil {
+		return nil
+	}
+	r.cancel()
+	r.wg.Wait()
+
+	ctx, cancel := context.WithTimeout(context.Background(), r.config.Timeout)
+	defer cancel()
+
+	var wg sync.WaitGroup
+	for _, t := range r.trackers {
+		if !t.started {
+			continue
+		}
+
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if _, err := r.announce(ctx, t.url, r.announceData(AnnounceEventStopped)); err != nil {
+				r.logger.Debug("Failed to send 'stopped' to the tracker", "tracker", t.rawURL, "err", err)
+			}
+		}()
+	}
+	wg.Wait()
+
+	return nil
+}
+
+func (r *trackerPeerResolver) Announce(data AnnounceData) error {
+	switch data.Event {
+	case AnnounceEventNone, AnnounceEventCompleted:
+	default:
+		return errors.New("Only 'completed' can be announced: 'started' and 'stopped' are sent by Start and Close.")
+	}
+
+	r.mu.Lock()
+	r.data = data
+	r.mu.Unlock()
+
+	if data.Event == AnnounceEventCompleted {
+		r.markCompleted()
+	}
 	return nil
 }
+
+// markCompleted records the transition to finished and announces it right away.
+func (r *trackerPeerResolver) markCompleted() {
+	r.mu.Lock()
+	r.completed = true
+	r.mu.Unlock()
+
+	r.wakeAll()
+}
+
+func (r *trackerPeerResolver) wakeAll() {
+	for _, t := range r.trackers {
+		select {
+		case t.wake <- struct{}{}:
+		default:
+		}
+	}
+}
+
+// announceData returns the counters to announce, from the configured TransferStats if any.
+func (r *trackerPeerResolver) announceData(event AnnounceEvent) AnnounceData {
+	r.mu.Lock()
+	data := r.data
+	r.mu.Unlock()
+
+	if stats := r.config.Stats; stats != nil {
+		data.Uploaded = stats.Uploaded()
+		data.Downloaded = stats.Downloaded()
+		data.Left = stats.Left()
+	}
+
+	data.Event = event
+	return data
+}
+
+// nextEvent picks the event of the next announce to t: 'started' until the tracker acknowledged
+// it, then 'completed' once if the download finished while we were announcing to the tracker.
+func (r *trackerPeerResolver) nextEvent(t *trackerEntry) AnnounceEvent {
+	r.mu.Lock()
+	completed := r.completed
+	r.mu.Unlock()
+
+	switch {
+	case !t.started:
+		return AnnounceEventStarted
+	case completed && !t.completedSent:
+		return AnnounceEventCompleted
+	default:
+		return AnnounceEventNone
+	}
+}
+
+func (r *trackerPeerResolver) RegisterHandler(handler PeerDiscoveryHandler) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.handlers = append(r.handlers, handler)
+}
+
+func (r *trackerPeerResolver) RegisterStatusHandler(handler TrackerStatusHandler) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.statusHandlers = append(r.statusHandlers, handler)
+}
+
+func (r *trackerPeerResolver) Statuses() []TrackerStatus {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	statuses := make([]TrackerStatus, 0, len(r.trackers))
+	for _, t := range r.trackers {
+		statuses = append(statuses, t.status)
+	}
+	return statuses
+}
+
+// runTracker announces to a single tracker, then waits for the interval given by the tracker (or
+// the back-off delay after a failure) before announcing again.
+func (r *trackerPeerResolver) runTracker(ctx context.Context, t *trackerEntry) {
+	for {
+		r.announceTo(ctx, t)
+
+		r.mu.Lock()
+		wait := time.Until(t.status.NextAnnounce)
+		r.mu.Unlock()
+
+		timer := time.NewTimer(wait)
+		select {
+		case <-ctx.Done():
+			timer.Stop()
+			return
+		case <-t.wake:
+			timer.Stop()
+		case <-timer.C:
+		}
+	}
+}
+
+func (r *trackerPeerResolver) announceTo(ctx context.Context, t *trackerEntry) {
+	r.updateStatus(t, func(status *TrackerStatus) {
+		status.State = TrackerStateUpdating
+	})
+
+	event := r.nextEvent(t)
+	data := r.announceData(event)
+
+	result, err := r.announce(ctx, t.url, data)
+	if ctx.Err() != nil {
+		return
+	}
+
+	now := time.Now()
+	if err != nil {
+		delay := t.backoff.Next()
+		r.logger.Warn("Announce failed", "tracker", t.rawURL, "err", err, "retry_in", delay)
+
+		r.updateStatus(t, func(status *TrackerStatus) {
+			status.State = stateFromError(err)
+			status.LastError = err
+			status.LastAnnounce = now
+			status.NextAnnounce = now.Add(delay)
+			status.Failures = t.backoff.Failures()
+		})
+		return
+	}
+
+	switch event {
+	case AnnounceEventStarted:
+		t.started = true
+		// A tracker first contacted after the download finished learns it from 'left' = 0,
+		// it must not receive 'completed' afterwards.
+		t.completedSent = data.Left == 0
+	case AnnounceEventCompleted:
+		t.completedSent = true
+	}
+
+	t.backoff.Reset()
+	r.updateStatus(t, func(status *TrackerStatus) {
+		status.State = TrackerStateWorking
+		status.LastError = nil
+		status.Warning = result.warning
+		status.LastAnnounce = now
+		status.NextAnnounce = now.Add(result.interval)
+		status.Failures = 0
+		status.Seeders = result.seeders
+		status.Leechers = result.leechers
+		status.PeerCount = len(result.peers)
+	})
+
+	r.dispatchPeers(result.peers)
+}
+
+type announceResult struct {
+	interval time.Duration
+	seeders  int32
+	leechers int32
+	warning  string
+	peers    []PeerAddr
+}
+
+func (r *trackerPeerResolver) announce(ctx context.Context, trackerURL *TrackerURL, data AnnounceData) (*announceResult, error) {
+	numWant := int32(-1)
+	if r.maxPeerCount >= 0 {
+		numWant = int32(r.maxPeerCount)
+	}
+
+	result := &announceResult{}
+	var interval int32
+
+	switch trackerURL.Scheme {
+	case "udp":
+		resp, err := r.udpClient.SendAnnounceRequestToURL(ctx, trackerURL, r.config.Timeout, &TrackerUDPAnnounceRequest{
+			TxnID:      rand.Int31(),
+			InfoHash:   r.infoHash,
+			PeerID:     r.config.PeerID,
+			Downloaded: data.Downloaded,
+			Uploaded:   data.Uploaded,
+			Left:       data.Left,
+			Event:      data.Event,
+			Port:       r.config.Port,
+			Key:        r.key,
+			NumWant:    numWant,
+		})
+		if err != nil {
+			return nil, err
+		}
+
+		interval = resp.Interval
+		result.seeders, result.leechers = resp.Seeders, resp.Leechers
+		result.peers = resp.PeerAddresses
+
+	default:
+		resp, err := r.httpClient.SendAnnounceRequestDualStack(trackerURL.String(), r.config.Timeout, &TrackerHTTPAnnounceRequest{
+			InfoHash:   r.infoHash,
+			PeerID:     r.config.PeerID,
+			Port:       r.config.Port,
+			Downloaded: data.Downloaded,
+			Uploaded:   data.Uploaded,
+			Left:       data.Left,
+			Event:      data.Event,
+			NumWant:    numWant,
+			Key:        r.key,
+		})
+		if err != nil {
+			return nil, err
+		}
+
+		interval = max(resp.Interval, resp.MinInterval)
+		result.seeders, result.leechers = resp.Complete, resp.Incomplete
+		result.warning = resp.WarningMessage
+		result.peers = resp.PeerAddresses
+	}
+
+	result.interval = time.Duration(interval) * time.Second
+	if result.interval <= 0 {
+		result.interval = defaultAnnounceInterval
+	}
+
+	return result, nil
+}
+
+func (r *trackerPeerResolver) updateStatus(t *trackerEntry, update func(status *TrackerStatus)) {
+	r.mu.Lock()
+	update(&t.status)
+	status := t.status
+	handlers := r.statusHandlers
+	r.mu.Unlock()
+
+	for _, handler := range handlers {
+		handler(status)
+	}
+}
+
+func (r *trackerPeerResolver) dispatchPeers(peers []PeerAddr) {
+	if len(peers) == 0 {
+		return
+	}
+
+	if r.maxPeerCount >= 0 && len(peers) > r.maxPeerCount {
+		peers = peers[:r.maxPeerCount]
+	}
+
+	addrs := make([]common.PeerAddr, 0, len(peers))
+	for _, p := range peers {
+		addrs = append(addrs, common.PeerAddr{Host: p.IP.String(), Port: p.Port})
+	}
+
+	r.mu.Lock()
+	handlers := r.handlers
+	r.mu.Unlock()
+
+	for _, handler := range handlers {
+		if err := handler(addrs); err != nil {
+			r.logger.Error("Peer discovery handler failed", "err", err)
+		}
+	}
+}
@@ -6,6 +6,7 @@ import (
 	"fmt"
 	"math/rand"
 	"net"
+	"strconv"
 )
 
 type TrackerAction int32
@@ -29,9 +30,26 @@ const (
 )
 
 const (
-	UDPAnnounceRequestSize = 98
-	UDPConnectRequestSize  = 16
-	UDPConnectResponseSize = 16
+	UDPAnnounceRequestSize        = 98
+	UDPAnnounceResponseHeaderSize = 20
+	UDPConnectRequestSize         = 16
+	UDPConnectResponseSize        = 16
+	UDPScrapeRequestHeaderSize    = 16
+	UDPScrapeResponseHeaderSize   = 8
+	UDPErrorResponseHeaderSize    = 8
+
+	// Magic constant identifying the UDP tracker protocol in connect requests.
+	UDPProtocolID int64 = 0x41727101980
+
+	// Number of bytes per torrent in a scrape response: seeders, completed and leechers.
+	UDPScrapeStatsSize = 12
+)
+
+// Size of a peer entry in the compact peer format: 4 or 16 bytes of IP address followed by a
+// 2-byte port, both in network byte order.
+const (
+	CompactPeerSizeIPv4 = 6
+	CompactPeerSizeIPv6 = 18
 )
 
 type PeerAddr struct {
@@ -39,6 +57,10 @@ type PeerAddr struct {
 	Port uint16
 }
 
+func (addr PeerAddr) String() string {
+	return net.JoinHostPort(addr.IP.String(), strconv.Itoa(int(addr.Port)))
+}
+
 type TrackerUDPResponse interface {
 	Action() TrackerAction
 }
@@ -48,14 +70,18 @@ type TrackerUDPAnnounceRequest struct {
 	TxnID        int32
 	InfoHash     [20]byte
 	PeerID       [20]byte
-	Downloaded   int32
-	Uploaded     int32
-	Left         int32
+	Downloaded   int64
+	Uploaded     int64
+	Left         int64
 	Event        AnnounceEvent
 	IPAddr       *net.IP
 	Port         uint16
 	Key          int32
 	NumWant      int32
+
+	// URLData is the path and query of the tracker's announce URL, sent as BEP 41 options after
+	// the fixed-size request. Private trackers use it to receive the passkey.
+	URLData string
 }
 
 // Schema for the announce response returned by a tracker.
@@ -94,9 +120,10 @@ type TrackerUDPErrorResponse struct {
 // 88      32-bit integer  key
 // 92      32-bit integer  num_want        -1 // default
 // 96      16-bit integer  port
-// 98
+// 98      options (BEP 41), only present if URLData is set
 func (req TrackerUDPAnnounceRequest) Marshal() []byte {
-	serializedReq := make([]byte, UDPAnnounceRequestSize)
+	options := MarshalUDPOptions(req.URLData)
+	serializedReq := make([]byte, UDPAnnounceRequestSize, UDPAnnounceRequestSize+len(options))
 
 	binary.BigEndian.PutUint64(serializedReq[0:8], uint64(req.ConnectionID))
 	binary.BigEndian.PutUint32(serializedReq[8:12], uint32(req.Action()))
@@ -108,18 +135,19 @@ func (req TrackerUDPAnnounceRequest) Marshal() []byte {
 	binary.BigEndian.PutUint64(serializedReq[72:80], uint64(req.Uploaded))
 	binary.BigEndian.PutUint32(serializedReq[80:84], uint32(req.Event))
 
-	if req.IPAddr == nil {
+	// The IP address field can only hold an IPv4 address. For IPv6 announces it must be 0, the
+	// tracker uses the source address of the packet instead.
+	if req.IPAddr == nil || req.IPAddr.To4() == nil {
 		binary.BigEndian.PutUint32(serializedReq[84:88], uint32(0))
 	} else {
-		rawIpv4 := req.IPAddr.To4()
-		copy(serializedReq[84:88], rawIpv4)
+		copy(serializedReq[84:88], req.IPAddr.To4())
 	}
 
 	binary.BigEndian.PutUint32(serializedReq[88:92], 0)
 	binary.BigEndian.PutUint32(serializedReq[92:96], uint32(req.NumWant))
 	binary.BigEndian.PutUint16(serializedReq[96:98], req.Port)
 
-	return serializedReq
+	return append(serializedReq, options...)
 }
 
 // Response format:
@@ -132,11 +160,30 @@ func (req TrackerUDPAnnounceRequest) Marshal() []byte {
 // 20 + 6 * n  32-bit integer  IP address
 // 24 + 6 * n  16-bit integer  TCP port
 // 20 + 6 * N
+//
+// This is the IPv4 format, which trackers use when the announce request was sent over IPv4.
 func UnmarshalTrackerUDPAnnounceResponse(rawResponse []byte) (*TrackerUDPAnnounceResponse, error) {
-	// Validate the response size
-	responseSize := len(rawResponse)
-	if (responseSize-20)%6 != 0 {
-		return nil, errors.New("Announce response's size is invalid. Currently only IPv4 is supported.")
+	return unmarshalTrackerUDPAnnounceResponse(rawResponse, false)
+}
+
+// UnmarshalTrackerUDPAnnounceResponse6 parses an announce response received over IPv6. The
+// layout is the same as the IPv4 one, except that each peer entry is 18 bytes long:
+//
+// Offset       Size             Name            Value
+// 20 + 18 * n  128-bit integer  IP address
+// 36 + 18 * n  16-bit integer   TCP port
+// 20 + 18 * N
+func UnmarshalTrackerUDPAnnounceResponse6(rawResponse []byte) (*TrackerUDPAnnounceResponse, error) {
+	return unmarshalTrackerUDPAnnounceResponse(rawResponse, true)
+}
+
+func unmarshalTrackerUDPAnnounceResponse(rawResponse []byte, ipv6 bool) (*TrackerUDPAnnounceResponse, error) {
+	if len(rawResponse) < UDPAnnounceResponseHeaderSize {
+		return nil, fmt.Errorf(
+			"Announce response is too short. Expect at least %d bytes, but got %d.",
+			UDPAnnounceResponseHeaderSize,
+			len(rawResponse),
+		)
 	}
 
 	action := binary.BigEndian.Uint32(rawResponse[:4])
@@ -145,16 +192,9 @@ func UnmarshalTrackerUDPAnnounceResponse(rawResponse []byte) (*TrackerUDPAnnounc
 	}
 
 	// Parse addreses of peers
-	peerCount := (responseSize - 20) / 6
-	peers := []PeerAddr{}
-	for i := 0; i < peerCount; i++ {
-		ipOffset := 20 + 6*i
-		portOffset := 24 + 6*i
-		newPeer := PeerAddr{
-			IP:   net.IP(rawResponse[ipOffset : ipOffset+4]),
-			Port: binary.BigEndian.Uint16(rawResponse[portOffset : portOffset+2]),
-		}
-		peers = append(peers, newPeer)
+	peers, err := UnmarshalCompactPeers(rawResponse[UDPAnnounceResponseHeaderSize:], ipv6)
+	if err != nil {
+		return nil, fmt.Errorf("Announce response's size is invalid: %w", err)
 	}
 
 	return &TrackerUDPAnnounceResponse{
@@ -166,6 +206,62 @@ func UnmarshalTrackerUDPAnnounceResponse(rawResponse []byte) (*TrackerUDPAnnounc
 	}, nil
 }
 
+// UnmarshalCompactPeers parses a list of peers in the compact format, which is shared by UDP
+// announce responses and the 'peers'/'peers6' keys of HTTP announce responses.
+func UnmarshalCompactPeers(raw []byte, ipv6 bool) ([]PeerAddr, error) {
+	entrySize, ipSize := CompactPeerSizeIPv4, net.IPv4len
+	if ipv6 {
+		entrySize, ipSize = CompactPeerSizeIPv6, net.IPv6len
+	}
+
+	if len(raw)%entrySize != 0 {
+		return nil, fmt.Errorf("compact peer list's length %d is not a multiple of %d", len(raw), entrySize)
+	}
+
+	peers := make([]PeerAddr, 0, len(raw)/entrySize)
+	for offset := 0; offset < len(raw); offset += entrySize {
+		// copy the address so that the returned peers don't keep the (potentially large)
+		// response buffer alive.
+		ip := make(net.IP, ipSize)
+		copy(ip, raw[offset:offset+ipSize])
+		peers = append(peers, PeerAddr{
+			IP:   ip,
+			Port: binary.BigEndian.Uint16(raw[offset+ipSize : offset+entrySize]),
+		})
+	}
+
+	return peers, nil
+}
+
+// MarshalCompactPeers is the inverse of UnmarshalCompactPeers. Peers whose address doesn't
+// belong to the requested family are skipped.
+func MarshalCompactPeers(peers []PeerAddr, ipv6 bool) []byte {
+	entrySize := CompactPeerSizeIPv4
+	if ipv6 {
+		entrySize = CompactPeerSizeIPv6
+	}
+
+	raw := make([]byte, 0, len(peers)*entrySize)
+	for _, p := range peers {
+		ip := p.IP.To4()
+		if ipv6 {
+			if ip != nil {
+				continue
+			}
+			ip = p.IP.To16()
+		}
+
+		if ip == nil {
+			continue
+		}
+
+		raw = append(raw, ip...)
+		raw = binary.BigEndian.AppendUint16(raw, p.Port)
+	}
+
+	return raw
+}
+
 func (req TrackerUDPAnnounceRequest) Action() TrackerAction {
 	return TrackerActionAnnounce
 }
@@ -194,7 +290,7 @@ func CreateTrackerUDPConnectRequest(genTxnID bool) *TrackerUDPConnectRequest {
 // 16
 func (req TrackerUDPConnectRequest) Marshal() []byte {
 	rawRequest := make([]byte, UDPConnectRequestSize)
-	binary.BigEndian.PutUint64(rawRequest[0:8], 0x41727101980)
+	binary.BigEndian.PutUint64(rawRequest[0:8], uint64(UDPProtocolID))
 	binary.BigEndian.PutUint32(rawRequest[8:12], uint32(req.Action()))
 	binary.BigEndian.PutUint32(rawRequest[12:], uint32(req.TxnID))
 	return rawRequest
@@ -219,6 +315,10 @@ func (req TrackerUDPConnectResponse) Action() TrackerAction {
 // 8       64-bit integer  connection_id
 // 16
 func UnmarshalTrackerUDPConnectResponse(rawResponse []byte) (*TrackerUDPConnectResponse, error) {
+	if len(rawResponse) < UDPConnectResponseSize {
+		return nil, fmt.Errorf("Connect response is too short. Expect %d bytes, but got %d.", UDPConnectResponseSize, len(rawResponse))
+	}
+
 	action := binary.BigEndian.Uint32(rawResponse[:4])
 
 	if TrackerAction(action) != TrackerActionConnect {
@@ -243,6 +343,10 @@ func (r TrackerUDPAnnounceResponse) Action() TrackerAction {
 // 4       32-bit integer  transaction_id
 // 8       string  message
 func UnmarshalTrackerUDPErrorResponse(rawResponse []byte) (*TrackerUDPErrorResponse, error) {
+	if len(rawResponse) < UDPErrorResponseHeaderSize {
+		return nil, fmt.Errorf("Error response is too short: %d bytes.", len(rawResponse))
+	}
+
 	action := binary.BigEndian.Uint32(rawResponse[:4])
 
 	if TrackerAction(action) != TrackerActionError {
@@ -264,3 +368,219 @@ func (r TrackerUDPErrorResponse) Action() TrackerAction {
 func getActionFromRawResp(resp []byte) TrackerAction {
 	return TrackerAction(binary.BigEndian.Uint32(resp[:4]))
 }
+
+// UnmarshalTrackerUDPConnectRequest parses a connect request, as received by a tracker.
+func UnmarshalTrackerUDPConnectRequest(rawRequest []byte) (*TrackerUDPConnectRequest, error) {
+	if len(rawRequest) < UDPConnectRequestSize {
+		return nil, fmt.Errorf("Connect request is too short. Expect %d bytes, but got %d.", UDPConnectRequestSize, len(rawRequest))
+	}
+
+	if int64(binary.BigEndian.Uint64(rawRequest[0:8])) != UDPProtocolID {
+		return nil, errors.New("Invalid protocol ID in connect request.")
+	}
+
+	if action := getActionFromRawRequest(rawRequest); action != TrackerActionConnect {
+		return nil, fmt.Errorf("Invalid value of field 'action', expect '%d', but got: '%d'.", TrackerActionConnect, action)
+	}
+
+	return &TrackerUDPConnectRequest{
+		TxnID: int32(binary.BigEndian.Uint32(rawRequest[12:16])),
+	}, nil
+}
+
+func (resp TrackerUDPConnectResponse) Marshal() []byte {
+	raw := make([]byte, UDPConnectResponseSize)
+	binary.BigEndian.PutUint32(raw[0:4], uint32(resp.Action()))
+	binary.BigEndian.PutUint32(raw[4:8], uint32(resp.TxnID))
+	binary.BigEndian.PutUint64(raw[8:16], uint64(resp.ConnectionID))
+	return raw
+}
+
+// UnmarshalTrackerUDPAnnounceRequest parses an announce request, as received by a tracker. The
+// layout is described in TrackerUDPAnnounceRequest.Marshal. Malformed options are ignored rather
+// than failing the whole request, as BEP 41 recommends.
+func UnmarshalTrackerUDPAnnounceRequest(rawRequest []byte) (*TrackerUDPAnnounceRequest, error) {
+	if len(rawRequest) < UDPAnnounceRequestSize {
+		return nil, fmt.Errorf("Announce request is too short. Expect %d bytes, but got %d.", UDPAnnounceRequestSize, len(rawRequest))
+	}
+
+	if action := getActionFromRawRequest(rawRequest); action != TrackerActionAnnounce {
+		return nil, fmt.Errorf("Invalid value of field 'action', expect '%d', but got: '%d'.", TrackerActionAnnounce, action)
+	}
+
+	req := &TrackerUDPAnnounceRequest{
+		ConnectionID: int64(binary.BigEndian.Uint64(rawRequest[0:8])),
+		TxnID:        int32(binary.BigEndian.Uint32(rawRequest[12:16])),
+		Downloaded:   int64(binary.BigEndian.Uint64(rawRequest[56:64])),
+		Left:         int64(binary.BigEndian.Uint64(rawRequest[64:72])),
+		Uploaded:     int64(binary.BigEndian.Uint64(rawRequest[72:80])),
+		Event:        AnnounceEvent(binary.BigEndian.Uint32(rawRequest[80:84])),
+		Key:          int32(binary.BigEndian.Uint32(rawRequest[88:92])),
+		NumWant:      int32(binary.BigEndian.Uint32(rawRequest[92:96])),
+		Port:         binary.BigEndian.Uint16(rawRequest[96:98]),
+	}
+	copy(req.InfoHash[:], rawRequest[16:36])
+	copy(req.PeerID[:], rawRequest[36:56])
+
+	if ip := net.IP(rawRequest[84:88]); !ip.Equal(net.IPv4zero) {
+		ipAddr := net.IPv4(ip[0], ip[1], ip[2], ip[3])
+		req.IPAddr = &ipAddr
+	}
+
+	if urlData, err := UnmarshalUDPOptions(rawRequest[UDPAnnounceRequestSize:]); err == nil {
+		req.URLData = urlData
+	}
+
+	return req, nil
+}
+
+// Marshal serializes the response in the IPv4 format. Peers that are not IPv4 are skipped.
+func (resp TrackerUDPAnnounceResponse) Marshal() []byte {
+	return resp.marshal(false)
+}
+
+// Marshal6 serializes the response in the IPv6 format, used when the announce request was
+// received over IPv6. Peers that are not IPv6 are skipped.
+func (resp TrackerUDPAnnounceResponse) Marshal6() []byte {
+	return resp.marshal(true)
+}
+
+func (resp TrackerUDPAnnounceResponse) marshal(ipv6 bool) []byte {
+	raw := make([]byte, UDPAnnounceResponseHeaderSize)
+	binary.BigEndian.PutUint32(raw[0:4], uint32(resp.Action()))
+	binary.BigEndian.PutUint32(raw[4:8], uint32(resp.TxnID))
+	binary.BigEndian.PutUint32(raw[8:12], uint32(resp.Interval))
+	binary.BigEndian.PutUint32(raw[12:16], uint32(resp.Leechers))
+	binary.BigEndian.PutUint32(raw[16:20], uint32(resp.Seeders))
+	return append(raw, MarshalCompactPeers(resp.PeerAddresses, ipv6)...)
+}
+
+// Scrape request format:
+// Offset          Size            Name            Value
+// 0               64-bit integer  connection_id
+// 8               32-bit integer  action          2 // scrape
+// 12              32-bit integer  transaction_id
+// 16 + 20 * n     20-byte string  info_hash
+// 16 + 20 * N
+type TrackerUDPScrapeRequest struct {
+	ConnectionID int64
+	TxnID        int32
+	InfoHashes   [][20]byte
+}
+
+func (req TrackerUDPScrapeRequest) Action() TrackerAction {
+	return TrackerActionScrape
+}
+
+func (req TrackerUDPScrapeRequest) Marshal() []byte {
+	raw := make([]byte, UDPScrapeRequestHeaderSize, UDPScrapeRequestHeaderSize+20*len(req.InfoHashes))
+	binary.BigEndian.PutUint64(raw[0:8], uint64(req.ConnectionID))
+	binary.BigEndian.PutUint32(raw[8:12], uint32(req.Action()))
+	binary.BigEndian.PutUint32(raw[12:16], uint32(req.TxnID))
+	for _, infoHash := range req.InfoHashes {
+		raw = append(raw, infoHash[:]...)
+	}
+	return raw
+}
+
+func UnmarshalTrackerUDPScrapeRequest(rawRequest []byte) (*TrackerUDPScrapeRequest, error) {
+	if len(rawRequest) < UDPScrapeRequestHeaderSize || (len(rawRequest)-UDPScrapeRequestHeaderSize)%20 != 0 {
+		return nil, fmt.Errorf("Scrape request's size is invalid: %d.", len(rawRequest))
+	}
+
+	if action := getActionFromRawRequest(rawRequest); action != TrackerActionScrape {
+		return nil, fmt.Errorf("Invalid value of field 'action', expect '%d', but got: '%d'.", TrackerActionScrape, action)
+	}
+
+	req := &TrackerUDPScrapeRequest{
+		ConnectionID: int64(binary.BigEndian.Uint64(rawRequest[0:8])),
+		TxnID:        int32(binary.BigEndian.Uint32(rawRequest[12:16])),
+	}
+	for offset := UDPScrapeRequestHeaderSize; offset < len(rawRequest); offset += 20 {
+		var infoHash [20]byte
+		copy(infoHash[:], rawRequest[offset:offset+20])
+		req.InfoHashes = append(req.InfoHashes, infoHash)
+	}
+
+	return req, nil
+}
+
+// Swarm statistics of a single torrent, as returned by scrape requests.
+type ScrapeStats struct {
+	Seeders   int32
+	Completed int32
+	Leechers  int32
+}
+
+// Scrape response format:
+// Offset      Size            Name            Value
+// 0           32-bit integer  action          2 // scrape
+// 4           32-bit integer  transaction_id
+// 8 + 12 * n  32-bit integer  seeders
+// 12 + 12 * n 32-bit integer  completed
+// 16 + 12 * n 32-bit integer  leechers
+// 8 + 12 * N
+type TrackerUDPScrapeResponse struct {
+	TxnID int32
+	Stats []ScrapeStats
+}
+
+func (resp TrackerUDPScrapeResponse) Action() TrackerAction {
+	return TrackerActionScrape
+}
+
+func (resp TrackerUDPScrapeResponse) Marshal() []byte {
+	raw := make([]byte, UDPScrapeResponseHeaderSize+UDPScrapeStatsSize*len(resp.Stats))
+	binary.BigEndian.PutUint32(raw[0:4], uint32(resp.Action()))
+	binary.BigEndian.PutUint32(raw[4:8], uint32(resp.TxnID))
+	for i, stats := range resp.Stats {
+		offset := UDPScrapeResponseHeaderSize + UDPScrapeStatsSize*i
+		binary.BigEndian.PutUint32(raw[offset:offset+4], uint32(stats.Seeders))
+		binary.BigEndian.PutUint32(raw[offset+4:offset+8], uint32(stats.Completed))
+		binary.BigEndian.PutUint32(raw[offset+8:offset+12], uint32(stats.Leechers))
+	}
+	return raw
+}
+
+func UnmarshalTrackerUDPScrapeResponse(rawResponse []byte) (*TrackerUDPScrapeResponse, error) {
+	if len(rawResponse) < UDPScrapeResponseHeaderSize || (len(rawResponse)-UDPScrapeResponseHeaderSize)%UDPScrapeStatsSize != 0 {
+		return nil, fmt.Errorf("Scrape response's size is invalid: %d.", len(rawResponse))
+	}
+
+	if action := getActionFromRawResp(rawResponse); action != TrackerActionScrape {
+		return nil, fmt.Errorf("Invalid value of field 'action', expect '%d', but got: '%d'.", TrackerActionScrape, action)
+	}
+
+	resp := &TrackerUDPScrapeResponse{
+		TxnID: int32(binary.BigEndian.Uint32(rawResponse[4:8])),
+	}
+	for offset := UDPScrapeResponseHeaderSize; offset < len(rawResponse); offset += UDPScrapeStatsSize {
+		resp.Stats = append(resp.Stats, ScrapeStats{
+			Seeders:   int32(binary.BigEndian.Uint32(rawResponse[offset : offset+4])),
+			Completed: int32(binary.BigEndian.Uint32(rawResponse[offset+4 : offset+8])),
+			Leechers:  int32(binary.BigEndian.Uint32(rawResponse[offset+8 : offset+12])),
+		})
+	}
+
+	return resp, nil
+}
+
+func (r TrackerUDPErrorResponse) Marshal() []byte {
+	raw := make([]byte, UDPErrorResponseHeaderSize, UDPErrorResponseHeaderSize+len(r.Message))
+	binary.BigEndian.PutUint32(raw[0:4], uint32(r.Action()))
+	binary.BigEndian.PutUint32(raw[4:8], uint32(r.TxnID))
+	return append(raw, r.Message...)
+}
+
+// GetActionFromRawRequest returns the action of a request received by a tracker. The action is
+// located right after the 64-bit connection ID (or protocol ID for connect requests).
+func GetActionFromRawRequest(rawRequest []byte) TrackerAction {
+	if len(rawRequest) < 12 {
+		return -1
+	}
+	return getActionFromRawRequest(rawRequest)
+}
+
+func getActionFromRawRequest(req []byte) TrackerAction {
+	return TrackerAction(binary.BigEndian.Uint32(req[8:12]))
+}
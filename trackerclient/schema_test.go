@@ -0,0 +1,150 @@
+package trackerclient
+
+import (
+	"encoding/binary"
+	"net"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func createAnnounceResponseHeader(txnID, interval, leechers, seeders uint32) []byte {
+	raw := make([]byte, UDPAnnounceResponseHeaderSize)
+	binary.BigEndian.PutUint32(raw[0:4], uint32(TrackerActionAnnounce))
+	binary.BigEndian.PutUint32(raw[4:8], txnID)
+	binary.BigEndian.PutUint32(raw[8:12], interval)
+	binary.BigEndian.PutUint32(raw[12:16], leechers)
+	binary.BigEndian.PutUint32(raw[16:20], seeders)
+	return raw
+}
+
+func TestUnmarshalUDPAnnounceResponseIPv4(t *testing.T) {
+	raw := createAnnounceResponseHeader(7, 1800, 3, 4)
+	raw = append(raw, 10, 0, 0, 1, 0x1a, 0xe1)
+	raw = append(raw, 192, 168, 1, 2, 0x1a, 0xe2)
+
+	resp, err := UnmarshalTrackerUDPAnnounceResponse(raw)
+	assert.NoError(t, err)
+	assert.Equal(t, int32(7), resp.TxnID)
+	assert.Equal(t, int32(1800), resp.Interval)
+	assert.Len(t, resp.PeerAddresses, 2)
+	assert.Equal(t, "10.0.0.1:6881", resp.PeerAddresses[0].String())
+	assert.Equal(t, "192.168.1.2:6882", resp.PeerAddresses[1].String())
+
+	// The IPv4 layout doesn't accept 18-byte entries.
+	raw = createAnnounceResponseHeader(7, 1800, 3, 4)
+	raw = append(raw, make([]byte, 18)...)
+	raw = append(raw, 0)
+	_, err = UnmarshalTrackerUDPAnnounceResponse(raw)
+	assert.Error(t, err)
+
+	// Truncated header
+	_, err = UnmarshalTrackerUDPAnnounceResponse(raw[:10])
+	assert.Error(t, err)
+}
+
+func TestUnmarshalUDPAnnounceResponseIPv6(t *testing.T) {
+	peerIP := net.ParseIP("2001:db8::1")
+
+	raw := createAnnounceResponseHeader(9, 900, 1, 1)
+	raw = append(raw, peerIP...)
+	raw = append(raw, 0x1a, 0xe1)
+
+	resp, err := UnmarshalTrackerUDPAnnounceResponse6(raw)
+	assert.NoError(t, err)
+	assert.Len(t, resp.PeerAddresses, 1)
+	assert.True(t, peerIP.Equal(resp.PeerAddresses[0].IP))
+	assert.Equal(t, uint16(6881), resp.PeerAddresses[0].Port)
+
+	_, err = UnmarshalTrackerUDPAnnounceResponse6(raw[:len(raw)-1])
+	assert.Error(t, err)
+}
+
+func TestCompactPeersRoundTrip(t *testing.T) {
+	peers := []PeerAddr{
+		{IP: net.ParseIP("1.2.3.4"), Port: 1},
+		{IP: net.ParseIP("::1"), Port: 2},
+		{IP: net.ParseIP("5.6.7.8"), Port: 3},
+	}
+
+	raw4 := MarshalCompactPeers(peers, false)
+	assert.Len(t, raw4, 2*CompactPeerSizeIPv4)
+	decoded4, err := UnmarshalCompactPeers(raw4, false)
+	assert.NoError(t, err)
+	assert.Equal(t, "1.2.3.4:1", decoded4[0].String())
+	assert.Equal(t, "5.6.7.8:3", decoded4[1].String())
+
+	raw6 := MarshalCompactPeers(peers, true)
+	assert.Len(t, raw6, CompactPeerSizeIPv6)
+	decoded6, err := UnmarshalCompactPeers(raw6, true)
+	assert.NoError(t, err)
+	assert.Equal(t, "[::1]:2", decoded6[0].String())
+}
+
+func TestMarshalAnnounceRequestIPv6Address(t *testing.T) {
+	ip := net.ParseIP("2001:db8::1")
+	req := TrackerUDPAnnounceRequest{IPAddr: &ip}
+	raw := req.Marshal()
+	assert.Equal(t, []byte{0, 0, 0, 0}, raw[84:88])
+
+	ip = net.ParseIP("10.1.2.3")
+	raw = req.Marshal()
+	assert.Equal(t, []byte{10, 1, 2, 3}, raw[84:88])
+}
+
+func TestUnmarshalHTTPAnnounceResponse(t *testing.T) {
+	peers := string([]byte{10, 0, 0, 1, 0x1a, 0xe1})
+	peers6 := string(append(net.ParseIP("2001:db8::2").To16(), 0x1a, 0xe2))
+	body := "d8:completei5e10:incompletei2e8:intervali1800e5:peers6:" + peers +
+		"6:peers618:" + peers6 + "e"
+
+	resp, err := UnmarshalTrackerHTTPAnnounceResponse([]byte(body))
+	assert.NoError(t, err)
+	assert.Equal(t, int32(1800), resp.Interval)
+	assert.Equal(t, int32(5), resp.Complete)
+	assert.Len(t, resp.PeerAddresses, 2)
+	assert.Equal(t, "10.0.0.1:6881", resp.PeerAddresses[0].String())
+	assert.Equal(t, "[2001:db8::2]:6882", resp.PeerAddresses[1].String())
+
+	// Non-compact peer list
+	body = "d8:intervali60e5:peersld2:ip9:127.0.0.17:peer id20:aaaaaaaaaaaaaaaaaaaa4:porti6881eeee"
+	resp, err = UnmarshalTrackerHTTPAnnounceResponse([]byte(body))
+	assert.NoError(t, err)
+	assert.Len(t, resp.PeerAddresses, 1)
+	assert.Equal(t, "127.0.0.1:6881", resp.PeerAddresses[0].String())
+
+	body = "d14:failure reason9:not founde"
+	_, err = UnmarshalTrackerHTTPAnnounceResponse([]byte(body))
+	assert.ErrorContains(t, err, "not found")
+}
+
+func TestHTTPAnnounceRequestURL(t *testing.T) {
+	req := TrackerHTTPAnnounceRequest{
+		InfoHash: [20]byte{0x20, 0xff},
+		Port:     6881,
+		Left:     5 << 32,
+		Event:    AnnounceEventStarted,
+		IPv6:     net.ParseIP("2001:db8::1"),
+	}
+
+	u, err := req.URL("http://tracker.example/announce?passkey=abc")
+	assert.NoError(t, err)
+	assert.Contains(t, u, "passkey=abc&info_hash=%20%FF%00")
+	assert.Contains(t, u, "left=21474836480")
+	assert.Contains(t, u, "event=started")
+	assert.Contains(t, u, "ipv6=2001%3Adb8%3A%3A1")
+}
+
+func TestAnnounceRequest64BitCounters(t *testing.T) {
+	req := TrackerUDPAnnounceRequest{
+		Downloaded: 3 << 31,
+		Uploaded:   5 << 33,
+		Left:       7 << 40,
+	}
+
+	decoded, err := UnmarshalTrackerUDPAnnounceRequest(req.Marshal())
+	assert.NoError(t, err)
+	assert.Equal(t, req.Downloaded, decoded.Downloaded)
+	assert.Equal(t, req.Uploaded, decoded.Uploaded)
+	assert.Equal(t, req.Left, decoded.Left)
+}
@@ -0,0 +1,108 @@
+package trackerclient
+
+import (
+	"errors"
+	"fmt"
+	"time"
+)
+
+type TrackerState int
+
+const (
+	// The tracker hasn't been contacted yet.
+	TrackerStateNotContacted TrackerState = iota
+	// An announce is in flight.
+	TrackerStateUpdating
+	// The last announce succeeded.
+	TrackerStateWorking
+	// The tracker answered the last announce with an error message (TrackerFailure).
+	TrackerStateFailed
+	// The tracker didn't answer the last announce (TrackerTimeout).
+	TrackerStateUnreachable
+	// The tracker answered the last announce with an invalid response (TrackerProtocolError).
+	TrackerStateProtocolError
+)
+
+func (s TrackerState) String() string {
+	switch s {
+	case TrackerStateNotContacted:
+		return "not contacted"
+	case TrackerStateUpdating:
+		return "updating"
+	case TrackerStateWorking:
+		return "working"
+	case TrackerStateFailed:
+		return "failed"
+	case TrackerStateUnreachable:
+		return "unreachable"
+	case TrackerStateProtocolError:
+		return "protocol error"
+	default:
+		return fmt.Sprintf("UnknownTrackerState(%d)", int(s))
+	}
+}
+
+// TrackerStatus is a snapshot of the state of a single tracker of a torrent.
+type TrackerStatus struct {
+	URL  string
+	Tier int
+
+	State TrackerState
+	// LastError is the error of the last announce, nil if it succeeded.
+	LastError error
+	// Warning is the last warning message sent by the tracker along with a successful response.
+	Warning string
+
+	LastAnnounce time.Time
+	NextAnnounce time.Time
+	// Failures is the number of consecutive failed announces.
+	Failures int
+
+	Seeders   int32
+	Leechers  int32
+	PeerCount int
+}
+
+// Message returns a human-readable description of the status, suitable for display.
+func (s TrackerStatus) Message() string {
+	var failure *TrackerFailure
+
+	switch s.State {
+	case TrackerStateWorking:
+		if s.Warning != "" {
+			return "tracker warns: " + s.Warning
+		}
+		return fmt.Sprintf("working, %d peers received", s.PeerCount)
+	case TrackerStateFailed:
+		if errors.As(s.LastError, &failure) {
+			return "tracker says: " + failure.Reason
+		}
+		return "failed"
+	case TrackerStateUnreachable:
+		return "unreachable"
+	case TrackerStateProtocolError:
+		return fmt.Sprintf("invalid response: %v", errors.Unwrap(s.LastError))
+	default:
+		return s.State.String()
+	}
+}
+
+// TrackerStatusHandler is called every time the status of a tracker changes.
+type TrackerStatusHandler func(status TrackerStatus)
+
+// stateFromError maps an announce error to the resulting tracker state.
+func stateFromError(err error) TrackerState {
+	var failure *TrackerFailure
+	var timeout *TrackerTimeout
+
+	switch {
+	case err == nil:
+		return TrackerStateWorking
+	case errors.As(err, &failure):
+		return TrackerStateFailed
+	case errors.As(err, &timeout):
+		return TrackerStateUnreachable
+	default:
+		return TrackerStateProtocolError
+	}
+}
@@ -0,0 +1,55 @@
+package trackerclient
+
+import (
+	"errors"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestBackoff(t *testing.T) {
+	b := &Backoff{Initial: time.Second, Max: 10 * time.Second}
+
+	assert.Equal(t, time.Second, b.Next())
+	assert.Equal(t, 2*time.Second, b.Next())
+	assert.Equal(t, 4*time.Second, b.Next())
+	assert.Equal(t, 8*time.Second, b.Next())
+	assert.Equal(t, 10*time.Second, b.Next())
+	assert.Equal(t, 10*time.Second, b.Next())
+	assert.Equal(t, 6, b.Failures())
+
+	b.Reset()
+	assert.Equal(t, time.Second, b.Next())
+
+	// jitter stays within 10% of the delay
+	b = NewBackoff(time.Second, time.Minute)
+	delay := b.Next()
+	assert.GreaterOrEqual(t, delay, time.Second)
+	assert.LessOrEqual(t, delay, 1100*time.Millisecond)
+}
+
+func TestTrackerErrorClassification(t *testing.T) {
+	failure := &TrackerFailure{Tracker: "udp://t:1", Reason: "unregistered torrent"}
+	timeout := wrapNetworkError("udp://t:1", &net.OpError{Op: "read", Err: errors.New("i/o timeout")})
+	protocolErr := wrapNetworkError("udp://t:1", errors.New("response is too short"))
+
+	assert.IsType(t, &TrackerTimeout{}, timeout)
+	assert.IsType(t, &TrackerProtocolError{}, protocolErr)
+	assert.Same(t, failure, wrapNetworkError("udp://t:1", failure))
+
+	assert.Equal(t, TrackerStateFailed, stateFromError(failure))
+	assert.Equal(t, TrackerStateUnreachable, stateFromError(timeout))
+	assert.Equal(t, TrackerStateProtocolError, stateFromError(protocolErr))
+	assert.Equal(t, TrackerStateWorking, stateFromError(nil))
+
+	assert.Equal(t, failure, mostRelevantError([]error{timeout, failure, protocolErr}))
+	assert.Equal(t, protocolErr, mostRelevantError([]error{timeout, protocolErr}))
+
+	status := TrackerStatus{State: TrackerStateFailed, LastError: failure}
+	assert.Equal(t, "tracker says: unregistered torrent", status.Message())
+
+	status = TrackerStatus{State: TrackerStateUnreachable, LastError: timeout}
+	assert.Equal(t, "unreachable", status.Message())
+}
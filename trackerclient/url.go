@@ -0,0 +1,176 @@
+package trackerclient
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"net/url"
+	"strconv"
+	"strings"
+)
+
+// Resolver resolves tracker hostnames. *net.Resolver implements it; tests can inject a fake one
+// to avoid depending on DNS.
+type Resolver interface {
+	LookupIP(ctx context.Context, network, host string) ([]net.IP, error)
+}
+
+// TrackerURL is a parsed announce URL of a tracker, e.g.
+// 'udp://tracker.example:1337/announce?passkey=abc'.
+type TrackerURL struct {
+	Scheme   string
+	Host     string
+	Port     int
+	Path     string
+	RawQuery string
+}
+
+// ParseTrackerURL parses and validates an announce URL. Only the 'udp', 'http' and 'https'
+// schemes are supported. The port is mandatory for UDP trackers, and defaults to the standard
+// port for HTTP(S) ones.
+func ParseTrackerURL(rawURL string) (*TrackerURL, error) {
+	u, err := url.Parse(strings.TrimSpace(rawURL))
+	if err != nil {
+		return nil, fmt.Errorf("Invalid tracker URL '%s': %w", rawURL, err)
+	}
+
+	trackerURL := &TrackerURL{
+		Scheme:   strings.ToLower(u.Scheme),
+		Host:     u.Hostname(),
+		Path:     u.EscapedPath(),
+		RawQuery: u.RawQuery,
+	}
+
+	if trackerURL.Host == "" {
+		return nil, fmt.Errorf("Invalid tracker URL '%s': missing host.", rawURL)
+	}
+
+	var defaultPort int
+	switch trackerURL.Scheme {
+	case "udp":
+		defaultPort = 0
+	case "http":
+		defaultPort = 80
+	case "https":
+		defaultPort = 443
+	default:
+		return nil, fmt.Errorf("Invalid tracker URL '%s': unsupported scheme '%s'.", rawURL, u.Scheme)
+	}
+
+	if u.Port() == "" {
+		if defaultPort == 0 {
+			return nil, fmt.Errorf("Invalid tracker URL '%s': missing port.", rawURL)
+		}
+		trackerURL.Port = defaultPort
+	} else {
+		port, err := strconv.Atoi(u.Port())
+		if err != nil || port <= 0 || port > 65535 {
+			return nil, fmt.Errorf("Invalid tracker URL '%s': invalid port '%s'.", rawURL, u.Port())
+		}
+		trackerURL.Port = port
+	}
+
+	return trackerURL, nil
+}
+
+func (u TrackerURL) String() string {
+	s := u.Scheme + "://" + net.JoinHostPort(u.Host, strconv.Itoa(u.Port)) + u.Path
+	if u.RawQuery != "" {
+		s += "?" + u.RawQuery
+	}
+	return s
+}
+
+// URLData returns the path and query string of the URL, which UDP trackers receive through the
+// URLData option (BEP 41) since the UDP protocol itself has no notion of a path.
+func (u TrackerURL) URLData() string {
+	if u.RawQuery == "" {
+		return u.Path
+	}
+	return u.Path + "?" + u.RawQuery
+}
+
+// Resolve returns the addresses of the tracker. If the host is an IP literal, no lookup is made.
+// resolver may be nil, in which case net.DefaultResolver is used.
+func (u TrackerURL) Resolve(ctx context.Context, resolver Resolver) ([]net.IP, error) {
+	if ip := net.ParseIP(u.Host); ip != nil {
+		return []net.IP{ip}, nil
+	}
+
+	if resolver == nil {
+		resolver = net.DefaultResolver
+	}
+
+	ips, err := resolver.LookupIP(ctx, "ip", u.Host)
+	if err != nil {
+		return nil, fmt.Errorf("Failed to resolve tracker host '%s': %w", u.Host, err)
+	}
+
+	if len(ips) == 0 {
+		return nil, fmt.Errorf("Failed to resolve tracker host '%s': no address found.", u.Host)
+	}
+
+	return ips, nil
+}
+
+// UDP tracker protocol extension options (BEP 41). Options are appended to announce requests,
+// each one starts with its type, followed (except for EndOfOptions and NOP) by a length byte and
+// the option's data.
+const (
+	UDPOptionEndOfOptions byte = 0x0
+	UDPOptionNOP          byte = 0x1
+	UDPOptionURLData      byte = 0x2
+)
+
+// MarshalUDPOptions encodes urlData as a sequence of URLData options. Data longer than 255 bytes
+// is split over several options, which the tracker concatenates.
+func MarshalUDPOptions(urlData string) []byte {
+	if urlData == "" {
+		return nil
+	}
+
+	raw := make([]byte, 0, len(urlData)+2*(len(urlData)/255+1)+1)
+	for len(urlData) > 0 {
+		chunk := urlData[:min(255, len(urlData))]
+		urlData = urlData[len(chunk):]
+
+		raw = append(raw, UDPOptionURLData, byte(len(chunk)))
+		raw = append(raw, chunk...)
+	}
+
+	return append(raw, UDPOptionEndOfOptions)
+}
+
+// UnmarshalUDPOptions decodes the options following an announce request and returns the
+// concatenated URLData. Unknown options are skipped using their length byte.
+func UnmarshalUDPOptions(raw []byte) (string, error) {
+	var urlData strings.Builder
+
+	for i := 0; i < len(raw); {
+		optionType := raw[i]
+		switch optionType {
+		case UDPOptionEndOfOptions:
+			return urlData.String(), nil
+		case UDPOptionNOP:
+			i++
+			continue
+		}
+
+		if i+1 >= len(raw) {
+			return "", errors.New("UDP tracker option is truncated.")
+		}
+
+		length := int(raw[i+1])
+		if i+2+length > len(raw) {
+			return "", errors.New("UDP tracker option's length exceeds the packet.")
+		}
+
+		if optionType == UDPOptionURLData {
+			urlData.Write(raw[i+2 : i+2+length])
+		}
+		i += 2 + length
+	}
+
+	return urlData.String(), nil
+}
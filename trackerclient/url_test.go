@@ -0,0 +1,105 @@
+package trackerclient
+
+import (
+	"context"
+	"net"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+type fakeResolver map[string][]net.IP
+
+func (r fakeResolver) LookupIP(ctx context.Context, network, host string) ([]net.IP, error) {
+	ips, ok := r[host]
+	if !ok {
+		return nil, &net.DNSError{Err: "no such host", Name: host, IsNotFound: true}
+	}
+	return ips, nil
+}
+
+func TestParseTrackerURL(t *testing.T) {
+	u, err := ParseTrackerURL(" UDP://tracker.example:1337/announce?passkey=abc%20d \n")
+	assert.NoError(t, err)
+	assert.Equal(t, "udp", u.Scheme)
+	assert.Equal(t, "tracker.example", u.Host)
+	assert.Equal(t, 1337, u.Port)
+	assert.Equal(t, "/announce?passkey=abc%20d", u.URLData())
+	assert.Equal(t, "udp://tracker.example:1337/announce?passkey=abc%20d", u.String())
+
+	u, err = ParseTrackerURL("http://[2001:db8::1]/announce")
+	assert.NoError(t, err)
+	assert.Equal(t, "2001:db8::1", u.Host)
+	assert.Equal(t, 80, u.Port)
+
+	u, err = ParseTrackerURL("https://tracker.example/announce")
+	assert.NoError(t, err)
+	assert.Equal(t, 443, u.Port)
+
+	invalidURLs := []string{
+		"udp://tracker.example/announce", // missing port
+		"wss://tracker.example:443",      // unsupported scheme
+		"udp://:1337",                    // missing host
+		"udp://tracker.example:99999",    // invalid port
+		"://",
+	}
+	for _, raw := range invalidURLs {
+		_, err := ParseTrackerURL(raw)
+		assert.Error(t, err, raw)
+	}
+}
+
+func TestResolveTrackerURL(t *testing.T) {
+	resolver := fakeResolver{"tracker.example": {net.ParseIP("10.0.0.1"), net.ParseIP("2001:db8::1")}}
+
+	u, _ := ParseTrackerURL("udp://tracker.example:1337")
+	ips, err := u.Resolve(context.Background(), resolver)
+	assert.NoError(t, err)
+	assert.Len(t, ips, 2)
+
+	// IP literals are not looked up
+	u, _ = ParseTrackerURL("udp://127.0.0.1:1337")
+	ips, err = u.Resolve(context.Background(), resolver)
+	assert.NoError(t, err)
+	assert.True(t, net.ParseIP("127.0.0.1").Equal(ips[0]))
+
+	u, _ = ParseTrackerURL("udp://unknown.example:1337")
+	_, err = u.Resolve(context.Background(), resolver)
+	assert.Error(t, err)
+}
+
+func TestUDPOptions(t *testing.T) {
+	assert.Nil(t, MarshalUDPOptions(""))
+
+	raw := MarshalUDPOptions("/announce")
+	assert.Equal(t, append([]byte{UDPOptionURLData, 9}, append([]byte("/announce"), UDPOptionEndOfOptions)...), raw)
+
+	// Long URL data is split over several options
+	long := "/announce?passkey=" + strings.Repeat("x", 300)
+	raw = MarshalUDPOptions(long)
+	assert.Equal(t, UDPOptionURLData, raw[0])
+	assert.Equal(t, byte(255), raw[1])
+	decoded, err := UnmarshalUDPOptions(raw)
+	assert.NoError(t, err)
+	assert.Equal(t, long, decoded)
+
+	// NOP and unknown options are skipped
+	raw = []byte{UDPOptionNOP, 0x7, 2, 'x', 'y', UDPOptionURLData, 2, '/', 'a', UDPOptionEndOfOptions, 0xff}
+	decoded, err = UnmarshalUDPOptions(raw)
+	assert.NoError(t, err)
+	assert.Equal(t, "/a", decoded)
+
+	_, err = UnmarshalUDPOptions([]byte{UDPOptionURLData, 10, 'a'})
+	assert.Error(t, err)
+}
+
+func TestAnnounceRequestWithURLData(t *testing.T) {
+	req := TrackerUDPAnnounceRequest{TxnID: 3, Port: 6881, NumWant: -1, URLData: "/announce?passkey=abc"}
+	raw := req.Marshal()
+	assert.Greater(t, len(raw), UDPAnnounceRequestSize)
+
+	decoded, err := UnmarshalTrackerUDPAnnounceRequest(raw)
+	assert.NoError(t, err)
+	assert.Equal(t, req, *decoded)
+}
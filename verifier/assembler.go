@@ -0,0 +1,94 @@
+package verifier
+
+import (
+	"github.com/dpnam2112/bittorrent-client/common"
+	"github.com/dpnam2112/bittorrent-client/peer"
+)
+
+// Piece is a piece assembled from the blocks received from the peers.
+type Piece struct {
+	Index uint32
+	Data  []byte
+	// Contributors are the peers that sent the blocks of the piece, one per block, in order.
+	Contributors []common.PeerAddr
+}
+
+// Assembler collects the blocks of the pieces being downloaded, until a piece is complete.
+// It isn't safe for concurrent use.
+type Assembler struct {
+	numPieces   int
+	pieceLength int64
+	totalLength int64
+	blockSize   uint32
+	pieces      map[uint32]*pieceBuffer
+}
+
+type pieceBuffer struct {
+	data         []byte
+	contributors []common.PeerAddr
+	received     []bool
+	remaining    int
+}
+
+// NewAssembler creates an assembler for the pieces of a torrent, downloaded in blocks of 16 KiB.
+func NewAssembler(numPieces int, pieceLength int64, totalLength int64) *Assembler {
+	return &Assembler{
+		numPieces:   numPieces,
+		pieceLength: pieceLength,
+		totalLength: totalLength,
+		blockSize:   peer.StandardBlockSize,
+		pieces:      make(map[uint32]*pieceBuffer),
+	}
+}
+
+func (a *Assembler) pieceSize(index uint32) int64 {
+	if int(index) == a.numPieces-1 {
+		return a.totalLength - int64(index)*a.pieceLength
+	}
+	return a.pieceLength
+}
+
+// AddBlock adds a block received from a peer, and returns the piece once all its blocks are
+// received. Blocks that don't match the block layout of the piece, and blocks received already,
+// are ignored.
+func (a *Assembler) AddBlock(from common.PeerAddr, index, begin uint32, block []byte) (*Piece, bool) {
+	if int(index) >= a.numPieces || begin%a.blockSize != 0 {
+		return nil, false
+	}
+	size := a.pieceSize(index)
+	if int64(begin) >= size || int64(len(block)) != min(int64(a.blockSize), size-int64(begin)) {
+		return nil, false
+	}
+
+	buffer, ok := a.pieces[index]
+	if !ok {
+		numBlocks := int((size + int64(a.blockSize) - 1) / int64(a.blockSize))
+		buffer = &pieceBuffer{
+			data:         make([]byte, size),
+			contributors: make([]common.PeerAddr, numBlocks),
+			received:     make([]bool, numBlocks),
+			remaining:    numBlocks,
+		}
+		a.pieces[index] = buffer
+	}
+
+	i := begin / a.blockSize
+	if buffer.received[i] {
+		return nil, false
+	}
+	copy(buffer.data[begin:], block)
+	buffer.contributors[i] = from
+	buffer.received[i] = true
+	buffer.remaining--
+	if buffer.remaining > 0 {
+		return nil, false
+	}
+
+	delete(a.pieces, index)
+	return &Piece{Index: index, Data: buffer.data, Contributors: buffer.contributors}, true
+}
+
+// Discard drops the blocks received for a piece.
+func (a *Assembler) Discard(index uint32) {
+	delete(a.pieces, index)
+}
@@ -0,0 +1,88 @@
+package verifier
+
+import (
+	"crypto/sha1"
+	"slices"
+
+	"github.com/dpnam2112/bittorrent-client/common"
+	"github.com/dpnam2112/bittorrent-client/peer"
+)
+
+// Attributor finds the peers that sent corrupt blocks. When a piece sent by several peers fails
+// verification, the hash of each of its blocks is kept with the peer that sent it. Once the piece
+// is downloaded again and passes, the blocks that differ from the good data tell who sent corrupt
+// data. It isn't safe for concurrent use.
+type Attributor struct {
+	blockSize uint32
+	failed    map[uint32][]blockRecord
+}
+
+type blockRecord struct {
+	from  common.PeerAddr
+	block int
+	hash  [20]byte
+}
+
+func NewAttributor() *Attributor {
+	return &Attributor{
+		blockSize: peer.StandardBlockSize,
+		failed:    make(map[uint32][]blockRecord),
+	}
+}
+
+// Failed records the blocks of a piece that failed verification. When a single peer sent all of
+// them, it's the culprit; otherwise, the peers are suspects until the piece is downloaded again.
+func (a *Attributor) Failed(piece *Piece) (culprits []common.PeerAddr, suspects []common.PeerAddr) {
+	contributors := distinct(piece.Contributors)
+	if len(contributors) == 1 {
+		return contributors, nil
+	}
+
+	for i, from := range piece.Contributors {
+		a.failed[piece.Index] = append(a.failed[piece.Index], blockRecord{
+			from:  from,
+			block: i,
+			hash:  sha1.Sum(a.blockData(piece, i)),
+		})
+	}
+	return nil, contributors
+}
+
+// Verified compares the blocks of a piece that passed verification with the blocks recorded
+// when it failed, and returns the peers that sent different data.
+func (a *Attributor) Verified(piece *Piece) (culprits []common.PeerAddr) {
+	records, ok := a.failed[piece.Index]
+	if !ok {
+		return nil
+	}
+	delete(a.failed, piece.Index)
+
+	for _, record := range records {
+		if sha1.Sum(a.blockData(piece, record.block)) != record.hash {
+			culprits = append(culprits, record.from)
+		}
+	}
+	return distinct(culprits)
+}
+
+// Suspected reports whether a piece failed verification, and hasn't passed since.
+func (a *Attributor) Suspected(index uint32) bool {
+	_, ok := a.failed[index]
+	return ok
+}
+
+func (a *Attributor) blockData(piece *Piece, block int) []byte {
+	begin := min(len(piece.Data), block*int(a.blockSize))
+	end := min(len(piece.Data), begin+int(a.blockSize))
+	return piece.Data[begin:end]
+}
+
+func distinct(addrs []common.PeerAddr) []common.PeerAddr {
+	var unique []common.PeerAddr
+	for _, addr := range addrs {
+		if !slices.Contains(unique, addr) {
+			unique = append(unique, addr)
+		}
+	}
+	return unique
+}
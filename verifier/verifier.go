@@ -0,0 +1,208 @@
+package verifier
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha1"
+	"errors"
+	"fmt"
+	"log/slog"
+	"runtime"
+	"sync"
+)
+
+// ErrVerifierClosed is returned by Submit once the verifier is closed.
+var ErrVerifierClosed = errors.New("Verifier is closed")
+
+// State is the verification state of a piece.
+type State int
+
+const (
+	StateUnverified State = iota
+	// StatePending: the piece is queued or being hashed.
+	StatePending
+	StateGood
+	StateBad
+)
+
+func (s State) String() string {
+	switch s {
+	case StateUnverified:
+		return "unverified"
+	case StatePending:
+		return "pending"
+	case StateGood:
+		return "good"
+	case StateBad:
+		return "bad"
+	default:
+		return fmt.Sprintf("unknown(%d)", int(s))
+	}
+}
+
+// Result is the outcome of the verification of a piece.
+type Result struct {
+	Piece *Piece
+	OK    bool
+}
+
+type Config struct {
+	// Workers is the number of pieces hashed in parallel. Defaults to the number of CPUs.
+	Workers int
+	// QueueSize is the number of pieces waiting for a worker. Submit blocks when the queue is
+	// full, which slows down the download instead of buffering pieces without bound. Defaults to
+	// twice the number of workers.
+	QueueSize int
+	// OnResult is called with the result of each piece, from the worker goroutines.
+	OnResult func(Result)
+	Logger   *slog.Logger
+}
+
+// Verifier checks the pieces against their SHA-1 hashes, with a bounded pool of workers, so that
+// hashing doesn't hold up the goroutines reading from the peers.
+type Verifier struct {
+	hashes [][20]byte
+	config Config
+	logger *slog.Logger
+
+	queue  chan *Piece
+	cancel context.CancelFunc
+	done   chan struct{}
+	once   sync.Once
+	wg     sync.WaitGroup
+
+	mu     sync.Mutex
+	states []State
+}
+
+// New creates a verifier for the pieces whose hashes are concatenated in pieceHashes, as in the
+// pieces field of the info dictionary.
+func New(pieceHashes []byte, config Config) *Verifier {
+	if config.Workers <= 0 {
+		config.Workers = runtime.NumCPU()
+	}
+	if config.QueueSize <= 0 {
+		config.QueueSize = 2 * config.Workers
+	}
+	if config.OnResult == nil {
+		config.OnResult = func(Result) {}
+	}
+	if config.Logger == nil {
+		config.Logger = slog.Default()
+	}
+
+	hashes := make([][20]byte, len(pieceHashes)/20)
+	for i := range hashes {
+		copy(hashes[i][:], pieceHashes[20*i:])
+	}
+
+	return &Verifier{
+		hashes: hashes,
+		config: config,
+		logger: config.Logger,
+		queue:  make(chan *Piece, config.QueueSize),
+		done:   make(chan struct{}),
+		states: make([]State, len(hashes)),
+	}
+}
+
+func (v *Verifier) Start(ctx context.Context) error {
+	if v.cancel != nil {
+		return fmt.Errorf("Verifier is already started.")
+	}
+	ctx, v.cancel = context.WithCancel(ctx)
+
+	for range v.config.Workers {
+		v.wg.Add(1)
+		go func() {
+			defer v.wg.Done()
+			v.work(ctx)
+		}()
+	}
+	return nil
+}
+
+// Close stops the workers. The pieces still queued are dropped.
+func (v *Verifier) Close() error {
+	v.once.Do(func() { close(v.done) })
+	if v.cancel == nil {
+		return nil
+	}
+	v.cancel()
+	v.wg.Wait()
+	return nil
+}
+
+// Submit queues a complete piece for verification. It blocks while the queue is full.
+func (v *Verifier) Submit(ctx context.Context, piece *Piece) error {
+	if int(piece.Index) >= len(v.hashes) {
+		return fmt.Errorf("Failed to submit piece %d: out of range", piece.Index)
+	}
+	select {
+	case <-v.done:
+		return ErrVerifierClosed
+	default:
+	}
+
+	v.mu.Lock()
+	v.states[piece.Index] = StatePending
+	v.mu.Unlock()
+
+	select {
+	case v.queue <- piece:
+		return nil
+	case <-ctx.Done():
+		v.setState(piece.Index, StateUnverified)
+		return ctx.Err()
+	case <-v.done:
+		v.setState(piece.Index, StateUnverified)
+		return ErrVerifierClosed
+	}
+}
+
+// State returns the verification state of a piece.
+func (v *Verifier) State(index uint32) State {
+	v.mu.Lock()
+	defer v.mu.Unlock()
+	if int(index) >= len(v.states) {
+		return StateUnverified
+	}
+	return v.states[index]
+}
+
+// Verify hashes a piece right away, on the calling goroutine, and records its state. It's used to
+// check the data already on disk.
+func (v *Verifier) Verify(piece *Piece) bool {
+	if int(piece.Index) >= len(v.hashes) {
+		return false
+	}
+	sum := sha1.Sum(piece.Data)
+	ok := bytes.Equal(sum[:], v.hashes[piece.Index][:])
+	if ok {
+		v.setState(piece.Index, StateGood)
+	} else {
+		v.setState(piece.Index, StateBad)
+	}
+	return ok
+}
+
+func (v *Verifier) setState(index uint32, state State) {
+	v.mu.Lock()
+	defer v.mu.Unlock()
+	v.states[index] = state
+}
+
+func (v *Verifier) work(ctx context.Context) {
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case piece := <-v.queue:
+			ok := v.Verify(piece)
+			if !ok {
+				v.logger.Debug("Piece failed verification", "piece", piece.Index)
+			}
+			v.config.OnResult(Result{Piece: piece, OK: ok})
+		}
+	}
+}
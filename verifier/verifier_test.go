@@ -0,0 +1,138 @@
+package verifier
+
+import (
+	"context"
+	"crypto/sha1"
+	"testing"
+	"time"
+
+	"github.com/dpnam2112/bittorrent-client/common"
+	"github.com/stretchr/testify/assert"
+)
+
+const blockSize = 16 * 1024
+
+func pieceHashes(pieces ...[]byte) []byte {
+	var hashes []byte
+	for _, piece := range pieces {
+		sum := sha1.Sum(piece)
+		hashes = append(hashes, sum[:]...)
+	}
+	return hashes
+}
+
+func TestAssembler(t *testing.T) {
+	a := NewAssembler(2, 2*blockSize, 2*blockSize+10)
+	alice := common.PeerAddr{Host: "10.0.0.1", Port: 6881}
+	bob := common.PeerAddr{Host: "10.0.0.2", Port: 6881}
+
+	first := make([]byte, blockSize)
+	second := make([]byte, blockSize)
+	second[0] = 1
+
+	// Blocks outside of the layout of the piece are ignored.
+	_, ok := a.AddBlock(alice, 0, 1, first)
+	assert.False(t, ok)
+	_, ok = a.AddBlock(alice, 0, 0, first[:10])
+	assert.False(t, ok)
+	_, ok = a.AddBlock(alice, 2, 0, first)
+	assert.False(t, ok)
+
+	// Blocks may arrive in any order; only the first copy of a block counts.
+	_, ok = a.AddBlock(bob, 0, blockSize, second)
+	assert.False(t, ok)
+	_, ok = a.AddBlock(alice, 0, blockSize, first)
+	assert.False(t, ok)
+	piece, ok := a.AddBlock(alice, 0, 0, first)
+	assert.True(t, ok)
+	assert.Equal(t, uint32(0), piece.Index)
+	assert.Equal(t, append(append([]byte{}, first...), second...), piece.Data)
+	assert.Equal(t, []common.PeerAddr{alice, bob}, piece.Contributors)
+
+	// The last piece is shorter.
+	piece, ok = a.AddBlock(bob, 1, 0, make([]byte, 10))
+	assert.True(t, ok)
+	assert.Len(t, piece.Data, 10)
+
+	// Discarded blocks are received again.
+	_, ok = a.AddBlock(alice, 0, 0, first)
+	assert.False(t, ok)
+	a.Discard(0)
+	_, ok = a.AddBlock(alice, 0, 0, first)
+	assert.False(t, ok)
+	piece, ok = a.AddBlock(alice, 0, blockSize, first)
+	assert.True(t, ok)
+	assert.Equal(t, []common.PeerAddr{alice, alice}, piece.Contributors)
+}
+
+func TestVerifier(t *testing.T) {
+	good := []byte("good piece")
+	results := make(chan Result, 2)
+	v := New(pieceHashes(good, []byte("other piece")), Config{
+		Workers:  2,
+		OnResult: func(result Result) { results <- result },
+	})
+	assert.NoError(t, v.Start(context.Background()))
+	assert.Error(t, v.Start(context.Background()))
+	defer v.Close()
+
+	assert.NoError(t, v.Submit(context.Background(), &Piece{Index: 0, Data: good}))
+	assert.NoError(t, v.Submit(context.Background(), &Piece{Index: 1, Data: []byte("corrupt")}))
+	assert.Error(t, v.Submit(context.Background(), &Piece{Index: 2}))
+
+	outcomes := map[uint32]bool{}
+	for range 2 {
+		select {
+		case result := <-results:
+			outcomes[result.Piece.Index] = result.OK
+		case <-time.After(5 * time.Second):
+			t.Fatal("No verification result")
+		}
+	}
+	assert.Equal(t, map[uint32]bool{0: true, 1: false}, outcomes)
+	assert.Equal(t, StateGood, v.State(0))
+	assert.Equal(t, StateBad, v.State(1))
+}
+
+func TestVerifierQueueIsBounded(t *testing.T) {
+	v := New(pieceHashes([]byte("a"), []byte("b")), Config{Workers: 1, QueueSize: 1})
+
+	// Without running workers, the second piece doesn't fit in the queue.
+	assert.NoError(t, v.Submit(context.Background(), &Piece{Index: 0, Data: []byte("a")}))
+	assert.Equal(t, StatePending, v.State(0))
+
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	assert.ErrorIs(t, v.Submit(ctx, &Piece{Index: 1, Data: []byte("b")}), context.DeadlineExceeded)
+	assert.Equal(t, StateUnverified, v.State(1))
+
+	v.Close()
+	assert.ErrorIs(t, v.Submit(context.Background(), &Piece{Index: 1, Data: []byte("b")}), ErrVerifierClosed)
+}
+
+func TestAttributor(t *testing.T) {
+	a := NewAttributor()
+	alice := common.PeerAddr{Host: "10.0.0.1", Port: 6881}
+	bob := common.PeerAddr{Host: "10.0.0.2", Port: 6881}
+
+	good := make([]byte, 3*blockSize)
+	bad := append([]byte(nil), good...)
+	bad[blockSize] = 1
+
+	// A piece sent by a single peer: it's the culprit.
+	culprits, suspects := a.Failed(&Piece{Index: 0, Data: bad, Contributors: []common.PeerAddr{bob, bob, bob}})
+	assert.Equal(t, []common.PeerAddr{bob}, culprits)
+	assert.Empty(t, suspects)
+	assert.False(t, a.Suspected(0))
+
+	// Several peers: they are suspects until the good piece shows who sent the corrupt block.
+	culprits, suspects = a.Failed(&Piece{Index: 1, Data: bad, Contributors: []common.PeerAddr{alice, bob, alice}})
+	assert.Empty(t, culprits)
+	assert.Equal(t, []common.PeerAddr{alice, bob}, suspects)
+	assert.True(t, a.Suspected(1))
+
+	assert.Empty(t, a.Verified(&Piece{Index: 0, Data: good}))
+	assert.Equal(t, []common.PeerAddr{bob}, a.Verified(&Piece{Index: 1, Data: good, Contributors: []common.PeerAddr{alice, alice, alice}}))
+	assert.False(t, a.Suspected(1))
+	assert.Empty(t, a.Verified(&Piece{Index: 1, Data: good}))
+}